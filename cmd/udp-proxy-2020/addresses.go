@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+// updateAddresses applies the new addresses of the running interfaces in
+// changed.  Interfaces which are not running are skipped; they pick up their
+// addresses when they are attached.
+func (r *runner) updateAddresses(changed map[string][]proxy.InterfaceAddress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, iname := range slices.Sorted(maps.Keys(changed)) {
+		r.updateInterfaceAddresses(iname, changed[iname])
+	}
+}
+
+// updateInterfaceAddresses rebuilds the BPF filter, broadcast addresses and
+// UDP listeners of a running interface from its new addresses and forgets the
+// clients learned on a subnet it no longer has, without restarting its
+// pipeline.  Must be called with mu held.
+func (r *runner) updateInterfaceAddresses(iname string, addrs []proxy.InterfaceAddress) {
+	state := r.current()
+	s, ok := state.ifaces[iname]
+	if !ok || proxy.SameAddresses(s.addrs, addrs) {
+		return
+	}
+
+	filter := config.BuildBPFFilter(portsForInterface(state.groups, iname), addrs)
+	if s.source != nil {
+		if err := s.source.SetBPFFilter(filter); err != nil {
+			slog.Error("Failed to update BPF filter", "interface", iname, "filter", filter, "error", err)
+		}
+	}
+
+	if s.netif != nil {
+		bcast, err := discoverBroadcastAddresses(r.dm, s.netif, addrs, r.cfg, iname)
+		if err != nil {
+			slog.Warn("Keeping the previous broadcast addresses", "interface", iname, "broadcast", s.bcastIPs)
+		} else {
+			s.bcastIPs = bcast
+			for key, route := range state.routes {
+				if key.dst == iname {
+					route.SetBroadcastAddresses(bcast)
+				}
+			}
+		}
+	}
+
+	r.restartListeners(iname)
+
+	// Clients learned on a subnet the interface no longer has are gone too.
+	before, after := interfaceNetworks(s.addrs), interfaceNetworks(addrs)
+	stale := func(ip net.IP) bool {
+		return networksContain(before, ip) && !networksContain(after, ip)
+	}
+	removed := 0
+	for _, g := range state.groups {
+		if g.hasMember(iname) {
+			removed += g.registry.RemoveStaleClients(iname, stale)
+		}
+	}
+
+	s.addrs = addrs
+	ifaces := maps.Clone(state.ifaces)
+	ifaces[iname] = s
+	next := *state
+	next.ifaces = ifaces
+	r.setState(&next)
+	slog.Info("Interface addresses changed", "interface", iname, "filter", filter, "broadcast", s.bcastIPs, "removed_clients", removed)
+}
+
+// updateMTUs applies the new MTUs of the running interfaces in changed to the
+// routes sending on them, so packets are fragmented to fit.  Unknown MTUs are
+// skipped.
+func (r *runner) updateMTUs(changed map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, iname := range slices.Sorted(maps.Keys(changed)) {
+		r.updateInterfaceMTU(iname, changed[iname])
+	}
+}
+
+// updateInterfaceMTU changes the MTU the routes to the running interfaces
+// sending on the host interface iname fragment packets for: iname itself and
+// the logical VLAN interfaces it is the trunk of.  Must be called with mu
+// held.
+func (r *runner) updateInterfaceMTU(iname string, mtu int) {
+	if mtu <= 0 {
+		return
+	}
+	state := r.current()
+	var ifaces map[string]ifaceState
+	for name, s := range state.ifaces {
+		if s.netif == nil || s.netif.Name != iname || s.netif.MTU == mtu {
+			continue
+		}
+		for key, route := range state.routes {
+			if key.dst != name {
+				continue
+			}
+			for _, sink := range route.Sinks {
+				if fragment, ok := sink.(*stages.FragmentSink); ok {
+					fragment.SetMTU(mtu)
+				}
+			}
+		}
+
+		// Routes added later, when another interface attaches, use the new
+		// MTU as well.
+		netif := *s.netif
+		netif.MTU = mtu
+		s.netif = &netif
+		if ifaces == nil {
+			ifaces = maps.Clone(state.ifaces)
+		}
+		ifaces[name] = s
+		slog.Info("Interface MTU changed", "interface", name, "mtu", mtu)
+	}
+	if ifaces != nil {
+		next := *state
+		next.ifaces = ifaces
+		r.setState(&next)
+	}
+}
+
+// interfaceNetworks returns the subnets of addrs.
+func interfaceNetworks(addrs []proxy.InterfaceAddress) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if addr.IP == nil || addr.Netmask == nil {
+			continue
+		}
+		networks = append(networks, &net.IPNet{IP: addr.IP.Mask(addr.Netmask), Mask: addr.Netmask})
+	}
+	return networks
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+func testAddress(cidr, bcast string) proxy.InterfaceAddress {
+	ip, network, _ := net.ParseCIDR(cidr)
+	return proxy.InterfaceAddress{IP: ip, Netmask: network.Mask, Broadaddr: net.ParseIP(bcast)}
+}
+
+func TestRunner_UpdateInterfaceAddresses(t *testing.T) {
+	cfg := config.Default()
+	cfg.Groups = []config.GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1"}}}
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{"eth1": {"192.168.1.10"}})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	now := time.Now()
+	registry.Restore([]stages.ClientInfo{
+		{IP: net.IP{192, 168, 1, 50}, Interface: "eth1", LastSeen: now},
+		{IP: net.IP{192, 168, 0, 50}, Interface: "eth0", LastSeen: now},
+	}, now)
+	group := &relayGroup{name: "roon", ports: []int32{9003}, members: []string{"eth0", "eth1"}, registry: registry}
+
+	netif := &net.Interface{Flags: net.FlagBroadcast | net.FlagUp}
+	ifaces := map[string]ifaceState{}
+	for iname, cidr := range map[string]string{"eth0": "192.168.0.1/24", "eth1": "192.168.1.1/24"} {
+		addr := testAddress(cidr, "")
+		addr.Broadaddr = net.IP{addr.IP[12], addr.IP[13], addr.IP[14], 255}
+		ifaces[iname] = ifaceState{
+			name:      iname,
+			netif:     netif,
+			pipeline:  proxy.NewPipeline(&testSource{name: "PcapSource:" + iname}),
+			broadcast: true,
+			bcastIPs:  []net.IP{addr.Broadaddr},
+			addrs:     []proxy.InterfaceAddress{addr},
+		}
+	}
+	routes := map[routeKey]*stages.RouteSink{}
+	for _, key := range []routeKey{{"roon", "eth0", "eth1"}, {"roon", "eth1", "eth0"}} {
+		route := &stages.RouteSink{Iname: key.dst, Group: "roon", Broadcast: true, BroadcastAddresses: ifaces[key.dst].bcastIPs, Registry: registry}
+		ifaces[key.src].pipeline.AddSink(route)
+		routes[key] = route
+	}
+	state := &proxyState{groups: []*relayGroup{group}, ifaces: ifaces, routes: routes}
+	r := newRunner(context.Background(), &proxy.HostDeviceManager{}, cfg, state)
+
+	newAddrs := []proxy.InterfaceAddress{testAddress("10.1.0.5/24", "10.1.0.255"), testAddress("10.2.0.5/24", "10.2.0.255")}
+	wantBcast := []net.IP{net.ParseIP("10.1.0.255"), net.ParseIP("10.2.0.255")}
+	r.updateAddresses(map[string][]proxy.InterfaceAddress{"eth1": newAddrs, "tun0": newAddrs})
+
+	current := r.current()
+	if current == state || !slices.EqualFunc(current.ifaces["eth1"].bcastIPs, wantBcast, net.IP.Equal) {
+		t.Fatalf("expected the new broadcast addresses in the state, got %v", current.ifaces["eth1"].bcastIPs)
+	}
+	if !proxy.SameAddresses(current.ifaces["eth1"].addrs, newAddrs) {
+		t.Fatal("expected the new addresses in the state")
+	}
+	if got := routes[routeKey{"roon", "eth0", "eth1"}].BroadcastAddresses; !slices.EqualFunc(got, wantBcast, net.IP.Equal) {
+		t.Fatalf("expected the route to eth1 to use the new broadcast addresses, got %v", got)
+	}
+	if got := routes[routeKey{"roon", "eth1", "eth0"}].BroadcastAddresses; len(got) != 1 || !got[0].Equal(net.ParseIP("192.168.0.255")) {
+		t.Fatalf("expected the route to eth0 to be unchanged, got %v", got)
+	}
+	if registry.Has("192.168.1.50") {
+		t.Fatal("expected the client learned on the old subnet to be removed")
+	}
+	if !registry.Has("192.168.1.10") || !registry.Has("192.168.0.50") {
+		t.Fatal("expected the fixed IP and the clients on other interfaces to be kept")
+	}
+
+	// The same addresses again are a no-op.
+	r.updateAddresses(map[string][]proxy.InterfaceAddress{"eth1": newAddrs})
+	if r.current() != current {
+		t.Fatal("expected unchanged addresses not to replace the state")
+	}
+}
+
+func TestRunner_UpdateInterfaceMTU(t *testing.T) {
+	cfg := config.Default()
+	group := &relayGroup{name: "roon", ports: []int32{9003}, members: []string{"eth0", "eth1", "eth1.10"}}
+
+	ifaces := map[string]ifaceState{}
+	for iname, host := range map[string]string{"eth0": "eth0", "eth1": "eth1", "eth1.10": "eth1"} {
+		ifaces[iname] = ifaceState{
+			name:     iname,
+			netif:    &net.Interface{Name: host, MTU: 1500},
+			pipeline: proxy.NewPipeline(&testSource{name: "PcapSource:" + iname}),
+		}
+	}
+	routes := map[routeKey]*stages.RouteSink{}
+	fragments := map[string]*stages.FragmentSink{}
+	for _, key := range []routeKey{{"roon", "eth1", "eth0"}, {"roon", "eth0", "eth1"}, {"roon", "eth0", "eth1.10"}} {
+		fragment := &stages.FragmentSink{Iname: key.dst, MTU: 1500, Sink: &taggedSink{target: key.dst}}
+		route := &stages.RouteSink{Iname: key.dst, Group: "roon", Sinks: []proxy.Sink{fragment}}
+		ifaces[key.src].pipeline.AddSink(route)
+		routes[key] = route
+		fragments[key.dst] = fragment
+	}
+	state := &proxyState{groups: []*relayGroup{group}, ifaces: ifaces, routes: routes}
+	r := newRunner(context.Background(), &proxy.HostDeviceManager{}, cfg, state)
+
+	r.updateMTUs(map[string]int{"eth1": 1400, "tun0": 1400})
+	for iname, want := range map[string]int{"eth0": 1500, "eth1": 1400, "eth1.10": 1400} {
+		if got := fragments[iname].MTU; got != want {
+			t.Errorf("expected the route to %s to fragment for MTU %d, got %d", iname, want, got)
+		}
+		if got := r.current().ifaces[iname].netif.MTU; got != want {
+			t.Errorf("expected MTU %d for %s in the state, got %d", want, iname, got)
+		}
+	}
+	if state.ifaces["eth1"].netif.MTU != 1500 {
+		t.Fatal("expected the previous state to be unchanged")
+	}
+
+	// An unknown MTU is ignored.
+	current := r.current()
+	r.updateMTUs(map[string]int{"eth1": 0})
+	if r.current() != current {
+		t.Fatal("expected an unknown MTU not to replace the state")
+	}
+}
+
+func TestDiscoverBroadcastAddresses(t *testing.T) {
+	netif := &net.Interface{Flags: net.FlagBroadcast | net.FlagUp}
+	addrs := []proxy.InterfaceAddress{
+		testAddress("fd00::1/64", ""),
+		testAddress("192.168.1.1/24", "192.168.1.255"),
+		testAddress("10.20.0.1/16", "10.20.255.255"),
+		testAddress("192.168.1.2/24", "192.168.1.255"),
+	}
+
+	cfg := config.Default()
+	got, err := discoverBroadcastAddresses(&proxy.HostDeviceManager{}, netif, addrs, cfg, "eth0")
+	if err != nil {
+		t.Fatalf("discoverBroadcastAddresses failed: %v", err)
+	}
+	want := []net.IP{net.ParseIP("192.168.1.255"), net.ParseIP("10.20.255.255")}
+	if !slices.EqualFunc(got, want, net.IP.Equal) {
+		t.Fatalf("expected a broadcast address per subnet %v, got %v", want, got)
+	}
+
+	cfg.Interfaces = []config.InterfaceConfig{{Name: "eth0", BroadcastSubnets: []string{"10.20.0.0/16"}}}
+	got, err = discoverBroadcastAddresses(&proxy.HostDeviceManager{}, netif, addrs, cfg, "eth0")
+	if err != nil {
+		t.Fatalf("discoverBroadcastAddresses failed: %v", err)
+	}
+	if len(got) != 1 || !got[0].Equal(net.ParseIP("10.20.255.255")) {
+		t.Fatalf("expected only the selected subnet, got %v", got)
+	}
+
+	cfg.Interfaces[0].BroadcastSubnets = []string{"172.16.0.0/12"}
+	if _, err := discoverBroadcastAddresses(&proxy.HostDeviceManager{}, netif, addrs, cfg, "eth0"); err == nil {
+		t.Fatal("expected an error when no subnet is selected")
+	}
+}
@@ -4,30 +4,53 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/kong"
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
 )
 
 type CLI struct {
-	Interface      []string `kong:"short='i',help='Two or more interfaces to use'"`
-	FixedIp        []string `kong:"short='I',help='IPs to always send to iface@ip'"`
-	Port           []int32  `kong:"short='p',help='One or more UDP ports to process'"`
-	Timeout        int64    `kong:"short='t',default=250,help='Timeout in msec'"`
-	CacheTTL       int64    `kong:"short='T',default=180,help='Client IP cache TTL in minutes'"`
-	DeliverLocal   bool     `kong:"short='l',help='Deliver packets locally over loopback'"`
-	Level          string   `kong:"short='L',default='info',enum='trace,debug,info,warn,error',help='Log level [trace|debug|info|warn|error]'"`
-	LogLines       bool     `kong:"help='Print line number in logs'"`
-	Logfile        string   `kong:"default='stderr',help='Write logs to filename'"`
-	NoListen       bool     `kong:"help='Do not listen locally on UDP ports'"`
-	Decode         bool     `kong:"help='Print packet decodes to stdout similar to tcpdump -e'"`
-	Pcap           bool     `kong:"short='P',help='Generate pcap files for debugging'"`
-	PcapPath       string   `kong:"short='d',default='/root',help='Directory to write debug pcap files'"`
-	GraphPipeline  string   `kong:"help='Generate Graphviz dot file for pipelines at specified path'"`
-	ListInterfaces bool     `kong:"help='List available interfaces and exit'"`
-	Version        bool     `kong:"short='v',help='Print version information'"`
+	Config           string   `kong:"short='c',help='Path to YAML or TOML config file'"`
+	Interface        []string `kong:"short='i',help='Two or more interfaces or patterns (tun*, /^wg[0-9]+$/) to use'"`
+	ExcludeInterface []string `kong:"help='Interfaces or patterns to leave out of --interface patterns'"`
+	FixedIp          []string `kong:"short='I',help='IPs to always send to iface@ip'"`
+	Port             []int32  `kong:"short='p',help='One or more UDP ports to process'"`
+	Timeout          int64    `kong:"short='t',default=250,help='Timeout in msec'"`
+	CacheTTL         int64    `kong:"short='T',default=180,help='Client IP cache TTL in minutes'"`
+	DeliverLocal     bool     `kong:"short='l',help='Deliver packets locally over loopback'"`
+	Level            string   `kong:"short='L',default='info',enum='trace,debug,info,warn,error',help='Log level [trace|debug|info|warn|error]'"`
+	LogLines         bool     `kong:"help='Print line number in logs'"`
+	Logfile          string   `kong:"default='stderr',help='Write logs to filename'"`
+	NoListen         bool     `kong:"help='Do not listen locally on UDP ports'"`
+	Capture          string   `kong:"help='Capture backend [libpcap|afpacket], default libpcap unless built without cgo'"`
+	Decode           bool     `kong:"help='Print packet decodes to stdout similar to tcpdump -e'"`
+	Pcap             bool     `kong:"short='P',help='Generate pcap files for debugging'"`
+	PcapPath         string   `kong:"short='d',default='/root',help='Directory to write debug pcap files'"`
+	Multicast        bool     `kong:"help='Relay multicast packets to the same group on other interfaces'"`
+	MulticastTTL     int      `kong:"help='TTL for relayed multicast packets, 0 keeps the original TTL'"`
+	MulticastJoin    []string `kong:"help='IPv4 multicast groups to join (IGMP) on each interface'"`
+	DedupWindow      int64    `kong:"help='Drop copies of a packet seen again within this many msec, 0 disables'"`
+	MetricsListen    string   `kong:"help='Serve Prometheus metrics on [host]:port'"`
+	ControlSocket    string   `kong:"help='Path of the control socket, disabled by default'"`
+	StateFile        string   `kong:"help='Save learned clients to this file and restore them on startup'"`
+	StateInterval    int64    `kong:"default=60,help='How often to save the state file in seconds'"`
+	ShutdownTimeout  int64    `kong:"default=5,help='Seconds to wait for packets to drain and files to close on shutdown'"`
+	GraphPipeline    string   `kong:"help='Generate Graphviz dot file for pipelines at specified path'"`
+	ListInterfaces   bool     `kong:"help='List available interfaces and exit'"`
+	Version          bool     `kong:"short='v',help='Print version information'"`
+
+	Run    RunCmd    `kong:"cmd,default='1',hidden,help='Run the proxy (default)'"`
+	Ctl    CtlCmd    `kong:"cmd,help='Control a running udp-proxy-2020 via the control socket'"`
+	Replay ReplayCmd `kong:"cmd,help='Replay a pcap file through the proxy without capturing or sending packets'"`
 }
 
-func parseArgs() CLI {
+// RunCmd is the default command which runs the proxy.
+type RunCmd struct{}
+
+// parseArgs parses the command line and returns the CLI, the selected command
+// and the set of flag names which were explicitly specified by the user.
+func parseArgs() (CLI, string, map[string]bool) {
 	cli := CLI{}
 	parser := kong.Must(
 		&cli,
@@ -35,7 +58,7 @@ func parseArgs() CLI {
 		kong.Description("A crappy UDP proxy for the year 2020 and beyond!"),
 		kong.UsageOnError(),
 	)
-	_, err := parser.Parse(os.Args[1:])
+	ctx, err := parser.Parse(os.Args[1:])
 	parser.FatalIfErrorf(err)
 
 	if cli.Version {
@@ -49,56 +72,161 @@ func parseArgs() CLI {
 		os.Exit(0)
 	}
 
-	if len(cli.Interface) < 2 && !cli.ListInterfaces && !cli.Version && cli.GraphPipeline == "" {
-		fmt.Fprintf(os.Stderr, "Please specify two or more --interface\n")
-		os.Exit(1)
-	}
-	if len(cli.Port) < 1 && !cli.ListInterfaces && !cli.Version && cli.GraphPipeline == "" {
-		fmt.Fprintf(os.Stderr, "Please specify one or more --port\n")
-		os.Exit(1)
+	return cli, ctx.Command(), setFlags(ctx)
+}
+
+// setFlags returns the names of the flags which were set on the command line.
+func setFlags(ctx *kong.Context) map[string]bool {
+	set := make(map[string]bool)
+	for _, path := range ctx.Path {
+		if path.Flag != nil {
+			set[path.Flag.Name] = true
+		}
 	}
+	return set
+}
 
-	if cli.GraphPipeline != "" {
-		if len(cli.Interface) < 2 {
-			fmt.Fprintf(os.Stderr, "Please specify two or more --interface for --graph-pipeline\n")
-			os.Exit(1)
+// buildConfig loads the --config file (if any) and then applies every flag
+// which was explicitly set on the command line on top of it, so flags always
+// win over values from the file.
+func buildConfig(cli CLI, set map[string]bool) (*config.Config, error) {
+	cfg := config.Default()
+	if cli.Config != "" {
+		var err error
+		if cfg, err = config.Load(cli.Config); err != nil {
+			return nil, err
 		}
-		if len(cli.Port) < 1 {
-			fmt.Fprintf(os.Stderr, "Please specify one or more --port for --graph-pipeline\n")
-			os.Exit(1)
+	}
+
+	if set["interface"] || set["port"] {
+		// --interface and --port describe a single full mesh which
+		// replaces any relay groups from the file.
+		cfg.Groups = nil
+	}
+	if set["interface"] {
+		// Keep any per-interface overrides from the file for interfaces
+		// which are also listed on the command line.
+		interfaces := make([]config.InterfaceConfig, 0, len(cli.Interface))
+		for _, iname := range cli.Interface {
+			if iface := cfg.Interface(iname); iface != nil {
+				interfaces = append(interfaces, *iface)
+			} else {
+				interfaces = append(interfaces, config.InterfaceConfig{Name: iname})
+			}
 		}
+		cfg.Interfaces = interfaces
+	}
+	if set["exclude-interface"] {
+		cfg.ExcludeInterfaces = cli.ExcludeInterface
+	}
+	if set["fixed-ip"] {
+		cfg.FixedIPs = cli.FixedIp
+	}
+	if set["port"] {
+		cfg.Ports = cli.Port
+	}
+	if set["timeout"] {
+		cfg.Timeout = cli.Timeout
+	}
+	if set["cache-ttl"] {
+		cfg.CacheTTL = cli.CacheTTL
+	}
+	if set["deliver-local"] {
+		cfg.DeliverLocal = cli.DeliverLocal
+	}
+	if set["level"] {
+		cfg.Level = cli.Level
+	}
+	if set["log-lines"] {
+		cfg.LogLines = cli.LogLines
+	}
+	if set["logfile"] {
+		cfg.Logfile = cli.Logfile
+	}
+	if set["no-listen"] {
+		cfg.NoListen = cli.NoListen
+	}
+	if set["capture"] {
+		cfg.Capture = cli.Capture
+	}
+	if set["decode"] {
+		cfg.Decode = cli.Decode
+	}
+	if set["pcap"] {
+		cfg.Pcap = cli.Pcap
+	}
+	if set["pcap-path"] {
+		cfg.PcapPath = cli.PcapPath
+	}
+	if set["dedup-window"] {
+		cfg.DedupWindow = cli.DedupWindow
+	}
+	if set["control-socket"] {
+		cfg.ControlSocket = cli.ControlSocket
+	}
+	if set["state-file"] {
+		cfg.StateFile = cli.StateFile
+	}
+	if set["state-interval"] {
+		cfg.StateInterval = cli.StateInterval
+	}
+	if set["shutdown-timeout"] {
+		cfg.ShutdownTimeout = cli.ShutdownTimeout
+	}
+	if set["metrics-listen"] {
+		cfg.MetricsListen = cli.MetricsListen
+	}
+	if set["multicast"] {
+		cfg.Multicast = cli.Multicast
+	}
+	if set["multicast-ttl"] {
+		cfg.MulticastTTL = cli.MulticastTTL
+	}
+	if set["multicast-join"] {
+		cfg.MulticastJoin = cli.MulticastJoin
 	}
 
-	return cli
+	return cfg, nil
 }
 
-func setupLogging(cli CLI) {
-	var level slog.Level
-	switch cli.Level {
+// logLevel is the level of the default logger, which may be changed at
+// runtime via the control socket.
+var logLevel = new(slog.LevelVar)
+
+// parseLevel converts one of config.LogLevels into a slog.Level.
+func parseLevel(name string) (slog.Level, error) {
+	switch name {
 	case "trace":
-		level = slog.LevelDebug - 4
+		return slog.LevelDebug - 4, nil
 	case "debug":
-		level = slog.LevelDebug
-	case "warn":
-		level = slog.LevelWarn
+		return slog.LevelDebug, nil
 	case "info":
-		level = slog.LevelInfo
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
 	case "error":
-		level = slog.LevelError
-	default:
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("invalid log level %q, must be one of [%s]", name, strings.Join(config.LogLevels, "|"))
+}
+
+func setupLogging(cfg *config.Config) {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
 		level = slog.LevelInfo
 	}
+	logLevel.Set(level)
 
 	opts := &slog.HandlerOptions{
-		Level:     level,
-		AddSource: cli.LogLines,
+		Level:     logLevel,
+		AddSource: cfg.LogLines,
 	}
 
 	var handler slog.Handler
-	if cli.Logfile != "stderr" {
-		file, err := os.OpenFile(cli.Logfile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if cfg.Logfile != config.DefaultLogfile {
+		file, err := os.OpenFile(cfg.Logfile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to open log file %s: %v\n", cli.Logfile, err)
+			fmt.Fprintf(os.Stderr, "Unable to open log file %s: %v\n", cfg.Logfile, err)
 			os.Exit(1)
 		}
 		handler = slog.NewTextHandler(file, opts)
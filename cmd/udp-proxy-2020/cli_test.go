@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+func parseTestArgs(t *testing.T, args ...string) (CLI, map[string]bool) {
+	t.Helper()
+	cli := CLI{}
+	parser, err := kong.New(&cli)
+	if err != nil {
+		t.Fatalf("kong.New failed: %v", err)
+	}
+	ctx, err := parser.Parse(args)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return cli, setFlags(ctx)
+}
+
+func TestBuildConfig_FlagsOnly(t *testing.T) {
+	cli, set := parseTestArgs(t, "-i", "eth0", "-i", "eth1", "-p", "9003", "--cache-ttl", "30", "-I", "eth1@10.0.0.5")
+
+	cfg, err := buildConfig(cli, set)
+	if err != nil {
+		t.Fatalf("buildConfig failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if got := cfg.InterfaceNames(); len(got) != 2 || got[0] != "eth0" || got[1] != "eth1" {
+		t.Errorf("unexpected interfaces: %v", got)
+	}
+	if cfg.CacheTTL != 30 {
+		t.Errorf("expected cache-ttl 30, got %d", cfg.CacheTTL)
+	}
+	if cfg.Timeout != 250 {
+		t.Errorf("expected default timeout 250, got %d", cfg.Timeout)
+	}
+	if len(cfg.FixedIPs) != 1 || cfg.FixedIPs[0] != "eth1@10.0.0.5" {
+		t.Errorf("unexpected fixed IPs: %v", cfg.FixedIPs)
+	}
+}
+
+func TestBuildConfig_FlagsOverrideFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "udp-proxy-2020.yaml")
+	err := os.WriteFile(path, []byte(`
+interfaces:
+  - name: eth0
+    timeout: 900
+  - name: eth1
+ports: [9003]
+timeout: 500
+level: debug
+decode: true
+`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cli, set := parseTestArgs(t, "--config", path, "-i", "eth0", "-i", "wg0", "--timeout", "100")
+	cfg, err := buildConfig(cli, set)
+	if err != nil {
+		t.Fatalf("buildConfig failed: %v", err)
+	}
+
+	if got := cfg.InterfaceNames(); len(got) != 2 || got[0] != "eth0" || got[1] != "wg0" {
+		t.Errorf("expected --interface to replace the interface list, got %v", got)
+	}
+	if iface := cfg.Interface("eth0"); iface == nil || iface.Timeout != 900 {
+		t.Errorf("expected per-interface override for eth0 to be kept, got %+v", iface)
+	}
+	if cfg.Timeout != 100 {
+		t.Errorf("expected --timeout to override file, got %d", cfg.Timeout)
+	}
+	if cfg.Level != "debug" {
+		t.Errorf("expected level from file when --level is unset, got %s", cfg.Level)
+	}
+	if !cfg.Decode {
+		t.Error("expected decode from file when --decode is unset")
+	}
+	if len(cfg.Ports) != 1 || cfg.Ports[0] != 9003 {
+		t.Errorf("expected ports from file, got %v", cfg.Ports)
+	}
+}
+
+func TestBuildConfig_FlagsReplaceGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "udp-proxy-2020.yaml")
+	err := os.WriteFile(path, []byte(`
+groups:
+  - name: roon
+    ports: [9003]
+    interfaces: [eth0, tun0]
+`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cli, set := parseTestArgs(t, "--config", path, "-i", "eth0", "-i", "eth1", "-p", "1900")
+	cfg, err := buildConfig(cli, set)
+	if err != nil {
+		t.Fatalf("buildConfig failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	groups := cfg.RelayGroups()
+	if len(groups) != 1 || groups[0].Name != "" || groups[0].Ports[0] != 1900 {
+		t.Fatalf("expected flags to replace groups with a single mesh, got %+v", groups)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/control"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+// controlHandler answers control socket requests using the running proxyState.
+type controlHandler struct {
+	mu    sync.RWMutex
+	state *proxyState
+
+	// reloads reloads the config, nil if reloading isn't supported.
+	reloads *reloadTracker
+}
+
+func newControlHandler(state *proxyState) *controlHandler {
+	return &controlHandler{state: state}
+}
+
+// set replaces the state being controlled.
+func (h *controlHandler) set(state *proxyState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = state
+}
+
+func (h *controlHandler) Handle(req control.Request) (any, error) {
+	h.mu.RLock()
+	state := h.state
+	h.mu.RUnlock()
+	if state == nil {
+		return nil, fmt.Errorf("proxy is not running")
+	}
+
+	switch req.Command {
+	case control.CmdClients:
+		groups, err := selectGroups(state.groups, req.Group, "")
+		if err != nil {
+			return nil, err
+		}
+		return listClients(groups, time.Now()), nil
+	case control.CmdAddFixedIP, control.CmdRemoveFixedIP:
+		return changeFixedIP(state, req)
+	case control.CmdFlush:
+		groups, err := selectGroups(state.groups, req.Group, "")
+		if err != nil {
+			return nil, err
+		}
+		removed := 0
+		for _, g := range groups {
+			removed += g.registry.Flush()
+		}
+		slog.Info("Flushed learned clients", "removed", removed)
+		return control.Result{Message: fmt.Sprintf("removed %d learned clients", removed)}, nil
+	case control.CmdLogLevel:
+		if len(req.Args) != 1 {
+			return nil, fmt.Errorf("%s requires a single level", req.Command)
+		}
+		level, err := parseLevel(req.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		logLevel.Set(level)
+		slog.Info("Changed log level", "level", req.Args[0])
+		return control.Result{Message: fmt.Sprintf("log level set to %s", req.Args[0])}, nil
+	case control.CmdPipelines:
+		return describePipelines(state), nil
+	case control.CmdReload:
+		if h.reloads == nil {
+			return nil, fmt.Errorf("reload is not supported")
+		}
+		// A reload can take longer than a request may, so it is only
+		// started here and its outcome is reported by status.
+		return h.reloads.start(), nil
+	case control.CmdStatus:
+		status := control.Status{Reloads: []control.ReloadStatus{}}
+		if h.reloads != nil {
+			status.Reloads = h.reloads.history()
+		}
+		return status, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", req.Command)
+}
+
+// selectGroups returns the groups with the given name (any when empty) which
+// have iname as a member (any when empty).
+func selectGroups(groups []*relayGroup, name, iname string) ([]*relayGroup, error) {
+	var selected []*relayGroup
+	for _, g := range groups {
+		if name != "" && g.name != name {
+			continue
+		}
+		if iname != "" && !g.hasMember(iname) {
+			continue
+		}
+		selected = append(selected, g)
+	}
+	if len(selected) == 0 {
+		switch {
+		case name != "" && iname != "":
+			return nil, fmt.Errorf("interface %s is not a member of group %q", iname, name)
+		case name != "":
+			return nil, fmt.Errorf("unknown group %q", name)
+		case iname != "":
+			return nil, fmt.Errorf("interface %s is not being relayed", iname)
+		}
+	}
+	return selected, nil
+}
+
+func listClients(groups []*relayGroup, now time.Time) []control.Client {
+	clients := []control.Client{}
+	for _, g := range groups {
+		for _, info := range g.registry.GetClients() {
+			c := control.Client{
+				Group:     g.name,
+				Interface: info.Interface,
+				IP:        info.IP.String(),
+				Fixed:     info.LastSeen.IsZero(),
+			}
+			if len(info.MAC) > 0 {
+				c.MAC = info.MAC.String()
+			}
+			if !c.Fixed {
+				c.LastSeen = info.LastSeen
+				c.TTLRemaining = max(g.registry.GetTTL()-now.Sub(info.LastSeen), 0)
+			}
+			clients = append(clients, c)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := clients[i], clients[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Interface != b.Interface {
+			return a.Interface < b.Interface
+		}
+		return a.IP < b.IP
+	})
+	return clients
+}
+
+func changeFixedIP(state *proxyState, req control.Request) (any, error) {
+	if len(req.Args) != 1 {
+		return nil, fmt.Errorf("%s requires a single iface@ip", req.Command)
+	}
+	iname, ip, err := config.ParseFixedIP(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	groups, err := selectGroups(state.groups, req.Group, iname)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := 0
+	for _, g := range groups {
+		if req.Command == control.CmdAddFixedIP {
+			g.registry.AddFixedIP(iname, ip)
+			changed++
+		} else if g.registry.RemoveFixedIP(iname, ip) {
+			changed++
+		}
+	}
+	if req.Command == control.CmdRemoveFixedIP && changed == 0 {
+		return nil, fmt.Errorf("%s is not a fixed IP on %s", ip, iname)
+	}
+
+	verb := "added"
+	if req.Command == control.CmdRemoveFixedIP {
+		verb = "removed"
+	}
+	slog.Info("Fixed IP "+verb, "interface", iname, "ip", ip.String(), "groups", changed)
+	return control.Result{Message: fmt.Sprintf("%s %s@%s in %d group(s)", verb, iname, ip, changed)}, nil
+}
+
+// describePipelines returns the topology of the running pipelines.
+func describePipelines(state *proxyState) []control.Pipeline {
+	pipelines := make([]control.Pipeline, 0, len(state.pipelines))
+	for _, p := range state.pipelines {
+		desc := control.Pipeline{Source: p.Source.Name()}
+		for _, proc := range p.Processors {
+			desc.Processors = append(desc.Processors, proc.Name())
+		}
+		for _, sink := range p.CurrentSinks() {
+			sinkDesc := control.Sink{Name: sink.Name()}
+			if route, ok := sink.(*stages.RouteSink); ok {
+				for _, proc := range route.Processors {
+					sinkDesc.Processors = append(sinkDesc.Processors, proc.Name())
+				}
+				for _, nested := range route.Sinks {
+					sinkDesc.Sinks = append(sinkDesc.Sinks, nested.Name())
+				}
+			}
+			desc.Sinks = append(desc.Sinks, sinkDesc)
+		}
+		pipelines = append(pipelines, desc)
+	}
+	return pipelines
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/control"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+func parseTestCommand(t *testing.T, args ...string) (CLI, string, map[string]bool) {
+	t.Helper()
+	cli := CLI{}
+	parser, err := kong.New(&cli)
+	if err != nil {
+		t.Fatalf("kong.New failed: %v", err)
+	}
+	ctx, err := parser.Parse(args)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return cli, ctx.Command(), setFlags(ctx)
+}
+
+func buildControlTestPacket(t *testing.T, srcIP net.IP) *proxy.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x01, 0x02, 0x03, 0x04, 0x05},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: 9003, DstPort: 9003}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum failed: %v", err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatalf("SerializeLayers failed: %v", err)
+	}
+	raw := buf.Bytes()
+	return &proxy.Packet{
+		Raw:              raw,
+		Packet:           gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default),
+		ArrivalInterface: "eth0",
+	}
+}
+
+func newTestControlState(t *testing.T) *proxyState {
+	t.Helper()
+	roon, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{"eth0": {"10.0.0.1"}})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	ssdp, err := stages.NewRegistryProcessorByInterface(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+
+	pipeline := proxy.NewPipeline(&testSource{name: "PcapSource:eth0"})
+	pipeline.AddProcessor(&stages.FilterProcessor{Iname: "eth0"})
+	pipeline.AddSink(&stages.RouteSink{Iname: "eth1", Group: "roon", Sinks: []proxy.Sink{&stages.ForwardingSink{Iname: "eth1"}}})
+
+	return &proxyState{
+		pipelines: []*proxy.Pipeline{pipeline},
+		groups: []*relayGroup{
+			{name: "roon", members: []string{"eth0", "eth1"}, registry: roon},
+			{name: "ssdp", members: []string{"eth0", "eth2"}, registry: ssdp},
+		},
+	}
+}
+
+func TestControlHandler_FixedIPs(t *testing.T) {
+	state := newTestControlState(t)
+	h := newControlHandler(state)
+
+	if _, err := h.Handle(control.Request{Command: control.CmdAddFixedIP, Args: []string{"eth0@10.0.0.9"}}); err != nil {
+		t.Fatalf("add-fixed-ip failed: %v", err)
+	}
+	if !state.groups[0].registry.Has("10.0.0.9") || !state.groups[1].registry.Has("10.0.0.9") {
+		t.Fatal("expected fixed IP to be added to every group eth0 is in")
+	}
+
+	if _, err := h.Handle(control.Request{Command: control.CmdAddFixedIP, Args: []string{"eth2@10.0.2.9"}, Group: "roon"}); err == nil {
+		t.Fatal("expected error adding a fixed IP on an interface outside the group")
+	}
+
+	if _, err := h.Handle(control.Request{Command: control.CmdRemoveFixedIP, Args: []string{"eth0@10.0.0.9"}, Group: "ssdp"}); err != nil {
+		t.Fatalf("remove-fixed-ip failed: %v", err)
+	}
+	if !state.groups[0].registry.Has("10.0.0.9") || state.groups[1].registry.Has("10.0.0.9") {
+		t.Fatal("expected fixed IP to only be removed from the ssdp group")
+	}
+
+	if _, err := h.Handle(control.Request{Command: control.CmdRemoveFixedIP, Args: []string{"eth1@10.0.1.1"}}); err == nil {
+		t.Fatal("expected error removing an unknown fixed IP")
+	}
+}
+
+func TestControlHandler_ClientsAndFlush(t *testing.T) {
+	state := newTestControlState(t)
+	h := newControlHandler(state)
+
+	ssdp := state.groups[1].registry
+	ssdp.AddFixedIP("eth2", net.ParseIP("10.0.2.1"))
+	state.groups[0].registry.AddFixedIP("eth1", net.ParseIP("10.0.1.1"))
+
+	data, err := h.Handle(control.Request{Command: control.CmdClients, Group: "roon"})
+	if err != nil {
+		t.Fatalf("clients failed: %v", err)
+	}
+	clients := data.([]control.Client)
+	if len(clients) != 2 || clients[0].IP != "10.0.0.1" || clients[1].IP != "10.0.1.1" || !clients[0].Fixed {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+
+	if _, err := h.Handle(control.Request{Command: control.CmdClients, Group: "nope"}); err == nil {
+		t.Fatal("expected error for unknown group")
+	}
+
+	data, err = h.Handle(control.Request{Command: control.CmdFlush})
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if msg := data.(control.Result).Message; msg != "removed 0 learned clients" {
+		t.Fatalf("unexpected flush result: %s", msg)
+	}
+}
+
+func TestListClients_TTLRemaining(t *testing.T) {
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	pkt := buildControlTestPacket(t, net.IP{10, 0, 0, 2})
+	if _, err := registry.ProcessForInterface("eth0", pkt); err != nil {
+		t.Fatalf("ProcessForInterface failed: %v", err)
+	}
+
+	clients := listClients([]*relayGroup{{registry: registry}}, time.Now().Add(15*time.Minute))
+	if len(clients) != 1 || clients[0].Fixed {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+	if ttl := clients[0].TTLRemaining; ttl > 45*time.Minute || ttl < 44*time.Minute {
+		t.Fatalf("expected ~45m TTL remaining, got %s", ttl)
+	}
+	if clients[0].MAC != "00:01:02:03:04:05" {
+		t.Fatalf("unexpected MAC: %s", clients[0].MAC)
+	}
+}
+
+func TestControlHandler_LogLevel(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	h := newControlHandler(newTestControlState(t))
+
+	if _, err := h.Handle(control.Request{Command: control.CmdLogLevel, Args: []string{"debug"}}); err != nil {
+		t.Fatalf("log-level failed: %v", err)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("expected debug level, got %s", logLevel.Level())
+	}
+	if _, err := h.Handle(control.Request{Command: control.CmdLogLevel, Args: []string{"verbose"}}); err == nil {
+		t.Fatal("expected error for invalid level")
+	}
+}
+
+func TestRunCtl_Pipelines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := control.Listen(path, newControlHandler(newTestControlState(t)))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go server.Serve(t.Context())
+
+	cli, command, _ := parseTestCommand(t, "ctl", "pipelines", "--control-socket", path)
+	var out bytes.Buffer
+	if err := runCtl(cli, command, &out); err != nil {
+		t.Fatalf("runCtl failed: %v", err)
+	}
+	want := "PcapSource:eth0\n  -> FilterProcessor:eth0\n  => RouteSink(roon:eth1)\n       => ForwardingSink(eth1)\n"
+	if out.String() != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	cli, command, _ = parseTestCommand(t, "ctl", "clients", "--control-socket", path)
+	out.Reset()
+	if err := runCtl(cli, command, &out); err != nil {
+		t.Fatalf("runCtl failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "roon   eth0       10.0.0.1  -    -          fixed") {
+		t.Fatalf("unexpected clients output:\n%s", out.String())
+	}
+}
+
+func TestControlHandler_Reload(t *testing.T) {
+	h := newControlHandler(newTestControlState(t))
+	if _, err := h.Handle(control.Request{Command: control.CmdReload}); err == nil {
+		t.Fatal("expected error when reload is not supported")
+	}
+
+	// The reload is still running when the request is answered.
+	release := make(chan struct{})
+	h.reloads = newReloadTracker(func() (string, error) {
+		<-release
+		return "added interfaces eth2", nil
+	})
+	cli, command, _ := parseTestCommand(t, "ctl", "reload")
+	req, err := ctlRequest(cli, command)
+	if err != nil {
+		t.Fatalf("ctlRequest failed: %v", err)
+	}
+	data, err := h.Handle(req)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if started := data.(control.ReloadStatus); started.ID != 1 || !started.Finished.IsZero() {
+		t.Fatalf("expected the reload to be started, got %+v", started)
+	}
+
+	status := func() control.ReloadStatus {
+		t.Helper()
+		data, err := h.Handle(control.Request{Command: control.CmdStatus})
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		reloads := data.(control.Status).Reloads
+		if len(reloads) != 1 {
+			t.Fatalf("expected 1 reload, got %+v", reloads)
+		}
+		return reloads[0]
+	}
+	if !status().Finished.IsZero() {
+		t.Fatal("expected the reload to be running")
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for status().Finished.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the reload to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := status(); got.Summary != "added interfaces eth2" || got.Error != "" {
+		t.Fatalf("unexpected reload outcome: %+v", got)
+	}
+}
+
+func TestRunCtl_ReloadWaitsForOutcome(t *testing.T) {
+	h := newControlHandler(newTestControlState(t))
+	outcomes := []error{nil, errors.New("invalid configuration")}
+	h.reloads = newReloadTracker(func() (string, error) {
+		// Slower than a poll, so ctl has to wait for the outcome.
+		time.Sleep(2 * reloadPollInterval)
+		err := outcomes[0]
+		outcomes = outcomes[1:]
+		return "added interfaces eth2", err
+	})
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := control.Listen(path, h)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go server.Serve(t.Context())
+
+	cli, command, _ := parseTestCommand(t, "ctl", "reload", "--control-socket", path)
+	var out bytes.Buffer
+	if err := runCtl(cli, command, &out); err != nil {
+		t.Fatalf("runCtl failed: %v", err)
+	}
+	if out.String() != "added interfaces eth2\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+	if err := runCtl(cli, command, &out); err == nil || !strings.Contains(err.Error(), "invalid configuration") {
+		t.Fatalf("expected the reload error, got %v", err)
+	}
+
+	cli, command, _ = parseTestCommand(t, "ctl", "status", "--control-socket", path)
+	out.Reset()
+	if err := runCtl(cli, command, &out); err != nil {
+		t.Fatalf("runCtl failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "added interfaces eth2") || !strings.Contains(out.String(), "failed: invalid configuration") {
+		t.Fatalf("unexpected status output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/control"
+)
+
+// CtlCmd holds the `ctl` subcommands which talk to a running udp-proxy-2020
+// over its --control-socket.
+type CtlCmd struct {
+	Clients       CtlClientsCmd   `kong:"cmd,help='List the known clients'"`
+	AddFixedIP    CtlFixedIPCmd   `kong:"cmd,name='add-fixed-ip',help='Add a fixed IP (iface@ip)'"`
+	RemoveFixedIP CtlFixedIPCmd   `kong:"cmd,name='remove-fixed-ip',help='Remove a fixed IP (iface@ip)'"`
+	Flush         CtlFlushCmd     `kong:"cmd,help='Forget all learned clients, keeping fixed IPs'"`
+	LogLevel      CtlLogLevelCmd  `kong:"cmd,name='log-level',help='Change the log level'"`
+	Pipelines     CtlPipelinesCmd `kong:"cmd,help='Show the running pipelines'"`
+	Reload        CtlReloadCmd    `kong:"cmd,help='Reload the config file, same as SIGHUP'"`
+	Status        CtlStatusCmd    `kong:"cmd,help='Show the outcome of the latest reloads'"`
+}
+
+type CtlClientsCmd struct {
+	Group string `kong:"help='Only list clients of this relay group'"`
+}
+
+type CtlFixedIPCmd struct {
+	FixedIP string `kong:"arg,help='Fixed IP as iface@ip'"`
+	Group   string `kong:"help='Only change this relay group, default is every group the interface is in'"`
+}
+
+type CtlFlushCmd struct {
+	Group string `kong:"help='Only flush this relay group'"`
+}
+
+type CtlLogLevelCmd struct {
+	Level string `kong:"arg,enum='trace,debug,info,warn,error',help='New log level [trace|debug|info|warn|error]'"`
+}
+
+type CtlPipelinesCmd struct{}
+
+type CtlReloadCmd struct{}
+
+type CtlStatusCmd struct{}
+
+// reloadPollInterval is how often `ctl reload` asks whether the reload it
+// started has finished.
+const reloadPollInterval = 250 * time.Millisecond
+
+// ctlRequest converts the selected ctl command into a control.Request.
+func ctlRequest(cli CLI, command string) (control.Request, error) {
+	switch command {
+	case "ctl clients":
+		return control.Request{Command: control.CmdClients, Group: cli.Ctl.Clients.Group}, nil
+	case "ctl add-fixed-ip <fixed-ip>":
+		return control.Request{Command: control.CmdAddFixedIP, Args: []string{cli.Ctl.AddFixedIP.FixedIP}, Group: cli.Ctl.AddFixedIP.Group}, nil
+	case "ctl remove-fixed-ip <fixed-ip>":
+		return control.Request{Command: control.CmdRemoveFixedIP, Args: []string{cli.Ctl.RemoveFixedIP.FixedIP}, Group: cli.Ctl.RemoveFixedIP.Group}, nil
+	case "ctl flush":
+		return control.Request{Command: control.CmdFlush, Group: cli.Ctl.Flush.Group}, nil
+	case "ctl log-level <level>":
+		return control.Request{Command: control.CmdLogLevel, Args: []string{cli.Ctl.LogLevel.Level}}, nil
+	case "ctl pipelines":
+		return control.Request{Command: control.CmdPipelines}, nil
+	case "ctl reload":
+		return control.Request{Command: control.CmdReload}, nil
+	case "ctl status":
+		return control.Request{Command: control.CmdStatus}, nil
+	}
+	return control.Request{}, fmt.Errorf("unknown command: %s", command)
+}
+
+// runCtl sends the selected ctl command to the control socket and prints the
+// result to w.
+func runCtl(cli CLI, command string, w io.Writer) error {
+	if cli.ControlSocket == "" {
+		return fmt.Errorf("--control-socket is required")
+	}
+	req, err := ctlRequest(cli, command)
+	if err != nil {
+		return err
+	}
+
+	switch req.Command {
+	case control.CmdClients:
+		var clients []control.Client
+		if err := control.Call(cli.ControlSocket, req, &clients); err != nil {
+			return err
+		}
+		printClients(w, clients)
+	case control.CmdPipelines:
+		var pipelines []control.Pipeline
+		if err := control.Call(cli.ControlSocket, req, &pipelines); err != nil {
+			return err
+		}
+		printPipelines(w, pipelines)
+	case control.CmdReload:
+		var started control.ReloadStatus
+		if err := control.Call(cli.ControlSocket, req, &started); err != nil {
+			return err
+		}
+		reload, err := waitReload(cli.ControlSocket, started.ID)
+		if err != nil {
+			return err
+		}
+		if reload.Error != "" {
+			return fmt.Errorf("reload failed: %s", reload.Error)
+		}
+		fmt.Fprintln(w, reload.Summary)
+	case control.CmdStatus:
+		var status control.Status
+		if err := control.Call(cli.ControlSocket, req, &status); err != nil {
+			return err
+		}
+		printStatus(w, status)
+	default:
+		var result control.Result
+		if err := control.Call(cli.ControlSocket, req, &result); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, result.Message)
+	}
+	return nil
+}
+
+// waitReload polls the status until the reload with id has finished and
+// returns it.  Every poll is a request of its own, so a slow reload doesn't
+// run into the timeout of a request.
+func waitReload(path string, id int) (control.ReloadStatus, error) {
+	for {
+		var status control.Status
+		if err := control.Call(path, control.Request{Command: control.CmdStatus}, &status); err != nil {
+			return control.ReloadStatus{}, fmt.Errorf("unable to get the outcome of reload %d: %w", id, err)
+		}
+		i := slices.IndexFunc(status.Reloads, func(r control.ReloadStatus) bool { return r.ID == id })
+		if i < 0 {
+			return control.ReloadStatus{}, fmt.Errorf("reload %d was forgotten by later reloads, see the log for its outcome", id)
+		}
+		if !status.Reloads[i].Finished.IsZero() {
+			return status.Reloads[i], nil
+		}
+		time.Sleep(reloadPollInterval)
+	}
+}
+
+func printStatus(w io.Writer, status control.Status) {
+	if len(status.Reloads) == 0 {
+		fmt.Fprintln(w, "No reloads yet")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RELOAD\tSTARTED\tDURATION\tOUTCOME")
+	for _, r := range status.Reloads {
+		duration, outcome := "-", "running"
+		if !r.Finished.IsZero() {
+			duration = r.Finished.Sub(r.Started).Truncate(time.Millisecond).String()
+			outcome = r.Summary
+			if r.Error != "" {
+				outcome = "failed: " + r.Error
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", r.ID, r.Started.Local().Format(time.DateTime), duration, outcome)
+	}
+	tw.Flush()
+}
+
+func printClients(w io.Writer, clients []control.Client) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tINTERFACE\tIP\tMAC\tLAST SEEN\tTTL")
+	for _, c := range clients {
+		group := c.Group
+		if group == "" {
+			group = "-"
+		}
+		mac := c.MAC
+		if mac == "" {
+			mac = "-"
+		}
+		lastSeen, ttl := "-", "fixed"
+		if !c.Fixed {
+			lastSeen = c.LastSeen.Local().Format(time.DateTime)
+			ttl = c.TTLRemaining.Truncate(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", group, c.Interface, c.IP, mac, lastSeen, ttl)
+	}
+	tw.Flush()
+}
+
+func printPipelines(w io.Writer, pipelines []control.Pipeline) {
+	for i, p := range pipelines {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, p.Source)
+		for _, proc := range p.Processors {
+			fmt.Fprintf(w, "  -> %s\n", proc)
+		}
+		for _, sink := range p.Sinks {
+			fmt.Fprintf(w, "  => %s\n", sink.Name)
+			if len(sink.Processors) > 0 {
+				fmt.Fprintf(w, "       %s\n", strings.Join(sink.Processors, " -> "))
+			}
+			for _, nested := range sink.Sinks {
+				fmt.Fprintf(w, "       => %s\n", nested)
+			}
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/rewrite"
+	"go.yaml.in/yaml/v3"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the udp-proxy-out-*.pcap files in testdata/golden")
+
+// goldenWriter writes the packets sent on an interface to a pcap file.
+type goldenWriter struct {
+	file    *os.File
+	writer  *pcapgo.Writer
+	packets int
+}
+
+func newGoldenWriter(t *testing.T, path string, linkType layers.LinkType) *goldenWriter {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, rewrite.EgressFraming(linkType)); err != nil {
+		t.Fatalf("WriteFileHeader failed: %v", err)
+	}
+	return &goldenWriter{file: f, writer: w}
+}
+
+func (w *goldenWriter) WritePacketData(data []byte) error {
+	// Numbering the packets keeps the files the same on every run.
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(w.packets), 0), CaptureLength: len(data), Length: len(data)}
+	w.packets++
+	return w.writer.WritePacket(ci, data)
+}
+
+func (w *goldenWriter) Close() { w.file.Close() }
+
+// goldenNetwork is dir/network.yaml, the interfaces of the VirtualNetwork the
+// captures of a golden test are replayed on.  The link type of an interface
+// is the one of the captures of the interfaces on it.
+type goldenNetwork struct {
+	Interfaces []struct {
+		Name      string   `yaml:"name"`
+		Addresses []string `yaml:"addresses"` // address/prefix
+		MTU       int      `yaml:"mtu"`       // 1500 if unset
+	} `yaml:"interfaces"`
+}
+
+// newGoldenNetwork returns the VirtualNetwork of dir/network.yaml.  Every
+// interface is up and can broadcast, whatever its link type.
+func newGoldenNetwork(t *testing.T, dir string, linkTypes map[string]layers.LinkType) *proxy.VirtualNetwork {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "network.yaml"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var network goldenNetwork
+	if err := yaml.Unmarshal(data, &network); err != nil {
+		t.Fatalf("invalid network.yaml: %v", err)
+	}
+
+	n := proxy.NewVirtualNetwork()
+	for _, iface := range network.Interfaces {
+		linkType, ok := linkTypes[iface.Name]
+		if !ok {
+			t.Fatalf("no capture of an interface on %s", iface.Name)
+		}
+		vi := proxy.VirtualInterface{
+			Name:     iface.Name,
+			LinkType: linkType,
+			MTU:      cmp.Or(iface.MTU, 1500),
+			Flags:    net.FlagBroadcast | net.FlagMulticast,
+		}
+		if linkType == layers.LinkTypeEthernet {
+			vi.HardwareAddr = replayHardwareAddr
+		}
+		for _, cidr := range iface.Addresses {
+			ip, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatalf("invalid address of %s: %v", iface.Name, err)
+			}
+			addr := proxy.InterfaceAddress{IP: ip, Netmask: subnet.Mask}
+			if ip4 := ip.To4(); ip4 != nil {
+				addr.Broadaddr = make(net.IP, len(ip4))
+				for i := range ip4 {
+					addr.Broadaddr[i] = ip4[i] | ^subnet.Mask[i]
+				}
+			}
+			vi.Addresses = append(vi.Addresses, addr)
+		}
+		if err := n.Add(vi); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	return n
+}
+
+// goldenSource is the source of a pipeline in the golden tests, which reports
+// when it reads the barrier frame injected after a capture.  By then every
+// packet before it was processed by the pipeline.
+type goldenSource struct {
+	proxy.Source
+	barrier []byte
+	reached chan struct{}
+}
+
+func (s *goldenSource) Read(ctx context.Context) (*proxy.Packet, error) {
+	for {
+		pkt, err := s.Source.Read(ctx)
+		if err != nil || pkt == nil || !bytes.Equal(pkt.Raw, s.barrier) {
+			return pkt, err
+		}
+		select {
+		case s.reached <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// goldenBarrier returns the barrier frame of iname, tagged with its VLAN ID
+// for a VLAN.  The pipelines only look at it as raw bytes, whatever the link
+// type of the interface.
+func goldenBarrier(iname string) []byte {
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0xff}
+	if _, vid, ok := proxy.ParseVLANInterface(iname); ok {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(layers.EthernetTypeDot1Q))
+		frame = binary.BigEndian.AppendUint16(frame, vid)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, 0x88b5) // local experimental
+	return append(frame, "golden barrier"...)
+}
+
+// sentOn returns the interface a packet sent on the device iname was sent on,
+// the VLAN of a tagged frame.
+func sentOn(iname string, linkType layers.LinkType, data []byte) string {
+	pkt := &proxy.Packet{Raw: data, Packet: gopacket.NewPacket(data, linkType, gopacket.Default)}
+	if vid, ok := proxy.PacketVLAN(pkt); ok {
+		return proxy.VLANInterfaceName(iname, vid)
+	}
+	return iname
+}
+
+// TestGolden replays the captures in every directory of testdata/golden and
+// compares what was relayed with the udp-proxy-out-*.pcap files there.  Run
+// with -update to rewrite them after an intended change.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("no golden tests found: %v", err)
+	}
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			testGolden(t, dir)
+		})
+	}
+}
+
+// testGolden runs the proxy for dir/config.yaml on the VirtualNetwork of
+// dir/network.yaml, like on the interfaces of the host.  The packets of
+// dir/udp-proxy-in-<interface>.pcap are injected on every interface, one
+// interface after the other in the order of the config so clients learned
+// from one capture are known to the next, and what the pipeline of the
+// interface sends on every other one is written to
+// udp-proxy-out-<src>-to-<dst>.pcap.
+func testGolden(t *testing.T, dir string) {
+	cfg, err := config.Load(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	cfg.NoListen = true
+
+	inames := cfg.InterfaceNames()
+	captures := make(map[string][][]byte, len(inames))
+	linkTypes := make(map[string]layers.LinkType)
+	for _, iname := range inames {
+		// Captures without packets only set the link type of an interface.
+		linkType, packets := readCapture(t, filepath.Join(dir, "udp-proxy-in-"+iname+".pcap"))
+		device := proxy.DeviceName(iname)
+		if lt, ok := linkTypes[device]; ok && lt != linkType {
+			t.Fatalf("the captures of the interfaces on %s have different link types", device)
+		}
+		linkTypes[device] = linkType
+		captures[iname] = packets
+	}
+
+	n := newGoldenNetwork(t, dir, linkTypes)
+	state, err := setupPipelines(cfg, n)
+	if err != nil {
+		t.Fatalf("setupPipelines failed: %v", err)
+	}
+	sources := make(map[string]*goldenSource, len(state.ifaces))
+	for iname, s := range state.ifaces {
+		sources[iname] = &goldenSource{Source: s.pipeline.Source, barrier: goldenBarrier(iname), reached: make(chan struct{})}
+		s.pipeline.Source = sources[iname]
+	}
+	startVirtualProxy(t, n, cfg, state)
+
+	out := t.TempDir()
+	writers := make(map[[2]string]*goldenWriter, len(state.routes))
+	for key := range state.routes {
+		pair := [2]string{key.src, key.dst}
+		if _, ok := writers[pair]; ok {
+			t.Fatalf("more than one group relays from %s to %s", key.src, key.dst)
+		}
+		path := filepath.Join(out, routePcapFilename(key.group, key.src, key.dst))
+		writers[pair] = newGoldenWriter(t, path, linkTypes[proxy.DeviceName(key.dst)])
+	}
+
+	for _, src := range inames {
+		device := proxy.DeviceName(src)
+		for _, data := range append(captures[src], goldenBarrier(src)) {
+			if err := n.Inject(device, data); err != nil {
+				t.Fatalf("Inject failed: %v", err)
+			}
+		}
+		select {
+		case <-sources[src].reached:
+		case <-time.After(virtualTimeout):
+			t.Fatalf("%s: timed out waiting for the capture to be processed", src)
+		}
+
+		// Everything was sent by now, the queues only need to be emptied.
+		for _, device := range slices.Sorted(maps.Keys(linkTypes)) {
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				data, err := n.Transmitted(ctx, device)
+				cancel()
+				if err != nil {
+					break
+				}
+				dst := sentOn(device, linkTypes[device], data)
+				w, ok := writers[[2]string{src, dst}]
+				if !ok {
+					t.Errorf("%s: packet sent on %s without a route to it", src, dst)
+					continue
+				}
+				if err := w.WritePacketData(data); err != nil {
+					t.Fatalf("WritePacketData failed: %v", err)
+				}
+			}
+		}
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+
+	got := goldenFiles(t, out)
+	if *updateGolden {
+		for _, name := range goldenFiles(t, dir) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+		}
+		for _, name := range got {
+			data, err := os.ReadFile(filepath.Join(out, name))
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dir, name), data, 0644)
+			}
+			if err != nil {
+				t.Fatalf("unable to update %s: %v", name, err)
+			}
+		}
+		return
+	}
+
+	if want := goldenFiles(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("expected files %v, got %v", want, got)
+	}
+	for _, name := range got {
+		compareCaptures(t, filepath.Join(dir, name), filepath.Join(out, name))
+	}
+}
+
+// goldenFiles returns the names of the udp-proxy-out-*.pcap files in dir.
+func goldenFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "udp-proxy-out-*.pcap"))
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
+}
+
+// compareCaptures reports every packet which differs between the pcap files.
+func compareCaptures(t *testing.T, wantPath, gotPath string) {
+	t.Helper()
+	wantType, want := readCapture(t, wantPath)
+	gotType, got := readCapture(t, gotPath)
+	name := filepath.Base(wantPath)
+	if gotType != wantType {
+		t.Errorf("%s: expected link type %v, got %v", name, wantType, gotType)
+		return
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: expected %d packets, got %d", name, len(want), len(got))
+	}
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("%s: packet %d differs\nwant: %s\ngot:  %s", name, i,
+				gopacket.NewPacket(want[i], wantType, gopacket.Default),
+				gopacket.NewPacket(got[i], gotType, gopacket.Default))
+		}
+	}
+}
+
+func readCapture(t *testing.T, path string) (layers.LinkType, [][]byte) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	var packets [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			return r.LinkType(), packets
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		packets = append(packets, data)
+	}
+}
@@ -6,66 +6,72 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 )
 
-// startUDPListeners starts a UDP listener on each interface and port, reading and discarding packets.
-func startUDPListeners(ctx context.Context, wg *sync.WaitGroup, cli CLI) {
-	for _, iname := range cli.Interface {
-		addrs, err := net.InterfaceByName(iname)
-		if err != nil {
-			slog.Error("Failed to get interface for UDP listen", "interface", iname, "error", err)
-			continue
-		}
-		ifaceAddrs, err := addrs.Addrs()
-		if err != nil {
-			slog.Error("Failed to get addresses for UDP listen", "interface", iname, "error", err)
+// startInterfaceListeners starts a UDP listener on each address of iname, as
+// known to dm, and port, reading and discarding packets until ctx is
+// cancelled, which closes the sockets right away so the ports can be bound
+// again.
+func startInterfaceListeners(ctx context.Context, wg *sync.WaitGroup, dm proxy.DeviceManager, iname string, ports []int32) {
+	addrs, err := dm.GetAddresses(iname)
+	if err != nil {
+		slog.Error("Failed to get addresses for UDP listen", "interface", iname, "error", err)
+		return
+	}
+	for _, addr := range addrs {
+		ip := addr.IP
+		if ip == nil || ip.IsMulticast() || ip.IsLoopback() {
 			continue
 		}
-		for _, addr := range ifaceAddrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
+		// IPv6 link-local addresses are commonly the only IPv6 address on a
+		// link and need the interface as their zone to be bound.
+		zone := ""
+		if ip.IsLinkLocalUnicast() {
+			if ip.To4() != nil {
+				continue
 			}
-			if ip == nil || ip.IsMulticast() || ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+			zone = iname
+		}
+		for _, port := range ports {
+			laddr := &net.UDPAddr{IP: ip, Port: int(port), Zone: zone}
+			conn, err := net.ListenUDP("udp", laddr)
+			if err != nil {
+				slog.Warn("Failed to listen on UDP", "interface", iname, "address", laddr.String(), "error", err)
 				continue
 			}
-			for _, port := range cli.Port {
-				laddr := &net.UDPAddr{IP: ip, Port: int(port)}
-				conn, err := net.ListenUDP("udp", laddr)
-				if err != nil {
-					slog.Warn("Failed to listen on UDP", "interface", iname, "address", laddr.String(), "error", err)
-					continue
-				}
-				wg.Add(1)
-				go func(c *net.UDPConn, ifn string, p int) {
-					defer wg.Done()
-					defer c.Close()
-					buf := make([]byte, 2048)
-					for {
-						select {
-						case <-ctx.Done():
+			wg.Add(1)
+			go func(c *net.UDPConn, ifn string, p int) {
+				defer wg.Done()
+				defer c.Close()
+				stop := context.AfterFunc(ctx, func() { c.Close() })
+				defer stop()
+				buf := make([]byte, 2048)
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					default:
+						if err := c.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+							slog.Warn("Failed to set UDP read deadline", "interface", ifn, "port", p, "error", err)
 							return
-						default:
-							if err := c.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
-								slog.Warn("Failed to set UDP read deadline", "interface", ifn, "port", p, "error", err)
-								return
+						}
+						_, _, err := c.ReadFromUDP(buf)
+						if err != nil {
+							if ne, ok := err.(net.Error); ok && ne.Timeout() {
+								continue
 							}
-							_, _, err := c.ReadFromUDP(buf)
-							if err != nil {
-								if ne, ok := err.(net.Error); ok && ne.Timeout() {
-									continue
-								}
-								slog.Warn("UDP listen error", "interface", ifn, "port", p, "error", err)
+							if ctx.Err() != nil {
 								return
 							}
-							// Packet is read and ignored
+							slog.Warn("UDP listen error", "interface", ifn, "port", p, "error", err)
+							return
 						}
+						// Packet is read and ignored
 					}
-				}(conn, iname, int(port))
-			}
+				}
+			}(conn, iname, int(port))
 		}
 	}
 }
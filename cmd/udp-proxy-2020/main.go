@@ -24,16 +24,21 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 	"github.com/gopacket/gopacket/pcapgo"
 	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/control"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/rewrite"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
 )
 
@@ -46,38 +51,116 @@ var newRegistryProcessorByInterface = stages.NewRegistryProcessorByInterface
 var newTransmitterSink = stages.NewTransmitterSink
 
 func main() {
-	cli := parseArgs()
-	setupLogging(cli)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	os.Exit(run())
+}
+
+// run runs udp-proxy-2020 and returns the exit status: 0 after a clean
+// shutdown, 1 if it failed to start or to shut down cleanly.
+func run() int {
+	cli, command, set := parseArgs()
+	if strings.HasPrefix(command, "ctl ") {
+		if err := runCtl(cli, command, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	cfg, err := buildConfig(cli, set)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load config: %v\n", err)
+		return 1
+	}
+	if !cli.ListInterfaces {
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			return 1
+		}
+	}
+	setupLogging(cfg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	timeout, ttl := getDurations(cli)
+	if command == "replay <file>" {
+		if err := runReplay(ctx, cfg, cli.Replay); err != nil {
+			slog.Error("Replay failed", "error", err)
+			return 1
+		}
+		return 0
+	}
 
-	dm, err := proxy.NewDeviceManager()
+	dm, err := proxy.NewHostDeviceManager(cfg.Capture)
 	if err != nil {
 		slog.Error("Failed to initialize device manager", "error", err)
-		os.Exit(1)
+		return 1
 	}
 	defer dm.CloseHandles()
 
 	if cli.ListInterfaces {
 		dm.ListInterfaces()
-		os.Exit(0)
+		return 0
 	}
+	// Interface patterns are expanded again by the runner whenever the
+	// available interfaces change.
+	cfg = cfg.Expand(dm.InterfaceNames())
 
-	pipelines, registries, err := setupPipelines(cli, dm, timeout, ttl)
+	state, err := setupPipelines(cfg, dm)
 	if err != nil {
 		slog.Error("Failed to set up pipelines", "error", err)
-		return
+		return 1
 	}
+	checkLoopbackRouting(state.loopback)
 
 	if cli.GraphPipeline != "" {
-		if err := GenerateDotFile(pipelines, cli.GraphPipeline); err != nil {
+		if err := GenerateDotFile(state.pipelines, cli.GraphPipeline); err != nil {
 			slog.Error("Failed to generate dot file", "error", err)
-			os.Exit(1)
+			return 1
 		}
 		slog.Info("Successfully generated Graphviz dot file", "path", cli.GraphPipeline)
-		os.Exit(0)
+		return 0
+	}
+
+	r := newRunner(ctx, dm, cfg, state)
+	reloads := newReloadTracker(func() (string, error) {
+		newCfg, err := buildConfig(cli, set)
+		if err != nil {
+			return "", err
+		}
+		if err := newCfg.Validate(); err != nil {
+			return "", fmt.Errorf("invalid configuration: %w", err)
+		}
+		return r.reload(newCfg)
+	})
+
+	if cfg.MetricsListen != "" {
+		metrics.Enable()
+		collector := newStateCollector(state)
+		r.onState = append(r.onState, collector.set)
+		metrics.Registry.MustRegister(collector)
+		go func() {
+			if err := metrics.Serve(ctx, cfg.MetricsListen); err != nil {
+				slog.Error("Metrics endpoint failed", "address", cfg.MetricsListen, "error", err)
+			}
+		}()
+	}
+
+	if cfg.ControlSocket != "" {
+		handler := newControlHandler(state)
+		handler.reloads = reloads
+		r.onState = append(r.onState, handler.set)
+		server, err := control.Listen(cfg.ControlSocket, handler)
+		if err != nil {
+			slog.Warn("Control socket disabled", "path", cfg.ControlSocket, "error", err)
+		} else {
+			go server.Serve(ctx)
+			defer server.Close()
+		}
+	}
+
+	groups := func() []*relayGroup { return r.current().groups }
+	if cfg.StateFile != "" {
+		loadState(cfg.StateFile, state.groups)
+		go saveStatePeriodically(ctx, cfg.StateFile, cfg.StateIntervalDuration(), groups)
 	}
 
 	go func() {
@@ -88,45 +171,47 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				for _, r := range registries {
-					r.Cleanup()
+				for _, g := range groups() {
+					g.registry.Cleanup()
 				}
 			}
 		}
 	}()
 
-	var wg sync.WaitGroup
-	for _, p := range pipelines {
-		wg.Add(1)
-		go func(pipe *proxy.Pipeline) {
-			defer wg.Done()
-			if err := pipe.Run(ctx); err != nil {
-				slog.Error("Pipeline error", "error", err)
-			}
-		}(p)
-	}
-
-	// Start UDP listeners if --no-listen is not set
-	if !cli.NoListen {
-		startUDPListeners(ctx, &wg, cli)
-	}
+	// Watch before starting so no interface change after the setup is missed;
+	// the events are queued until the runner handles them.
+	events, unsubscribe := dm.Subscribe()
+	defer unsubscribe()
+	go dm.Watch(ctx, interfacePollInterval)
+	r.start()
+	go watchReloadSignal(ctx, reloads.run)
+	go r.watchInterfaces(ctx, events)
 
 	slog.Info("All pipelines started")
-	wg.Wait()
+	<-ctx.Done()
+	// Restore the default signal handling so a second signal exits immediately.
+	stop()
+	return shutdown(&r.wg, &r.failed, r.config(), r.current())
 }
 
-func getDurations(cli CLI) (time.Duration, time.Duration) {
-	timeout := config.ParseTimeout(cli.Timeout)
-	if cli.CacheTTL <= 0 {
-		slog.Error("CacheTTL must be a positive number of minutes")
-		os.Exit(1)
-	}
-	ttl, err := time.ParseDuration(fmt.Sprintf("%dm", cli.CacheTTL))
-	if err != nil {
-		slog.Error("Invalid CacheTTL", "value", cli.CacheTTL, "error", err)
-		os.Exit(1)
-	}
-	return timeout, ttl
+// proxyState is everything built from the config which is needed while
+// running: the pipelines to run and the shared state used by their stages.
+type proxyState struct {
+	pipelines []*proxy.Pipeline
+	groups    []*relayGroup
+	dedup     *stages.DedupCache
+	trunks    *stages.TrunkCaptures
+	loopback  string
+	// ifaces and routes only hold the interfaces which are available, the
+	// others are pending until they appear.
+	ifaces map[string]ifaceState
+	routes map[routeKey]*stages.RouteSink
+}
+
+// routeKey identifies the RouteSink relaying a group's packets from one
+// interface to another.
+type routeKey struct {
+	group, src, dst string
 }
 
 type ifaceState struct {
@@ -135,13 +220,23 @@ type ifaceState struct {
 	source    *stages.PcapSource
 	pipeline  *proxy.Pipeline
 	broadcast bool
-	bcastIP   net.IP
+	bcastIPs  []net.IP
+	addrs     []proxy.InterfaceAddress // the BPF filter and bcastIPs are built from
+	// egressLimit is shared by every route relaying to the interface, nil
+	// without egress rate limits.
+	egressLimit *stages.RateLimitProcessor
+}
+
+// receivesRoutes reports whether packets can be relayed to iname.  Nothing can
+// be sent on the any pseudo-interface, it only captures.
+func receivesRoutes(iname string) bool {
+	return iname != proxy.AnyInterface
 }
 
 func attachCrossInterfaceSinks(states []ifaceState, addSink func(src, dst ifaceState) error) error {
 	for _, src := range states {
 		for _, dst := range states {
-			if src.name == dst.name {
+			if src.name == dst.name || !receivesRoutes(dst.name) {
 				continue
 			}
 			if err := addSink(src, dst); err != nil {
@@ -162,104 +257,466 @@ func buildSharedRegistries(ttl time.Duration, fixedIPs map[string][]string) ([]*
 	return []*stages.RegistryProcessor{registry}, nil
 }
 
-func setupPipelines(cli CLI, dm *proxy.DeviceManager, timeout, ttl time.Duration) ([]*proxy.Pipeline, []*stages.RegistryProcessor, error) {
-	checkDuplicateInterfaces(cli.Interface)
+// relayGroup is the runtime state of a config.GroupConfig: the registry shared
+// by its members and the interfaces it relays between.
+type relayGroup struct {
+	name       string
+	ports      []int32
+	members    []string
+	otherPorts map[string][]int32 // ports of the other groups, by member
+	registry   *stages.RegistryProcessor
+}
+
+// hasMember reports whether iname is one of the interfaces of the group.
+func (g *relayGroup) hasMember(iname string) bool {
+	for _, member := range g.members {
+		if member == iname {
+			return true
+		}
+	}
+	return false
+}
+
+// buildRelayGroups returns the relay groups from the config, adding the
+// loopback interface (if not empty) to every group.
+func buildRelayGroups(cfg *config.Config, loopback string) []*relayGroup {
+	var groups []*relayGroup
+	for _, g := range cfg.RelayGroups() {
+		members := append([]string{}, g.Interfaces...)
+		if loopback != "" {
+			members = append(members, loopback)
+		}
+		groups = append(groups, &relayGroup{
+			name:    g.Name,
+			ports:   g.Ports,
+			members: members,
+		})
+	}
+	for _, g := range groups {
+		g.otherPorts = make(map[string][]int32, len(g.members))
+		for _, other := range groups {
+			if other == g {
+				continue
+			}
+			for _, iname := range g.members {
+				if other.hasMember(iname) {
+					g.otherPorts[iname] = append(g.otherPorts[iname], other.ports...)
+				}
+			}
+		}
+	}
+	return groups
+}
 
-	interfaces := cli.Interface
-	if cli.DeliverLocal {
-		lb := dm.GetLoopback()
-		if lb == "" {
-			slog.Error("Unable to find loopback interface")
-			return nil, nil, fmt.Errorf("loopback interface not found")
+// portsForInterface returns the union of the ports of every group iname is a member of.
+func portsForInterface(groups []*relayGroup, iname string) []int32 {
+	var ports []int32
+	seen := make(map[int32]bool)
+	for _, g := range groups {
+		for _, member := range g.members {
+			if member != iname {
+				continue
+			}
+			for _, port := range g.ports {
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
 		}
-		interfaces = append(interfaces, lb)
 	}
+	return ports
+}
+
+func setupPipelines(cfg *config.Config, dm proxy.DeviceManager) (*proxyState, error) {
+	loopback, err := loopbackFor(cfg, dm)
+	if err != nil {
+		return nil, err
+	}
+	interfaces := relayInterfaces(cfg, loopback)
 
-	fixedIPs := getFixedIPs(cli, dm)
-	registries, err := buildSharedRegistries(ttl, fixedIPs)
+	fixedIPs, err := getFixedIPs(cfg, dm)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid fixed IP configuration: %w", err)
+		return nil, err
 	}
-	registry := registries[0]
+	groups := buildRelayGroups(cfg, loopback)
+
+	var pipelines []*proxy.Pipeline
+	states := make(map[string]ifaceState, len(interfaces))
+	routes := make(map[routeKey]*stages.RouteSink)
 
-	var (
-		pipelines []*proxy.Pipeline
-		states    []ifaceState
-	)
+	// A single dedup cache is shared by every pipeline so copies are detected
+	// no matter which interface they come back in on.
+	var dedup *stages.DedupCache
+	if window := cfg.DedupWindowDuration(); window > 0 {
+		dedup = stages.NewDedupCache(window)
+	}
+	trunks := stages.NewTrunkCaptures(dm)
 
+	// One pipeline per interface is shared by every group the interface is in.
 	for _, iname := range interfaces {
-		state, pipeline, err := setupInterfacePipeline(cli, dm, registry, iname, timeout)
+		if !interfaceReady(dm, iname) {
+			// Attached by the runner once it shows up, see watchInterfaces.
+			slog.Warn("Interface not available, waiting for it to appear", "interface", iname)
+			continue
+		}
+		state, pipeline, err := setupInterfacePipeline(cfg, dm, trunks, dedup, iname, portsForInterface(groups, iname))
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		states = append(states, state)
+		states[iname] = state
 		pipelines = append(pipelines, pipeline)
 	}
 
-	if err := attachCrossInterfaceSinks(states, func(src, dst ifaceState) error {
-		return setupCrossInterfaceSink(cli, dm, registry, src, dst)
-	}); err != nil {
-		return nil, nil, err
+	for _, group := range groups {
+		groupFixedIPs := make(map[string][]string)
+		groupStates := make([]ifaceState, 0, len(group.members))
+		for _, iname := range group.members {
+			if ips, ok := fixedIPs[iname]; ok {
+				groupFixedIPs[iname] = ips
+			}
+			if state, ok := states[iname]; ok {
+				groupStates = append(groupStates, state)
+			}
+		}
+
+		groupRegistries, err := buildSharedRegistries(cfg.CacheTTLDuration(), groupFixedIPs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fixed IP configuration: %w", err)
+		}
+		group.registry = groupRegistries[0]
+
+		for _, state := range groupStates {
+			state.pipeline.AddProcessor(&stages.RegistryLearnerProcessor{
+				Registry:   group.registry,
+				Iname:      state.name,
+				Group:      group.name,
+				Ports:      group.ports,
+				OtherPorts: group.otherPorts[state.name],
+			})
+		}
+
+		if err := attachCrossInterfaceSinks(groupStates, func(src, dst ifaceState) error {
+			route, err := newCrossInterfaceRoute(cfg, dm, group, src, dst)
+			if err != nil {
+				return err
+			}
+			src.pipeline.AddSink(route)
+			routes[routeKey{group.name, src.name, dst.name}] = route
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &proxyState{pipelines: pipelines, groups: groups, dedup: dedup, trunks: trunks, loopback: loopback, ifaces: states, routes: routes}, nil
+}
+
+// interfaceReady reports whether iname exists and has an address, which is
+// needed to set up its pipeline.  A logical VLAN interface is ready once its
+// trunk exists, the trunk doesn't need an address.  The any pseudo-interface
+// only exists on Linux.
+func interfaceReady(dm proxy.DeviceManager, iname string) bool {
+	if iname == proxy.AnyInterface {
+		return runtime.GOOS == "linux"
+	}
+	if trunk, _, ok := proxy.ParseVLANInterface(iname); ok {
+		return !interfaceGone(dm, trunk)
+	}
+	if _, err := dm.Interface(iname); err != nil {
+		return false
+	}
+	_, err := dm.GetAddresses(iname)
+	return err == nil
+}
+
+// interfaceGone reports whether iname, or the trunk of a logical VLAN
+// interface, has been deleted.  Interfaces which are only down are left to the
+// PcapSource and TransmitterSink to reconnect.
+func interfaceGone(dm proxy.DeviceManager, iname string) bool {
+	if iname == proxy.AnyInterface {
+		return false
 	}
+	_, err := dm.Interface(proxy.DeviceName(iname))
+	return err != nil
+}
 
-	return pipelines, registries, nil
+// addRegistryLearners adds a RegistryLearnerProcessor to the pipeline of
+// iname for each relay group it is a member of.
+func addRegistryLearners(pipeline *proxy.Pipeline, groups []*relayGroup, iname string) {
+	for _, g := range groups {
+		if g.hasMember(iname) {
+			pipeline.AddProcessor(&stages.RegistryLearnerProcessor{
+				Registry:   g.registry,
+				Iname:      iname,
+				Group:      g.name,
+				Ports:      g.ports,
+				OtherPorts: g.otherPorts[iname],
+			})
+		}
+	}
 }
 
 // setupInterfacePipeline initializes a pipeline for a single interface and returns its state and pipeline.
-func setupInterfacePipeline(cli CLI, dm *proxy.DeviceManager, registry *stages.RegistryProcessor, iname string, timeout time.Duration) (ifaceState, *proxy.Pipeline, error) {
-	netif, err := net.InterfaceByName(iname)
+func setupInterfacePipeline(cfg *config.Config, dm proxy.DeviceManager, trunks *stages.TrunkCaptures, dedup *stages.DedupCache, iname string, ports []int32) (ifaceState, *proxy.Pipeline, error) {
+	if trunk, vid, ok := proxy.ParseVLANInterface(iname); ok {
+		return setupVLANPipeline(cfg, dm, trunks, dedup, iname, trunk, vid, ports)
+	}
+	if iname == proxy.AnyInterface {
+		return setupAnyPipeline(cfg, dm, dedup, ports)
+	}
+
+	netif, err := dm.Interface(iname)
 	if err != nil {
 		slog.Error("Interface not found", "interface", iname, "error", err)
 		return ifaceState{}, nil, fmt.Errorf("interface not found: %s", iname)
 	}
 
-	source, err := stages.NewPcapSource(dm, iname, (netif.Flags&net.FlagBroadcast) == 0, timeout)
+	promisc := cfg.PromiscFor(iname, (netif.Flags&net.FlagBroadcast) == 0)
+	source, err := stages.NewPcapSource(dm, iname, promisc, cfg.TimeoutFor(iname))
 	if err != nil {
 		slog.Error("Failed to open interface", "interface", iname, "error", err)
 		return ifaceState{}, nil, fmt.Errorf("failed to open interface: %s", iname)
 	}
-	rhandle := source.Handle()
 
 	addrs, err := dm.GetAddresses(iname)
 	if err != nil {
 		slog.Error("Failed to get addresses for interface", "interface", iname, "error", err)
 		return ifaceState{}, nil, fmt.Errorf("failed to get addresses for interface: %s", iname)
 	}
-	filter := config.BuildBPFFilter(cli.Port, addrs)
-	if err := rhandle.SetBPFFilter(filter); err != nil {
+	filter := config.BuildBPFFilter(ports, addrs)
+	if err := source.SetBPFFilter(filter); err != nil {
 		slog.Error("Failed to set BPF filter", "interface", iname, "error", err)
 		return ifaceState{}, nil, fmt.Errorf("failed to set BPF filter for interface: %s", iname)
 	}
 
-	pipeline := proxy.NewPipeline(source)
-	pipeline.AddProcessor(&stages.FilterProcessor{Iname: iname})
-	if cli.Decode {
-		pipeline.AddProcessor(stages.NewDecodeProcessor(iname, stages.DirectionInbound, os.Stdout))
+	pipeline, err := newInterfacePipeline(cfg, dedup, iname, ports, source, source.LinkType())
+	if err != nil {
+		return ifaceState{}, nil, err
 	}
-	pipeline.AddProcessor(&stages.RegistryLearnerProcessor{Registry: registry, Iname: iname})
 
-	if cli.Pcap {
-		if err := addPcapFileSink(pipeline, cli.PcapPath, fmt.Sprintf("udp-proxy-in-%s.pcap", iname), rhandle.LinkType()); err != nil {
-			return ifaceState{}, nil, err
-		}
+	bcast, err := discoverBroadcastAddresses(dm, netif, addrs, cfg, iname)
+	if err != nil {
+		return ifaceState{}, nil, err
 	}
 
-	bcast, err := discoverBroadcastAddress(dm, netif, addrs, cli, iname)
+	state := ifaceState{
+		name:        iname,
+		netif:       netif,
+		source:      source,
+		pipeline:    pipeline,
+		broadcast:   (netif.Flags&net.FlagBroadcast) != 0 || (cfg.DeliverLocal && iname == dm.GetLoopback()),
+		bcastIPs:    bcast,
+		addrs:       addrs,
+		egressLimit: newEgressRateLimit(cfg, iname),
+	}
+	return state, pipeline, nil
+}
+
+// setupVLANPipeline initializes the pipeline of a logical VLAN interface,
+// which reads the packets tagged with vid from the capture of the trunk shared
+// by all of its VLANs.  The host has no address on the VLAN, so its subnets
+// and broadcast addresses come from the broadcast-subnets of the interface.
+func setupVLANPipeline(cfg *config.Config, dm proxy.DeviceManager, trunks *stages.TrunkCaptures, dedup *stages.DedupCache, iname, trunk string, vid uint16, ports []int32) (ifaceState, *proxy.Pipeline, error) {
+	netif, err := dm.Interface(trunk)
+	if err != nil {
+		slog.Error("Trunk interface not found", "interface", iname, "trunk", trunk, "error", err)
+		return ifaceState{}, nil, fmt.Errorf("trunk interface not found: %s", trunk)
+	}
+
+	addrs := vlanAddresses(cfg, iname)
+	promisc := cfg.PromiscFor(iname, (netif.Flags&net.FlagBroadcast) == 0)
+	source, err := trunks.Open(trunk, vid, config.BuildBPFFilter(ports, addrs), promisc, cfg.TimeoutFor(iname))
+	if err != nil {
+		slog.Error("Failed to open VLAN", "interface", iname, "error", err)
+		return ifaceState{}, nil, fmt.Errorf("failed to open VLAN interface: %s", iname)
+	}
+
+	pipeline, err := newInterfacePipeline(cfg, dedup, iname, ports, source, source.LinkType())
+	if err != nil {
+		source.Close()
+		return ifaceState{}, nil, err
+	}
+
+	var bcast []net.IP
+	for _, addr := range addrs {
+		bcast = append(bcast, addr.Broadaddr)
+	}
+	if len(bcast) == 0 {
+		slog.Warn("No broadcast-subnets for VLAN interface, only relaying to known clients", "interface", iname)
+	}
+
+	state := ifaceState{
+		name:        iname,
+		netif:       netif,
+		pipeline:    pipeline,
+		broadcast:   len(bcast) > 0,
+		bcastIPs:    bcast,
+		addrs:       addrs,
+		egressLimit: newEgressRateLimit(cfg, iname),
+	}
+	return state, pipeline, nil
+}
+
+// setupAnyPipeline initializes the pipeline of the any pseudo-interface, which
+// captures the packets of every interface for relaying to the other members
+// of its relay groups.  It has no addresses, so packets aren't filtered by
+// subnet, and nothing is sent on it.
+func setupAnyPipeline(cfg *config.Config, dm proxy.DeviceManager, dedup *stages.DedupCache, ports []int32) (ifaceState, *proxy.Pipeline, error) {
+	iname := proxy.AnyInterface
+	// Promiscuous mode isn't supported on the any pseudo-interface.
+	source, err := stages.NewPcapSource(dm, iname, false, cfg.TimeoutFor(iname))
 	if err != nil {
+		slog.Error("Failed to open interface", "interface", iname, "error", err)
+		return ifaceState{}, nil, fmt.Errorf("failed to open interface: %s", iname)
+	}
+	if err := source.SetBPFFilter(config.BuildBPFFilter(ports, nil)); err != nil {
+		slog.Error("Failed to set BPF filter", "interface", iname, "error", err)
+		source.Close()
+		return ifaceState{}, nil, fmt.Errorf("failed to set BPF filter for interface: %s", iname)
+	}
+
+	pipeline, err := newInterfacePipeline(cfg, dedup, iname, ports, source, source.LinkType())
+	if err != nil {
+		source.Close()
 		return ifaceState{}, nil, err
 	}
 
 	state := ifaceState{
-		name:      iname,
-		netif:     netif,
-		source:    source,
-		pipeline:  pipeline,
-		broadcast: (netif.Flags & net.FlagBroadcast) != 0,
-		bcastIP:   bcast,
+		name:     iname,
+		netif:    &net.Interface{Name: iname},
+		source:   source,
+		pipeline: pipeline,
 	}
 	return state, pipeline, nil
 }
 
+// vlanAddresses returns the broadcast-subnets of a logical VLAN interface as
+// the interface addresses it would have if the host had an address on them.
+func vlanAddresses(cfg *config.Config, iname string) []proxy.InterfaceAddress {
+	var addrs []proxy.InterfaceAddress
+	for _, subnet := range cfg.BroadcastSubnetsFor(iname) {
+		ip := subnet.IP.To4()
+		if ip == nil {
+			continue
+		}
+		bcast := make(net.IP, len(ip))
+		for i := range ip {
+			bcast[i] = ip[i] | ^subnet.Mask[i]
+		}
+		addrs = append(addrs, proxy.InterfaceAddress{IP: ip, Netmask: subnet.Mask, Broadaddr: bcast})
+	}
+	return addrs
+}
+
+// newInterfacePipeline returns the pipeline reading the packets of iname from
+// source, with the processors every interface gets.  ports are the ports
+// relayed on iname, the ones its BPF filter is built for.
+func newInterfacePipeline(cfg *config.Config, dedup *stages.DedupCache, iname string, ports []int32, source proxy.Source, linkType layers.LinkType) (*proxy.Pipeline, error) {
+	pipeline := proxy.NewPipeline(source)
+	// Fragments have no UDP header for the other processors.
+	pipeline.AddProcessor(stages.NewReassemblyProcessor(iname, ports))
+	pipeline.AddProcessor(&stages.FilterProcessor{Iname: iname})
+	if rules := cfg.IngressACLFor(iname); len(rules) > 0 {
+		// Must run before the RegistryLearnerProcessor so denied clients
+		// are never learned.
+		pipeline.AddProcessor(&stages.ACLProcessor{Iname: iname, Direction: stages.DirectionInbound, Rules: aclRules(rules)})
+	}
+	if dedup != nil {
+		// Must run before the RegistryLearnerProcessor so looped copies
+		// don't teach us clients on the wrong interface.
+		pipeline.AddProcessor(&stages.DedupProcessor{Cache: dedup, Iname: iname})
+	}
+	if limit := stages.NewRateLimitProcessor(iname, stages.DirectionInbound, rateLimits(cfg)); len(limit.Limits) > 0 {
+		pipeline.AddProcessor(limit)
+	}
+	if cfg.DecodeFor(iname) {
+		pipeline.AddProcessor(stages.NewDecodeProcessor(iname, stages.DirectionInbound, os.Stdout))
+	}
+
+	if cfg.PcapFor(iname) {
+		if err := addPcapFileSink(pipeline, cfg.PcapPath, fmt.Sprintf("udp-proxy-in-%s.pcap", iname), linkType); err != nil {
+			return nil, err
+		}
+	}
+	return pipeline, nil
+}
+
+// aclRules converts the ACL rules of the config for an ACLProcessor.
+func aclRules(rules []config.ACLRule) []stages.ACLRule {
+	out := make([]stages.ACLRule, len(rules))
+	for i, rule := range rules {
+		out[i] = stages.ACLRule{
+			Allow:    rule.Allow(),
+			Networks: rule.Networks(),
+			MACs:     rule.HardwareAddrs(),
+			SrcPorts: rule.SrcPorts,
+			DstPorts: rule.DstPorts,
+		}
+		if len(rule.Interfaces) > 0 {
+			out[i].Interface = rule.MatchesInterface
+		}
+	}
+	return out
+}
+
+// rateLimits converts the rate limits of the config for a RateLimitProcessor.
+func rateLimits(cfg *config.Config) []stages.RateLimit {
+	limits := make([]stages.RateLimit, len(cfg.RateLimits))
+	for i, limit := range cfg.RateLimits {
+		limits[i] = stages.RateLimit{
+			Ports: limit.Ports,
+			By:    stages.RateLimitKey(limit.Per),
+			Rate:  limit.Rate,
+			Burst: limit.Burst,
+		}
+	}
+	return limits
+}
+
+// newEgressRateLimit returns the RateLimitProcessor shared by the routes
+// relaying to iname, or nil without egress rate limits.
+func newEgressRateLimit(cfg *config.Config, iname string) *stages.RateLimitProcessor {
+	limit := stages.NewRateLimitProcessor(iname, stages.DirectionOutbound, rateLimits(cfg))
+	if len(limit.Limits) == 0 {
+		return nil
+	}
+	return limit
+}
+
+// joinMulticastGroups joins the multicast-join groups on iname, if it is a
+// multicast capable configured interface, so that IGMP snooping switches
+// deliver them to us.  Failures are logged since relaying still works on
+// networks without snooping.
+func joinMulticastGroups(dm proxy.DeviceManager, cfg *config.Config, iname string) *proxy.MulticastMembership {
+	groups := cfg.MulticastGroups()
+	if len(groups) == 0 || !cfg.HasInterface(iname) {
+		return nil
+	}
+	if proxy.IsVLANInterfaceName(iname) || iname == proxy.AnyInterface {
+		// The host isn't a member of the VLANs of a trunk, and the any
+		// pseudo-interface can't join groups.
+		return nil
+	}
+	netif, err := dm.Interface(iname)
+	if err != nil {
+		slog.Warn("Unable to join multicast groups", "interface", iname, "error", err)
+		return nil
+	}
+	if (netif.Flags & net.FlagMulticast) == 0 {
+		slog.Debug("Interface does not support multicast, not joining groups", "interface", iname)
+		return nil
+	}
+	m, err := proxy.JoinMulticastGroups(netif, groups)
+	if err != nil {
+		slog.Warn("Unable to join multicast groups", "interface", iname, "error", err)
+	}
+	if m != nil {
+		slog.Info("Joined multicast groups", "interface", iname, "groups", len(m.Groups))
+	}
+	return m
+}
+
 // addPcapFileSink adds a PcapFileSink to the pipeline.
 func addPcapFileSink(pipeline *proxy.Pipeline, pcapPath, filename string, linkType layers.LinkType) error {
 	fPath := filepath.Join(pcapPath, filename)
@@ -278,20 +735,42 @@ func addPcapFileSink(pipeline *proxy.Pipeline, pcapPath, filename string, linkTy
 	return nil
 }
 
-// discoverBroadcastAddress finds the broadcast address for an interface.
-func discoverBroadcastAddress(dm *proxy.DeviceManager, netif *net.Interface, addrs []pcap.InterfaceAddress, cli CLI, iname string) (net.IP, error) {
-	var bcast net.IP
+// checkLoopbackRouting warns when Linux drops the packets deliver-local sends
+// to 127.0.0.1 as martians, which it does unless route_localnet is enabled on
+// the loopback interface.
+func checkLoopbackRouting(loopback string) {
+	if loopback == "" {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join("/proc/sys/net/ipv4/conf", loopback, "route_localnet"))
+	if err != nil || strings.TrimSpace(string(data)) != "0" {
+		return // not Linux, or enabled
+	}
+	slog.Warn("Packets delivered locally will be dropped, enable route_localnet on the loopback interface",
+		"interface", loopback, "fix", fmt.Sprintf("sysctl -w net.ipv4.conf.%s.route_localnet=1", loopback))
+}
+
+// discoverBroadcastAddresses finds the broadcast address of every IPv4 subnet
+// of an interface, limited to its broadcast-subnets if any are configured.
+func discoverBroadcastAddresses(dm proxy.DeviceManager, netif *net.Interface, addrs []proxy.InterfaceAddress, cfg *config.Config, iname string) ([]net.IP, error) {
+	var bcast []net.IP
+	subnets := cfg.BroadcastSubnetsFor(iname)
 	for _, addr := range addrs {
-		if addr.IP.To4() != nil && addr.Broadaddr != nil {
-			bcast = addr.Broadaddr
-			break
+		if addr.IP.To4() == nil || addr.Broadaddr == nil {
+			continue
+		}
+		if len(subnets) > 0 && !networksContain(subnets, addr.IP) {
+			continue
+		}
+		if !slices.ContainsFunc(bcast, addr.Broadaddr.Equal) {
+			bcast = append(bcast, addr.Broadaddr)
 		}
 	}
 	if bcast == nil && (netif.Flags&net.FlagBroadcast) != 0 {
 		slog.Warn("No broadcast address found for interface", "interface", iname)
 	}
-	if cli.DeliverLocal && iname == dm.GetLoopback() {
-		bcast = net.ParseIP("127.0.0.1")
+	if cfg.DeliverLocal && iname == dm.GetLoopback() {
+		bcast = []net.IP{net.ParseIP("127.0.0.1")}
 	}
 	if bcast == nil && (netif.Flags&net.FlagBroadcast) != 0 {
 		slog.Error("Failed to discover broadcast address for interface", "interface", iname)
@@ -300,41 +779,83 @@ func discoverBroadcastAddress(dm *proxy.DeviceManager, netif *net.Interface, add
 	return bcast, nil
 }
 
-// setupCrossInterfaceSink attaches a cross-interface sink between two ifaceStates.
-func setupCrossInterfaceSink(cli CLI, dm *proxy.DeviceManager, registry *stages.RegistryProcessor, src, dst ifaceState) error {
-	transmitter, err := newTransmitterSink(dm, dst.name)
+// newCrossInterfaceRoute creates the RouteSink relaying a group's packets from src to dst.
+func newCrossInterfaceRoute(cfg *config.Config, dm proxy.DeviceManager, group *relayGroup, src, dst ifaceState) (*stages.RouteSink, error) {
+	transmitter, err := newTransmitterSink(dm, proxy.DeviceName(dst.name))
 	if err != nil {
 		slog.Error("Failed to create transmitter sink", "source_interface", src.name, "target_interface", dst.name, "error", err)
-		return fmt.Errorf("failed to create transmitter sink from %s to %s", src.name, dst.name)
+		return nil, fmt.Errorf("failed to create transmitter sink from %s to %s", src.name, dst.name)
 	}
 
-	route := &stages.RouteSink{
-		Iname:            dst.name,
-		Broadcast:        dst.broadcast,
-		BroadcastAddress: dst.bcastIP,
-		HardwareAddr:     dst.netif.HardwareAddr,
-		Registry:         registry,
-		LinkType:         transmitter.Writer.LinkType(),
+	route, err := newRouteSink(cfg, group, src, dst, transmitter.Writer.LinkType())
+	if err != nil {
+		transmitter.Close()
+		return nil, err
+	}
+
+	if dst.netif.MTU > 0 {
+		route.Sinks = append(route.Sinks, &stages.FragmentSink{Iname: dst.name, MTU: dst.netif.MTU, LinkType: route.LinkType, Sink: transmitter})
+	} else {
+		route.Sinks = append(route.Sinks, transmitter)
 	}
+	return route, nil
+}
+
+// loopbackHardwareAddr is the MAC address of the Ethernet frames on the Linux
+// loopback interface, which Go reports as having none.
+var loopbackHardwareAddr = net.HardwareAddr{0, 0, 0, 0, 0, 0}
 
-	if cli.Decode {
+// sourceHardwareAddr returns the source MAC address of the packets sent on netif.
+func sourceHardwareAddr(netif *net.Interface) net.HardwareAddr {
+	if len(netif.HardwareAddr) == 0 && (netif.Flags&net.FlagLoopback) != 0 {
+		return loopbackHardwareAddr
+	}
+	return netif.HardwareAddr
+}
+
+// newRouteSink creates the RouteSink relaying a group's packets from src to
+// dst with the processors and pcap file sink every route gets, but without
+// the sink sending the packets.
+func newRouteSink(cfg *config.Config, group *relayGroup, src, dst ifaceState, linkType layers.LinkType) (*stages.RouteSink, error) {
+	_, vid, _ := proxy.ParseVLANInterface(dst.name)
+	route := &stages.RouteSink{
+		Iname:              dst.name,
+		Group:              group.name,
+		Ports:              group.ports,
+		OtherPorts:         group.otherPorts[src.name],
+		Broadcast:          dst.broadcast,
+		BroadcastAddresses: dst.bcastIPs,
+		Multicast:          cfg.Multicast && (dst.netif.Flags&net.FlagMulticast) != 0,
+		MulticastTTL:       uint8(cfg.MulticastTTL),
+		HardwareAddr:       sourceHardwareAddr(dst.netif),
+		VLAN:               vid,
+		Registry:           group.registry,
+		LinkType:           linkType,
+	}
+
+	if rules := cfg.EgressACLFor(src.name, dst.name); len(rules) > 0 {
+		route.Processors = append(route.Processors, &stages.ACLProcessor{Iname: dst.name, Direction: stages.DirectionOutbound, In: src.name, Rules: aclRules(rules)})
+	}
+	if dst.egressLimit != nil {
+		route.Processors = append(route.Processors, dst.egressLimit)
+	}
+	if cfg.DecodeFor(dst.name) {
 		route.Processors = append(route.Processors, stages.NewDecodeProcessor(dst.name, stages.DirectionOutbound, os.Stdout))
 	}
 
-	if cli.Pcap {
-		if err := addRoutePcapFileSink(route, cli.PcapPath, src.name, dst.name, route.LinkType); err != nil {
-			return err
+	if cfg.PcapFor(dst.name) {
+		if err := addRoutePcapFileSink(route, cfg.PcapPath, group.name, src.name, dst.name, rewrite.EgressFraming(route.LinkType)); err != nil {
+			return nil, err
 		}
 	}
-
-	route.Sinks = append(route.Sinks, transmitter)
-	src.pipeline.AddSink(route)
-	return nil
+	return route, nil
 }
 
-// addRoutePcapFileSink adds a PcapFileSink to a RouteSink.
-func addRoutePcapFileSink(route *stages.RouteSink, pcapPath, srcName, dstName string, linkType layers.LinkType) error {
-	fPath := filepath.Join(pcapPath, fmt.Sprintf("udp-proxy-out-%s-to-%s.pcap", srcName, dstName))
+// addRoutePcapFileSink adds a PcapFileSink to a RouteSink.  Named relay groups
+// include the group name in the filename since the same interfaces may be in
+// several groups.
+func addRoutePcapFileSink(route *stages.RouteSink, pcapPath, groupName, srcName, dstName string, linkType layers.LinkType) error {
+	fPath := filepath.Join(pcapPath, routePcapFilename(groupName, srcName, dstName))
 	f, err := os.Create(fPath)
 	if err != nil {
 		slog.Error("Failed to create outbound pcap file", "error", err)
@@ -350,42 +871,36 @@ func addRoutePcapFileSink(route *stages.RouteSink, pcapPath, srcName, dstName st
 	return nil
 }
 
-func checkDuplicateInterfaces(ifaces []string) {
-	seenInterfaces := make(map[string]bool)
-	for _, iname := range ifaces {
-		if seenInterfaces[iname] {
-			slog.Error("Duplicate interface specified", "interface", iname)
-			os.Exit(1)
-		}
-		seenInterfaces[iname] = true
+// routePcapFilename returns the name of the pcap file of the packets a group
+// relays from srcName to dstName.
+func routePcapFilename(groupName, srcName, dstName string) string {
+	if groupName != "" {
+		return fmt.Sprintf("udp-proxy-out-%s-%s-to-%s.pcap", groupName, srcName, dstName)
 	}
+	return fmt.Sprintf("udp-proxy-out-%s-to-%s.pcap", srcName, dstName)
 }
 
-func getFixedIPs(cli CLI, dm *proxy.DeviceManager) map[string][]string {
+// getFixedIPs collects the fixed IPs from the per-interface config and the
+// interface@ip list, keyed by interface.  Every interface must be one we are
+// relaying on, or the loopback interface when deliver-local is enabled.
+func getFixedIPs(cfg *config.Config, dm proxy.DeviceManager) (map[string][]string, error) {
 	fixedIPs := make(map[string][]string)
-	for _, f := range cli.FixedIp {
-		parts := strings.Split(f, "@")
-		if len(parts) != 2 {
-			slog.Error("Invalid fixed IP format. Expected interface@ip", "value", f)
-			os.Exit(1)
-		}
-		if net.ParseIP(parts[1]) == nil {
-			slog.Error("Invalid fixed IP address", "ip", parts[1])
-			os.Exit(1)
-		}
-		// Check if the interface is in the whitelist or is loopback (if deliver-local is on)
-		validIface := false
-		for _, i := range cli.Interface {
-			if i == parts[0] {
-				validIface = true
-				break
-			}
+	for _, iface := range cfg.Interfaces {
+		if len(iface.FixedIPs) > 0 {
+			fixedIPs[iface.Name] = append(fixedIPs[iface.Name], iface.FixedIPs...)
+		}
+	}
+
+	for _, f := range cfg.FixedIPs {
+		iname, ip, err := config.ParseFixedIP(f)
+		if err != nil {
+			return nil, err
 		}
-		if !validIface && (!cli.DeliverLocal || parts[0] != dm.GetLoopback()) {
-			slog.Error("Fixed IP interface must be active", "interface", parts[0])
-			os.Exit(1)
+		if !cfg.MatchesInterface(iname) && (!cfg.DeliverLocal || iname != dm.GetLoopback()) {
+			slog.Error("Fixed IP interface must be active", "interface", iname)
+			return nil, fmt.Errorf("fixed IP interface must be active: %s", iname)
 		}
-		fixedIPs[parts[0]] = append(fixedIPs[parts[0]], parts[1])
+		fixedIPs[iname] = append(fixedIPs[iname], ip.String())
 	}
-	return fixedIPs
+	return fixedIPs, nil
 }
@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"net"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
 )
@@ -118,6 +122,30 @@ func TestAttachCrossInterfaceSinks_PropagatesErrors(t *testing.T) {
 	}
 }
 
+func TestAttachCrossInterfaceSinks_AnyOnlyCaptures(t *testing.T) {
+	states := []ifaceState{
+		{name: "any", pipeline: proxy.NewPipeline(&testSource{name: "src:any"})},
+		{name: "eth0", pipeline: proxy.NewPipeline(&testSource{name: "src:eth0"})},
+	}
+
+	var routes []string
+	if err := attachCrossInterfaceSinks(states, func(src, dst ifaceState) error {
+		routes = append(routes, src.name+"->"+dst.name)
+		return nil
+	}); err != nil {
+		t.Fatalf("attachCrossInterfaceSinks failed: %v", err)
+	}
+	if len(routes) != 1 || routes[0] != "any->eth0" {
+		t.Fatalf("expected only a route from the any pseudo-interface, got %v", routes)
+	}
+
+	cfg := config.Default()
+	specs := routeSpecs(cfg, []*relayGroup{{members: []string{"any", "eth0"}}})
+	if _, ok := specs[routeKey{"", "eth0", "any"}]; ok || len(specs) != 1 {
+		t.Fatalf("expected no route to the any pseudo-interface, got %v", specs)
+	}
+}
+
 func TestBuildSharedRegistries_UsesSingleSharedRegistry(t *testing.T) {
 	original := newRegistryProcessorByInterface
 	defer func() {
@@ -155,13 +183,13 @@ func TestBuildSharedRegistries_UsesSingleSharedRegistry(t *testing.T) {
 	}
 }
 
-func TestSetupCrossInterfaceSink_UsesStableLinkTypeAndSurvivesWriterLoss(t *testing.T) {
+func TestNewCrossInterfaceRoute_UsesStableLinkTypeAndSurvivesWriterLoss(t *testing.T) {
 	origFactory := newTransmitterSink
 	defer func() {
 		newTransmitterSink = origFactory
 	}()
 
-	newTransmitterSink = func(_ *proxy.DeviceManager, iname string) (*stages.TransmitterSink, error) {
+	newTransmitterSink = func(_ proxy.DeviceManager, iname string) (*stages.TransmitterSink, error) {
 		return &stages.TransmitterSink{
 			Writer: &integrationWriter{linkType: layers.LinkTypeEthernet},
 			Iname:  iname,
@@ -181,20 +209,21 @@ func TestSetupCrossInterfaceSink_UsesStableLinkTypeAndSurvivesWriterLoss(t *test
 		name:      "wg0",
 		netif:     &net.Interface{HardwareAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5}},
 		broadcast: true,
-		bcastIP:   net.IP{10, 10, 10, 255},
+		bcastIPs:  []net.IP{{10, 10, 10, 255}},
 	}
 
-	if err := setupCrossInterfaceSink(CLI{}, &proxy.DeviceManager{}, registry, src, dst); err != nil {
-		t.Fatalf("setupCrossInterfaceSink failed: %v", err)
+	route, err := newCrossInterfaceRoute(config.Default(), &proxy.HostDeviceManager{}, &relayGroup{registry: registry}, src, dst)
+	if err != nil {
+		t.Fatalf("newCrossInterfaceRoute failed: %v", err)
 	}
+	src.pipeline.AddSink(route)
 
 	if len(src.pipeline.Sinks) != 1 {
 		t.Fatalf("expected exactly one sink on source pipeline, got %d", len(src.pipeline.Sinks))
 	}
 
-	route, ok := src.pipeline.Sinks[0].(*stages.RouteSink)
-	if !ok {
-		t.Fatalf("expected RouteSink, got %T", src.pipeline.Sinks[0])
+	if src.pipeline.Sinks[0] != route {
+		t.Fatalf("expected the route sink, got %T", src.pipeline.Sinks[0])
 	}
 	if route.LinkType != layers.LinkTypeEthernet {
 		t.Fatalf("expected stable route link type Ethernet, got %v", route.LinkType)
@@ -233,3 +262,107 @@ func TestSetupCrossInterfaceSink_UsesStableLinkTypeAndSurvivesWriterLoss(t *test
 		t.Fatalf("route write should remain non-fatal while writer is unavailable: %v", err)
 	}
 }
+
+func TestBuildRelayGroups_AddsLoopbackAndUnionsPorts(t *testing.T) {
+	cfg := config.Default()
+	cfg.Groups = []config.GroupConfig{
+		{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "vlan20", "tun0"}},
+		{Name: "ssdp", Ports: []int32{1900}, Interfaces: []string{"eth0", "vlan30"}},
+	}
+
+	groups := buildRelayGroups(cfg, "lo")
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(groups))
+	}
+	if got := groups[1].members; len(got) != 3 || got[2] != "lo" {
+		t.Fatalf("expected loopback appended to group members, got %v", got)
+	}
+	if len(cfg.Groups[1].Interfaces) != 2 {
+		t.Fatal("buildRelayGroups must not modify the config")
+	}
+	if got := groups[0].otherPorts; len(got) != 2 || !slices.Equal(got["eth0"], []int32{1900}) || !slices.Equal(got["lo"], []int32{1900}) {
+		t.Fatalf("expected the ports of ssdp on eth0 and lo, got %v", got)
+	}
+
+	tests := []struct {
+		iname string
+		want  []int32
+	}{
+		{iname: "eth0", want: []int32{9003, 1900}},
+		{iname: "tun0", want: []int32{9003}},
+		{iname: "vlan30", want: []int32{1900}},
+		{iname: "lo", want: []int32{9003, 1900}},
+		{iname: "eth9", want: nil},
+	}
+	for _, tt := range tests {
+		got := portsForInterface(groups, tt.iname)
+		if len(got) != len(tt.want) {
+			t.Fatalf("portsForInterface(%s) = %v, want %v", tt.iname, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("portsForInterface(%s) = %v, want %v", tt.iname, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestAttachCrossInterfaceSinks_PerGroupMesh(t *testing.T) {
+	states := map[string]ifaceState{}
+	for _, iname := range []string{"eth0", "vlan20", "vlan30"} {
+		states[iname] = ifaceState{name: iname, pipeline: proxy.NewPipeline(&testSource{name: "src:" + iname})}
+	}
+
+	groups := [][]string{{"eth0", "vlan20"}, {"eth0", "vlan30"}}
+	for _, members := range groups {
+		groupStates := make([]ifaceState, 0, len(members))
+		for _, iname := range members {
+			groupStates = append(groupStates, states[iname])
+		}
+		if err := attachCrossInterfaceSinks(groupStates, func(src, dst ifaceState) error {
+			src.pipeline.AddSink(&taggedSink{target: dst.name})
+			return nil
+		}); err != nil {
+			t.Fatalf("attachCrossInterfaceSinks failed: %v", err)
+		}
+	}
+
+	if got := len(states["eth0"].pipeline.Sinks); got != 2 {
+		t.Fatalf("expected eth0 to have one sink per group, got %d", got)
+	}
+	for _, iname := range []string{"vlan20", "vlan30"} {
+		sinks := states[iname].pipeline.Sinks
+		if len(sinks) != 1 || sinks[0].(*taggedSink).target != "eth0" {
+			t.Fatalf("expected %s to only relay to eth0, got %v", iname, sinks)
+		}
+	}
+}
+
+func TestStateCollector_RegistryClientsAndDedup(t *testing.T) {
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth0": {"10.0.0.1", "10.0.0.2"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	dedup := stages.NewDedupCache(time.Second)
+	dedup.Seen(1)
+	dedup.Seen(1)
+
+	collector := newStateCollector(&proxyState{
+		groups: []*relayGroup{{name: "roon", registry: registry}},
+		dedup:  dedup,
+	})
+
+	expected := `
+# HELP udp_proxy_dedup_suppressed_total Duplicate packets suppressed across all pipelines.
+# TYPE udp_proxy_dedup_suppressed_total counter
+udp_proxy_dedup_suppressed_total 1
+# HELP udp_proxy_registry_clients Clients currently known by the relay group registry, by type (fixed or learned).
+# TYPE udp_proxy_registry_clients gauge
+udp_proxy_registry_clients{group="roon",interface="eth0",type="fixed"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "udp_proxy_registry_clients", "udp_proxy_dedup_suppressed_total"); err != nil {
+		t.Fatal(err)
+	}
+}
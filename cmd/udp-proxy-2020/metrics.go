@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	registryClientsDesc = prometheus.NewDesc(
+		"udp_proxy_registry_clients",
+		"Clients currently known by the relay group registry, by type (fixed or learned).",
+		[]string{"group", "interface", "type"}, nil,
+	)
+	dedupSuppressedDesc = prometheus.NewDesc(
+		"udp_proxy_dedup_suppressed_total",
+		"Duplicate packets suppressed across all pipelines.",
+		nil, nil,
+	)
+	dedupEntriesDesc = prometheus.NewDesc(
+		"udp_proxy_dedup_entries",
+		"Packets currently remembered for duplicate suppression.",
+		nil, nil,
+	)
+)
+
+// stateCollector exports the metrics which are read from the proxyState when
+// scraped rather than counted as packets flow.
+type stateCollector struct {
+	mu    sync.RWMutex
+	state *proxyState
+}
+
+func newStateCollector(state *proxyState) *stateCollector {
+	return &stateCollector{state: state}
+}
+
+// set replaces the state being exported.
+func (c *stateCollector) set(state *proxyState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- registryClientsDesc
+	ch <- dedupSuppressedDesc
+	ch <- dedupEntriesDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	state := c.state
+	c.mu.RUnlock()
+	if state == nil {
+		return
+	}
+
+	type clientKey struct{ iname, kind string }
+	for _, g := range state.groups {
+		if g.registry == nil {
+			continue
+		}
+		counts := make(map[clientKey]int)
+		for _, client := range g.registry.GetClients() {
+			kind := "learned"
+			if client.LastSeen.IsZero() {
+				kind = "fixed"
+			}
+			counts[clientKey{client.Interface, kind}]++
+		}
+		for key, count := range counts {
+			ch <- prometheus.MustNewConstMetric(registryClientsDesc, prometheus.GaugeValue, float64(count), g.name, key.iname, key.kind)
+		}
+	}
+
+	if state.dedup != nil {
+		ch <- prometheus.MustNewConstMetric(dedupSuppressedDesc, prometheus.CounterValue, float64(state.dedup.Suppressed()))
+		ch <- prometheus.MustNewConstMetric(dedupEntriesDesc, prometheus.GaugeValue, float64(state.dedup.Len()))
+	}
+}
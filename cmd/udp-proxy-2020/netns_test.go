@@ -0,0 +1,578 @@
+//go:build linux && netns
+
+package main
+
+// The network namespace suite runs the udp-proxy-2020 binary against veth,
+// bridge and tun interfaces.  It needs root and iproute2:
+//
+//	sudo -E env "PATH=$PATH" go test -tags netns -count=1 -run Netns ./cmd/udp-proxy-2020
+//
+// Set UDP_PROXY_2020_BIN to test an existing binary instead of building one
+// and UDP_PROXY_2020_CAPTURE to select its capture backend.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/control"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// netnsHelperEnv makes the test binary run a helper instead of the tests,
+	// see runNetnsHelper.
+	netnsHelperEnv = "UDP_PROXY_NETNS_HELPER"
+	netnsPort      = 9999
+	// netnsTimeout is how long to wait for a packet to be relayed, which
+	// includes the proxy starting up or reconnecting after a flap.
+	netnsTimeout = 15 * time.Second
+)
+
+var (
+	netnsBuildDir string
+	netnsSeq      atomic.Int32
+)
+
+func TestMain(m *testing.M) {
+	if helper := os.Getenv(netnsHelperEnv); helper != "" {
+		if err := runNetnsHelper(strings.Fields(helper)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	code := m.Run()
+	if netnsBuildDir != "" {
+		os.RemoveAll(netnsBuildDir)
+	}
+	os.Exit(code)
+}
+
+// runNetnsHelper runs one of the helpers the tests start inside a namespace:
+//
+//	recv <addr>            print "<src> <dst> <payload>" for every datagram
+//	send <addr> <payload>  send a single datagram, broadcasts allowed
+//	tun <name>             create a tun interface, print "ready" and then the
+//	                       UDP packets sent on it like recv, while injecting
+//	                       the "<src> <dst> <payload>" lines read from stdin
+func runNetnsHelper(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "recv":
+		return netnsRecv(args[1])
+	case len(args) == 3 && args[0] == "send":
+		return netnsSend(args[1], args[2])
+	case len(args) == 2 && args[0] == "tun":
+		return netnsTun(args[1])
+	}
+	return fmt.Errorf("invalid helper: %v", args)
+}
+
+func netnsRecv(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return sockErr
+	}
+
+	buf := make([]byte, 2048)
+	oob := make([]byte, 256)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+		dst := net.IPv4zero
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			// struct in_pktinfo: ifindex, local address, header destination
+			if msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_PKTINFO && len(msg.Data) >= 12 {
+				dst = net.IP(msg.Data[8:12])
+			}
+		}
+		fmt.Printf("%s %s %s\n", src.IP, dst, buf[:n])
+	}
+}
+
+func netnsSend(addr, payload string) error {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.WriteTo([]byte(payload), raddr)
+	return err
+}
+
+func netnsTun(name string) error {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		return err
+	}
+	tun := os.NewFile(uintptr(fd), "/dev/net/tun")
+	defer tun.Close()
+	fmt.Println("ready")
+
+	go func() {
+		lines := bufio.NewScanner(os.Stdin)
+		for lines.Scan() {
+			f := strings.Fields(lines.Text())
+			if len(f) != 3 {
+				continue
+			}
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(f[0]), DstIP: net.ParseIP(f[1])}
+			udp := &layers.UDP{SrcPort: netnsPort, DstPort: netnsPort}
+			_ = udp.SetNetworkLayerForChecksum(ip)
+			buf := gopacket.NewSerializeBuffer()
+			opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(f[2])); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			if _, err := tun.Write(buf.Bytes()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		// the test is done with us
+		os.Exit(0)
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := tun.Read(buf)
+		if err != nil {
+			return err
+		}
+		pkt := gopacket.NewPacket(buf[:n], layers.LayerTypeIPv4, gopacket.Default)
+		ip, _ := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, _ := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if ip == nil || udp == nil || udp.DstPort != netnsPort {
+			continue
+		}
+		fmt.Printf("%s %s %s\n", ip.SrcIP, ip.DstIP, udp.Payload)
+	}
+}
+
+// netnsDatagram is a datagram reported by a recv or tun helper.
+type netnsDatagram struct {
+	src, dst, payload string
+}
+
+// netnsProc is a process running in a namespace.
+type netnsProc struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan string
+	done  chan struct{} // closed when the process exited
+	err   error         // set once done is closed
+}
+
+// netnsTopology is a set of namespaces: "proxy" runs udp-proxy-2020, which
+// relays between
+//
+//	up0  10.200.0.1/24  veth to c0 10.200.0.2/24 in "lan0"
+//	up1  10.201.0.1/24  veth to c1 10.201.0.2/24 in "lan1"
+//	br0  10.202.0.1/24  bridge, port bp2 is a veth to c2 10.202.0.2/24 in "lan2"
+//	tun0 10.203.0.1/24  tun, with a helper at 10.203.0.2 on the other side
+type netnsTopology struct {
+	t      *testing.T
+	prefix string
+	dir    string
+	tun    *netnsProc
+	proxy  *netnsProc
+}
+
+func newNetnsTopology(t *testing.T) *netnsTopology {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("the network namespace tests need root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the network namespace tests need iproute2")
+	}
+	n := &netnsTopology{
+		t:      t,
+		prefix: fmt.Sprintf("udpp%d-%d", os.Getpid(), netnsSeq.Add(1)),
+		dir:    t.TempDir(),
+	}
+	for _, ns := range []string{"proxy", "lan0", "lan1", "lan2"} {
+		n.ip("netns", "add", n.ns(ns))
+		t.Cleanup(func() { _ = exec.Command("ip", "netns", "del", n.ns(ns)).Run() })
+		n.exec(ns, "sysctl", "-qw", "net.ipv4.conf.all.rp_filter=0", "net.ipv4.conf.default.rp_filter=0")
+		n.ip("-n", n.ns(ns), "link", "set", "lo", "up")
+	}
+	// Linux drops the packets --deliver-local sends to 127.0.0.1 otherwise.
+	n.exec("proxy", "sysctl", "-qw", "net.ipv4.conf.lo.route_localnet=1")
+	n.addVeth(0)
+	n.addVeth(1)
+
+	n.ip("-n", n.ns("proxy"), "link", "add", "br0", "type", "bridge")
+	n.ip("-n", n.ns("proxy"), "link", "add", "bp2", "type", "veth", "peer", "name", "c2", "netns", n.ns("lan2"))
+	n.ip("-n", n.ns("proxy"), "link", "set", "bp2", "master", "br0")
+	n.ip("-n", n.ns("proxy"), "addr", "add", "10.202.0.1/24", "brd", "+", "dev", "br0")
+	n.ip("-n", n.ns("lan2"), "addr", "add", "10.202.0.2/24", "brd", "+", "dev", "c2")
+	n.ip("-n", n.ns("proxy"), "link", "set", "bp2", "up")
+	n.ip("-n", n.ns("proxy"), "link", "set", "br0", "up")
+	n.ip("-n", n.ns("lan2"), "link", "set", "c2", "up")
+
+	n.tun = n.start("proxy", "tun tun0")
+	if line := n.next(n.tun, netnsTimeout); line != "ready" {
+		t.Fatalf("tun helper failed: %q", line)
+	}
+	n.ip("-n", n.ns("proxy"), "addr", "add", "10.203.0.1/24", "dev", "tun0")
+	n.ip("-n", n.ns("proxy"), "link", "set", "tun0", "up")
+	return n
+}
+
+// ns returns the name of the namespace called name in this topology.
+func (n *netnsTopology) ns(name string) string {
+	return n.prefix + "-" + name
+}
+
+// addVeth connects up<i> 10.20<i>.0.1 in the proxy namespace to c<i>
+// 10.20<i>.0.2 in lan<i>.
+func (n *netnsTopology) addVeth(i int) {
+	n.t.Helper()
+	up, c, lan := fmt.Sprintf("up%d", i), fmt.Sprintf("c%d", i), n.ns(fmt.Sprintf("lan%d", i))
+	n.ip("-n", n.ns("proxy"), "link", "add", up, "type", "veth", "peer", "name", c, "netns", lan)
+	n.ip("-n", n.ns("proxy"), "addr", "add", fmt.Sprintf("10.20%d.0.1/24", i), "brd", "+", "dev", up)
+	n.ip("-n", lan, "addr", "add", fmt.Sprintf("10.20%d.0.2/24", i), "brd", "+", "dev", c)
+	n.ip("-n", n.ns("proxy"), "link", "set", up, "up")
+	n.ip("-n", lan, "link", "set", c, "up")
+}
+
+func (n *netnsTopology) ip(args ...string) {
+	n.t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		n.t.Fatalf("ip %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// exec runs a command in the namespace ns.
+func (n *netnsTopology) exec(ns string, args ...string) {
+	n.t.Helper()
+	args = append([]string{"netns", "exec", n.ns(ns)}, args...)
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		n.t.Fatalf("ip %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// start runs a helper of the test binary in the namespace ns, which is
+// stopped when the test ends.
+func (n *netnsTopology) start(ns, helper string) *netnsProc {
+	n.t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", n.ns(ns), os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), netnsHelperEnv+"="+helper)
+	return n.startCmd(cmd)
+}
+
+func (n *netnsTopology) startCmd(cmd *exec.Cmd) *netnsProc {
+	n.t.Helper()
+	p := &netnsProc{cmd: cmd, lines: make(chan string, 100), done: make(chan struct{})}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	if p.stdin, err = cmd.StdinPipe(); err != nil {
+		n.t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		n.t.Fatalf("failed to start %v: %v", cmd.Args, err)
+	}
+	go func() {
+		lines := bufio.NewScanner(stdout)
+		for lines.Scan() {
+			p.lines <- lines.Text()
+		}
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+	n.t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-p.done
+	})
+	return p
+}
+
+// next returns the next line printed by p.
+func (n *netnsTopology) next(p *netnsProc, timeout time.Duration) string {
+	n.t.Helper()
+	select {
+	case line := <-p.lines:
+		return line
+	case <-p.done:
+		n.t.Fatalf("%v exited: %v", p.cmd.Args, p.err)
+	case <-time.After(timeout):
+		n.t.Fatalf("timed out waiting for %v", p.cmd.Args)
+	}
+	return ""
+}
+
+// startProxy runs udp-proxy-2020 relaying port 9999 between every interface
+// of the proxy namespace.  When the test ends it must shut down cleanly.
+func (n *netnsTopology) startProxy(args ...string) {
+	n.t.Helper()
+	logfile := filepath.Join(n.dir, "udp-proxy-2020.log")
+	args = append([]string{
+		"netns", "exec", n.ns("proxy"), netnsBinary(n.t),
+		"--interface", "up0,up1,br0,tun0",
+		"--port", fmt.Sprint(netnsPort),
+		"--control-socket", n.controlSocket(),
+		"--level", "debug",
+		"--logfile", logfile,
+	}, args...)
+	if capture := os.Getenv("UDP_PROXY_2020_CAPTURE"); capture != "" {
+		args = append(args, "--capture", capture)
+	}
+	n.proxy = n.startCmd(exec.Command("ip", args...))
+	n.t.Cleanup(func() {
+		if n.t.Failed() {
+			if out, err := os.ReadFile(logfile); err == nil {
+				n.t.Logf("udp-proxy-2020 log:\n%s", out)
+			}
+		}
+	})
+	n.t.Cleanup(func() {
+		select {
+		case <-n.proxy.done:
+			n.t.Errorf("udp-proxy-2020 exited early: %v", n.proxy.err)
+			return
+		default:
+		}
+		_ = n.proxy.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-n.proxy.done:
+			if n.proxy.err != nil {
+				n.t.Errorf("udp-proxy-2020 didn't shut down cleanly: %v", n.proxy.err)
+			}
+		case <-time.After(netnsTimeout):
+			n.t.Error("udp-proxy-2020 didn't shut down")
+		}
+	})
+}
+
+func (n *netnsTopology) controlSocket() string {
+	return filepath.Join(n.dir, "control.sock")
+}
+
+// send sends a datagram with payload from the namespace ns to addr.
+func (n *netnsTopology) send(ns, addr, payload string) func() {
+	return func() {
+		cmd := exec.Command("ip", "netns", "exec", n.ns(ns), os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%s=send %s:%d %s", netnsHelperEnv, addr, netnsPort, payload))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			n.t.Fatalf("send from %s to %s failed: %v: %s", ns, addr, err, out)
+		}
+	}
+}
+
+// sendTun sends a datagram with payload from the other side of tun0.
+func (n *netnsTopology) sendTun(src, dst, payload string) func() {
+	return func() {
+		if _, err := fmt.Fprintf(n.tun.stdin, "%s %s %s\n", src, dst, payload); err != nil {
+			n.t.Fatalf("send on tun0 failed: %v", err)
+		}
+	}
+}
+
+// relay repeats send until rcv reports a datagram with payload, which has to
+// be relayed once the proxy is ready, and returns it.
+func (n *netnsTopology) relay(send func(), rcv *netnsProc, payload string) netnsDatagram {
+	n.t.Helper()
+	deadline := time.Now().Add(netnsTimeout)
+	for time.Now().Before(deadline) {
+		send()
+		wait := time.After(250 * time.Millisecond)
+	read:
+		for {
+			select {
+			case line := <-rcv.lines:
+				f := strings.Fields(line)
+				if len(f) == 3 && f[2] == payload {
+					return netnsDatagram{src: f[0], dst: f[1], payload: f[2]}
+				}
+			case <-rcv.done:
+				n.t.Fatalf("%v exited: %v", rcv.cmd.Args, rcv.err)
+			case <-wait:
+				break read
+			}
+		}
+	}
+	n.t.Fatalf("%s was not relayed", payload)
+	return netnsDatagram{}
+}
+
+// netnsBinary returns the udp-proxy-2020 binary to test, building it once.
+func netnsBinary(t *testing.T) string {
+	t.Helper()
+	if bin := os.Getenv("UDP_PROXY_2020_BIN"); bin != "" {
+		return bin
+	}
+	bin := filepath.Join(netnsBuildDir, "udp-proxy-2020")
+	if netnsBuildDir != "" {
+		return bin
+	}
+	dir, err := os.MkdirTemp("", "udp-proxy-2020-netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netnsBuildDir = dir
+	bin = filepath.Join(dir, "udp-proxy-2020")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v: %s", err, out)
+	}
+	return bin
+}
+
+// expectLearned checks that the proxy learned ip on iname.
+func (n *netnsTopology) expectLearned(iname, ip string) {
+	n.t.Helper()
+	var clients []control.Client
+	if err := control.Call(n.controlSocket(), control.Request{Command: control.CmdClients}, &clients); err != nil {
+		n.t.Fatalf("listing the clients failed: %v", err)
+	}
+	for _, c := range clients {
+		if c.Interface == iname && c.IP == ip && !c.Fixed {
+			return
+		}
+	}
+	n.t.Errorf("expected %s to be learned on %s, clients: %+v", ip, iname, clients)
+}
+
+func TestNetns_Relays(t *testing.T) {
+	n := newNetnsTopology(t)
+	lan0 := n.start("lan0", "recv 0.0.0.0:9999")
+	lan1 := n.start("lan1", "recv 0.0.0.0:9999")
+	lan2 := n.start("lan2", "recv 0.0.0.0:9999")
+	n.startProxy()
+
+	// A broadcast on a veth reaches the broadcast address of the veth and
+	// the bridge, and its sender is learned.
+	got := n.relay(n.send("lan0", "10.200.0.255", "hello"), lan1, "hello")
+	if got.src != "10.200.0.2" || got.dst != "10.201.0.255" {
+		t.Errorf("unexpected datagram on lan1: %+v", got)
+	}
+	got = n.relay(func() {}, lan2, "hello")
+	if got.src != "10.200.0.2" || got.dst != "10.202.0.255" {
+		t.Errorf("unexpected datagram on lan2: %+v", got)
+	}
+	n.expectLearned("up0", "10.200.0.2")
+
+	// The unicast reply goes back to the learned client only.
+	got = n.relay(n.send("lan1", "10.201.0.1", "reply"), lan0, "reply")
+	if got.src != "10.201.0.2" || got.dst != "10.200.0.2" {
+		t.Errorf("unexpected reply on lan0: %+v", got)
+	}
+	n.expectLearned("up1", "10.201.0.2")
+
+	// tun0 has no broadcast address, so only the learned client behind it
+	// gets packets.
+	got = n.relay(n.sendTun("10.203.0.2", "10.203.0.1", "from-tun"), lan2, "from-tun")
+	if got.src != "10.203.0.2" || got.dst != "10.202.0.255" {
+		t.Errorf("unexpected datagram from tun0 on lan2: %+v", got)
+	}
+	n.expectLearned("tun0", "10.203.0.2")
+	got = n.relay(n.send("lan2", "10.202.0.255", "to-tun"), n.tun, "to-tun")
+	if got.src != "10.202.0.2" || got.dst != "10.203.0.2" {
+		t.Errorf("unexpected datagram on tun0: %+v", got)
+	}
+}
+
+func TestNetns_InterfaceFlaps(t *testing.T) {
+	n := newNetnsTopology(t)
+	lan0 := n.start("lan0", "recv 0.0.0.0:9999")
+	lan1 := n.start("lan1", "recv 0.0.0.0:9999")
+	n.startProxy()
+
+	// both directions across up1, so its capture and its transmitter have
+	// to recover
+	relayBoth := func(step string) {
+		t.Helper()
+		n.relay(n.send("lan0", "10.200.0.255", step+"-out"), lan1, step+"-out")
+		n.relay(n.send("lan1", "10.201.0.255", step+"-in"), lan0, step+"-in")
+	}
+	relayBoth("start")
+
+	// The capture and the transmitter of up1 fail while it is down and
+	// reconnect once it is up again.
+	n.ip("-n", n.ns("proxy"), "link", "set", "up1", "down")
+	n.send("lan0", "10.200.0.255", "while-down")()
+	time.Sleep(time.Second)
+	n.ip("-n", n.ns("proxy"), "link", "set", "up1", "up")
+	relayBoth("down-up")
+
+	// A deleted interface is detached, and attached again when a new one
+	// with the same name appears.  The receiver in lan1 is bound to any
+	// address, so it keeps working on the new c1.
+	n.ip("-n", n.ns("proxy"), "link", "del", "up1")
+	time.Sleep(time.Second)
+	n.addVeth(1)
+	relayBoth("re-added")
+}
+
+func TestNetns_DeliverLocal(t *testing.T) {
+	n := newNetnsTopology(t)
+	local := n.start("proxy", "recv 127.0.0.1:9999")
+	n.startProxy("--deliver-local")
+
+	got := n.relay(n.send("lan0", "10.200.0.255", "local"), local, "local")
+	if got.src != "10.200.0.2" || got.dst != "127.0.0.1" {
+		t.Errorf("unexpected datagram on the loopback: %+v", got)
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/control"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+// reloadPlan is what has to change to go from the running config to a new one.
+type reloadPlan struct {
+	stop          []string   // interfaces to stop: removed or restarted
+	start         []string   // interfaces to start: added or restarted
+	removeRoutes  []routeKey // routes to remove from interfaces which keep running
+	addRoutes     []routeKey // routes to add to interfaces which keep running
+	addedGroups   []string
+	removedGroups []string
+}
+
+// relayInterfaces returns the interfaces to run a pipeline on: the configured
+// interfaces plus the loopback interface, if not empty.
+func relayInterfaces(cfg *config.Config, loopback string) []string {
+	interfaces := cfg.InterfaceNames()
+	if loopback != "" {
+		interfaces = append(interfaces, loopback)
+	}
+	return interfaces
+}
+
+// loopbackFor returns the loopback interface when deliver-local is enabled.
+func loopbackFor(cfg *config.Config, dm proxy.DeviceManager) (string, error) {
+	if !cfg.DeliverLocal {
+		return "", nil
+	}
+	loopback := dm.GetLoopback()
+	if loopback == "" {
+		slog.Error("Unable to find loopback interface")
+		return "", fmt.Errorf("loopback interface not found")
+	}
+	return loopback, nil
+}
+
+// pipelineSpec describes everything the pipeline of iname is built from.  The
+// pipeline is restarted when its spec changes.
+func pipelineSpec(cfg *config.Config, groups []*relayGroup, iname, loopback string) string {
+	spec := struct {
+		Promisc     *bool
+		Subnets     []string
+		Timeout     time.Duration
+		Decode      bool
+		Pcap        bool
+		PcapPath    string
+		DedupWindow time.Duration
+		Groups      []string
+		Loopback    bool
+		ACL         []config.ACLRule
+		RateLimits  []config.RateLimitConfig
+	}{
+		Timeout:     cfg.TimeoutFor(iname),
+		Decode:      cfg.DecodeFor(iname),
+		Pcap:        cfg.PcapFor(iname),
+		DedupWindow: cfg.DedupWindowDuration(),
+		Loopback:    iname == loopback,
+		ACL:         cfg.IngressACLFor(iname),
+		RateLimits:  cfg.RateLimits,
+	}
+	if iface := cfg.Interface(iname); iface != nil {
+		spec.Promisc = iface.Promisc
+		spec.Subnets = iface.BroadcastSubnets
+	}
+	if spec.Pcap {
+		spec.PcapPath = cfg.PcapPath
+	}
+	for _, g := range groups {
+		if g.hasMember(iname) {
+			spec.Groups = append(spec.Groups, fmt.Sprintf("%s%v", g.name, g.ports))
+		}
+	}
+	return fmt.Sprintf("%+v", spec)
+}
+
+// routeSpecs describes every RouteSink built for the config.  A RouteSink is
+// replaced when its spec changes.
+func routeSpecs(cfg *config.Config, groups []*relayGroup) map[routeKey]string {
+	specs := make(map[routeKey]string)
+	for _, g := range groups {
+		for _, dst := range g.members {
+			if !receivesRoutes(dst) {
+				continue
+			}
+			spec := struct {
+				Ports        []int32
+				Decode       bool
+				Pcap         bool
+				PcapPath     string
+				Multicast    bool
+				MulticastTTL int
+				Subnets      []string
+			}{
+				Ports:        g.ports,
+				Decode:       cfg.DecodeFor(dst),
+				Pcap:         cfg.PcapFor(dst),
+				Multicast:    cfg.Multicast,
+				MulticastTTL: cfg.MulticastTTL,
+			}
+			if spec.Pcap {
+				spec.PcapPath = cfg.PcapPath
+			}
+			if iface := cfg.Interface(dst); iface != nil {
+				spec.Subnets = iface.BroadcastSubnets
+			}
+			for _, src := range g.members {
+				if src != dst {
+					specs[routeKey{g.name, src, dst}] = fmt.Sprintf("%+v%+v", spec, cfg.EgressACLFor(src, dst))
+				}
+			}
+		}
+	}
+	return specs
+}
+
+// planReload works out which interfaces and routes have to be started and
+// stopped to go from oldCfg to newCfg.  Interfaces whose pipeline is unchanged
+// keep running; only their routes are updated.
+func planReload(oldCfg, newCfg *config.Config, oldLoopback, newLoopback string) *reloadPlan {
+	plan := &reloadPlan{}
+	oldGroups := buildRelayGroups(oldCfg, oldLoopback)
+	newGroups := buildRelayGroups(newCfg, newLoopback)
+
+	oldIfaces := relayInterfaces(oldCfg, oldLoopback)
+	newIfaces := relayInterfaces(newCfg, newLoopback)
+	changed := make(map[string]bool)
+	for _, iname := range oldIfaces {
+		if !slices.Contains(newIfaces, iname) {
+			plan.stop = append(plan.stop, iname)
+			changed[iname] = true
+		} else if pipelineSpec(oldCfg, oldGroups, iname, oldLoopback) != pipelineSpec(newCfg, newGroups, iname, newLoopback) {
+			plan.stop = append(plan.stop, iname)
+			plan.start = append(plan.start, iname)
+			changed[iname] = true
+		}
+	}
+	for _, iname := range newIfaces {
+		if !slices.Contains(oldIfaces, iname) {
+			plan.start = append(plan.start, iname)
+			changed[iname] = true
+		}
+	}
+
+	// Routes of stopped and started interfaces are replaced along with their
+	// pipeline.  Routes to them from interfaces which keep running have to be
+	// replaced too since they were built from the old interface.
+	oldRoutes := routeSpecs(oldCfg, oldGroups)
+	newRoutes := routeSpecs(newCfg, newGroups)
+	for key, spec := range oldRoutes {
+		if changed[key.src] {
+			continue
+		}
+		if newSpec, ok := newRoutes[key]; !ok || newSpec != spec || changed[key.dst] {
+			plan.removeRoutes = append(plan.removeRoutes, key)
+		}
+	}
+	for key, spec := range newRoutes {
+		if changed[key.src] {
+			continue
+		}
+		if oldSpec, ok := oldRoutes[key]; !ok || oldSpec != spec || changed[key.dst] {
+			plan.addRoutes = append(plan.addRoutes, key)
+		}
+	}
+	slices.SortFunc(plan.removeRoutes, compareRouteKeys)
+	slices.SortFunc(plan.addRoutes, compareRouteKeys)
+
+	for _, g := range newGroups {
+		if findGroup(oldGroups, g.name) == nil {
+			plan.addedGroups = append(plan.addedGroups, g.name)
+		}
+	}
+	for _, g := range oldGroups {
+		if findGroup(newGroups, g.name) == nil {
+			plan.removedGroups = append(plan.removedGroups, g.name)
+		}
+	}
+	return plan
+}
+
+func compareRouteKeys(a, b routeKey) int {
+	return strings.Compare(a.String(), b.String())
+}
+
+func (k routeKey) String() string {
+	if k.group != "" {
+		return fmt.Sprintf("%s:%s->%s", k.group, k.src, k.dst)
+	}
+	return fmt.Sprintf("%s->%s", k.src, k.dst)
+}
+
+// keepRestartSettings reverts the settings of newCfg which can not be changed
+// while running to their values in oldCfg, returning the names of the ones
+// which changed.
+func keepRestartSettings(oldCfg, newCfg *config.Config) []string {
+	var changed []string
+	if newCfg.NoListen != oldCfg.NoListen {
+		changed = append(changed, "no-listen")
+		newCfg.NoListen = oldCfg.NoListen
+	}
+	if newCfg.Capture != oldCfg.Capture {
+		changed = append(changed, "capture")
+		newCfg.Capture = oldCfg.Capture
+	}
+	if newCfg.MetricsListen != oldCfg.MetricsListen {
+		changed = append(changed, "metrics-listen")
+		newCfg.MetricsListen = oldCfg.MetricsListen
+	}
+	if newCfg.ControlSocket != oldCfg.ControlSocket {
+		changed = append(changed, "control-socket")
+		newCfg.ControlSocket = oldCfg.ControlSocket
+	}
+	if newCfg.StateFile != oldCfg.StateFile || newCfg.StateInterval != oldCfg.StateInterval {
+		changed = append(changed, "state-file")
+		newCfg.StateFile, newCfg.StateInterval = oldCfg.StateFile, oldCfg.StateInterval
+	}
+	if newCfg.Logfile != oldCfg.Logfile || newCfg.LogLines != oldCfg.LogLines {
+		changed = append(changed, "logfile")
+		newCfg.Logfile, newCfg.LogLines = oldCfg.Logfile, oldCfg.LogLines
+	}
+	return changed
+}
+
+// syncFixedIPs updates the fixed IPs of the registry from the fixed IPs of the
+// old config to the ones of the new config, keyed by interface: the fixed IPs
+// of the new config are added and the ones only in the old config removed.
+// Fixed IPs added at runtime with ctl are kept, as are the learned clients.
+// Returns the number of fixed IPs added and removed.
+func syncFixedIPs(registry *stages.RegistryProcessor, oldFixedIPs, fixedIPs map[string][]string) (added, removed int) {
+	want := fixedIPSet(fixedIPs)
+	configured := fixedIPSet(oldFixedIPs)
+	for iname, ips := range fixedIPs {
+		for _, ipStr := range ips {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				continue
+			}
+			if !isFixedIP(registry, iname, ip) {
+				registry.AddFixedIP(iname, ip)
+				slog.Info("Added fixed IP", "interface", iname, "ip", ip.String())
+				added++
+			}
+		}
+	}
+	for _, info := range registry.GetClients() {
+		key := info.Interface + "@" + info.IP.String()
+		if !info.LastSeen.IsZero() || want[key] {
+			continue
+		}
+		if !configured[key] {
+			slog.Info("Keeping fixed IP added at runtime", "interface", info.Interface, "ip", info.IP.String())
+			continue
+		}
+		if registry.RemoveFixedIP(info.Interface, info.IP) {
+			slog.Info("Removed fixed IP", "interface", info.Interface, "ip", info.IP.String())
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// fixedIPSet returns the set of interface@ip of fixedIPs.
+func fixedIPSet(fixedIPs map[string][]string) map[string]bool {
+	set := make(map[string]bool)
+	for iname, ips := range fixedIPs {
+		for _, ipStr := range ips {
+			if ip := net.ParseIP(ipStr); ip != nil {
+				set[iname+"@"+ip.String()] = true
+			}
+		}
+	}
+	return set
+}
+
+func isFixedIP(registry *stages.RegistryProcessor, iname string, ip net.IP) bool {
+	for _, info := range registry.GetClientsForInterface(iname) {
+		if info.LastSeen.IsZero() && info.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupFixedIPs returns the fixed IPs of the members of g.
+func groupFixedIPs(fixedIPs map[string][]string, g *relayGroup) map[string][]string {
+	ips := make(map[string][]string)
+	for _, iname := range g.members {
+		if v, ok := fixedIPs[iname]; ok {
+			ips[iname] = v
+		}
+	}
+	return ips
+}
+
+// reload switches the running proxy over to cfg, only stopping and starting the
+// interfaces and routes which changed.  The learned clients of relay groups
+// which still exist are kept.  Returns a summary of what changed.
+func (r *runner) reload(cfg *config.Config) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	summary, err := r.apply(cfg.Expand(r.availableInterfaces()))
+	slog.Info("Reloaded configuration", "changes", summary)
+	return summary, err
+}
+
+// apply switches the running proxy over to cfg, which must already be
+// expanded.  Must be called with mu held.
+func (r *runner) apply(cfg *config.Config) (string, error) {
+	oldCfg := r.cfg
+	state := r.current()
+
+	restart := keepRestartSettings(oldCfg, cfg)
+	oldLoopback, err := loopbackFor(oldCfg, r.dm)
+	if err != nil {
+		return "", err
+	}
+	loopback, err := loopbackFor(cfg, r.dm)
+	if err != nil {
+		return "", err
+	}
+	fixedIPs, err := getFixedIPs(cfg, r.dm)
+	if err != nil {
+		return "", err
+	}
+	// The running config was valid, so its fixed IPs are too.  Without them
+	// no fixed IP is removed.
+	oldFixedIPs, err := getFixedIPs(oldCfg, r.dm)
+	if err != nil {
+		slog.Warn("Unable to get the fixed IPs of the running config, keeping them", "error", err)
+	}
+	plan := planReload(oldCfg, cfg, oldLoopback, loopback)
+
+	groups := buildRelayGroups(cfg, loopback)
+	fixedAdded, fixedRemoved := 0, 0
+	for _, g := range groups {
+		if prev := findGroup(state.groups, g.name); prev != nil {
+			g.registry = prev.registry
+			g.registry.SetTTL(cfg.CacheTTLDuration())
+			added, removed := syncFixedIPs(g.registry, groupFixedIPs(oldFixedIPs, g), groupFixedIPs(fixedIPs, g))
+			fixedAdded += added
+			fixedRemoved += removed
+			continue
+		}
+		registries, err := buildSharedRegistries(cfg.CacheTTLDuration(), groupFixedIPs(fixedIPs, g))
+		if err != nil {
+			return "", fmt.Errorf("invalid fixed IP configuration: %w", err)
+		}
+		g.registry = registries[0]
+	}
+
+	dedup := state.dedup
+	if cfg.DedupWindowDuration() != oldCfg.DedupWindowDuration() {
+		dedup = nil
+		if window := cfg.DedupWindowDuration(); window > 0 {
+			dedup = stages.NewDedupCache(window)
+		}
+	}
+
+	ifaces := maps.Clone(state.ifaces)
+	routes := maps.Clone(state.routes)
+	for _, iname := range plan.stop {
+		slog.Info("Stopping interface", "interface", iname)
+		r.stopInterface(iname)
+		delete(ifaces, iname)
+		for key := range routes {
+			if key.src == iname {
+				delete(routes, key)
+			}
+		}
+	}
+	for _, key := range plan.removeRoutes {
+		route, ok := routes[key]
+		if !ok {
+			continue
+		}
+		slog.Info("Removing route", "route", key.String())
+		ifaces[key.src].pipeline.RemoveSink(route)
+		if err := route.Close(); err != nil {
+			slog.Warn("Error closing route", "route", key.String(), "error", err)
+		}
+		delete(routes, key)
+	}
+
+	r.cfg = cfg
+	var errs []error
+	for _, iname := range plan.start {
+		if !r.interfaceReady(iname) {
+			slog.Warn("Interface not available, waiting for it to appear", "interface", iname)
+			continue
+		}
+		s, err := r.setupInterface(cfg, dedup, groups, iname)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ifaces[iname] = s
+	}
+
+	addRoute := func(g *relayGroup, key routeKey) {
+		if err := r.addRoute(cfg, g, ifaces, routes, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, g := range groups {
+		for _, src := range g.members {
+			if !slices.Contains(plan.start, src) {
+				continue
+			}
+			for _, dst := range g.members {
+				if dst != src {
+					addRoute(g, routeKey{g.name, src, dst})
+				}
+			}
+		}
+	}
+	for _, key := range plan.addRoutes {
+		slog.Info("Adding route", "route", key.String())
+		addRoute(findGroup(groups, key.group), key)
+	}
+
+	for _, iname := range plan.start {
+		if s, ok := ifaces[iname]; ok {
+			slog.Info("Starting interface", "interface", iname)
+			r.startInterface(iname, s.pipeline)
+		}
+	}
+	if !slices.Equal(cfg.MulticastJoin, oldCfg.MulticastJoin) {
+		for iname := range ifaces {
+			if !slices.Contains(plan.start, iname) {
+				r.rejoinMulticast(iname)
+			}
+		}
+	}
+
+	r.setState(&proxyState{
+		pipelines: orderedPipelines(cfg, loopback, ifaces),
+		groups:    groups,
+		dedup:     dedup,
+		trunks:    state.trunks,
+		loopback:  loopback,
+		ifaces:    ifaces,
+		routes:    routes,
+	})
+
+	if level, err := parseLevel(cfg.Level); err == nil {
+		logLevel.Set(level)
+	}
+	for _, name := range restart {
+		slog.Warn("Changing this setting requires a restart", "setting", name)
+	}
+
+	return plan.summary(fixedAdded, fixedRemoved, restart), errors.Join(errs...)
+}
+
+// summary describes the plan in a single line.
+func (p *reloadPlan) summary(fixedAdded, fixedRemoved int, restart []string) string {
+	var added, removed, restarted []string
+	for _, iname := range p.start {
+		if slices.Contains(p.stop, iname) {
+			restarted = append(restarted, iname)
+		} else {
+			added = append(added, iname)
+		}
+	}
+	for _, iname := range p.stop {
+		if !slices.Contains(p.start, iname) {
+			removed = append(removed, iname)
+		}
+	}
+
+	var parts []string
+	list := func(what string, names []string) {
+		if len(names) > 0 {
+			parts = append(parts, fmt.Sprintf("%s %s", what, strings.Join(names, ",")))
+		}
+	}
+	count := func(what string, n int) {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", what, n))
+		}
+	}
+	list("added interfaces", added)
+	list("removed interfaces", removed)
+	list("restarted interfaces", restarted)
+	list("added groups", groupNames(p.addedGroups))
+	list("removed groups", groupNames(p.removedGroups))
+	count("added routes", len(p.addRoutes))
+	count("removed routes", len(p.removeRoutes))
+	count("added fixed IPs", fixedAdded)
+	count("removed fixed IPs", fixedRemoved)
+	list("restart required for", restart)
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// groupNames returns the names of relay groups for display, calling the
+// unnamed group used when there are no groups in the config "default".
+func groupNames(names []string) []string {
+	display := make([]string, len(names))
+	for i, name := range names {
+		display[i] = name
+		if name == "" {
+			display[i] = "default"
+		}
+	}
+	return display
+}
+
+// watchReloadSignal calls reload on every SIGHUP until ctx is cancelled.
+func watchReloadSignal(ctx context.Context, reload func() (string, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration")
+			if _, err := reload(); err != nil {
+				slog.Error("Unable to reload configuration", "error", err)
+			}
+		}
+	}
+}
+
+// reloadHistory is how many reloads reloadTracker remembers.
+const reloadHistory = 8
+
+// reloadTracker runs the reloads of the config and remembers the outcome of
+// the latest ones for `ctl status`.
+type reloadTracker struct {
+	reload func() (string, error)
+
+	mu      sync.Mutex // protects reloads and nextID
+	reloads []control.ReloadStatus
+	nextID  int
+}
+
+func newReloadTracker(reload func() (string, error)) *reloadTracker {
+	return &reloadTracker{reload: reload, nextID: 1}
+}
+
+// run reloads the config and returns the summary of the changes.
+func (t *reloadTracker) run() (string, error) {
+	return t.finish(t.begin())
+}
+
+// start reloads the config in the background and returns its status.
+func (t *reloadTracker) start() control.ReloadStatus {
+	status := t.begin()
+	go func() {
+		if _, err := t.finish(status); err != nil {
+			slog.Error("Unable to reload configuration", "error", err)
+		}
+	}()
+	return status
+}
+
+// history returns the status of the latest reloads, oldest first.
+func (t *reloadTracker) history() []control.ReloadStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.reloads)
+}
+
+func (t *reloadTracker) begin() control.ReloadStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := control.ReloadStatus{ID: t.nextID, Started: time.Now()}
+	t.nextID++
+	t.reloads = append(t.reloads, status)
+	if len(t.reloads) > reloadHistory {
+		t.reloads = slices.Delete(t.reloads, 0, len(t.reloads)-reloadHistory)
+	}
+	return status
+}
+
+func (t *reloadTracker) finish(status control.ReloadStatus) (string, error) {
+	summary, err := t.reload()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.reloads {
+		if t.reloads[i].ID != status.ID {
+			continue
+		}
+		t.reloads[i].Finished, t.reloads[i].Summary = time.Now(), summary
+		if err != nil {
+			t.reloads[i].Error = err.Error()
+		}
+	}
+	return summary, err
+}
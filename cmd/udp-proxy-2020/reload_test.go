@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+func meshConfig(inames ...string) *config.Config {
+	cfg := config.Default()
+	cfg.Ports = []int32{9003}
+	for _, iname := range inames {
+		cfg.Interfaces = append(cfg.Interfaces, config.InterfaceConfig{Name: iname})
+	}
+	return cfg
+}
+
+func TestPlanReload_AddInterfaceKeepsOthersRunning(t *testing.T) {
+	plan := planReload(meshConfig("eth0", "eth1"), meshConfig("eth0", "eth1", "eth2"), "", "")
+
+	if len(plan.stop) != 0 || !slices.Equal(plan.start, []string{"eth2"}) {
+		t.Fatalf("expected only eth2 to start, got stop=%v start=%v", plan.stop, plan.start)
+	}
+	want := []routeKey{{"", "eth0", "eth2"}, {"", "eth1", "eth2"}}
+	if !slices.Equal(plan.addRoutes, want) || len(plan.removeRoutes) != 0 {
+		t.Fatalf("expected routes %v to be added, got add=%v remove=%v", want, plan.addRoutes, plan.removeRoutes)
+	}
+	if got := plan.summary(0, 0, nil); got != "added interfaces eth2; added routes 2" {
+		t.Fatalf("unexpected summary: %s", got)
+	}
+}
+
+func TestPlanReload_RemoveInterface(t *testing.T) {
+	plan := planReload(meshConfig("eth0", "eth1", "eth2"), meshConfig("eth0", "eth1"), "", "")
+
+	if !slices.Equal(plan.stop, []string{"eth2"}) || len(plan.start) != 0 {
+		t.Fatalf("expected only eth2 to stop, got stop=%v start=%v", plan.stop, plan.start)
+	}
+	want := []routeKey{{"", "eth0", "eth2"}, {"", "eth1", "eth2"}}
+	if !slices.Equal(plan.removeRoutes, want) || len(plan.addRoutes) != 0 {
+		t.Fatalf("expected routes %v to be removed, got add=%v remove=%v", want, plan.addRoutes, plan.removeRoutes)
+	}
+}
+
+func TestPlanReload_ChangedInterfaceIsRestarted(t *testing.T) {
+	newCfg := meshConfig("eth0", "eth1", "eth2")
+	decode := true
+	newCfg.Interfaces[1].Decode = &decode
+
+	plan := planReload(meshConfig("eth0", "eth1", "eth2"), newCfg, "", "")
+	if !slices.Equal(plan.stop, []string{"eth1"}) || !slices.Equal(plan.start, []string{"eth1"}) {
+		t.Fatalf("expected eth1 to restart, got stop=%v start=%v", plan.stop, plan.start)
+	}
+	// Routes to eth1 from the interfaces which keep running are rebuilt.
+	want := []routeKey{{"", "eth0", "eth1"}, {"", "eth2", "eth1"}}
+	if !slices.Equal(plan.removeRoutes, want) || !slices.Equal(plan.addRoutes, want) {
+		t.Fatalf("expected routes %v to be replaced, got add=%v remove=%v", want, plan.addRoutes, plan.removeRoutes)
+	}
+	if got := plan.summary(0, 0, nil); got != "restarted interfaces eth1; added routes 2; removed routes 2" {
+		t.Fatalf("unexpected summary: %s", got)
+	}
+}
+
+func TestPlanReload_ACL(t *testing.T) {
+	newCfg := meshConfig("eth0", "eth1", "eth2")
+	newCfg.ACL = []config.ACLRule{
+		{Action: config.ACLDeny, Interfaces: []string{"eth1"}, SrcNets: []string{"10.0.20.0/24"}},
+		{Action: config.ACLDeny, Interfaces: []string{"eth0"}, OutInterfaces: []string{"eth2"}},
+	}
+
+	plan := planReload(meshConfig("eth0", "eth1", "eth2"), newCfg, "", "")
+	if !slices.Equal(plan.stop, []string{"eth1"}) || !slices.Equal(plan.start, []string{"eth1"}) {
+		t.Fatalf("expected eth1 to restart, got stop=%v start=%v", plan.stop, plan.start)
+	}
+	want := []routeKey{{"", "eth0", "eth1"}, {"", "eth0", "eth2"}, {"", "eth2", "eth1"}}
+	if !slices.Equal(plan.removeRoutes, want) || !slices.Equal(plan.addRoutes, want) {
+		t.Fatalf("expected routes %v to be replaced, got add=%v remove=%v", want, plan.addRoutes, plan.removeRoutes)
+	}
+}
+
+func TestPlanReload_FixedIPsAndTTLDoNotRestart(t *testing.T) {
+	newCfg := meshConfig("eth0", "eth1")
+	newCfg.FixedIPs = []string{"eth1@10.0.1.5"}
+	newCfg.CacheTTL = 30
+	newCfg.Level = "debug"
+
+	plan := planReload(meshConfig("eth0", "eth1"), newCfg, "", "")
+	if got := plan.summary(0, 0, nil); got != "no changes" {
+		t.Fatalf("expected no pipeline changes, got %s", got)
+	}
+}
+
+func TestPlanReload_Groups(t *testing.T) {
+	oldCfg := meshConfig("eth0", "eth1", "eth2")
+	newCfg := meshConfig("eth0", "eth1", "eth2")
+	newCfg.Groups = []config.GroupConfig{
+		{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1", "eth2"}},
+		{Name: "ssdp", Ports: []int32{1900}, Interfaces: []string{"eth0", "eth1"}},
+	}
+
+	plan := planReload(oldCfg, newCfg, "", "")
+	if !slices.Equal(plan.addedGroups, []string{"roon", "ssdp"}) || !slices.Equal(plan.removedGroups, []string{""}) {
+		t.Fatalf("unexpected groups: added=%v removed=%v", plan.addedGroups, plan.removedGroups)
+	}
+	if len(plan.start) != 3 {
+		t.Fatalf("expected every interface to restart with new learners, got %v", plan.start)
+	}
+	if got := plan.summary(0, 0, nil); got != "restarted interfaces eth0,eth1,eth2; added groups roon,ssdp; removed groups default" {
+		t.Fatalf("unexpected summary: %s", got)
+	}
+}
+
+func TestKeepRestartSettings(t *testing.T) {
+	oldCfg := meshConfig("eth0", "eth1")
+	newCfg := meshConfig("eth0", "eth1")
+	newCfg.MetricsListen = ":9090"
+	newCfg.NoListen = true
+
+	changed := keepRestartSettings(oldCfg, newCfg)
+	if !slices.Equal(changed, []string{"no-listen", "metrics-listen"}) {
+		t.Fatalf("unexpected changed settings: %v", changed)
+	}
+	if newCfg.MetricsListen != "" || newCfg.NoListen {
+		t.Fatal("expected restart only settings to keep their running values")
+	}
+}
+
+func TestSyncFixedIPs(t *testing.T) {
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth0": {"10.0.0.5", "10.0.0.6"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	registry.Restore([]stages.ClientInfo{{IP: net.IP{10, 0, 1, 9}, Interface: "eth1", LastSeen: time.Now()}}, time.Now())
+
+	added, removed := syncFixedIPs(registry, map[string][]string{
+		"eth0": {"10.0.0.5", "10.0.0.6"},
+	}, map[string][]string{
+		"eth0": {"10.0.0.5"},
+		"eth1": {"10.0.1.5"},
+	})
+	if added != 1 || removed != 1 {
+		t.Fatalf("expected 1 added and 1 removed, got %d and %d", added, removed)
+	}
+	if registry.Has("10.0.0.6") || !registry.Has("10.0.1.5") || !registry.Has("10.0.0.5") {
+		t.Fatalf("unexpected clients: %+v", registry.GetClients())
+	}
+	if !registry.Has("10.0.1.9") {
+		t.Fatal("expected learned client to be kept")
+	}
+}
+
+func TestRunnerReload_KeepsRuntimeFixedIPs(t *testing.T) {
+	oldCfg := config.Default()
+	oldCfg.Groups = []config.GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1"}}}
+	oldCfg.FixedIPs = []string{"eth0@10.0.0.5"}
+
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{"eth0": {"10.0.0.5"}})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	group := &relayGroup{name: "roon", ports: []int32{9003}, members: []string{"eth0", "eth1"}, registry: registry}
+	ifaces := map[string]ifaceState{}
+	for _, iname := range group.members {
+		ifaces[iname] = ifaceState{name: iname, pipeline: proxy.NewPipeline(&testSource{name: "PcapSource:" + iname})}
+	}
+	state := &proxyState{groups: []*relayGroup{group}, ifaces: ifaces, routes: map[routeKey]*stages.RouteSink{}}
+	r := newRunner(context.Background(), &proxy.HostDeviceManager{}, oldCfg, state)
+
+	// Added with ctl add-fixed-ip, so not in any config.
+	registry.AddFixedIP("eth1", net.IP{10, 0, 1, 7})
+
+	newCfg := config.Default()
+	newCfg.Groups = oldCfg.Groups
+	summary, err := r.reload(newCfg)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if summary != "removed fixed IPs 1" {
+		t.Fatalf("unexpected summary: %s", summary)
+	}
+	if registry.Has("10.0.0.5") {
+		t.Fatal("expected the fixed IP removed from the config to be removed")
+	}
+	if !registry.Has("10.0.1.7") {
+		t.Fatal("expected the fixed IP added at runtime to be kept")
+	}
+}
+
+func TestRunnerReload_RemovesInterfaceAndUpdatesFixedIPs(t *testing.T) {
+	oldCfg := config.Default()
+	oldCfg.Groups = []config.GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1", "eth2"}}}
+	oldCfg.FixedIPs = []string{"eth0@10.0.0.5"}
+
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{"eth0": {"10.0.0.5"}})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	group := &relayGroup{name: "roon", ports: []int32{9003}, members: []string{"eth0", "eth1", "eth2"}, registry: registry}
+
+	ifaces := map[string]ifaceState{}
+	routes := map[routeKey]*stages.RouteSink{}
+	var pipelines []*proxy.Pipeline
+	for _, iname := range group.members {
+		p := proxy.NewPipeline(&testSource{name: "PcapSource:" + iname})
+		ifaces[iname] = ifaceState{name: iname, pipeline: p}
+		pipelines = append(pipelines, p)
+	}
+	for _, src := range group.members {
+		for _, dst := range group.members {
+			if src != dst {
+				route := &stages.RouteSink{Iname: dst, Group: "roon", Registry: registry, Sinks: []proxy.Sink{&taggedSink{target: dst}}}
+				ifaces[src].pipeline.AddSink(route)
+				routes[routeKey{"roon", src, dst}] = route
+			}
+		}
+	}
+
+	state := &proxyState{pipelines: pipelines, groups: []*relayGroup{group}, ifaces: ifaces, routes: routes}
+	r := newRunner(context.Background(), &proxy.HostDeviceManager{}, oldCfg, state)
+	var notified *proxyState
+	r.onState = append(r.onState, func(s *proxyState) { notified = s })
+
+	newCfg := config.Default()
+	newCfg.Groups = []config.GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1"}}}
+	newCfg.FixedIPs = []string{"eth1@10.0.1.5"}
+	newCfg.CacheTTL = 30
+
+	summary, err := r.reload(newCfg)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if summary != "removed interfaces eth2; removed routes 2; added fixed IPs 1; removed fixed IPs 1" {
+		t.Fatalf("unexpected summary: %s", summary)
+	}
+
+	current := r.current()
+	if notified != current || len(current.pipelines) != 2 || len(current.routes) != 2 {
+		t.Fatalf("unexpected state after reload: %+v", current)
+	}
+	for _, iname := range []string{"eth0", "eth1"} {
+		sinks := current.ifaces[iname].pipeline.CurrentSinks()
+		if len(sinks) != 1 || sinks[0].(*stages.RouteSink).Iname == "eth2" {
+			t.Fatalf("expected only the route to the other remaining interface on %s, got %v", iname, sinks)
+		}
+	}
+	if current.groups[0].registry != registry {
+		t.Fatal("expected the group registry to be kept")
+	}
+	if registry.Has("10.0.0.5") || !registry.Has("10.0.1.5") || registry.GetTTL() != 30*time.Minute {
+		t.Fatalf("expected fixed IPs and TTL to be updated in place, got %+v ttl=%s", registry.GetClients(), registry.GetTTL())
+	}
+	if r.config() != newCfg {
+		t.Fatal("expected the new config to be running")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+// ReplayCmd feeds a capture through the pipeline of an interface and writes
+// the packets which would have been relayed to pcap files, without capturing
+// or sending anything.
+type ReplayCmd struct {
+	File     string  `kong:"arg,type='existingfile',help='pcap or pcapng file to replay'"`
+	As       string  `kong:"help='Interface the packets were captured on, default is taken from udp-proxy-in-<interface>.pcap'"`
+	Realtime bool    `kong:"help='Replay the packets with the timing they were captured with'"`
+	Speed    float64 `kong:"default=1,help='Speed up --realtime replays this many times'"`
+	Loop     bool    `kong:"help='Start over at the end of the file until interrupted'"`
+	Output   string  `kong:"short='o',default='.',type='existingdir',help='Directory to write the relayed packets to'"`
+}
+
+// replayHardwareAddr is the source MAC address of the relayed packets, since
+// the interfaces they would be sent on may not exist here.
+var replayHardwareAddr = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+var replayFileName = regexp.MustCompile(`^udp-proxy-in-(.+)\.pcap(ng)?$`)
+
+// replayInterface returns the interface a file written by --pcap was captured
+// on, or an empty string for other files.
+func replayInterface(path string) string {
+	if m := replayFileName.FindStringSubmatch(filepath.Base(path)); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// runReplay replays cmd.File as if it was captured on one of the interfaces of
+// cfg.  Every route from it writes to a udp-proxy-out-*.pcap file in
+// cmd.Output instead of sending the packets.
+func runReplay(ctx context.Context, cfg *config.Config, cmd ReplayCmd) error {
+	iname := cmd.As
+	if iname == "" {
+		iname = replayInterface(cmd.File)
+	}
+	if iname == "" {
+		return fmt.Errorf("--as is required for files not named udp-proxy-in-<interface>.pcap")
+	}
+
+	cfg = replayConfig(cfg, []string{iname})
+	if !cfg.HasInterface(iname) {
+		return fmt.Errorf("%s is not relayed by the configuration", iname)
+	}
+
+	source, err := stages.NewPcapFileSource(cmd.File, iname)
+	if err != nil {
+		return err
+	}
+	source.Realtime = cmd.Realtime
+	source.Speed = cmd.Speed
+	source.Loop = cmd.Loop
+
+	var dedup *stages.DedupCache
+	if window := cfg.DedupWindowDuration(); window > 0 {
+		dedup = stages.NewDedupCache(window)
+	}
+	groups, err := buildReplayGroups(cfg)
+	if err != nil {
+		source.Close()
+		return err
+	}
+	pipeline, err := newInterfacePipeline(cfg, dedup, iname, portsForInterface(groups, iname), source, source.LinkType())
+	if err != nil {
+		source.Close()
+		return err
+	}
+	addRegistryLearners(pipeline, groups, iname)
+
+	src := ifaceState{name: iname}
+	for _, group := range groups {
+		if !group.hasMember(iname) {
+			continue
+		}
+		for _, dst := range group.members {
+			if dst == iname || !receivesRoutes(dst) {
+				continue
+			}
+			route, err := newRouteSink(cfg, group, src, replayInterfaceState(cfg, dst), layers.LinkTypeEthernet)
+			if err == nil {
+				err = addRoutePcapFileSink(route, cmd.Output, group.name, iname, dst, layers.LinkTypeEthernet)
+			}
+			if err != nil {
+				source.Close()
+				return err
+			}
+			pipeline.AddSink(route)
+		}
+	}
+
+	slog.Info("Replaying capture", "file", cmd.File, "interface", iname, "output", cmd.Output)
+	if err := pipeline.Run(ctx); err != nil {
+		return err
+	}
+	slog.Info("Replay finished", "file", cmd.File)
+	return nil
+}
+
+// replayConfig returns cfg for replaying captures of inames.  There are no
+// interfaces to match patterns against besides those, nothing is delivered
+// locally and only the routes write pcap files, so the files being replayed
+// can't be overwritten.
+func replayConfig(cfg *config.Config, inames []string) *config.Config {
+	cfg = cfg.Expand(inames)
+	out := *cfg
+	out.Pcap = false
+	out.DeliverLocal = false
+	out.Interfaces = make([]config.InterfaceConfig, len(cfg.Interfaces))
+	for i, iface := range cfg.Interfaces {
+		iface.Pcap = nil
+		out.Interfaces[i] = iface
+	}
+	return &out
+}
+
+// buildReplayGroups returns the relay groups of cfg, each with a registry
+// holding its fixed IPs.  cfg must come from replayConfig.
+func buildReplayGroups(cfg *config.Config) ([]*relayGroup, error) {
+	// Without deliver-local the DeviceManager isn't needed.
+	fixedIPs, err := getFixedIPs(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := buildRelayGroups(cfg, "")
+	for _, group := range groups {
+		groupFixedIPs := make(map[string][]string)
+		for _, member := range group.members {
+			if ips, ok := fixedIPs[member]; ok {
+				groupFixedIPs[member] = ips
+			}
+		}
+		registries, err := buildSharedRegistries(cfg.CacheTTLDuration(), groupFixedIPs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fixed IP configuration: %w", err)
+		}
+		group.registry = registries[0]
+	}
+	return groups, nil
+}
+
+// replayInterfaceState returns the state of an interface relayed to by a
+// replay.  Its broadcast addresses come from its broadcast-subnets, or the
+// limited broadcast address without any.
+func replayInterfaceState(cfg *config.Config, iname string) ifaceState {
+	addrs := vlanAddresses(cfg, iname)
+	var bcast []net.IP
+	for _, addr := range addrs {
+		bcast = append(bcast, addr.Broadaddr)
+	}
+	if len(bcast) == 0 {
+		bcast = []net.IP{net.IPv4bcast}
+	}
+	return ifaceState{
+		name: iname,
+		netif: &net.Interface{
+			Name:         proxy.DeviceName(iname),
+			Flags:        net.FlagUp | net.FlagBroadcast | net.FlagMulticast,
+			HardwareAddr: replayHardwareAddr,
+		},
+		broadcast:   true,
+		bcastIPs:    bcast,
+		addrs:       addrs,
+		egressLimit: newEgressRateLimit(cfg, iname),
+	}
+}
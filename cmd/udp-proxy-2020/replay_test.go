@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+func TestReplayInterface(t *testing.T) {
+	for path, want := range map[string]string{
+		"/root/udp-proxy-in-eth0.pcap":        "eth0",
+		"udp-proxy-in-eth0@vlan20.pcapng":     "eth0@vlan20",
+		"udp-proxy-out-eth0-to-eth1.pcap":     "",
+		"/tmp/capture.pcap":                   "",
+		"udp-proxy-in-.pcap":                  "",
+		"/var/tmp/udp-proxy-in-tun0.pcap.bak": "",
+	} {
+		if got := replayInterface(path); got != want {
+			t.Errorf("replayInterface(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestParseArgs_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "udp-proxy-in-eth0.pcap")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	cli, command, _ := parseTestCommand(t, "replay", path, "--realtime", "--speed", "4")
+	if command != "replay <file>" {
+		t.Fatalf("unexpected command %q", command)
+	}
+	if cli.Replay.File != path || !cli.Replay.Realtime || cli.Replay.Speed != 4 || cli.Replay.Output == "" {
+		t.Errorf("unexpected replay options: %+v", cli.Replay)
+	}
+}
+
+func TestRunReplay_WritesRelayedPackets(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "udp-proxy-in-eth0.pcap")
+	f, err := os.Create(in)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		pkt := buildControlTestPacket(t, net.IPv4(10, 0, 0, byte(5+i)))
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1000, 0), CaptureLength: len(pkt.Raw), Length: len(pkt.Raw)}
+		if err := w.WritePacket(ci, pkt.Raw); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	f.Close()
+
+	cfg := meshConfig("eth0", "eth1", "eth2")
+	cfg.Interfaces[2].BroadcastSubnets = []string{"192.168.2.0/24"}
+	if err := runReplay(context.Background(), cfg, ReplayCmd{File: in, Speed: 1, Output: dir}); err != nil {
+		t.Fatalf("runReplay failed: %v", err)
+	}
+
+	for dst, bcast := range map[string]net.IP{"eth1": net.IPv4bcast, "eth2": net.IPv4(192, 168, 2, 255)} {
+		out, err := os.Open(filepath.Join(dir, "udp-proxy-out-eth0-to-"+dst+".pcap"))
+		if err != nil {
+			t.Fatalf("expected a pcap file for %s: %v", dst, err)
+		}
+		r, err := pcapgo.NewReader(out)
+		if err != nil {
+			t.Fatalf("NewReader failed: %v", err)
+		}
+		packets := 0
+		for {
+			data, _, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("ReadPacketData failed: %v", err)
+			}
+			packets++
+			ip, ok := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if !ok || !ip.DstIP.Equal(bcast) {
+				t.Errorf("%s: expected a packet to %s, got %v", dst, bcast, ip)
+			}
+		}
+		out.Close()
+		if packets != 3 {
+			t.Errorf("%s: expected 3 relayed packets, got %d", dst, packets)
+		}
+	}
+}
+
+func TestRunReplay_RequiresInterface(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := runReplay(context.Background(), meshConfig("eth0", "eth1"), ReplayCmd{File: path, Output: "."}); err == nil {
+		t.Fatal("expected an error without --as")
+	}
+	if err := runReplay(context.Background(), meshConfig("eth0", "eth1"), ReplayCmd{File: path, As: "eth9", Output: "."}); err == nil {
+		t.Fatal("expected an error for an interface which isn't relayed")
+	}
+}
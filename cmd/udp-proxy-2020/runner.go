@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+// interfacePollInterval is how often the interfaces are polled for changes
+// where rtnetlink isn't available.
+const interfacePollInterval = time.Second
+
+// runner runs the pipeline and UDP listeners of every interface in the current
+// proxyState.  Interfaces are started and stopped individually so a config
+// reload only interrupts the interfaces it changes.
+type runner struct {
+	ctx    context.Context
+	dm     proxy.DeviceManager
+	wg     sync.WaitGroup // every pipeline and listener, for shutdown
+	failed atomic.Bool    // set when a pipeline returns an error
+
+	mu      sync.Mutex // serializes reloads and protects cfg and running
+	cfg     *config.Config
+	state   atomic.Pointer[proxyState]
+	running map[string]*runningIface
+
+	// onState is called with the new state after every reload.
+	onState []func(*proxyState)
+
+	// Replaceable for tests.
+	availableInterfaces func() []string
+	interfaceReady      func(iname string) bool
+	interfaceGone       func(iname string) bool
+	setupInterface      func(cfg *config.Config, dedup *stages.DedupCache, groups []*relayGroup, iname string) (ifaceState, error)
+	newRoute            func(cfg *config.Config, group *relayGroup, src, dst ifaceState) (*stages.RouteSink, error)
+	joinMulticast       func(cfg *config.Config, iname string) *proxy.MulticastMembership
+}
+
+// runningIface tracks the goroutines of a running interface.
+type runningIface struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The UDP listeners are restarted on their own when the addresses of
+	// the interface change.
+	stopListeners context.CancelFunc // nil without listeners
+	listeners     *sync.WaitGroup
+
+	multicast *proxy.MulticastMembership // nil without multicast-join
+}
+
+func newRunner(ctx context.Context, dm proxy.DeviceManager, cfg *config.Config, state *proxyState) *runner {
+	r := &runner{
+		ctx:     ctx,
+		dm:      dm,
+		cfg:     cfg,
+		running: make(map[string]*runningIface),
+	}
+	r.availableInterfaces = dm.InterfaceNames
+	r.interfaceReady = func(iname string) bool { return interfaceReady(dm, iname) }
+	r.interfaceGone = func(iname string) bool { return interfaceGone(dm, iname) }
+	r.setupInterface = func(cfg *config.Config, dedup *stages.DedupCache, groups []*relayGroup, iname string) (ifaceState, error) {
+		s, pipeline, err := setupInterfacePipeline(cfg, dm, r.current().trunks, dedup, iname, portsForInterface(groups, iname))
+		if err != nil {
+			return ifaceState{}, err
+		}
+		addRegistryLearners(pipeline, groups, iname)
+		return s, nil
+	}
+	r.newRoute = func(cfg *config.Config, group *relayGroup, src, dst ifaceState) (*stages.RouteSink, error) {
+		return newCrossInterfaceRoute(cfg, dm, group, src, dst)
+	}
+	r.joinMulticast = func(cfg *config.Config, iname string) *proxy.MulticastMembership {
+		return joinMulticastGroups(dm, cfg, iname)
+	}
+	r.state.Store(state)
+	return r
+}
+
+// current returns the running proxyState.
+func (r *runner) current() *proxyState {
+	return r.state.Load()
+}
+
+// config returns the running config.
+func (r *runner) config() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// start starts every interface of the current state.
+func (r *runner) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for iname, s := range r.current().ifaces {
+		r.startInterface(iname, s.pipeline)
+	}
+}
+
+// startInterface runs the pipeline of iname and, unless disabled, its UDP
+// listeners, and joins the multicast-join groups on it.  Must be called with
+// mu held.
+func (r *runner) startInterface(iname string, pipeline *proxy.Pipeline) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	ri := &runningIface{ctx: ctx, cancel: cancel}
+	r.running[iname] = ri
+	ri.multicast = r.joinMulticast(r.cfg, iname)
+
+	// Leave the second half of the shutdown timeout for closing the sinks.
+	pipeline.DrainTimeout = r.cfg.ShutdownTimeoutDuration() / 2
+	ri.wg.Add(1)
+	go func() {
+		defer ri.wg.Done()
+		if err := pipeline.Run(ctx); err != nil {
+			slog.Error("Pipeline error", "interface", iname, "error", err)
+			r.failed.Store(true)
+		}
+	}()
+
+	// Only the configured interfaces get listeners, not the loopback
+	// interface added by deliver-local.  The host has no address on a
+	// logical VLAN interface or the any pseudo-interface to listen on.
+	if !r.cfg.NoListen && r.cfg.HasInterface(iname) && !proxy.IsVLANInterfaceName(iname) && iname != proxy.AnyInterface {
+		r.startListeners(iname, ri)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ri.wg.Wait()
+	}()
+}
+
+// startListeners starts the UDP listeners of iname, replacing any running
+// ones.  Must be called with mu held.
+func (r *runner) startListeners(iname string, ri *runningIface) {
+	// Count the new listeners before the old ones are gone, so ri.wg
+	// doesn't drop to zero while the interface is still running.
+	ri.wg.Add(1)
+	if ri.stopListeners != nil {
+		ri.stopListeners()
+		ri.listeners.Wait()
+	}
+	ctx, stop := context.WithCancel(ri.ctx)
+	listeners := &sync.WaitGroup{}
+	startInterfaceListeners(ctx, listeners, r.dm, iname, r.cfg.PortsFor(iname))
+	ri.stopListeners, ri.listeners = stop, listeners
+	go func() {
+		defer ri.wg.Done()
+		listeners.Wait()
+	}()
+}
+
+// restartListeners binds the UDP listeners of iname again, for when its
+// addresses changed.  Must be called with mu held.
+func (r *runner) restartListeners(iname string) {
+	if ri, ok := r.running[iname]; ok && ri.stopListeners != nil {
+		r.startListeners(iname, ri)
+	}
+}
+
+// rejoinMulticast replaces the multicast-join memberships of iname, for when
+// the groups changed.  Must be called with mu held.
+func (r *runner) rejoinMulticast(iname string) {
+	if ri, ok := r.running[iname]; ok {
+		ri.multicast.Close()
+		ri.multicast = r.joinMulticast(r.cfg, iname)
+	}
+}
+
+// stopInterface stops the pipeline and listeners of iname, leaves its
+// multicast groups and waits for them to finish, which closes the pipeline's
+// source and sinks.  Must be called with mu held.
+func (r *runner) stopInterface(iname string) {
+	ri, ok := r.running[iname]
+	if !ok {
+		return
+	}
+	delete(r.running, iname)
+	ri.multicast.Close()
+	ri.cancel()
+	if !waitTimeout(&ri.wg, r.cfg.ShutdownTimeoutDuration()) {
+		slog.Warn("Timed out waiting for interface to stop", "interface", iname)
+	}
+}
+
+// setState replaces the current state and notifies the onState callbacks.
+func (r *runner) setState(state *proxyState) {
+	r.state.Store(state)
+	for _, f := range r.onState {
+		f(state)
+	}
+}
+
+// addRoute creates the route for key and adds it to the pipeline of its source
+// interface.  Routes from or to an interface which is pending are skipped; they
+// are added by attachInterface once it shows up.
+func (r *runner) addRoute(cfg *config.Config, g *relayGroup, ifaces map[string]ifaceState, routes map[routeKey]*stages.RouteSink, key routeKey) error {
+	src, ok := ifaces[key.src]
+	if !ok {
+		return nil
+	}
+	dst, ok := ifaces[key.dst]
+	if !ok || !receivesRoutes(dst.name) {
+		return nil
+	}
+	route, err := r.newRoute(cfg, g, src, dst)
+	if err != nil {
+		return err
+	}
+	src.pipeline.AddSink(route)
+	routes[key] = route
+	return nil
+}
+
+// orderedPipelines returns the pipelines of ifaces in config order.
+func orderedPipelines(cfg *config.Config, loopback string, ifaces map[string]ifaceState) []*proxy.Pipeline {
+	var pipelines []*proxy.Pipeline
+	for _, iname := range relayInterfaces(cfg, loopback) {
+		if s, ok := ifaces[iname]; ok {
+			pipelines = append(pipelines, s.pipeline)
+		}
+	}
+	return pipelines
+}
+
+// pending returns the interfaces of the current config which are not running
+// because they did not exist yet.  Must be called with mu held.
+func (r *runner) pending() []string {
+	state := r.current()
+	var pending []string
+	for _, iname := range relayInterfaces(r.cfg, state.loopback) {
+		if _, ok := state.ifaces[iname]; !ok {
+			pending = append(pending, iname)
+		}
+	}
+	return pending
+}
+
+// attachInterface sets up the pipeline of a pending interface, adds the routes
+// between it and the other members of its relay groups and starts it.  Must be
+// called with mu held.
+func (r *runner) attachInterface(iname string) error {
+	state := r.current()
+	s, err := r.setupInterface(r.cfg, state.dedup, state.groups, iname)
+	if err != nil {
+		return err
+	}
+	ifaces := maps.Clone(state.ifaces)
+	routes := maps.Clone(state.routes)
+	ifaces[iname] = s
+
+	var errs []error
+	for _, g := range state.groups {
+		if !g.hasMember(iname) {
+			continue
+		}
+		for _, other := range g.members {
+			if other == iname {
+				continue
+			}
+			for _, key := range []routeKey{{g.name, iname, other}, {g.name, other, iname}} {
+				if err := r.addRoute(r.cfg, g, ifaces, routes, key); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	r.startInterface(iname, s.pipeline)
+	r.setState(&proxyState{
+		pipelines: orderedPipelines(r.cfg, state.loopback, ifaces),
+		groups:    state.groups,
+		dedup:     state.dedup,
+		trunks:    state.trunks,
+		loopback:  state.loopback,
+		ifaces:    ifaces,
+		routes:    routes,
+	})
+	return errors.Join(errs...)
+}
+
+// detachInterface stops a deleted interface and removes the routes to it from
+// the other pipelines, leaving it pending until it shows up again.  The clients
+// learned on it are forgotten, an interface re-created with the same name has a
+// new MAC address and likely new neighbors.  Must be called with mu held.
+func (r *runner) detachInterface(iname string) {
+	state := r.current()
+	r.stopInterface(iname) // closes the routes from iname
+
+	removed := 0
+	for _, g := range state.groups {
+		if g.hasMember(iname) {
+			removed += g.registry.FlushInterface(iname)
+		}
+	}
+	if removed > 0 {
+		slog.Info("Forgot the clients of the deleted interface", "interface", iname, "removed_clients", removed)
+	}
+
+	ifaces := maps.Clone(state.ifaces)
+	routes := maps.Clone(state.routes)
+	delete(ifaces, iname)
+	for key, route := range routes {
+		switch iname {
+		case key.src:
+			delete(routes, key)
+		case key.dst:
+			if src, ok := ifaces[key.src]; ok {
+				src.pipeline.RemoveSink(route)
+			}
+			if err := route.Close(); err != nil {
+				slog.Warn("Error closing route", "route", key.String(), "error", err)
+			}
+			delete(routes, key)
+		}
+	}
+
+	r.setState(&proxyState{
+		pipelines: orderedPipelines(r.cfg, state.loopback, ifaces),
+		groups:    state.groups,
+		dedup:     state.dedup,
+		trunks:    state.trunks,
+		loopback:  state.loopback,
+		ifaces:    ifaces,
+		routes:    routes,
+	})
+}
+
+// checkInterfaces re-evaluates the interface patterns, attaches the pending
+// interfaces which showed up and detaches the running interfaces which were
+// deleted.  Interfaces which are merely down keep running; their sources and
+// sinks reconnect once they come back up.
+func (r *runner) checkInterfaces() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cfg.HasPatterns() {
+		cfg := r.cfg.Expand(r.availableInterfaces())
+		if !sameRelayGroups(cfg, r.cfg) {
+			summary, err := r.apply(cfg)
+			slog.Info("Interface patterns matched different interfaces", "changes", summary)
+			if err != nil {
+				slog.Error("Unable to apply interface pattern changes", "error", err)
+			}
+		}
+	}
+
+	for _, iname := range r.pending() {
+		if !r.interfaceReady(iname) {
+			continue
+		}
+		slog.Info("Interface appeared, attaching", "interface", iname)
+		if err := r.attachInterface(iname); err != nil {
+			slog.Error("Unable to attach interface", "interface", iname, "error", err)
+		}
+	}
+
+	for iname := range r.current().ifaces {
+		if r.interfaceGone(iname) {
+			slog.Info("Interface was deleted, detaching", "interface", iname)
+			r.detachInterface(iname)
+		}
+	}
+}
+
+// watchInterfaces handles every batch of link events until ctx is cancelled:
+// interfaces which appeared or went away are attached or detached by
+// checkInterfaces, and address and MTU changes of running interfaces are
+// applied by updateAddresses and updateMTUs.
+func (r *runner) watchInterfaces(ctx context.Context, events <-chan proxy.LinkEvent) {
+	for {
+		changed := make(map[string][]proxy.InterfaceAddress)
+		mtus := make(map[string]int)
+		collect := func(event proxy.LinkEvent) {
+			if event.Kind == proxy.LinkGone {
+				delete(changed, event.Interface)
+				delete(mtus, event.Interface)
+			} else {
+				changed[event.Interface] = event.Addresses
+				mtus[event.Interface] = event.MTU
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			collect(event)
+		}
+		// Handle every event which is already queued in one go.
+		for drained := false; !drained; {
+			select {
+			case event := <-events:
+				collect(event)
+			default:
+				drained = true
+			}
+		}
+		r.checkInterfaces()
+		r.updateAddresses(changed)
+		r.updateMTUs(mtus)
+	}
+}
+
+// sameRelayGroups reports whether a and b relay between the same interfaces.
+func sameRelayGroups(a, b *config.Config) bool {
+	ga, gb := a.RelayGroups(), b.RelayGroups()
+	return slices.EqualFunc(ga, gb, func(x, y config.GroupConfig) bool {
+		return x.Name == y.Name && slices.Equal(x.Interfaces, y.Interfaces)
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+// newPendingTestRunner returns a runner for a roon group of eth0, eth1 and
+// tun0 where only eth0 and eth1 are running, and the set of interfaces which
+// exist.
+func newPendingTestRunner(t *testing.T) (*runner, map[string]bool) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.NoListen = true
+	cfg.Groups = []config.GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1", "tun0"}}}
+
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	group := &relayGroup{name: "roon", ports: []int32{9003}, members: []string{"eth0", "eth1", "tun0"}, registry: registry}
+
+	present := map[string]bool{"eth0": true, "eth1": true}
+	ifaces := map[string]ifaceState{}
+	routes := map[routeKey]*stages.RouteSink{}
+	newRoute := func(_ *config.Config, g *relayGroup, _, dst ifaceState) (*stages.RouteSink, error) {
+		return &stages.RouteSink{Iname: dst.name, Group: g.name, Registry: g.registry, Sinks: []proxy.Sink{&taggedSink{target: dst.name}}}, nil
+	}
+	for _, iname := range []string{"eth0", "eth1"} {
+		ifaces[iname] = ifaceState{name: iname, pipeline: proxy.NewPipeline(&testSource{name: "PcapSource:" + iname})}
+	}
+	for _, key := range []routeKey{{"roon", "eth0", "eth1"}, {"roon", "eth1", "eth0"}} {
+		route, _ := newRoute(cfg, group, ifaces[key.src], ifaces[key.dst])
+		ifaces[key.src].pipeline.AddSink(route)
+		routes[key] = route
+	}
+
+	state := &proxyState{groups: []*relayGroup{group}, ifaces: ifaces, routes: routes}
+	state.pipelines = orderedPipelines(cfg, "", ifaces)
+	r := newRunner(context.Background(), &proxy.HostDeviceManager{}, cfg, state)
+	r.interfaceReady = func(iname string) bool { return present[iname] }
+	r.interfaceGone = func(iname string) bool { return !present[iname] }
+	r.setupInterface = func(_ *config.Config, _ *stages.DedupCache, groups []*relayGroup, iname string) (ifaceState, error) {
+		pipeline := proxy.NewPipeline(&testSource{name: "PcapSource:" + iname})
+		addRegistryLearners(pipeline, groups, iname)
+		return ifaceState{name: iname, pipeline: pipeline}, nil
+	}
+	r.newRoute = newRoute
+	return r, present
+}
+
+func routeTargets(p *proxy.Pipeline) map[string]bool {
+	targets := map[string]bool{}
+	for _, sink := range p.CurrentSinks() {
+		targets[sink.(*stages.RouteSink).Iname] = true
+	}
+	return targets
+}
+
+func TestRunner_AttachesPendingInterface(t *testing.T) {
+	r, present := newPendingTestRunner(t)
+	if pending := r.pending(); len(pending) != 1 || pending[0] != "tun0" {
+		t.Fatalf("expected tun0 to be pending, got %v", pending)
+	}
+
+	r.checkInterfaces()
+	if len(r.current().ifaces) != 2 {
+		t.Fatal("expected tun0 to stay pending until it exists")
+	}
+
+	present["tun0"] = true
+	r.checkInterfaces()
+	current := r.current()
+	if len(r.pending()) != 0 || len(current.pipelines) != 3 || len(current.routes) != 6 {
+		t.Fatalf("expected tun0 to be attached, got %d pipelines and %d routes", len(current.pipelines), len(current.routes))
+	}
+	if _, ok := r.running["tun0"]; !ok {
+		t.Fatal("expected tun0 to be running")
+	}
+	for iname, want := range map[string][]string{"eth0": {"eth1", "tun0"}, "eth1": {"eth0", "tun0"}, "tun0": {"eth0", "eth1"}} {
+		targets := routeTargets(current.ifaces[iname].pipeline)
+		if len(targets) != len(want) || !targets[want[0]] || !targets[want[1]] {
+			t.Fatalf("unexpected routes from %s: %v", iname, targets)
+		}
+	}
+}
+
+func TestRunner_DetachesDeletedInterface(t *testing.T) {
+	r, present := newPendingTestRunner(t)
+	present["tun0"] = true
+	r.checkInterfaces()
+
+	registry := r.current().groups[0].registry
+	registry.Restore([]stages.ClientInfo{
+		{IP: net.IP{10, 0, 0, 9}, Interface: "tun0", LastSeen: time.Now()},
+		{IP: net.IP{10, 0, 1, 9}, Interface: "eth1", LastSeen: time.Now()},
+	}, time.Now())
+	registry.AddFixedIP("tun0", net.IP{10, 0, 0, 10})
+
+	delete(present, "tun0")
+	r.checkInterfaces()
+	current := r.current()
+	if pending := r.pending(); len(pending) != 1 || pending[0] != "tun0" {
+		t.Fatalf("expected tun0 to be pending again, got %v", pending)
+	}
+	if _, ok := r.running["tun0"]; ok {
+		t.Fatal("expected tun0 to be stopped")
+	}
+	if len(current.pipelines) != 2 || len(current.routes) != 2 {
+		t.Fatalf("expected only the eth0/eth1 routes, got %v", current.routes)
+	}
+	for _, iname := range []string{"eth0", "eth1"} {
+		if targets := routeTargets(current.ifaces[iname].pipeline); targets["tun0"] {
+			t.Fatalf("expected the route from %s to tun0 to be removed", iname)
+		}
+	}
+	if registry.Has("10.0.0.9") || !registry.Has("10.0.0.10") || !registry.Has("10.0.1.9") {
+		t.Fatalf("expected only the learned clients of tun0 to be forgotten, got %v", registry.GetClients())
+	}
+}
+
+func TestRunner_InterfacePatternsFollowAvailableInterfaces(t *testing.T) {
+	r, present := newPendingTestRunner(t)
+	source := config.Default()
+	source.NoListen = true
+	source.Groups = []config.GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1", "tun*"}}}
+	available := func() []string {
+		var names []string
+		for iname := range present {
+			names = append(names, iname)
+		}
+		return names
+	}
+	r.availableInterfaces = available
+	r.cfg = source.Expand(available())
+	r.current().groups[0].members = []string{"eth0", "eth1"}
+	if len(r.pending()) != 0 {
+		t.Fatalf("expected no pending interfaces, got %v", r.pending())
+	}
+
+	present["tun0"] = true
+	present["tun1"] = true
+	r.checkInterfaces()
+	current := r.current()
+	if got := r.config().RelayGroups()[0].Interfaces; len(got) != 4 || got[2] != "tun0" || got[3] != "tun1" {
+		t.Fatalf("expected tun0 and tun1 to join the group, got %v", got)
+	}
+	if len(current.ifaces) != 4 || len(current.routes) != 12 {
+		t.Fatalf("expected a full mesh of 4 interfaces, got %d interfaces and %d routes", len(current.ifaces), len(current.routes))
+	}
+	if targets := routeTargets(current.ifaces["eth0"].pipeline); !targets["tun0"] || !targets["tun1"] {
+		t.Fatalf("expected eth0 to relay to the tunnels, got %v", targets)
+	}
+
+	delete(present, "tun0")
+	r.checkInterfaces()
+	current = r.current()
+	if len(current.ifaces) != 3 || len(current.routes) != 6 || len(r.pending()) != 0 {
+		t.Fatalf("expected tun0 to leave the group, got %d interfaces, %d routes, pending %v", len(current.ifaces), len(current.routes), r.pending())
+	}
+	if targets := routeTargets(current.ifaces["eth0"].pipeline); targets["tun0"] {
+		t.Fatal("expected the route from eth0 to tun0 to be removed")
+	}
+	if r.config().Source() != source {
+		t.Fatal("expected the patterns to be kept")
+	}
+}
+
+// recordMulticastJoins replaces the multicast joins of r, returning how many
+// times each interface joined the groups.
+func recordMulticastJoins(r *runner) map[string]int {
+	joined := map[string]int{}
+	r.joinMulticast = func(cfg *config.Config, iname string) *proxy.MulticastMembership {
+		groups := cfg.MulticastGroups()
+		if len(groups) == 0 {
+			return nil
+		}
+		joined[iname]++
+		return &proxy.MulticastMembership{Iname: iname, Groups: groups}
+	}
+	return joined
+}
+
+func TestRunner_JoinsMulticastGroupsOnAttachedInterfaces(t *testing.T) {
+	r, present := newPendingTestRunner(t)
+	r.cfg.Multicast = true
+	r.cfg.MulticastJoin = []string{"239.255.255.250"}
+	joined := recordMulticastJoins(r)
+
+	present["tun0"] = true
+	r.checkInterfaces()
+	if joined["tun0"] != 1 || r.running["tun0"].multicast == nil {
+		t.Fatalf("expected tun0 to join the groups once attached, got %v", joined)
+	}
+
+	// A re-created interface joins the groups again.
+	delete(present, "tun0")
+	r.checkInterfaces()
+	present["tun0"] = true
+	r.checkInterfaces()
+	if joined["tun0"] != 2 || r.running["tun0"].multicast == nil {
+		t.Fatalf("expected tun0 to join the groups again, got %v", joined)
+	}
+}
+
+func TestRunnerReload_RejoinsChangedMulticastGroups(t *testing.T) {
+	r, present := newPendingTestRunner(t)
+	present["tun0"] = true
+	joined := recordMulticastJoins(r)
+	r.start()
+	r.checkInterfaces()
+	if len(joined) != 0 {
+		t.Fatalf("expected no groups to be joined, got %v", joined)
+	}
+
+	cfg := *r.config()
+	cfg.Multicast = true
+	cfg.MulticastJoin = []string{"239.255.255.250"}
+	if _, err := r.reload(&cfg); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	for _, iname := range []string{"eth0", "eth1", "tun0"} {
+		if joined[iname] != 1 || r.running[iname].multicast == nil {
+			t.Fatalf("expected every interface to join the groups once, got %v", joined)
+		}
+	}
+}
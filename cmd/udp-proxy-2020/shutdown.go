@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+)
+
+// shutdown waits for the pipelines and listeners in wg to stop after the
+// context was cancelled, which drains them and closes their sinks, and then
+// saves the state file.  Returns the exit status.
+func shutdown(wg *sync.WaitGroup, failed *atomic.Bool, cfg *config.Config, state *proxyState) int {
+	timeout := cfg.ShutdownTimeoutDuration()
+	slog.Info("Shutting down", "timeout", timeout)
+
+	status := 0
+	if !waitTimeout(wg, timeout) {
+		slog.Error("Timed out waiting for pipelines to stop, pcap files may be incomplete", "timeout", timeout)
+		status = 1
+	} else if failed.Load() {
+		status = 1
+	}
+
+	if cfg.StateFile != "" {
+		if err := saveState(cfg.StateFile, state.groups); err != nil {
+			slog.Error("Unable to save state file", "path", cfg.StateFile, "error", err)
+			status = 1
+		} else {
+			slog.Info("Saved state file", "path", cfg.StateFile)
+		}
+	}
+
+	if status == 0 {
+		slog.Info("Shutdown complete")
+	}
+	return status
+}
+
+// waitTimeout waits for wg, returning false if timeout expires first.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/state"
+)
+
+func TestWaitTimeout(t *testing.T) {
+	var wg sync.WaitGroup
+	if !waitTimeout(&wg, time.Second) {
+		t.Fatal("expected an idle WaitGroup to finish")
+	}
+
+	wg.Add(1)
+	if waitTimeout(&wg, 10*time.Millisecond) {
+		t.Fatal("expected waitTimeout to give up")
+	}
+	wg.Done()
+}
+
+func TestShutdown_SavesStateAndReturnsStatus(t *testing.T) {
+	cfg := config.Default()
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	ps := &proxyState{groups: newStateTestGroups(t)}
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	if status := shutdown(&wg, &failed, cfg, ps); status != 0 {
+		t.Fatalf("expected status 0, got %d", status)
+	}
+	if _, err := state.Load(cfg.StateFile); err != nil {
+		t.Fatalf("expected state file to be saved: %v", err)
+	}
+
+	failed.Store(true)
+	if status := shutdown(&wg, &failed, cfg, ps); status != 1 {
+		t.Fatalf("expected status 1 after a pipeline error, got %d", status)
+	}
+}
+
+func TestShutdown_Timeout(t *testing.T) {
+	cfg := config.Default()
+	cfg.ShutdownTimeout = 0 // expire immediately
+	cfg.StateFile = filepath.Join(t.TempDir(), "missing", "state.json")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	defer wg.Done()
+	var failed atomic.Bool
+	if status := shutdown(&wg, &failed, cfg, &proxyState{groups: newStateTestGroups(t)}); status != 1 {
+		t.Fatalf("expected status 1, got %d", status)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+	"github.com/synfinatic/udp-proxy-2020/internal/state"
+)
+
+// snapshotState returns the learned clients of every relay group.
+func snapshotState(groups []*relayGroup, now time.Time) *state.File {
+	f := &state.File{SavedAt: now}
+	for _, g := range groups {
+		sg := state.Group{Name: g.name, Clients: []state.Client{}}
+		for _, info := range g.registry.GetClients() {
+			if info.LastSeen.IsZero() {
+				continue // fixed IPs come from the config
+			}
+			c := state.Client{
+				Interface: info.Interface,
+				IP:        info.IP.String(),
+				LastSeen:  info.LastSeen,
+			}
+			if len(info.MAC) > 0 {
+				c.MAC = info.MAC.String()
+			}
+			sg.Clients = append(sg.Clients, c)
+		}
+		f.Groups = append(f.Groups, sg)
+	}
+	return f
+}
+
+// restoreState adds the clients from the state file to the registry of the
+// relay group with the same name.  Clients on interfaces which are no longer
+// in the group, or which expired while we were down, are skipped.  Returns the
+// number of clients restored.
+func restoreState(f *state.File, groups []*relayGroup, now time.Time) int {
+	restored := 0
+	for _, sg := range f.Groups {
+		g := findGroup(groups, sg.Name)
+		if g == nil {
+			slog.Debug("Skipping state for unknown relay group", "group", sg.Name)
+			continue
+		}
+		clients := make([]stages.ClientInfo, 0, len(sg.Clients))
+		for _, c := range sg.Clients {
+			ip := net.ParseIP(c.IP)
+			if ip == nil || !g.hasMember(c.Interface) {
+				slog.Debug("Skipping saved client", "group", sg.Name, "interface", c.Interface, "ip", c.IP)
+				continue
+			}
+			mac, _ := net.ParseMAC(c.MAC)
+			clients = append(clients, stages.ClientInfo{
+				IP:        ip,
+				Interface: c.Interface,
+				LastSeen:  c.LastSeen,
+				MAC:       mac,
+			})
+		}
+		restored += g.registry.Restore(clients, now)
+	}
+	return restored
+}
+
+func findGroup(groups []*relayGroup, name string) *relayGroup {
+	for _, g := range groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// loadState restores the learned clients saved in path.  A missing or
+// unreadable state file is not fatal; we just start with an empty registry.
+func loadState(path string, groups []*relayGroup) {
+	f, err := state.Load(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No state file, starting with no learned clients", "path", path)
+		return
+	} else if err != nil {
+		slog.Warn("Unable to load state file", "path", path, "error", err)
+		return
+	}
+	restored := restoreState(f, groups, time.Now())
+	slog.Info("Restored learned clients", "path", path, "clients", restored, "saved_at", f.SavedAt)
+}
+
+// saveState writes the learned clients of every relay group to path.
+func saveState(path string, groups []*relayGroup) error {
+	f := snapshotState(groups, time.Now())
+	if err := state.Save(path, f); err != nil {
+		return err
+	}
+	slog.Debug("Saved state file", "path", path)
+	return nil
+}
+
+// saveStatePeriodically saves the state file with the relay groups returned by
+// groups every interval until ctx is cancelled.
+func saveStatePeriodically(ctx context.Context, path string, interval time.Duration, groups func() []*relayGroup) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveState(path, groups()); err != nil {
+				slog.Error("Unable to save state file", "path", path, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+	"github.com/synfinatic/udp-proxy-2020/internal/state"
+)
+
+func newStateTestGroups(t *testing.T) []*relayGroup {
+	t.Helper()
+	var groups []*relayGroup
+	for _, name := range []string{"roon", "ssdp"} {
+		registry, err := stages.NewRegistryProcessorByInterface(time.Hour, map[string][]string{"eth0": {"10.0.0.1"}})
+		if err != nil {
+			t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+		}
+		groups = append(groups, &relayGroup{name: name, members: []string{"eth0", "tun0"}, registry: registry})
+	}
+	return groups
+}
+
+func TestSaveLoadState_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now()
+
+	groups := newStateTestGroups(t)
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	groups[0].registry.Restore([]stages.ClientInfo{
+		{IP: net.IP{10, 8, 0, 2}, Interface: "tun0", LastSeen: now.Add(-10 * time.Minute)},
+		{IP: net.IP{10, 0, 0, 7}, Interface: "eth0", LastSeen: now.Add(-time.Minute), MAC: mac},
+	}, now)
+	if err := saveState(path, groups); err != nil {
+		t.Fatalf("saveState failed: %v", err)
+	}
+
+	f, err := state.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(f.Groups) != 2 || len(f.Groups[0].Clients) != 2 || len(f.Groups[1].Clients) != 0 {
+		t.Fatalf("expected only learned clients to be saved, got %+v", f.Groups)
+	}
+
+	restartedGroups := newStateTestGroups(t)
+	loadState(path, restartedGroups)
+	if got := restartedGroups[0].registry.Len(); got != 3 {
+		t.Fatalf("expected 2 restored + 1 fixed client, got %d", got)
+	}
+	for _, c := range restartedGroups[0].registry.GetClientsForInterface("eth0") {
+		if c.IP.Equal(net.IP{10, 0, 0, 7}) && (c.MAC.String() != mac.String() || !c.LastSeen.Equal(now.Add(-time.Minute))) {
+			t.Fatalf("unexpected restored client: %+v", c)
+		}
+	}
+	if got := restartedGroups[1].registry.Len(); got != 1 {
+		t.Fatalf("expected only the fixed client in ssdp, got %d", got)
+	}
+}
+
+func TestRestoreState_SkipsStaleEntries(t *testing.T) {
+	now := time.Now()
+	groups := newStateTestGroups(t)
+	f := &state.File{Groups: []state.Group{
+		{Name: "roon", Clients: []state.Client{
+			{Interface: "tun0", IP: "10.8.0.2", LastSeen: now.Add(-2 * time.Hour)}, // expired
+			{Interface: "eth9", IP: "10.9.0.2", LastSeen: now},                     // no longer a member
+			{Interface: "tun0", IP: "bogus", LastSeen: now},
+			{Interface: "tun0", IP: "10.8.0.3", LastSeen: now.Add(-time.Minute)},
+		}},
+		{Name: "removed-group", Clients: []state.Client{
+			{Interface: "tun0", IP: "10.8.0.4", LastSeen: now},
+		}},
+	}}
+
+	if restored := restoreState(f, groups, now); restored != 1 {
+		t.Fatalf("expected 1 client restored, got %d", restored)
+	}
+	if !groups[0].registry.Has("10.8.0.3") {
+		t.Fatal("expected 10.8.0.3 to be restored")
+	}
+}
+
+func TestLoadState_MissingFile(t *testing.T) {
+	groups := newStateTestGroups(t)
+	loadState(filepath.Join(t.TempDir(), "nope.json"), groups)
+	if got := groups[0].registry.Len(); got != 1 {
+		t.Fatalf("expected only the fixed client, got %d", got)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// virtualTimeout is how long to wait for the proxy to react, which includes
+// the first reconnect attempt of a capture or transmitter.
+const virtualTimeout = 5 * time.Second
+
+func virtualEthernet(name string, mac byte, addr proxy.InterfaceAddress) proxy.VirtualInterface {
+	return proxy.VirtualInterface{
+		Name:         name,
+		LinkType:     layers.LinkTypeEthernet,
+		HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, mac},
+		Addresses:    []proxy.InterfaceAddress{addr},
+		MTU:          1500,
+		Flags:        net.FlagBroadcast | net.FlagMulticast,
+	}
+}
+
+// runVirtualProxy runs the proxy for cfg on the interfaces of n, like run
+// does on the interfaces of the host, until the test ends.
+func runVirtualProxy(t *testing.T, n *proxy.VirtualNetwork, cfg *config.Config) *runner {
+	t.Helper()
+	cfg.NoListen = true
+	state, err := setupPipelines(cfg, n)
+	if err != nil {
+		t.Fatalf("setupPipelines failed: %v", err)
+	}
+	return startVirtualProxy(t, n, cfg, state)
+}
+
+// startVirtualProxy runs the pipelines of state, set up by setupPipelines on
+// the interfaces of n, until the test ends.
+func startVirtualProxy(t *testing.T, n *proxy.VirtualNetwork, cfg *config.Config, state *proxyState) *runner {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRunner(ctx, n, cfg, state)
+	r.start()
+	events, unsubscribe := n.Subscribe()
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		r.watchInterfaces(ctx, events)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		unsubscribe()
+		<-watching
+		r.wg.Wait()
+	})
+	return r
+}
+
+// relay injects a packet from srcIP on src until it is sent on dst, and
+// returns what was sent.  Other packets sent on dst are skipped.
+func relay(t *testing.T, n *proxy.VirtualNetwork, src, dst string, srcIP net.IP) gopacket.Packet {
+	t.Helper()
+	data := buildControlTestPacket(t, srcIP).Raw
+	ctx, cancel := context.WithTimeout(context.Background(), virtualTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		if err := n.Inject(src, data); err != nil {
+			t.Fatalf("Inject failed: %v", err)
+		}
+		wait, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+		for {
+			out, err := n.Transmitted(wait, dst)
+			if err != nil {
+				break
+			}
+			pkt := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+			if ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok && ip.SrcIP.Equal(srcIP) {
+				stop()
+				return pkt
+			}
+		}
+		stop()
+	}
+	t.Fatalf("no packet from %s was relayed from %s to %s", srcIP, src, dst)
+	return nil
+}
+
+// waitForInterface waits until iname is running, or not.
+func waitForInterface(t *testing.T, r *runner, iname string, running bool) {
+	t.Helper()
+	deadline := time.Now().Add(virtualTimeout)
+	for time.Now().Before(deadline) {
+		if _, ok := r.current().ifaces[iname]; ok == running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s running=%v", iname, running)
+}
+
+func TestVirtualNetwork_Relays(t *testing.T) {
+	n := proxy.NewVirtualNetwork()
+	for _, iface := range []proxy.VirtualInterface{
+		virtualEthernet("eth0", 1, testAddress("10.0.0.1/24", "10.0.0.255")),
+		virtualEthernet("eth1", 2, testAddress("192.168.1.1/24", "192.168.1.255")),
+	} {
+		if err := n.Add(iface); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	r := runVirtualProxy(t, n, meshConfig("eth0", "eth1"))
+
+	pkt := relay(t, n, "eth0", "eth1", net.IP{10, 0, 0, 5})
+	eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if eth.SrcMAC.String() != "02:00:00:00:00:02" || eth.DstMAC.String() != "ff:ff:ff:ff:ff:ff" {
+		t.Errorf("expected a broadcast from the MAC of eth1, got %s -> %s", eth.SrcMAC, eth.DstMAC)
+	}
+	if !ip.DstIP.Equal(net.IP{192, 168, 1, 255}) {
+		t.Errorf("expected the broadcast address of eth1, got %s", ip.DstIP)
+	}
+	if !r.current().groups[0].registry.Has("10.0.0.5") {
+		t.Error("expected the client on eth0 to be learned")
+	}
+}
+
+func TestVirtualNetwork_InterfaceFlaps(t *testing.T) {
+	n := proxy.NewVirtualNetwork()
+	if err := n.Add(virtualEthernet("eth0", 1, testAddress("10.0.0.1/24", "10.0.0.255"))); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	eth1 := virtualEthernet("eth1", 2, testAddress("192.168.1.1/24", "192.168.1.255"))
+	r := runVirtualProxy(t, n, meshConfig("eth0", "eth1"))
+
+	// eth1 is pending until it shows up.
+	waitForInterface(t, r, "eth1", false)
+	if err := n.Add(eth1); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForInterface(t, r, "eth1", true)
+	relay(t, n, "eth0", "eth1", net.IP{10, 0, 0, 5})
+
+	// Interfaces which go down keep running and reconnect once up again.
+	for i, iname := range []string{"eth1", "eth0"} {
+		if err := n.SetUp(iname, false); err != nil {
+			t.Fatalf("SetUp failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := n.SetUp(iname, true); err != nil {
+			t.Fatalf("SetUp failed: %v", err)
+		}
+		relay(t, n, "eth0", "eth1", net.IP{10, 0, 0, byte(6 + i)})
+	}
+
+	// Deleted interfaces are detached and attached again when they return.
+	if err := n.Remove("eth1"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	waitForInterface(t, r, "eth1", false)
+	if err := n.Add(eth1); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForInterface(t, r, "eth1", true)
+	relay(t, n, "eth0", "eth1", net.IP{10, 0, 0, 8})
+}
+
+func TestVirtualNetwork_DeliverLocal(t *testing.T) {
+	n := proxy.NewVirtualNetwork()
+	lo := virtualEthernet("lo", 0, testAddress("127.0.0.1/8", ""))
+	lo.HardwareAddr, lo.Flags = nil, net.FlagLoopback
+	for _, iface := range []proxy.VirtualInterface{lo, virtualEthernet("eth0", 1, testAddress("10.0.0.1/24", "10.0.0.255"))} {
+		if err := n.Add(iface); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	cfg := meshConfig("eth0")
+	cfg.DeliverLocal = true
+	runVirtualProxy(t, n, cfg)
+
+	// The loopback interface has neither a broadcast address nor a MAC
+	// address, packets are sent to 127.0.0.1 from 00:00:00:00:00:00 instead.
+	pkt := relay(t, n, "eth0", "lo", net.IP{10, 0, 0, 5})
+	if eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); eth.SrcMAC.String() != "00:00:00:00:00:00" {
+		t.Errorf("expected the packet to be sent from 00:00:00:00:00:00, got %s", eth.SrcMAC)
+	}
+	if ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ip.DstIP.Equal(net.IP{127, 0, 0, 1}) {
+		t.Errorf("expected the packet to be sent to 127.0.0.1, got %s", ip.DstIP)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/config"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy/stages"
+)
+
+func TestVLANAddresses(t *testing.T) {
+	cfg := config.Default()
+	cfg.Interfaces = []config.InterfaceConfig{{Name: "eth0@vlan10", BroadcastSubnets: []string{"10.0.10.0/24", "172.16.0.0/12"}}}
+
+	addrs := vlanAddresses(cfg, "eth0@vlan10")
+	if len(addrs) != 2 {
+		t.Fatalf("expected an address per subnet, got %+v", addrs)
+	}
+	for i, want := range []string{"10.0.10.255", "172.31.255.255"} {
+		if !addrs[i].Broadaddr.Equal(net.ParseIP(want)) {
+			t.Errorf("expected broadcast address %s, got %s", want, addrs[i].Broadaddr)
+		}
+	}
+	if got := config.BuildBPFFilter([]int32{9003}, addrs); got != "(udp port 9003 or "+config.BPFFragmentFilter+") and (src net 10.0.10.0/24 or src net 172.16.0.0/12)" {
+		t.Errorf("unexpected filter %q", got)
+	}
+	if addrs := vlanAddresses(cfg, "eth0@vlan20"); addrs != nil {
+		t.Errorf("expected no addresses without broadcast-subnets, got %+v", addrs)
+	}
+}
+
+func TestNewCrossInterfaceRoute_VLAN(t *testing.T) {
+	origFactory := newTransmitterSink
+	defer func() {
+		newTransmitterSink = origFactory
+	}()
+	var device string
+	newTransmitterSink = func(_ proxy.DeviceManager, iname string) (*stages.TransmitterSink, error) {
+		device = iname
+		return &stages.TransmitterSink{
+			Writer: &integrationWriter{linkType: layers.LinkTypeEthernet},
+			Iname:  iname,
+		}, nil
+	}
+
+	registry, err := stages.NewRegistryProcessorByInterface(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	src := ifaceState{name: "eth0@vlan10", pipeline: proxy.NewPipeline(&testSource{name: "src:eth0@vlan10"})}
+	dst := ifaceState{
+		name:      "eth0@vlan20",
+		netif:     &net.Interface{HardwareAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5}},
+		broadcast: true,
+		bcastIPs:  []net.IP{{10, 0, 20, 255}},
+	}
+
+	route, err := newCrossInterfaceRoute(config.Default(), &proxy.HostDeviceManager{}, &relayGroup{registry: registry}, src, dst)
+	if err != nil {
+		t.Fatalf("newCrossInterfaceRoute failed: %v", err)
+	}
+	if device != "eth0" {
+		t.Fatalf("expected the transmitter on the trunk, got %q", device)
+	}
+	if route.VLAN != 20 || route.Iname != "eth0@vlan20" {
+		t.Fatalf("expected the route to tag VLAN 20 for eth0@vlan20, got %d for %s", route.VLAN, route.Iname)
+	}
+}
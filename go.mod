@@ -7,10 +7,28 @@ toolchain go1.26.3
 require (
 	github.com/alecthomas/kong v1.16.1
 	github.com/gopacket/gopacket v1.7.1
-	golang.org/x/net v0.55.0 // indirect; security
+	golang.org/x/net v0.55.0 // security
 )
 
-require golang.org/x/sys v0.45.0 // indirect
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/prometheus/client_golang v1.23.2
+	go.yaml.in/yaml/v3 v3.0.4
+	golang.org/x/sys v0.45.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.66.1 // indirect
+	github.com/prometheus/procfs v0.16.1 // indirect
+	go.yaml.in/yaml/v2 v2.4.2 // indirect
+	google.golang.org/protobuf v1.36.8 // indirect
+)
 
 // see: https://github.com/sirupsen/logrus/issues/1275
 // require golang.org/x/sys v0.0.0-20210817190340-bfb29a6856f2 // indirect
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// ACL rule actions.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule allows or denies the packets matching all of its conditions.  Rules
+// without OutInterfaces are applied when packets are captured, before clients
+// are learned.  Rules with OutInterfaces are applied when packets are relayed
+// to one of those interfaces.  The first matching rule wins and packets
+// matching no rule are allowed.
+type ACLRule struct {
+	Action string `yaml:"action" toml:"action"`
+	// Interfaces the packets were captured on, may contain patterns.
+	Interfaces []string `yaml:"interfaces" toml:"interfaces"`
+	// OutInterfaces the packets are relayed to, may contain patterns.
+	OutInterfaces []string `yaml:"out-interfaces" toml:"out-interfaces"`
+	SrcNets       []string `yaml:"src-nets" toml:"src-nets"`
+	SrcMACs       []string `yaml:"src-macs" toml:"src-macs"`
+	SrcPorts      []int32  `yaml:"src-ports" toml:"src-ports"`
+	DstPorts      []int32  `yaml:"dst-ports" toml:"dst-ports"`
+}
+
+func (c *Config) validateACL() []error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for i, rule := range c.ACL {
+		prefix := fmt.Sprintf("acl[%d]", i)
+		if rule.Action != ACLAllow && rule.Action != ACLDeny {
+			addErr("%s.action: must be one of [%s|%s], got %q", prefix, ACLAllow, ACLDeny, rule.Action)
+		}
+		for j, pattern := range rule.Interfaces {
+			if err := validatePattern(fmt.Sprintf("%s.interfaces[%d]", prefix, j), pattern); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for j, pattern := range rule.OutInterfaces {
+			if err := validatePattern(fmt.Sprintf("%s.out-interfaces[%d]", prefix, j), pattern); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for j, subnet := range rule.SrcNets {
+			if parseNet(subnet) == nil {
+				addErr("%s.src-nets[%d]: invalid IP address or subnet %q", prefix, j, subnet)
+			}
+		}
+		if len(rule.SrcMACs) > 0 && len(rule.OutInterfaces) > 0 {
+			// The source MAC is ours once the packet has been rewritten.
+			addErr("%s.src-macs: not supported with out-interfaces", prefix)
+		}
+		for j, mac := range rule.SrcMACs {
+			if hw, err := net.ParseMAC(mac); err != nil || len(hw) != 6 {
+				addErr("%s.src-macs[%d]: invalid MAC address %q", prefix, j, mac)
+			}
+		}
+		errs = append(errs, validatePorts(prefix+".src-ports", rule.SrcPorts)...)
+		errs = append(errs, validatePorts(prefix+".dst-ports", rule.DstPorts)...)
+	}
+	return errs
+}
+
+// parseNet parses a subnet in CIDR notation or a single IP address.
+func parseNet(subnet string) *net.IPNet {
+	if strings.Contains(subnet, "/") {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil
+		}
+		return n
+	}
+	ip := net.ParseIP(subnet)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Allow reports whether the rule allows the packets it matches.
+func (r ACLRule) Allow() bool {
+	return r.Action == ACLAllow
+}
+
+// Networks returns the parsed src-nets.  Invalid entries are skipped; they are
+// reported by Validate.
+func (r ACLRule) Networks() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, subnet := range r.SrcNets {
+		if n := parseNet(subnet); n != nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// HardwareAddrs returns the parsed src-macs.  Invalid entries are skipped;
+// they are reported by Validate.
+func (r ACLRule) HardwareAddrs() []net.HardwareAddr {
+	var macs []net.HardwareAddr
+	for _, mac := range r.SrcMACs {
+		if hw, err := net.ParseMAC(mac); err == nil && len(hw) == 6 {
+			macs = append(macs, hw)
+		}
+	}
+	return macs
+}
+
+// MatchesInterface reports whether the rule applies to packets captured on
+// iname.
+func (r ACLRule) MatchesInterface(iname string) bool {
+	return len(r.Interfaces) == 0 || matchesAny(r.Interfaces, iname)
+}
+
+// IngressACLFor returns the rules applied to the packets captured on iname.
+// Every ingress rule may apply to the any pseudo-interface, which captures
+// the packets of all the others.
+func (c *Config) IngressACLFor(iname string) []ACLRule {
+	var rules []ACLRule
+	for _, rule := range c.ACL {
+		if len(rule.OutInterfaces) == 0 && (iname == proxy.AnyInterface || rule.MatchesInterface(iname)) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// EgressACLFor returns the rules applied to the packets relayed from src to
+// dst.
+func (c *Config) EgressACLFor(src, dst string) []ACLRule {
+	var rules []ACLRule
+	for _, rule := range c.ACL {
+		if matchesAny(rule.OutInterfaces, dst) && rule.MatchesInterface(src) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func matchesAny(patterns []string, iname string) bool {
+	for _, pattern := range patterns {
+		if matchInterface(pattern, iname) {
+			return true
+		}
+	}
+	return false
+}
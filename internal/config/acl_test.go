@@ -0,0 +1,51 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACLFor(t *testing.T) {
+	cfg := Default()
+	cfg.ACL = []ACLRule{
+		{Action: ACLDeny, Interfaces: []string{"eth0@vlan20"}},
+		{Action: ACLDeny, SrcNets: []string{"10.0.20.0/24"}},
+		{Action: ACLDeny, Interfaces: []string{"eth0@*"}, OutInterfaces: []string{"eth1"}},
+		{Action: ACLAllow, OutInterfaces: []string{"/eth[0-9]/"}},
+	}
+
+	for _, tt := range []struct {
+		iname string
+		want  int
+	}{{"eth0@vlan20", 2}, {"eth1", 1}, {"any", 2}} {
+		if got := cfg.IngressACLFor(tt.iname); len(got) != tt.want {
+			t.Errorf("IngressACLFor(%q) returned %d rules, want %d", tt.iname, len(got), tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		src, dst string
+		want     int
+	}{{"eth0@vlan20", "eth1", 2}, {"eth2", "eth1", 1}, {"eth1", "eth0@vlan20", 0}} {
+		if got := cfg.EgressACLFor(tt.src, tt.dst); len(got) != tt.want {
+			t.Errorf("EgressACLFor(%q, %q) returned %d rules, want %d", tt.src, tt.dst, len(got), tt.want)
+		}
+	}
+}
+
+func TestACLRule_Networks(t *testing.T) {
+	rule := ACLRule{SrcNets: []string{"10.0.20.0/24", "10.0.10.5", "fd00::1", "bogus"}}
+	nets := rule.Networks()
+	if len(nets) != 3 {
+		t.Fatalf("Networks() returned %d networks, want 3", len(nets))
+	}
+	if !nets[0].Contains(net.ParseIP("10.0.20.7")) {
+		t.Errorf("%v does not contain 10.0.20.7", nets[0])
+	}
+	if !nets[1].Contains(net.ParseIP("10.0.10.5")) || nets[1].Contains(net.ParseIP("10.0.10.6")) {
+		t.Errorf("%v is not the single address 10.0.10.5", nets[1])
+	}
+	if !nets[2].Contains(net.ParseIP("fd00::1")) || nets[2].Contains(net.ParseIP("fd00::2")) {
+		t.Errorf("%v is not the single address fd00::1", nets[2])
+	}
+}
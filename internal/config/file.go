@@ -0,0 +1,551 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"go.yaml.in/yaml/v3"
+)
+
+// Default values used when neither the config file nor the CLI set a value.
+const (
+	DefaultTimeout         int64 = 250
+	DefaultCacheTTL        int64 = 180
+	DefaultLevel                 = "info"
+	DefaultLogfile               = "stderr"
+	DefaultPcapPath              = "/root"
+	DefaultStateInterval   int64 = 60
+	DefaultShutdownTimeout int64 = 5
+)
+
+// LogLevels is the list of valid values for Config.Level.
+var LogLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+// Config is the declarative description of which interfaces and ports
+// udp-proxy-2020 relays between.  It can be loaded from a YAML or TOML
+// file and mirrors the command line flags, with optional per-interface
+// overrides.
+type Config struct {
+	Interfaces        []InterfaceConfig `yaml:"interfaces" toml:"interfaces"`
+	ExcludeInterfaces []string          `yaml:"exclude-interfaces" toml:"exclude-interfaces"`
+	Groups            []GroupConfig     `yaml:"groups" toml:"groups"`
+	ACL               []ACLRule         `yaml:"acl" toml:"acl"`
+	RateLimits        []RateLimitConfig `yaml:"rate-limits" toml:"rate-limits"`
+	Ports             []int32           `yaml:"ports" toml:"ports"`
+	FixedIPs          []string          `yaml:"fixed-ip" toml:"fixed-ip"`
+	Timeout           int64             `yaml:"timeout" toml:"timeout"`
+	CacheTTL          int64             `yaml:"cache-ttl" toml:"cache-ttl"`
+	DeliverLocal      bool              `yaml:"deliver-local" toml:"deliver-local"`
+	NoListen          bool              `yaml:"no-listen" toml:"no-listen"`
+	Capture           string            `yaml:"capture" toml:"capture"`
+	Decode            bool              `yaml:"decode" toml:"decode"`
+	Pcap              bool              `yaml:"pcap" toml:"pcap"`
+	PcapPath          string            `yaml:"pcap-path" toml:"pcap-path"`
+	Multicast         bool              `yaml:"multicast" toml:"multicast"`
+	MulticastTTL      int               `yaml:"multicast-ttl" toml:"multicast-ttl"`
+	MulticastJoin     []string          `yaml:"multicast-join" toml:"multicast-join"`
+	DedupWindow       int64             `yaml:"dedup-window" toml:"dedup-window"`
+	MetricsListen     string            `yaml:"metrics-listen" toml:"metrics-listen"`
+	ControlSocket     string            `yaml:"control-socket" toml:"control-socket"`
+	StateFile         string            `yaml:"state-file" toml:"state-file"`
+	StateInterval     int64             `yaml:"state-interval" toml:"state-interval"`
+	ShutdownTimeout   int64             `yaml:"shutdown-timeout" toml:"shutdown-timeout"`
+	Level             string            `yaml:"level" toml:"level"`
+	Logfile           string            `yaml:"logfile" toml:"logfile"`
+	LogLines          bool              `yaml:"log-lines" toml:"log-lines"`
+
+	// source is the config with interface patterns this one was expanded
+	// from, see Expand.
+	source *Config
+}
+
+// InterfaceConfig describes a single interface, or every interface matching a
+// pattern, and any settings which override the global values for it.
+type InterfaceConfig struct {
+	Name     string   `yaml:"name" toml:"name"`
+	FixedIPs []string `yaml:"fixed-ips" toml:"fixed-ips"`
+	Timeout  int64    `yaml:"timeout" toml:"timeout"`
+	Promisc  *bool    `yaml:"promisc" toml:"promisc"`
+	Decode   *bool    `yaml:"decode" toml:"decode"`
+	Pcap     *bool    `yaml:"pcap" toml:"pcap"`
+	// BroadcastSubnets limits the subnets which get a copy of broadcasts
+	// on an interface with several IPv4 addresses; empty means all of them.
+	BroadcastSubnets []string `yaml:"broadcast-subnets" toml:"broadcast-subnets"`
+}
+
+// GroupConfig describes a relay group: a set of UDP ports which are relayed
+// only between the listed interfaces.  Each group has its own client
+// registry.  Interfaces may contain patterns; interfaces matching a pattern
+// are left out if they also match Exclude.
+type GroupConfig struct {
+	Name       string   `yaml:"name" toml:"name"`
+	Ports      []int32  `yaml:"ports" toml:"ports"`
+	Interfaces []string `yaml:"interfaces" toml:"interfaces"`
+	Exclude    []string `yaml:"exclude" toml:"exclude"`
+}
+
+// Default returns a Config populated with the default values.
+func Default() *Config {
+	return &Config{
+		Timeout:         DefaultTimeout,
+		CacheTTL:        DefaultCacheTTL,
+		PcapPath:        DefaultPcapPath,
+		Level:           DefaultLevel,
+		Logfile:         DefaultLogfile,
+		StateInterval:   DefaultStateInterval,
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// Load reads a YAML or TOML config file on top of the default values.  Files
+// ending in .toml are parsed as TOML, everything else as YAML.  Unknown keys
+// are an error.  The result is not validated so callers may apply overrides
+// before calling Validate.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	cfg := Default()
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = decodeTOML(data, cfg)
+	} else {
+		err = decodeYAML(data, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func decodeYAML(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func decodeTOML(data []byte, cfg *Config) error {
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// Validate checks the config for errors and returns all of them joined
+// together, each prefixed by the path of the offending key.
+func (c *Config) Validate() error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Groups) == 0 {
+		names := make([]string, len(c.Interfaces))
+		for i, iface := range c.Interfaces {
+			names[i] = iface.Name
+		}
+		if len(c.Interfaces) < 2 && !hasPattern(names) {
+			addErr("interfaces: two or more interfaces are required, got %d", len(c.Interfaces))
+		}
+		if len(c.Ports) < 1 {
+			addErr("ports: one or more ports are required")
+		}
+		errs = append(errs, validatePorts("ports", c.Ports)...)
+	} else {
+		if len(c.Ports) > 0 {
+			addErr("ports: must not be set when groups are defined, move them into a group")
+		}
+		errs = append(errs, c.validateGroups()...)
+	}
+
+	seen := make(map[string]int, len(c.Interfaces))
+	for i, iface := range c.Interfaces {
+		if iface.Name == "" {
+			addErr("interfaces[%d].name: must not be empty", i)
+			continue
+		}
+		if first, ok := seen[iface.Name]; ok {
+			addErr("interfaces[%d].name: duplicate interface %q (first defined at interfaces[%d])", i, iface.Name, first)
+			continue
+		}
+		seen[iface.Name] = i
+		if err := validateInterfaceName(fmt.Sprintf("interfaces[%d].name", i), iface.Name); err != nil {
+			errs = append(errs, err)
+		}
+		if IsInterfacePattern(iface.Name) && len(iface.FixedIPs) > 0 {
+			addErr("interfaces[%d].fixed-ips: not supported for interface pattern %q", i, iface.Name)
+		}
+		if len(c.Groups) > 0 && !c.inAnyGroup(iface.Name) {
+			addErr("interfaces[%d].name: interface %q is not a member of any group", i, iface.Name)
+		}
+		if iface.Timeout < 0 {
+			addErr("interfaces[%d].timeout: must not be negative, got %d", i, iface.Timeout)
+		}
+		for j, ip := range iface.FixedIPs {
+			if net.ParseIP(ip) == nil {
+				addErr("interfaces[%d].fixed-ips[%d]: invalid IP address %q", i, j, ip)
+			}
+		}
+		for j, subnet := range iface.BroadcastSubnets {
+			if ip, _, err := net.ParseCIDR(subnet); err != nil || ip.To4() == nil {
+				addErr("interfaces[%d].broadcast-subnets[%d]: invalid IPv4 subnet %q", i, j, subnet)
+			}
+		}
+	}
+
+	errs = append(errs, c.validateACL()...)
+	errs = append(errs, c.validateRateLimits()...)
+
+	for i, pattern := range c.ExcludeInterfaces {
+		if err := validatePattern(fmt.Sprintf("exclude-interfaces[%d]", i), pattern); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i, f := range c.FixedIPs {
+		if iname, _, err := ParseFixedIP(f); err != nil {
+			addErr("fixed-ip[%d]: %w", i, err)
+		} else if IsInterfacePattern(iname) {
+			addErr("fixed-ip[%d]: interface must not be a pattern, got %q", i, iname)
+		}
+	}
+
+	if c.MulticastTTL < 0 || c.MulticastTTL > 255 {
+		addErr("multicast-ttl: must be between 0 and 255, got %d", c.MulticastTTL)
+	}
+	if len(c.MulticastJoin) > 0 && !c.Multicast {
+		addErr("multicast-join: requires multicast to be enabled")
+	}
+	for i, group := range c.MulticastJoin {
+		if ip := net.ParseIP(group); ip == nil || ip.To4() == nil || !ip.IsMulticast() {
+			addErr("multicast-join[%d]: %q is not an IPv4 multicast group", i, group)
+		}
+	}
+
+	if c.DedupWindow < 0 {
+		addErr("dedup-window: must not be negative, got %d", c.DedupWindow)
+	}
+
+	if c.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsListen); err != nil {
+			addErr("metrics-listen: invalid address %q, expected [host]:port", c.MetricsListen)
+		}
+	}
+
+	if c.StateFile != "" && c.StateInterval <= 0 {
+		addErr("state-interval: must be a positive number of seconds, got %d", c.StateInterval)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		addErr("shutdown-timeout: must be a positive number of seconds, got %d", c.ShutdownTimeout)
+	}
+
+	if c.Timeout <= 0 {
+		addErr("timeout: must be a positive number of msec, got %d", c.Timeout)
+	}
+	if c.CacheTTL <= 0 {
+		addErr("cache-ttl: must be a positive number of minutes, got %d", c.CacheTTL)
+	}
+
+	if c.Capture != "" && !slices.Contains(proxy.CaptureBackends, c.Capture) {
+		addErr("capture: must be one of [%s], got %q", strings.Join(proxy.CaptureBackends, "|"), c.Capture)
+	}
+
+	validLevel := false
+	for _, l := range LogLevels {
+		if c.Level == l {
+			validLevel = true
+			break
+		}
+	}
+	if !validLevel {
+		addErr("level: must be one of [%s], got %q", strings.Join(LogLevels, "|"), c.Level)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateGroups() []error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	type portOwner struct {
+		group string
+		index int
+	}
+	owners := make(map[string]portOwner)
+	names := make(map[string]int, len(c.Groups))
+	for i, g := range c.Groups {
+		prefix := fmt.Sprintf("groups[%d]", i)
+		if g.Name == "" {
+			addErr("%s.name: must not be empty", prefix)
+		} else if first, ok := names[g.Name]; ok {
+			addErr("%s.name: duplicate group %q (first defined at groups[%d])", prefix, g.Name, first)
+		} else {
+			names[g.Name] = i
+		}
+
+		if len(g.Ports) < 1 {
+			addErr("%s.ports: one or more ports are required", prefix)
+		}
+		errs = append(errs, validatePorts(prefix+".ports", g.Ports)...)
+
+		if len(g.Interfaces) < 2 && !hasPattern(g.Interfaces) {
+			addErr("%s.interfaces: two or more interfaces are required, got %d", prefix, len(g.Interfaces))
+		}
+		members := make(map[string]bool, len(g.Interfaces))
+		for j, iname := range g.Interfaces {
+			if iname == "" {
+				addErr("%s.interfaces[%d]: must not be empty", prefix, j)
+				continue
+			}
+			if members[iname] {
+				addErr("%s.interfaces[%d]: duplicate interface %q", prefix, j, iname)
+				continue
+			}
+			members[iname] = true
+			if err := validateInterfaceName(fmt.Sprintf("%s.interfaces[%d]", prefix, j), iname); err != nil {
+				errs = append(errs, err)
+			}
+			if IsInterfacePattern(iname) {
+				// Checked for port conflicts by Expand.
+				continue
+			}
+
+			// A packet may only belong to a single group, otherwise it
+			// would be relayed (and learned) once per group.  It belongs
+			// to the group relaying its destination port on the interface,
+			// or failing that its source port.
+			for _, port := range g.Ports {
+				key := fmt.Sprintf("%s/%d", iname, port)
+				if owner, ok := owners[key]; ok && owner.index != i {
+					addErr("%s.interfaces[%d]: udp/%d on %q is already relayed by group %q", prefix, j, port, iname, owner.group)
+					continue
+				}
+				owners[key] = portOwner{group: g.Name, index: i}
+			}
+		}
+		for j, pattern := range g.Exclude {
+			if err := validatePattern(fmt.Sprintf("%s.exclude[%d]", prefix, j), pattern); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+func validatePorts(prefix string, ports []int32) []error {
+	var errs []error
+	for i, port := range ports {
+		if port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("%s[%d]: %d is not a valid UDP port", prefix, i, port))
+		}
+	}
+	return errs
+}
+
+func (c *Config) inAnyGroup(iname string) bool {
+	for _, g := range c.Groups {
+		for _, member := range g.Interfaces {
+			// Either may be a pattern.
+			if matchInterface(member, iname) || matchInterface(iname, member) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseFixedIP splits an interface@ip string into its interface and IP.
+func ParseFixedIP(value string) (string, net.IP, error) {
+	// Split at the last @ for logical VLAN interfaces like eth0@vlan10.
+	i := strings.LastIndex(value, "@")
+	if i <= 0 || (strings.Contains(value[:i], "@") && !proxy.IsVLANInterfaceName(value[:i])) {
+		return "", nil, fmt.Errorf("invalid fixed IP format %q, expected interface@ip", value)
+	}
+	iname, ipStr := value[:i], value[i+1:]
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid fixed IP address %q", ipStr)
+	}
+	return iname, ip, nil
+}
+
+// RelayGroups returns the relay groups to run.  When no groups are
+// configured, a single unnamed group relays the top level ports between all
+// of the top level interfaces.
+func (c *Config) RelayGroups() []GroupConfig {
+	if len(c.Groups) > 0 {
+		return c.Groups
+	}
+	names := make([]string, len(c.Interfaces))
+	for i, iface := range c.Interfaces {
+		names[i] = iface.Name
+	}
+	return []GroupConfig{{Ports: c.Ports, Interfaces: names}}
+}
+
+// InterfaceNames returns the names of all interfaces used by any relay group,
+// in the order they are first referenced.
+func (c *Config) InterfaceNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, g := range c.RelayGroups() {
+		for _, iname := range g.Interfaces {
+			if !seen[iname] {
+				seen[iname] = true
+				names = append(names, iname)
+			}
+		}
+	}
+	return names
+}
+
+// HasInterface reports whether the named interface is used by any relay group.
+func (c *Config) HasInterface(iname string) bool {
+	for _, name := range c.InterfaceNames() {
+		if name == iname {
+			return true
+		}
+	}
+	return false
+}
+
+// PortsFor returns every port relayed on the given interface across all
+// relay groups.
+func (c *Config) PortsFor(iname string) []int32 {
+	var ports []int32
+	seen := make(map[int32]bool)
+	for _, g := range c.RelayGroups() {
+		for _, member := range g.Interfaces {
+			if member != iname {
+				continue
+			}
+			for _, port := range g.Ports {
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+	return ports
+}
+
+// Interface returns the config for the named interface or nil if the
+// interface is not configured.
+func (c *Config) Interface(iname string) *InterfaceConfig {
+	for i := range c.Interfaces {
+		if c.Interfaces[i].Name == iname {
+			return &c.Interfaces[i]
+		}
+	}
+	return nil
+}
+
+// MulticastGroups returns the parsed multicast-join groups.  Invalid entries
+// are skipped; they are reported by Validate.
+func (c *Config) MulticastGroups() []net.IP {
+	var groups []net.IP
+	for _, group := range c.MulticastJoin {
+		if ip := net.ParseIP(group); ip != nil && ip.To4() != nil && ip.IsMulticast() {
+			groups = append(groups, ip)
+		}
+	}
+	return groups
+}
+
+// CacheTTLDuration returns the client cache TTL.
+func (c *Config) CacheTTLDuration() time.Duration {
+	return time.Duration(c.CacheTTL) * time.Minute
+}
+
+// StateIntervalDuration returns how often the state file is saved.
+func (c *Config) StateIntervalDuration() time.Duration {
+	return time.Duration(c.StateInterval) * time.Second
+}
+
+// ShutdownTimeoutDuration returns how long to wait for the pipelines to stop
+// on shutdown.
+func (c *Config) ShutdownTimeoutDuration() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+// DedupWindowDuration returns the duplicate suppression window, zero when
+// duplicate suppression is disabled.
+func (c *Config) DedupWindowDuration() time.Duration {
+	return ParseTimeout(c.DedupWindow)
+}
+
+// TimeoutFor returns the pcap timeout for the given interface.
+func (c *Config) TimeoutFor(iname string) time.Duration {
+	if iface := c.Interface(iname); iface != nil && iface.Timeout > 0 {
+		return ParseTimeout(iface.Timeout)
+	}
+	return ParseTimeout(c.Timeout)
+}
+
+// PromiscFor returns whether the given interface should be opened in
+// promiscuous mode, falling back to def when there is no override.
+func (c *Config) PromiscFor(iname string, def bool) bool {
+	if iface := c.Interface(iname); iface != nil && iface.Promisc != nil {
+		return *iface.Promisc
+	}
+	return def
+}
+
+// DecodeFor returns whether packet decodes are enabled for the given interface.
+func (c *Config) DecodeFor(iname string) bool {
+	if iface := c.Interface(iname); iface != nil && iface.Decode != nil {
+		return *iface.Decode
+	}
+	return c.Decode
+}
+
+// BroadcastSubnetsFor returns the subnets of the given interface which get a
+// copy of broadcasts, or nil for all of them.
+func (c *Config) BroadcastSubnetsFor(iname string) []*net.IPNet {
+	iface := c.Interface(iname)
+	if iface == nil {
+		return nil
+	}
+	var subnets []*net.IPNet
+	for _, subnet := range iface.BroadcastSubnets {
+		if _, n, err := net.ParseCIDR(subnet); err == nil {
+			subnets = append(subnets, n)
+		}
+	}
+	return subnets
+}
+
+// PcapFor returns whether debug pcap files are enabled for the given interface.
+func (c *Config) PcapFor(iname string) bool {
+	if iface := c.Interface(iname); iface != nil && iface.Pcap != nil {
+		return *iface.Pcap
+	}
+	return c.Pcap
+}
@@ -0,0 +1,462 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoad_YAML(t *testing.T) {
+	path := writeConfigFile(t, "udp-proxy-2020.yaml", `
+interfaces:
+  - name: eth0
+  - name: tun0
+    fixed-ips: [10.8.0.2]
+    timeout: 500
+    promisc: false
+    decode: true
+ports: [9003, 9100]
+cache-ttl: 300
+pcap-path: /tmp
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	if got := cfg.InterfaceNames(); len(got) != 2 || got[0] != "eth0" || got[1] != "tun0" {
+		t.Fatalf("unexpected interfaces: %v", got)
+	}
+	if len(cfg.Ports) != 2 || cfg.Ports[1] != 9100 {
+		t.Fatalf("unexpected ports: %v", cfg.Ports)
+	}
+	if cfg.CacheTTLDuration() != 300*time.Minute {
+		t.Errorf("unexpected cache ttl: %v", cfg.CacheTTLDuration())
+	}
+	if cfg.Level != DefaultLevel || cfg.Timeout != DefaultTimeout {
+		t.Errorf("expected defaults for unset keys, got level=%q timeout=%d", cfg.Level, cfg.Timeout)
+	}
+
+	if got := cfg.TimeoutFor("tun0"); got != 500*time.Millisecond {
+		t.Errorf("TimeoutFor(tun0) = %v, want 500ms", got)
+	}
+	if got := cfg.TimeoutFor("eth0"); got != 250*time.Millisecond {
+		t.Errorf("TimeoutFor(eth0) = %v, want 250ms", got)
+	}
+	if cfg.PromiscFor("tun0", true) {
+		t.Error("expected promisc override to disable promisc on tun0")
+	}
+	if !cfg.PromiscFor("eth0", true) {
+		t.Error("expected promisc default to be used on eth0")
+	}
+	if !cfg.DecodeFor("tun0") || cfg.DecodeFor("eth0") {
+		t.Error("expected decode only on tun0")
+	}
+	if iface := cfg.Interface("tun0"); iface == nil || len(iface.FixedIPs) != 1 {
+		t.Fatalf("expected one fixed IP on tun0, got %+v", iface)
+	}
+}
+
+func TestLoad_TOML(t *testing.T) {
+	path := writeConfigFile(t, "udp-proxy-2020.toml", `
+ports = [9003]
+level = "debug"
+fixed-ip = ["tun0@10.8.0.2"]
+
+[[interfaces]]
+name = "eth0"
+pcap = true
+
+[[interfaces]]
+name = "tun0"
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if cfg.Level != "debug" {
+		t.Errorf("unexpected level: %s", cfg.Level)
+	}
+	if !cfg.PcapFor("eth0") || cfg.PcapFor("tun0") {
+		t.Error("expected pcap only on eth0")
+	}
+	if len(cfg.FixedIPs) != 1 || cfg.FixedIPs[0] != "tun0@10.8.0.2" {
+		t.Errorf("unexpected fixed-ip: %v", cfg.FixedIPs)
+	}
+}
+
+func TestLoad_UnknownKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{name: "config.yaml", contents: "ports: [9003]\nprots: [9004]\n"},
+		{name: "config.toml", contents: "ports = [9003]\nprots = [9004]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfigFile(t, tt.name, tt.contents))
+			if err == nil {
+				t.Fatal("expected error for unknown key")
+			}
+			if !strings.Contains(err.Error(), "prots") {
+				t.Errorf("expected error to name the unknown key, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := Default()
+		cfg.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "eth1"}}
+		cfg.Ports = []int32{9003}
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr []string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{
+			name:    "too few interfaces",
+			modify:  func(c *Config) { c.Interfaces = c.Interfaces[:1] },
+			wantErr: []string{"interfaces: two or more interfaces are required, got 1"},
+		},
+		{
+			name:    "duplicate interface",
+			modify:  func(c *Config) { c.Interfaces = append(c.Interfaces, InterfaceConfig{Name: "eth0"}) },
+			wantErr: []string{`interfaces[2].name: duplicate interface "eth0" (first defined at interfaces[0])`},
+		},
+		{
+			name:    "empty interface name",
+			modify:  func(c *Config) { c.Interfaces[1].Name = "" },
+			wantErr: []string{"interfaces[1].name: must not be empty"},
+		},
+		{
+			name:    "bad per-interface fixed ip",
+			modify:  func(c *Config) { c.Interfaces[1].FixedIPs = []string{"10.0.0.1", "10.0.0.x"} },
+			wantErr: []string{`interfaces[1].fixed-ips[1]: invalid IP address "10.0.0.x"`},
+		},
+		{
+			name:    "bad broadcast subnet",
+			modify:  func(c *Config) { c.Interfaces[0].BroadcastSubnets = []string{"10.0.0.0/24", "10.0.1.255", "fd00::/64"} },
+			wantErr: []string{`interfaces[0].broadcast-subnets[1]: invalid IPv4 subnet "10.0.1.255"`, `interfaces[0].broadcast-subnets[2]: invalid IPv4 subnet "fd00::/64"`},
+		},
+		{
+			name: "valid acl",
+			modify: func(c *Config) {
+				c.ACL = []ACLRule{
+					{Action: ACLDeny, Interfaces: []string{"eth0*"}, SrcNets: []string{"10.0.20.0/24", "fd00::1"}, SrcMACs: []string{"02:00:00:00:20:01"}},
+					{Action: ACLAllow, OutInterfaces: []string{"eth1"}, SrcPorts: []int32{9003}, DstPorts: []int32{9003}},
+				}
+			},
+		},
+		{
+			name: "bad acl",
+			modify: func(c *Config) {
+				c.ACL = []ACLRule{
+					{Action: "drop", SrcNets: []string{"10.0.20.0/33"}, SrcMACs: []string{"02:00"}, DstPorts: []int32{0}},
+					{Action: ACLDeny, OutInterfaces: []string{"/(/"}, SrcMACs: []string{"02:00:00:00:20:01"}},
+				}
+			},
+			wantErr: []string{
+				`acl[0].action: must be one of [allow|deny], got "drop"`,
+				`acl[0].src-nets[0]: invalid IP address or subnet "10.0.20.0/33"`,
+				`acl[0].src-macs[0]: invalid MAC address "02:00"`,
+				"acl[0].dst-ports[0]: 0 is not a valid UDP port",
+				`acl[1].out-interfaces[0]: invalid interface pattern "/(/"`,
+				"acl[1].src-macs: not supported with out-interfaces",
+			},
+		},
+		{
+			name: "valid rate limits",
+			modify: func(c *Config) {
+				c.RateLimits = []RateLimitConfig{
+					{Per: RateLimitPerSource, Rate: 10, Burst: 20},
+					{Ports: []int32{1900}, Per: RateLimitPerEgress, Rate: 0.5},
+				}
+			},
+		},
+		{
+			name: "bad rate limits",
+			modify: func(c *Config) {
+				c.RateLimits = []RateLimitConfig{{Ports: []int32{70000}, Per: "group", Rate: 0, Burst: -1}}
+			},
+			wantErr: []string{
+				`rate-limits[0].per: must be one of [source|interface|egress], got "group"`,
+				"rate-limits[0].rate: must be a positive number of packets per second, got 0",
+				"rate-limits[0].burst: must not be negative, got -1",
+				"rate-limits[0].ports[0]: 70000 is not a valid UDP port",
+			},
+		},
+		{
+			name:    "bad fixed-ip format",
+			modify:  func(c *Config) { c.FixedIPs = []string{"eth0-10.0.0.1"} },
+			wantErr: []string{`fixed-ip[0]: invalid fixed IP format "eth0-10.0.0.1", expected interface@ip`},
+		},
+		{
+			name:    "bad port",
+			modify:  func(c *Config) { c.Ports = []int32{9003, 70000} },
+			wantErr: []string{"ports[1]: 70000 is not a valid UDP port"},
+		},
+		{
+			name: "valid multicast",
+			modify: func(c *Config) {
+				c.Multicast = true
+				c.MulticastTTL = 4
+				c.MulticastJoin = []string{"239.255.255.250", "224.0.0.251"}
+			},
+		},
+		{
+			name: "bad multicast",
+			modify: func(c *Config) {
+				c.MulticastTTL = 256
+				c.MulticastJoin = []string{"239.255.255.250", "10.0.0.1"}
+			},
+			wantErr: []string{
+				"multicast-ttl: must be between 0 and 255, got 256",
+				"multicast-join: requires multicast to be enabled",
+				`multicast-join[1]: "10.0.0.1" is not an IPv4 multicast group`,
+			},
+		},
+		{
+			name:    "negative dedup window",
+			modify:  func(c *Config) { c.DedupWindow = -1 },
+			wantErr: []string{"dedup-window: must not be negative, got -1"},
+		},
+		{
+			name:    "bad metrics-listen",
+			modify:  func(c *Config) { c.MetricsListen = "9090" },
+			wantErr: []string{`metrics-listen: invalid address "9090", expected [host]:port`},
+		},
+		{
+			name: "bad state-interval",
+			modify: func(c *Config) {
+				c.StateFile = "/var/lib/udp-proxy-2020/state.json"
+				c.StateInterval = 0
+			},
+			wantErr: []string{"state-interval: must be a positive number of seconds, got 0"},
+		},
+		{
+			name:    "bad shutdown-timeout",
+			modify:  func(c *Config) { c.ShutdownTimeout = -1 },
+			wantErr: []string{"shutdown-timeout: must be a positive number of seconds, got -1"},
+		},
+		{
+			name:    "bad capture",
+			modify:  func(c *Config) { c.Capture = "netmap" },
+			wantErr: []string{`capture: must be one of [libpcap|afpacket], got "netmap"`},
+		},
+		{
+			name: "multiple errors",
+			modify: func(c *Config) {
+				c.Ports = nil
+				c.CacheTTL = 0
+				c.Level = "verbose"
+			},
+			wantErr: []string{
+				"ports: one or more ports are required",
+				"cache-ttl: must be a positive number of minutes, got 0",
+				`level: must be one of [trace|debug|info|warn|error], got "verbose"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to contain %q, got:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad_Groups(t *testing.T) {
+	path := writeConfigFile(t, "udp-proxy-2020.yaml", `
+interfaces:
+  - name: tun0
+    fixed-ips: [10.8.0.2]
+groups:
+  - name: roon
+    ports: [9003]
+    interfaces: [eth0, vlan20, tun0]
+  - name: ssdp
+    ports: [1900]
+    interfaces: [eth0, vlan30]
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	groups := cfg.RelayGroups()
+	if len(groups) != 2 || groups[0].Name != "roon" || groups[1].Name != "ssdp" {
+		t.Fatalf("unexpected groups: %+v", groups)
+	}
+	want := []string{"eth0", "vlan20", "tun0", "vlan30"}
+	got := cfg.InterfaceNames()
+	if len(got) != len(want) {
+		t.Fatalf("InterfaceNames() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("InterfaceNames() = %v, want %v", got, want)
+		}
+	}
+	if ports := cfg.PortsFor("eth0"); len(ports) != 2 || ports[0] != 9003 || ports[1] != 1900 {
+		t.Errorf("PortsFor(eth0) = %v", ports)
+	}
+	if ports := cfg.PortsFor("vlan30"); len(ports) != 1 || ports[0] != 1900 {
+		t.Errorf("PortsFor(vlan30) = %v", ports)
+	}
+	if !cfg.HasInterface("vlan30") || cfg.HasInterface("eth9") {
+		t.Error("unexpected HasInterface result")
+	}
+}
+
+func TestRelayGroups_Implicit(t *testing.T) {
+	cfg := Default()
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "eth1"}}
+	cfg.Ports = []int32{9003}
+
+	groups := cfg.RelayGroups()
+	if len(groups) != 1 {
+		t.Fatalf("expected a single implicit group, got %d", len(groups))
+	}
+	if groups[0].Name != "" || len(groups[0].Interfaces) != 2 || groups[0].Ports[0] != 9003 {
+		t.Fatalf("unexpected implicit group: %+v", groups[0])
+	}
+}
+
+func TestValidate_Groups(t *testing.T) {
+	valid := func() *Config {
+		cfg := Default()
+		cfg.Groups = []GroupConfig{
+			{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "vlan20"}},
+			{Name: "ssdp", Ports: []int32{1900}, Interfaces: []string{"eth0", "vlan30"}},
+		}
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{
+			name:    "same port on different interfaces",
+			modify:  func(c *Config) { c.Groups[1].Ports = []int32{9003} },
+			wantErr: `groups[1].interfaces[0]: udp/9003 on "eth0" is already relayed by group "roon"`,
+		},
+		{
+			name:    "top level ports",
+			modify:  func(c *Config) { c.Ports = []int32{9003} },
+			wantErr: "ports: must not be set when groups are defined",
+		},
+		{
+			name:    "duplicate group",
+			modify:  func(c *Config) { c.Groups[1].Name = "roon" },
+			wantErr: `groups[1].name: duplicate group "roon" (first defined at groups[0])`,
+		},
+		{
+			name:    "single interface",
+			modify:  func(c *Config) { c.Groups[0].Interfaces = []string{"eth0"} },
+			wantErr: "groups[0].interfaces: two or more interfaces are required, got 1",
+		},
+		{
+			name:    "no ports",
+			modify:  func(c *Config) { c.Groups[0].Ports = nil },
+			wantErr: "groups[0].ports: one or more ports are required",
+		},
+		{
+			name:    "interface settings for unused interface",
+			modify:  func(c *Config) { c.Interfaces = []InterfaceConfig{{Name: "eth9"}} },
+			wantErr: `interfaces[0].name: interface "eth9" is not a member of any group`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParseFixedIP(t *testing.T) {
+	iname, ip, err := ParseFixedIP("tun0@10.8.0.2")
+	if err != nil {
+		t.Fatalf("ParseFixedIP failed: %v", err)
+	}
+	if iname != "tun0" || ip.String() != "10.8.0.2" {
+		t.Errorf("unexpected result: %s %s", iname, ip)
+	}
+
+	iname, ip, err = ParseFixedIP("eth0@vlan10@10.0.10.5")
+	if err != nil || iname != "eth0@vlan10" || ip.String() != "10.0.10.5" {
+		t.Errorf("unexpected result for a VLAN interface: %s %s %v", iname, ip, err)
+	}
+
+	for _, bad := range []string{"tun0", "@10.8.0.2", "tun0@nope", "a@b@c"} {
+		if _, _, err := ParseFixedIP(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
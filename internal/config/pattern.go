@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// IsInterfacePattern reports whether name is an interface pattern rather than
+// the name of an interface: either a glob like `tun*` or a regular expression
+// between slashes like `/^wg[0-9]+$/`.
+func IsInterfacePattern(name string) bool {
+	return isRegexPattern(name) || strings.ContainsAny(name, "*?[")
+}
+
+func isRegexPattern(name string) bool {
+	return len(name) > 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/")
+}
+
+// compileInterfacePattern returns a function which reports whether an
+// interface name matches pattern.  Globs and regular expressions must match
+// the whole name; names which aren't patterns only match themselves.
+func compileInterfacePattern(pattern string) (func(string) bool, error) {
+	if isRegexPattern(pattern) {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if !IsInterfacePattern(pattern) {
+		return func(iname string) bool { return iname == pattern }, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(iname string) bool {
+		ok, _ := path.Match(pattern, iname)
+		return ok
+	}, nil
+}
+
+// matchInterface reports whether iname matches pattern.  Invalid patterns
+// match nothing; they are reported by Validate.
+func matchInterface(pattern, iname string) bool {
+	match, err := compileInterfacePattern(pattern)
+	return err == nil && match(iname)
+}
+
+func validatePattern(key, pattern string) error {
+	if _, err := compileInterfacePattern(pattern); err != nil {
+		return fmt.Errorf("%s: invalid interface pattern %q: %w", key, pattern, err)
+	}
+	return nil
+}
+
+func hasPattern(names []string) bool {
+	return slices.ContainsFunc(names, IsInterfacePattern)
+}
+
+// HasPatterns reports whether any interface is configured as a pattern, in
+// which case the config has to be expanded against the available interfaces
+// with Expand before it is used.
+func (c *Config) HasPatterns() bool {
+	c = c.Source()
+	for _, iface := range c.Interfaces {
+		if IsInterfacePattern(iface.Name) {
+			return true
+		}
+	}
+	for _, g := range c.Groups {
+		if hasPattern(g.Interfaces) {
+			return true
+		}
+	}
+	return false
+}
+
+// Source returns the config with the interface patterns which c was expanded
+// from, or c itself if it wasn't expanded.
+func (c *Config) Source() *Config {
+	if c.source != nil {
+		return c.source
+	}
+	return c
+}
+
+// excluded reports whether iname is excluded from the pattern matches of a
+// group with the given exclude list.
+func (c *Config) excluded(iname string, exclude []string) bool {
+	for _, pattern := range c.ExcludeInterfaces {
+		if matchInterface(pattern, iname) {
+			return true
+		}
+	}
+	for _, pattern := range exclude {
+		if matchInterface(pattern, iname) {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns the names in available which match pattern and are not
+// excluded.
+func (c *Config) matching(pattern string, exclude, available []string) []string {
+	var names []string
+	for _, iname := range available {
+		if matchInterface(pattern, iname) && !c.excluded(iname, exclude) {
+			names = append(names, iname)
+		}
+	}
+	return names
+}
+
+// MatchesInterface reports whether iname is, or would be, relayed by any relay
+// group: it is listed by name or matches one of the patterns without being
+// excluded.
+func (c *Config) MatchesInterface(iname string) bool {
+	c = c.Source()
+	for _, g := range c.RelayGroups() {
+		for _, member := range g.Interfaces {
+			if member == iname {
+				return true
+			}
+			if IsInterfacePattern(member) && matchInterface(member, iname) && !c.excluded(iname, g.Exclude) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expand returns a copy of the config where every interface pattern is
+// replaced by the names in available which match it, in sorted order.  Names
+// listed explicitly are kept even if they are not available.  A match is left
+// out of a group if one of the group's ports is already relayed on it by
+// another group, since a packet may only belong to a single group.  Expanding
+// an expanded config starts again from its Source.
+func (c *Config) Expand(available []string) *Config {
+	src := c.Source()
+	if !src.HasPatterns() {
+		return src
+	}
+	available = slices.Sorted(slices.Values(available))
+
+	out := *src
+	out.source = src
+	out.Interfaces = nil
+	for _, iface := range src.Interfaces {
+		if !IsInterfacePattern(iface.Name) {
+			out.Interfaces = append(out.Interfaces, iface)
+			continue
+		}
+		for _, iname := range src.matching(iface.Name, nil, available) {
+			// Settings for a name win over the settings for a pattern.
+			if src.Interface(iname) == nil && out.Interface(iname) == nil {
+				match := iface
+				match.Name = iname
+				out.Interfaces = append(out.Interfaces, match)
+			}
+		}
+	}
+
+	if len(src.Groups) == 0 {
+		return &out
+	}
+	owners := make(map[string]string)
+	for _, g := range src.Groups {
+		for _, iname := range g.Interfaces {
+			if !IsInterfacePattern(iname) {
+				for _, port := range g.Ports {
+					owners[fmt.Sprintf("%s/%d", iname, port)] = g.Name
+				}
+			}
+		}
+	}
+	out.Groups = make([]GroupConfig, len(src.Groups))
+	for i, g := range src.Groups {
+		members := make([]string, 0, len(g.Interfaces))
+		for _, entry := range g.Interfaces {
+			names := []string{entry}
+			if IsInterfacePattern(entry) {
+				names = src.matching(entry, g.Exclude, available)
+			}
+			for _, iname := range names {
+				if slices.Contains(members, iname) || !claimPorts(owners, g, iname) {
+					continue
+				}
+				members = append(members, iname)
+			}
+		}
+		out.Groups[i] = g
+		out.Groups[i].Interfaces = members
+	}
+	return &out
+}
+
+// claimPorts records that g relays its ports on iname, unless another group
+// already does.
+func claimPorts(owners map[string]string, g GroupConfig, iname string) bool {
+	for _, port := range g.Ports {
+		if owner, ok := owners[fmt.Sprintf("%s/%d", iname, port)]; ok && owner != g.Name {
+			return false
+		}
+	}
+	for _, port := range g.Ports {
+		owners[fmt.Sprintf("%s/%d", iname, port)] = g.Name
+	}
+	return true
+}
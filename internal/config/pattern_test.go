@@ -0,0 +1,214 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIsInterfacePattern(t *testing.T) {
+	for name, want := range map[string]bool{
+		"eth0":         false,
+		"eth0.10":      false,
+		"tun*":         true,
+		"wg?":          true,
+		"vlan[23]0":    true,
+		"/^wg[0-9]+$/": true,
+		"/":            false,
+		"//":           false,
+		"tun/":         false,
+	} {
+		if got := IsInterfacePattern(name); got != want {
+			t.Errorf("IsInterfacePattern(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMatchInterface(t *testing.T) {
+	tests := []struct {
+		pattern, iname string
+		want           bool
+	}{
+		{"tun*", "tun0", true},
+		{"tun*", "tun12", true},
+		{"tun*", "eth0", false},
+		{"/wg[0-9]+/", "wg0", true},
+		{"/wg[0-9]+/", "wg0-backup", false}, // must match the whole name
+		{"/wg|tun0/", "tun0", true},
+		{"eth0", "eth0", true},
+		{"eth0", "eth01", false},
+		{"tun[", "tun[", false}, // invalid patterns match nothing
+	}
+	for _, tt := range tests {
+		if got := matchInterface(tt.pattern, tt.iname); got != tt.want {
+			t.Errorf("matchInterface(%q, %q) = %v, want %v", tt.pattern, tt.iname, got, tt.want)
+		}
+	}
+}
+
+func TestExpand_ImplicitGroup(t *testing.T) {
+	cfg := Default()
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "tun*", Timeout: 50}, {Name: "tun1", Timeout: 10}}
+	cfg.ExcludeInterfaces = []string{"tun9"}
+	cfg.Ports = []int32{9003}
+
+	expanded := cfg.Expand([]string{"tun9", "tun1", "eth0", "tun0", "wg0"})
+	if got := expanded.InterfaceNames(); !slices.Equal(got, []string{"eth0", "tun0", "tun1"}) {
+		t.Fatalf("unexpected interfaces: %v", got)
+	}
+	if got := expanded.TimeoutFor("tun0"); got != ParseTimeout(50) {
+		t.Fatalf("expected tun0 to get the pattern's timeout, got %s", got)
+	}
+	if got := expanded.TimeoutFor("tun1"); got != ParseTimeout(10) {
+		t.Fatalf("expected tun1 to keep its own timeout, got %s", got)
+	}
+	if expanded.Source() != cfg || expanded.HasInterface("tun*") {
+		t.Fatal("expected the pattern to be replaced and the source to be kept")
+	}
+
+	again := expanded.Expand([]string{"eth0"})
+	if got := again.InterfaceNames(); !slices.Equal(got, []string{"eth0", "tun1"}) {
+		t.Fatalf("expected re-expanding to start from the source, got %v", got)
+	}
+}
+
+func TestExpand_Groups(t *testing.T) {
+	cfg := Default()
+	cfg.Groups = []GroupConfig{
+		{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "tun*", "/wg[0-9]+/"}, Exclude: []string{"tun9"}},
+		{Name: "ssdp", Ports: []int32{1900}, Interfaces: []string{"eth0", "tun*"}},
+		{Name: "other", Ports: []int32{9003}, Interfaces: []string{"tun5", "eth1"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expanded := cfg.Expand([]string{"eth0", "eth1", "tun0", "tun5", "tun9", "wg0", "wg-test"})
+	want := map[string][]string{
+		"roon":  {"eth0", "tun0", "wg0"},
+		"ssdp":  {"eth0", "tun0", "tun5", "tun9"},
+		"other": {"tun5", "eth1"},
+	}
+	for _, g := range expanded.Groups {
+		if !slices.Equal(g.Interfaces, want[g.Name]) {
+			t.Errorf("group %s: expected %v, got %v", g.Name, want[g.Name], g.Interfaces)
+		}
+	}
+	if cfg.Groups[0].Interfaces[1] != "tun*" {
+		t.Fatal("expected the source config to be unchanged")
+	}
+
+	for iname, want := range map[string]bool{"tun3": true, "wg1": true, "tun9": true, "eth1": true, "eth2": false, "wg-test": false} {
+		if got := cfg.MatchesInterface(iname); got != want {
+			t.Errorf("MatchesInterface(%q) = %v, want %v", iname, got, want)
+		}
+	}
+}
+
+func TestExpand_NoPatterns(t *testing.T) {
+	cfg := Default()
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "eth1"}}
+	if cfg.Expand([]string{"eth0"}) != cfg {
+		t.Fatal("expected a config without patterns to be returned as is")
+	}
+}
+
+func TestValidate_Patterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{
+			name:   "single pattern",
+			modify: func(c *Config) { c.Interfaces = []InterfaceConfig{{Name: "tun*"}} },
+		},
+		{
+			name: "group with a single pattern",
+			modify: func(c *Config) {
+				c.Interfaces = nil
+				c.Groups = []GroupConfig{{Name: "vpn", Ports: []int32{9003}, Interfaces: []string{"/tun[0-9]+/"}}}
+			},
+		},
+		{
+			name: "settings for interfaces matching a group pattern",
+			modify: func(c *Config) {
+				c.Groups = []GroupConfig{{Name: "vpn", Ports: []int32{9003}, Interfaces: []string{"eth0", "tun*"}}}
+				c.Interfaces = []InterfaceConfig{{Name: "tun0"}, {Name: "tun[0-3]"}}
+			},
+		},
+		{
+			name:    "bad glob",
+			modify:  func(c *Config) { c.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "tun["}} },
+			wantErr: `interfaces[1].name: invalid interface pattern "tun["`,
+		},
+		{
+			name: "bad regex",
+			modify: func(c *Config) {
+				c.Groups = []GroupConfig{{Name: "vpn", Ports: []int32{9003}, Interfaces: []string{"eth0", "/tun(/"}}}
+			},
+			wantErr: `groups[0].interfaces[1]: invalid interface pattern "/tun(/"`,
+		},
+		{
+			name: "bad group exclude",
+			modify: func(c *Config) {
+				c.Groups = []GroupConfig{{Name: "vpn", Ports: []int32{9003}, Interfaces: []string{"eth0", "tun*"}, Exclude: []string{"["}}}
+			},
+			wantErr: `groups[0].exclude[0]: invalid interface pattern "["`,
+		},
+		{
+			name:    "bad exclude",
+			modify:  func(c *Config) { c.ExcludeInterfaces = []string{"/(/"} },
+			wantErr: `exclude-interfaces[0]: invalid interface pattern "/(/"`,
+		},
+		{
+			name:   "vlan interfaces",
+			modify: func(c *Config) { c.Interfaces = []InterfaceConfig{{Name: "eth0@vlan10"}, {Name: "eth0@vlan20"}} },
+		},
+		{
+			name:    "bad vlan interface",
+			modify:  func(c *Config) { c.Interfaces[1].Name = "eth0@vlan4095" },
+			wantErr: `interfaces[1].name: invalid VLAN interface "eth0@vlan4095", expected <interface>@vlan<1-4094>`,
+		},
+		{
+			name: "bad vlan interface in a group",
+			modify: func(c *Config) {
+				c.Interfaces = nil
+				c.Groups = []GroupConfig{{Name: "roon", Ports: []int32{9003}, Interfaces: []string{"eth0", "eth1@vlan"}}}
+			},
+			wantErr: `groups[0].interfaces[1]: invalid VLAN interface "eth1@vlan"`,
+		},
+		{
+			name:    "fixed ips for a pattern",
+			modify:  func(c *Config) { c.Interfaces[1] = InterfaceConfig{Name: "tun*", FixedIPs: []string{"10.0.0.1"}} },
+			wantErr: `interfaces[1].fixed-ips: not supported for interface pattern "tun*"`,
+		},
+		{
+			name:    "fixed ip on a pattern",
+			modify:  func(c *Config) { c.FixedIPs = []string{"tun*@10.0.0.1"} },
+			wantErr: `fixed-ip[0]: interface must not be a pattern, got "tun*"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "eth1"}}
+			cfg.Ports = []int32{9003}
+			tt.modify(cfg)
+			if len(cfg.Groups) > 0 {
+				cfg.Ports = nil
+			}
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
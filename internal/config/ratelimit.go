@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What a rate limit counts packets by.
+const (
+	RateLimitPerSource    = "source"
+	RateLimitPerInterface = "interface"
+	RateLimitPerEgress    = "egress"
+)
+
+// RateLimitPer is the list of valid values for RateLimitConfig.Per.
+var RateLimitPer = []string{RateLimitPerSource, RateLimitPerInterface, RateLimitPerEgress}
+
+// RateLimitConfig is a token bucket limiting the packets for Ports, or every
+// port when empty, to Rate packets per second with bursts of up to Burst
+// packets.  Per selects whether every source IP address, every capturing
+// interface or every egress interface gets its own bucket.
+type RateLimitConfig struct {
+	Ports []int32 `yaml:"ports" toml:"ports"`
+	Per   string  `yaml:"per" toml:"per"`
+	Rate  float64 `yaml:"rate" toml:"rate"`
+	Burst int     `yaml:"burst" toml:"burst"`
+}
+
+func (c *Config) validateRateLimits() []error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for i, limit := range c.RateLimits {
+		prefix := fmt.Sprintf("rate-limits[%d]", i)
+		valid := false
+		for _, per := range RateLimitPer {
+			if limit.Per == per {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			addErr("%s.per: must be one of [%s], got %q", prefix, strings.Join(RateLimitPer, "|"), limit.Per)
+		}
+		if limit.Rate <= 0 {
+			addErr("%s.rate: must be a positive number of packets per second, got %g", prefix, limit.Rate)
+		}
+		if limit.Burst < 0 {
+			addErr("%s.burst: must not be negative, got %d", prefix, limit.Burst)
+		}
+		errs = append(errs, validatePorts(prefix+".ports", limit.Ports)...)
+	}
+	return errs
+}
@@ -6,23 +6,28 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gopacket/gopacket/pcap"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 )
 
+// BPFFragmentFilter matches the UDP fragments which don't have the UDP header
+// a port filter needs: IPv4 fragments other than the first one and every IPv6
+// fragment.  A BPF filter can't tell which datagram they belong to, so the
+// ReassemblyProcessor drops the ones whose first fragment isn't for the ports.
+const BPFFragmentFilter = "(ip proto 17 and ip[6:2] & 0x1fff != 0) or (ip6 proto 44 and ip6[40] == 17)"
+
 // BuildBPFFilter takes a list of ports and builds a BPF filter string.
-func BuildBPFFilter(ports []int32, addresses []pcap.InterfaceAddress) string {
+// Fragments are let through to be reassembled.
+func BuildBPFFilter(ports []int32, addresses []proxy.InterfaceAddress) string {
 	if len(ports) < 1 {
 		return ""
 	}
-	var bpfPortFilters = make([]string, len(ports))
+	var bpfPortFilters = make([]string, len(ports), len(ports)+1)
 	for i, p := range ports {
 		bpfPortFilters[i] = fmt.Sprintf("udp port %d", p)
 	}
+	bpfPortFilters = append(bpfPortFilters, BPFFragmentFilter)
 
-	bpfFilter := strings.Join(bpfPortFilters, " or ")
-	if len(bpfPortFilters) > 1 {
-		bpfFilter = "(" + bpfFilter + ")"
-	}
+	bpfFilter := "(" + strings.Join(bpfPortFilters, " or ") + ")"
 
 	var networks []string
 	for _, addr := range addresses {
@@ -48,14 +53,23 @@ func ParseTimeout(timeout int64) time.Duration {
 	return time.Duration(timeout) * time.Millisecond
 }
 
-// GetNetwork takes a pcap.InterfaceAddress and returns a CIDR x.x.x.x/len format.
-func GetNetwork(addr pcap.InterfaceAddress) (string, error) {
-	var ip4 net.IP
-	if ip4 = addr.IP.To4(); ip4 == nil {
-		return "", fmt.Errorf("unable to getNetwork for IPv6 address: %s", addr.IP.String())
+// GetNetwork takes a proxy.InterfaceAddress and returns the network in CIDR
+// x.x.x.x/len or x:x::/len format.
+func GetNetwork(addr proxy.InterfaceAddress) (string, error) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		size, _ := addr.Netmask.Size()
+		mask := net.CIDRMask(size, 32)
+		return fmt.Sprintf("%s/%d", ip4.Mask(mask), size), nil
 	}
 
-	size, _ := addr.Netmask.Size()
-	mask := net.CIDRMask(size, 32)
-	return fmt.Sprintf("%s/%d", ip4.Mask(mask), size), nil
+	ip6 := addr.IP.To16()
+	if ip6 == nil {
+		return "", fmt.Errorf("unable to getNetwork for invalid address: %s", addr.IP.String())
+	}
+	size, bits := addr.Netmask.Size()
+	if bits != 128 {
+		return "", fmt.Errorf("invalid netmask for IPv6 address: %s", addr.IP.String())
+	}
+	mask := net.CIDRMask(size, 128)
+	return fmt.Sprintf("%s/%d", ip6.Mask(mask), size), nil
 }
@@ -1,11 +1,15 @@
 package config
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
 
-	"github.com/gopacket/gopacket/pcap"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	"golang.org/x/net/bpf"
 )
 
 func TestParseTimeout(t *testing.T) {
@@ -19,21 +23,37 @@ func TestParseTimeout(t *testing.T) {
 func TestGetNetwork(t *testing.T) {
 	tests := []struct {
 		name    string
-		addr    pcap.InterfaceAddress
+		addr    proxy.InterfaceAddress
 		want    string
 		wantErr bool
 	}{
 		{
 			name: "standard ipv4",
-			addr: pcap.InterfaceAddress{
+			addr: proxy.InterfaceAddress{
 				IP:      net.IP{192, 168, 1, 10},
 				Netmask: net.IPMask{255, 255, 255, 0},
 			},
 			want: "192.168.1.0/24",
 		},
 		{
-			name: "ipv6 failure",
-			addr: pcap.InterfaceAddress{
+			name: "standard ipv6",
+			addr: proxy.InterfaceAddress{
+				IP:      net.ParseIP("2001:db8:0:1::10"),
+				Netmask: net.CIDRMask(64, 128),
+			},
+			want: "2001:db8:0:1::/64",
+		},
+		{
+			name: "ipv6 link local",
+			addr: proxy.InterfaceAddress{
+				IP:      net.ParseIP("fe80::1c2:3ff:fe04:506"),
+				Netmask: net.CIDRMask(64, 128),
+			},
+			want: "fe80::/64",
+		},
+		{
+			name: "ipv6 without netmask",
+			addr: proxy.InterfaceAddress{
 				IP: net.ParseIP("2001:db8::1"),
 			},
 			wantErr: true,
@@ -54,26 +74,134 @@ func TestGetNetwork(t *testing.T) {
 }
 
 func TestBuildBPFFilter(t *testing.T) {
-	addr := pcap.InterfaceAddress{
+	addr := proxy.InterfaceAddress{
 		IP:      net.IP{192, 168, 1, 10},
 		Netmask: net.IPMask{255, 255, 255, 0},
 	}
 
-	got := BuildBPFFilter([]int32{53, 67}, []pcap.InterfaceAddress{addr})
-	want := "(udp port 53 or udp port 67) and src net 192.168.1.0/24"
+	got := BuildBPFFilter([]int32{53, 67}, []proxy.InterfaceAddress{addr})
+	want := "(udp port 53 or udp port 67 or " + BPFFragmentFilter + ") and src net 192.168.1.0/24"
 	if got != want {
 		t.Errorf("BuildBPFFilter() = %q, want %q", got, want)
 	}
 
-	gotMulti := BuildBPFFilter([]int32{53}, []pcap.InterfaceAddress{
+	gotMulti := BuildBPFFilter([]int32{53}, []proxy.InterfaceAddress{
 		addr,
 		{
 			IP:      net.IP{10, 0, 0, 5},
 			Netmask: net.IPMask{255, 0, 0, 0},
 		},
 	})
-	wantMulti := "udp port 53 and (src net 192.168.1.0/24 or src net 10.0.0.0/8)"
+	wantMulti := "(udp port 53 or " + BPFFragmentFilter + ") and (src net 192.168.1.0/24 or src net 10.0.0.0/8)"
 	if gotMulti != wantMulti {
 		t.Errorf("BuildBPFFilter() multi = %q, want %q", gotMulti, wantMulti)
 	}
+
+	gotDual := BuildBPFFilter([]int32{9003}, []proxy.InterfaceAddress{
+		addr,
+		{
+			IP:      net.ParseIP("2001:db8:0:1::10"),
+			Netmask: net.CIDRMask(64, 128),
+		},
+	})
+	wantDual := "(udp port 9003 or " + BPFFragmentFilter + ") and (src net 192.168.1.0/24 or src net 2001:db8:0:1::/64)"
+	if gotDual != wantDual {
+		t.Errorf("BuildBPFFilter() dual stack = %q, want %q", gotDual, wantDual)
+	}
+
+	// The AF_PACKET capture backend compiles the filters itself.
+	for _, filter := range []string{got, gotMulti, gotDual} {
+		for _, ethernet := range []bool{true, false} {
+			if _, err := proxy.CompileBPFFilter(filter, ethernet); err != nil {
+				t.Errorf("CompileBPFFilter(%q): %v", filter, err)
+			}
+		}
+	}
+}
+
+// testUDPPacket builds an Ethernet frame with a UDP packet from src to dst.
+// A non-zero fragOffset makes it a non-first IPv4 fragment.
+func testUDPPacket(t *testing.T, src, dst string, dport, fragOffset uint16) []byte {
+	t.Helper()
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: layers.UDPPort(dport)}
+	var ip gopacket.SerializableLayer
+	if srcIP.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: dstIP.To4(), FragOffset: fragOffset}
+		_ = udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dstIP}
+		_ = udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+		eth.EthernetType = layers.EthernetTypeIPv6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestBuildBPFFilter_ManyPortsAndAddresses(t *testing.T) {
+	var ports []int32
+	for i := range 40 {
+		ports = append(ports, int32(9000+i))
+	}
+	var addrs []proxy.InterfaceAddress
+	for i := range 20 {
+		addrs = append(addrs,
+			proxy.InterfaceAddress{IP: net.IPv4(10, byte(i), 0, 1), Netmask: net.CIDRMask(24, 32)},
+			proxy.InterfaceAddress{IP: net.ParseIP(fmt.Sprintf("fd00:%x::1", i)), Netmask: net.CIDRMask(64, 128)},
+		)
+	}
+	filter := BuildBPFFilter(ports, addrs)
+
+	raw, err := proxy.CompileBPFFilter(filter, true)
+	if err != nil {
+		t.Fatalf("CompileBPFFilter(%q): %v", filter, err)
+	}
+	prog := make([]bpf.Instruction, len(raw))
+	for i, ins := range raw {
+		prog[i] = ins.Disassemble()
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("NewVM: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		src, dst   string
+		dport      uint16
+		fragOffset uint16
+		want       bool
+	}{
+		{"first port first net", "10.0.0.5", "10.0.0.255", 9000, 0, true},
+		{"last port last net", "10.19.0.5", "10.19.0.255", 9039, 0, true},
+		{"other port", "10.19.0.5", "10.19.0.255", 9040, 0, false},
+		{"other net", "10.20.0.5", "10.20.0.255", 9039, 0, false},
+		{"fragment", "10.19.0.5", "10.19.0.255", 53, 100, true},
+		{"ipv6 first port", "fd00::5", "ff02::1", 9000, 0, true},
+		{"ipv6 last port last net", "fd00:13::5", "ff02::1", 9039, 0, true},
+		{"ipv6 other port", "fd00:13::5", "ff02::1", 53, 0, false},
+		{"ipv6 other net", "fd00:14::5", "ff02::1", 9039, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := vm.Run(testUDPPacket(t, tt.src, tt.dst, tt.dport, tt.fragOffset))
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if got := n > 0; got != tt.want {
+				t.Errorf("filter matched = %v, want %v", got, tt.want)
+			}
+		})
+	}
 }
@@ -0,0 +1,21 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// validateInterfaceName checks that name is a valid interface pattern, or the
+// valid name of a logical VLAN interface like eth0@vlan10.
+func validateInterfaceName(key, name string) error {
+	if IsInterfacePattern(name) {
+		return validatePattern(key, name)
+	}
+	if proxy.IsVLANInterfaceName(name) {
+		if _, _, ok := proxy.ParseVLANInterface(name); !ok {
+			return fmt.Errorf("%s: invalid VLAN interface %q, expected <interface>@vlan<1-4094>", key, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Package control implements the local control socket used by
+// `udp-proxy-2020 ctl` to inspect and manage a running udp-proxy-2020.
+//
+// The protocol is a single JSON encoded Request per connection, answered by a
+// single JSON encoded Response.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Commands understood by the control socket.
+const (
+	CmdClients       = "clients"
+	CmdAddFixedIP    = "add-fixed-ip"
+	CmdRemoveFixedIP = "remove-fixed-ip"
+	CmdFlush         = "flush"
+	CmdLogLevel      = "log-level"
+	CmdPipelines     = "pipelines"
+	CmdReload        = "reload"
+	CmdStatus        = "status"
+)
+
+// ioTimeout bounds how long a single request/response may take.
+const ioTimeout = 5 * time.Second
+
+// Request is sent by the client.
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Group   string   `json:"group,omitempty"`
+}
+
+// Response is sent by the server.  Data holds the command specific result.
+type Response struct {
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Client describes a client known by a relay group registry.
+type Client struct {
+	Group        string        `json:"group"`
+	Interface    string        `json:"interface"`
+	IP           string        `json:"ip"`
+	MAC          string        `json:"mac,omitempty"`
+	Fixed        bool          `json:"fixed"`
+	LastSeen     time.Time     `json:"last_seen,omitzero"`
+	TTLRemaining time.Duration `json:"ttl_remaining,omitempty"`
+}
+
+// Pipeline describes a running pipeline.
+type Pipeline struct {
+	Source     string   `json:"source"`
+	Processors []string `json:"processors,omitempty"`
+	Sinks      []Sink   `json:"sinks,omitempty"`
+}
+
+// Sink describes a sink and, for sinks like the RouteSink, the processors and
+// sinks nested inside of it.
+type Sink struct {
+	Name       string   `json:"name"`
+	Processors []string `json:"processors,omitempty"`
+	Sinks      []string `json:"sinks,omitempty"`
+}
+
+// Result is returned by commands which change state.
+type Result struct {
+	Message string `json:"message"`
+}
+
+// ReloadStatus describes a reload of the config, from SIGHUP or CmdReload.
+// CmdReload answers as soon as the reload started, which can take up to the
+// shutdown timeout for every interface it stops; its outcome is reported by
+// CmdStatus once Finished is set.
+type ReloadStatus struct {
+	ID       int       `json:"id"` // increasing in the order reloads started
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"` // zero while running
+	Summary  string    `json:"summary,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Status is returned by CmdStatus.
+type Status struct {
+	Reloads []ReloadStatus `json:"reloads"` // the latest reloads, oldest first
+}
+
+// Handler executes a Request and returns the value to send back as
+// Response.Data.
+type Handler interface {
+	Handle(req Request) (any, error)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(req Request) (any, error)
+
+func (f HandlerFunc) Handle(req Request) (any, error) {
+	return f(req)
+}
+
+// Server accepts connections on a Unix domain socket.
+type Server struct {
+	path     string
+	handler  Handler
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// Listen creates the control socket at path, only accessible by the current
+// user.  A stale socket left behind by a previous run is removed, but an error
+// is returned if another process is still serving on it.
+func Listen(path string, handler Handler) (*Server, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale control socket: %w", err)
+		}
+	}
+
+	// The socket is created with the permissions of the umask, so create
+	// it in a private directory and only move it into place once it is
+	// restricted to our user.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".udp-proxy-2020-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create control socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "ctl.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on control socket: %w", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to set control socket permissions: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to create control socket: %w", err)
+	}
+	return &Server{path: path, handler: handler, listener: l}, nil
+}
+
+// Serve handles connections until ctx is cancelled or Close is called.
+func (s *Server) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Control socket accept failed", "error", err)
+			}
+			break
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+	s.wg.Wait()
+}
+
+// Close stops accepting connections and removes the socket.
+func (s *Server) Close() error {
+	if err := s.listener.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove control socket: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	var req Request
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else {
+		slog.Debug("Control request", "command", req.Command, "args", req.Args, "group", req.Group)
+		data, err := s.handler.Handle(req)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if data != nil {
+			if resp.Data, err = json.Marshal(data); err != nil {
+				resp.Error = fmt.Sprintf("unable to encode response: %v", err)
+			}
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		slog.Warn("Unable to write control response", "error", err)
+	}
+}
+
+// Call sends req to the control socket at path and decodes the response data
+// into out, which may be nil.
+func Call(path string, req Request, out any) error {
+	conn, err := net.DialTimeout("unix", path, ioTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("unable to send request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if out != nil && len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, out); err != nil {
+			return fmt.Errorf("unable to decode response: %w", err)
+		}
+	}
+	return nil
+}
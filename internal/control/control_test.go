@@ -0,0 +1,124 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func startTestServer(t *testing.T, handler Handler) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := Listen(path, handler)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return path
+}
+
+func TestCall_RoundTrip(t *testing.T) {
+	path := startTestServer(t, HandlerFunc(func(req Request) (any, error) {
+		switch req.Command {
+		case CmdClients:
+			return []Client{{Group: req.Group, Interface: "eth0", IP: "10.0.0.1", Fixed: true}}, nil
+		case CmdFlush:
+			return nil, errors.New("flush failed")
+		}
+		return Result{Message: req.Command + " " + req.Args[0]}, nil
+	}))
+
+	var clients []Client
+	if err := Call(path, Request{Command: CmdClients, Group: "roon"}, &clients); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if len(clients) != 1 || clients[0].Group != "roon" || clients[0].IP != "10.0.0.1" || !clients[0].Fixed {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+
+	var result Result
+	if err := Call(path, Request{Command: CmdLogLevel, Args: []string{"debug"}}, &result); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if result.Message != "log-level debug" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	if err := Call(path, Request{Command: CmdFlush}, nil); err == nil || err.Error() != "flush failed" {
+		t.Fatalf("expected handler error to be returned, got %v", err)
+	}
+}
+
+func TestListen_SocketPermissions(t *testing.T) {
+	path := startTestServer(t, HandlerFunc(func(req Request) (any, error) { return nil, nil }))
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected socket mode 0600, got %o", perm)
+	}
+}
+
+func TestListen_RemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// Leave the socket file behind like a crashed process would.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	server, err := Listen(path, HandlerFunc(func(req Request) (any, error) { return nil, nil }))
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %v", err)
+	}
+	server.Close()
+}
+
+func TestListen_KeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	if err := os.WriteFile(path, []byte("not a socket"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := Listen(path, HandlerFunc(func(req Request) (any, error) { return nil, nil })); err == nil {
+		t.Fatal("expected error when the path is not a socket")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "not a socket" {
+		t.Fatalf("expected the file to be left alone, got %q, %v", data, err)
+	}
+}
+
+func TestServer_CloseRemovesSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := Listen(path, HandlerFunc(func(req Request) (any, error) { return nil, nil }))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+		t.Fatalf("expected the socket and its temporary directory to be removed, got %v", entries)
+	}
+}
+
+func TestListen_InUse(t *testing.T) {
+	path := startTestServer(t, HandlerFunc(func(req Request) (any, error) { return nil, nil }))
+	if _, err := Listen(path, HandlerFunc(func(req Request) (any, error) { return nil, nil })); err == nil {
+		t.Fatal("expected error when the control socket is in use")
+	}
+}
@@ -0,0 +1,330 @@
+// Package metrics defines the Prometheus metrics exported by udp-proxy-2020
+// and the HTTP endpoint which serves them.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "udp_proxy"
+
+// Stage results used for the result label of StagePackets and SinkPackets.
+const (
+	ResultKept    = "kept"
+	ResultDropped = "dropped"
+	ResultError   = "error"
+	ResultOK      = "ok"
+)
+
+// Registry holds every udp-proxy-2020 metric.  The per-packet metrics of the
+// pipelines and routes are only collected once Enable has been called.
+var Registry = prometheus.NewRegistry()
+
+// enabled turns on the per-packet metrics.
+var enabled atomic.Bool
+
+// Enable turns on collecting the per-packet metrics, for when they are served.
+// Pipelines and routes check it when they start, so it has to be called before.
+func Enable() {
+	enabled.Store(true)
+}
+
+// Enabled reports whether the per-packet metrics are collected.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+var (
+	// PipelinePackets counts packets read by each pipeline's source.
+	PipelinePackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pipeline_packets_total",
+		Help:      "Packets read by the pipeline source.",
+	}, []string{"pipeline"})
+
+	// PipelineReadErrors counts source read errors for each pipeline.
+	PipelineReadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pipeline_read_errors_total",
+		Help:      "Errors reading from the pipeline source.",
+	}, []string{"pipeline"})
+
+	// PipelineDuration tracks how long each packet took to pass through
+	// the processors and sinks of a pipeline.
+	PipelineDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pipeline_packet_duration_seconds",
+		Help:      "Time spent processing a packet in the pipeline.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 8),
+	}, []string{"pipeline"})
+
+	// StagePackets counts the result of every processor for every packet.
+	StagePackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stage_packets_total",
+		Help:      "Packets handled by a processor, by result (kept, dropped or error).",
+	}, []string{"pipeline", "stage", "result"})
+
+	// SinkPackets counts the packets written to every sink.
+	SinkPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_packets_total",
+		Help:      "Packets written to a sink, by result (ok or error).",
+	}, []string{"pipeline", "sink", "result"})
+
+	// RouteTargets counts the packets fanned out by each RouteSink.
+	RouteTargets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route_targets_total",
+		Help:      "Per-target copies of packets fanned out by a route sink.",
+	}, []string{"sink"})
+
+	// RouteNoTargets counts packets a RouteSink dropped for lack of targets.
+	RouteNoTargets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route_no_targets_total",
+		Help:      "Packets dropped by a route sink because there were no targets.",
+	}, []string{"sink"})
+
+	// SourceReconnects counts reconnect events of each PcapSource.
+	SourceReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_reconnect_events_total",
+		Help:      "Capture source reconnect events, by event (started or succeeded).",
+	}, []string{"interface", "event"})
+
+	// TransmitterDropped counts packets a TransmitterSink could not send.
+	TransmitterDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transmitter_dropped_total",
+		Help:      "Packets dropped by a transmitter, by reason (reconnecting or write_error).",
+	}, []string{"interface", "reason"})
+
+	// TransmitterReconnects counts reconnect events of each TransmitterSink.
+	TransmitterReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transmitter_reconnect_events_total",
+		Help:      "Transmitter reconnect events, by event (started or succeeded).",
+	}, []string{"interface", "event"})
+
+	// Reassembled counts the fragmented datagrams reassembled on each
+	// interface.
+	Reassembled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reassembled_datagrams_total",
+		Help:      "Fragmented datagrams reassembled.",
+	}, []string{"interface"})
+
+	// ReassemblyDropped counts the fragmented datagrams which were given up on.
+	ReassemblyDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reassembly_dropped_total",
+		Help:      "Fragmented datagrams dropped before being reassembled, by reason (timeout, overlap, invalid, too_large or memory).",
+	}, []string{"interface", "reason"})
+
+	// EgressFragments counts the fragments sent for packets exceeding the MTU
+	// of the egress interface.
+	EgressFragments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "egress_fragments_total",
+		Help:      "Fragments sent for packets larger than the MTU of the egress interface.",
+	}, []string{"interface"})
+
+	// ACLDenied counts the packets denied by an ACL, by direction (in for
+	// the ingress interface or out for the egress interface).
+	ACLDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "acl_denied_packets_total",
+		Help:      "Packets denied by an ACL, by direction (in or out).",
+	}, []string{"interface", "direction"})
+
+	// RateLimited counts the packets dropped by a rate limit, by direction
+	// and what the limit counts packets by (source, interface or egress).
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_packets_total",
+		Help:      "Packets dropped by a rate limit, by direction (in or out) and limit (source, interface or egress).",
+	}, []string{"interface", "direction", "by"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		PipelinePackets,
+		PipelineReadErrors,
+		PipelineDuration,
+		StagePackets,
+		SinkPackets,
+		RouteTargets,
+		RouteNoTargets,
+		SourceReconnects,
+		TransmitterDropped,
+		TransmitterReconnects,
+		Reassembled,
+		ReassemblyDropped,
+		EgressFragments,
+		ACLDenied,
+		RateLimited,
+	)
+}
+
+// PipelineCounters are the metrics of a pipeline, resolved once so counting a
+// packet doesn't have to look up its labels.
+type PipelineCounters struct {
+	Packets    prometheus.Counter
+	ReadErrors prometheus.Counter
+	Duration   prometheus.Observer
+}
+
+// NewPipelineCounters returns the metrics of pipeline, or nil when the metrics
+// are disabled.
+func NewPipelineCounters(pipeline string) *PipelineCounters {
+	if !Enabled() {
+		return nil
+	}
+	return &PipelineCounters{
+		Packets:    PipelinePackets.WithLabelValues(pipeline),
+		ReadErrors: PipelineReadErrors.WithLabelValues(pipeline),
+		Duration:   PipelineDuration.WithLabelValues(pipeline),
+	}
+}
+
+// StageCounters counts the results of a processor of a pipeline.
+type StageCounters struct {
+	kept, dropped, errors prometheus.Counter
+}
+
+// NewStageCounters returns the metrics of the stage of pipeline, or nil when the
+// metrics are disabled.
+func NewStageCounters(pipeline, stage string) *StageCounters {
+	if !Enabled() {
+		return nil
+	}
+	return &StageCounters{
+		kept:    StagePackets.WithLabelValues(pipeline, stage, ResultKept),
+		dropped: StagePackets.WithLabelValues(pipeline, stage, ResultDropped),
+		errors:  StagePackets.WithLabelValues(pipeline, stage, ResultError),
+	}
+}
+
+// Observe counts the return values of the processor.  Does nothing on a nil
+// StageCounters.
+func (c *StageCounters) Observe(keep bool, err error) {
+	switch {
+	case c == nil:
+	case err != nil:
+		c.errors.Inc()
+	case keep:
+		c.kept.Inc()
+	default:
+		c.dropped.Inc()
+	}
+}
+
+// SinkCounters counts the writes to a sink of a pipeline.
+type SinkCounters struct {
+	ok, errors prometheus.Counter
+}
+
+// NewSinkCounters returns the metrics of the sink of pipeline, or nil when the
+// metrics are disabled.
+func NewSinkCounters(pipeline, sink string) *SinkCounters {
+	if !Enabled() {
+		return nil
+	}
+	return &SinkCounters{
+		ok:     SinkPackets.WithLabelValues(pipeline, sink, ResultOK),
+		errors: SinkPackets.WithLabelValues(pipeline, sink, ResultError),
+	}
+}
+
+// Observe counts the Write error of the sink.  Does nothing on a nil
+// SinkCounters.
+func (c *SinkCounters) Observe(err error) {
+	switch {
+	case c == nil:
+	case err != nil:
+		c.errors.Inc()
+	default:
+		c.ok.Inc()
+	}
+}
+
+// RouteCounters are the metrics of a route sink.
+type RouteCounters struct {
+	Targets   prometheus.Counter
+	NoTargets prometheus.Counter
+}
+
+// NewRouteCounters returns the metrics of the route sink, or nil when the
+// metrics are disabled.
+func NewRouteCounters(sink string) *RouteCounters {
+	if !Enabled() {
+		return nil
+	}
+	return &RouteCounters{
+		Targets:   RouteTargets.WithLabelValues(sink),
+		NoTargets: RouteNoTargets.WithLabelValues(sink),
+	}
+}
+
+// StageResult returns the result label for a processor's return values.
+func StageResult(keep bool, err error) string {
+	switch {
+	case err != nil:
+		return ResultError
+	case keep:
+		return ResultKept
+	default:
+		return ResultDropped
+	}
+}
+
+// SinkResult returns the result label for a sink's Write error.
+func SinkResult(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOK
+}
+
+// Serve exposes the metrics on http://addr/metrics until ctx is cancelled.
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`<html><body><a href="/metrics">Metrics</a></body></html>`))
+	})
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving metrics", "address", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
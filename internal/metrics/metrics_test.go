@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStageResult(t *testing.T) {
+	if got := StageResult(true, nil); got != ResultKept {
+		t.Errorf("expected %q, got %q", ResultKept, got)
+	}
+	if got := StageResult(false, nil); got != ResultDropped {
+		t.Errorf("expected %q, got %q", ResultDropped, got)
+	}
+	if got := StageResult(true, errors.New("boom")); got != ResultError {
+		t.Errorf("expected %q, got %q", ResultError, got)
+	}
+	if got := SinkResult(nil); got != ResultOK {
+		t.Errorf("expected %q, got %q", ResultOK, got)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	if NewPipelineCounters("p") != nil || NewStageCounters("p", "stage") != nil || NewSinkCounters("p", "sink") != nil || NewRouteCounters("route") != nil {
+		t.Fatal("expected no counters while the metrics are disabled")
+	}
+	// Counting on the nil counters of a disabled pipeline does nothing.
+	(*StageCounters)(nil).Observe(true, nil)
+	(*SinkCounters)(nil).Observe(nil)
+
+	Enable()
+	defer enabled.Store(false)
+	stage := NewStageCounters("PcapSource:test1", "stage")
+	stage.Observe(true, nil)
+	stage.Observe(false, nil)
+	stage.Observe(false, nil)
+	stage.Observe(true, errors.New("boom"))
+	for result, want := range map[string]float64{ResultKept: 1, ResultDropped: 2, ResultError: 1} {
+		if got := testutil.ToFloat64(StagePackets.WithLabelValues("PcapSource:test1", "stage", result)); got != want {
+			t.Errorf("expected %v %s packets, got %v", want, result, got)
+		}
+	}
+	sink := NewSinkCounters("PcapSource:test1", "sink")
+	sink.Observe(nil)
+	sink.Observe(errors.New("boom"))
+	if got := testutil.ToFloat64(SinkPackets.WithLabelValues("PcapSource:test1", "sink", ResultOK)); got != 1 {
+		t.Errorf("expected 1 packet written, got %v", got)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on loopback: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, addr) }()
+
+	PipelinePackets.WithLabelValues("PcapSource:test0").Inc()
+
+	var body string
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(data)
+		break
+	}
+	if !strings.Contains(body, `udp_proxy_pipeline_packets_total{pipeline="PcapSource:test0"} 1`) {
+		t.Errorf("expected pipeline counter in metrics output, got:\n%s", body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after cancel")
+	}
+}
@@ -0,0 +1,692 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/bpf"
+)
+
+// bpfSnapLen is how much of a packet matching a compiled filter is captured,
+// like the snap length of the libpcap captures.
+const bpfSnapLen = 9000
+
+// bpfMaxInstructions is the longest program the kernel accepts, BPF_MAXINSNS.
+const bpfMaxInstructions = 4096
+
+// CompileBPFFilter compiles a capture filter into a classic BPF program for
+// packets starting with an Ethernet header, or with the IP header when
+// ethernet is false.  Only the part of the pcap-filter(7) syntax used by
+// udp-proxy-2020 is supported, so the AF_PACKET backend doesn't need libpcap:
+//
+//	ip, ip6, udp, tcp
+//	ip proto <n>, ip6 proto <n>
+//	[udp|tcp] [src|dst] port <n>
+//	[src|dst] net <cidr>, [src|dst] host <ip>
+//	ip[<offset>:<size>] [& <mask>] <relop> <n>, and the same for ip6
+//	vlan [<id>]
+//
+// combined with and, or, not and parentheses.  Like in libpcap, and and or
+// have the same precedence and associate to the left.  VLAN tags are matched
+// with the tag the kernel stripped from the packet, so the offsets of the
+// other expressions don't change after vlan.
+func CompileBPFFilter(filter string, ethernet bool) ([]bpf.RawInstruction, error) {
+	tokens, err := bpfTokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &bpfParser{tokens: tokens, ethernet: ethernet}
+	if ethernet {
+		p.nh = 14
+	}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", filter, p.tokens[p.pos])
+	}
+	root = p.lower(root)
+
+	c := &bpfCompiler{}
+	accept, reject := c.newLabel(), c.newLabel()
+	c.gen(root, accept, reject)
+	c.place(accept)
+	c.emit(bpf.RetConstant{Val: bpfSnapLen})
+	c.place(reject)
+	c.emit(bpf.RetConstant{Val: 0})
+	prog, err := c.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+	}
+	return bpf.Assemble(prog)
+}
+
+// bpfTokenize splits a filter into words, numbers, operators and brackets.
+// Colons are part of words, like IPv6 addresses, except between brackets.
+func bpfTokenize(filter string) ([]string, error) {
+	var tokens []string
+	brackets := 0
+	for i := 0; i < len(filter); {
+		ch := filter[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case strings.ContainsRune("()[]", rune(ch)) || (ch == ':' && brackets > 0):
+			if ch == '[' {
+				brackets++
+			} else if ch == ']' {
+				brackets--
+			}
+			tokens = append(tokens, string(ch))
+			i++
+		case strings.ContainsRune("&|!=<>", rune(ch)):
+			op := string(ch)
+			if i+1 < len(filter) && slices.Contains([]string{"&&", "||", "!=", "==", "<=", ">="}, filter[i:i+2]) {
+				op = filter[i : i+2]
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		default:
+			j := i
+			for j < len(filter) && isBPFWordChar(rune(filter[j]), brackets > 0) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid filter %q: unexpected %q", filter, filter[i:i+1])
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func isBPFWordChar(r rune, inBrackets bool) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '/' || r == '_' || r == '-' || (r == ':' && !inBrackets)
+}
+
+// bpfNode is a node of a parsed filter: bpfAnd, bpfOr, bpfNot, bpfPort or
+// bpfTest.  The bpfPort nodes are lowered to tests before compiling.
+type bpfNode interface{}
+
+type bpfAnd struct{ a, b bpfNode }
+
+type bpfOr struct{ a, b bpfNode }
+
+type bpfNot struct{ a bpfNode }
+
+// bpfTest runs loads, which leave a value in the A register, masks it if mask
+// isn't 0 and compares it with val.
+type bpfTest struct {
+	loads []bpf.Instruction
+	mask  uint32
+	cond  bpf.JumpTest
+	val   uint32
+}
+
+// bpfPort matches the packets of proto, UDP or TCP when 0, from or to any of
+// ports.  The port primitives of a filter joined by or are merged into one, so
+// the EtherType and protocol are tested once rather than for every port.
+type bpfPort struct {
+	proto uint32
+	dir   string // src, dst or empty for either
+	ports []uint32
+}
+
+// bpfAll matches if all nodes match.
+func bpfAll(nodes ...bpfNode) bpfNode {
+	n := nodes[0]
+	for _, next := range nodes[1:] {
+		n = bpfAnd{n, next}
+	}
+	return n
+}
+
+// bpfAny matches if any of nodes matches.
+func bpfAny(nodes ...bpfNode) bpfNode {
+	n := nodes[0]
+	for _, next := range nodes[1:] {
+		n = bpfOr{n, next}
+	}
+	return n
+}
+
+type bpfParser struct {
+	tokens   []string
+	pos      int
+	ethernet bool
+	nh       uint32 // offset of the IP header
+}
+
+func (p *bpfParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *bpfParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *bpfParser) expect(want string) error {
+	if tok := p.next(); tok != want {
+		return p.unexpected(tok, want)
+	}
+	return nil
+}
+
+func (p *bpfParser) unexpected(tok, want string) error {
+	if tok == "" {
+		return fmt.Errorf("invalid filter: expected %s at the end", want)
+	}
+	return fmt.Errorf("invalid filter: expected %s, got %q", want, tok)
+}
+
+// parseExpr parses unary expressions joined by and and or, which have the
+// same precedence in libpcap.
+func (p *bpfParser) parseExpr() (bpfNode, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "and", "&&":
+			p.next()
+			b, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			n = bpfAnd{n, b}
+		case "or", "||":
+			p.next()
+			b, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			n = bpfMergeOr(n, b)
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *bpfParser) parseUnary() (bpfNode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return bpfNot{n}, nil
+	case "(":
+		p.next()
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	}
+	return p.parsePrimitive()
+}
+
+func (p *bpfParser) parsePrimitive() (bpfNode, error) {
+	tok := p.next()
+	switch tok {
+	case "ip", "ip6":
+		switch p.peek() {
+		case "proto":
+			p.next()
+			proto, err := p.parseProto()
+			if err != nil {
+				return nil, err
+			}
+			return p.ipProto(tok == "ip6", proto), nil
+		case "[":
+			return p.parseRelation(tok == "ip6")
+		}
+		if tok == "ip6" {
+			return p.isIPv6(), nil
+		}
+		return p.isIPv4(), nil
+	case "udp", "tcp":
+		proto := ipProtoNumbers[tok]
+		switch p.peek() {
+		case "port", "src", "dst":
+			return p.parsePort(proto)
+		}
+		return bpfAny(p.ipProto(false, proto), p.ipProto(true, proto)), nil
+	case "port":
+		p.pos--
+		return p.parsePort(0)
+	case "src", "dst":
+		switch p.peek() {
+		case "port":
+			p.pos--
+			return p.parsePort(0)
+		case "net", "host":
+			p.next()
+			return p.parseNet(tok, p.tokens[p.pos-1] == "host")
+		}
+		return nil, p.unexpected(p.peek(), "port, net or host")
+	case "net", "host":
+		return p.parseNet("", tok == "host")
+	case "vlan":
+		present := bpfTest{loads: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtVLANTagPresent}}, cond: bpf.JumpNotEqual, val: 0}
+		if !isBPFNumber(p.peek()) {
+			return present, nil
+		}
+		vid, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		if vid > 4095 {
+			return nil, fmt.Errorf("invalid filter: VLAN ID %d out of range", vid)
+		}
+		tag := bpfTest{loads: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtVLANTag}}, mask: 0x0fff, cond: bpf.JumpEqual, val: vid}
+		return bpfAll(present, tag), nil
+	}
+	return nil, p.unexpected(tok, "a filter primitive")
+}
+
+// ipProtoNumbers are the protocol names accepted by proto.
+var ipProtoNumbers = map[string]uint32{"icmp": 1, "tcp": 6, "udp": 17, "icmp6": 58}
+
+func (p *bpfParser) parseProto() (uint32, error) {
+	if proto, ok := ipProtoNumbers[p.peek()]; ok {
+		p.next()
+		return proto, nil
+	}
+	proto, err := p.parseNumber()
+	if err == nil && proto > 255 {
+		err = fmt.Errorf("invalid filter: protocol %d out of range", proto)
+	}
+	return proto, err
+}
+
+func isBPFNumber(tok string) bool {
+	_, err := strconv.ParseUint(tok, 0, 32)
+	return err == nil
+}
+
+func (p *bpfParser) parseNumber() (uint32, error) {
+	tok := p.next()
+	n, err := strconv.ParseUint(tok, 0, 32)
+	if err != nil {
+		return 0, p.unexpected(tok, "a number")
+	}
+	return uint32(n), nil
+}
+
+// parsePort parses [src|dst] port <n> of proto, or of UDP and TCP when proto
+// is 0.
+func (p *bpfParser) parsePort(proto uint32) (bpfNode, error) {
+	dir := ""
+	if tok := p.peek(); tok == "src" || tok == "dst" {
+		dir = p.next()
+	}
+	if err := p.expect("port"); err != nil {
+		return nil, err
+	}
+	port, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+	if port > 65535 {
+		return nil, fmt.Errorf("invalid filter: port %d out of range", port)
+	}
+	return bpfPort{proto: proto, dir: dir, ports: []uint32{port}}, nil
+}
+
+// bpfMergeOr joins a and b with or, merging b into a, or into the last operand
+// of a, if both are port primitives of the same protocol and direction.
+func bpfMergeOr(a, b bpfNode) bpfNode {
+	pb, ok := b.(bpfPort)
+	if !ok {
+		return bpfOr{a, b}
+	}
+	switch a := a.(type) {
+	case bpfPort:
+		if a.proto == pb.proto && a.dir == pb.dir {
+			a.ports = append(slices.Clone(a.ports), pb.ports...)
+			return a
+		}
+	case bpfOr:
+		if last, ok := a.b.(bpfPort); ok && last.proto == pb.proto && last.dir == pb.dir {
+			return bpfOr{a.a, bpfMergeOr(last, pb)}
+		}
+	}
+	return bpfOr{a, b}
+}
+
+// lower replaces the bpfPort nodes of n with their tests.
+func (p *bpfParser) lower(n bpfNode) bpfNode {
+	switch n := n.(type) {
+	case bpfAnd:
+		return bpfAnd{p.lower(n.a), p.lower(n.b)}
+	case bpfOr:
+		return bpfOr{p.lower(n.a), p.lower(n.b)}
+	case bpfNot:
+		return bpfNot{p.lower(n.a)}
+	case bpfPort:
+		return p.port(n)
+	}
+	return n
+}
+
+// port matches the packets of n, which have to be the first IPv4 fragment or
+// IPv6 without extension headers, like in libpcap.  Every value is loaded once
+// and then compared with each port: a failed comparison leaves the A and X
+// registers alone for the next one.
+func (p *bpfParser) port(n bpfPort) bpfNode {
+	var offsets []uint32
+	if n.dir != "dst" {
+		offsets = append(offsets, 0)
+	}
+	if n.dir != "src" {
+		offsets = append(offsets, 2)
+	}
+	protos := []uint32{n.proto}
+	if n.proto == 0 {
+		protos = []uint32{ipProtoNumbers["udp"], ipProtoNumbers["tcp"]}
+	}
+
+	var v4, v6 []bpfNode
+	for i, off := range offsets {
+		for j, port := range n.ports {
+			t4 := bpfTest{cond: bpf.JumpEqual, val: port}
+			t6 := bpfTest{cond: bpf.JumpEqual, val: port}
+			if j == 0 {
+				if i == 0 {
+					// X is the length of the IPv4 header
+					t4.loads = append(t4.loads, bpf.LoadMemShift{Off: p.nh})
+				}
+				t4.loads = append(t4.loads, bpf.LoadIndirect{Off: p.nh + off, Size: 2})
+				t6.loads = []bpf.Instruction{bpf.LoadAbsolute{Off: p.nh + 40 + off, Size: 2}}
+			}
+			v4, v6 = append(v4, t4), append(v6, t6)
+		}
+	}
+	firstFragment := p.load(p.nh+6, 2, 0x1fff, bpf.JumpEqual, 0)
+	return bpfAny(
+		bpfAll(p.isIPv4(), p.anyValue(p.nh+9, 1, protos), firstFragment, bpfAny(v4...)),
+		bpfAll(p.isIPv6(), p.anyValue(p.nh+6, 1, protos), bpfAny(v6...)),
+	)
+}
+
+// anyValue matches the packets with any of vals at off, loading it once.
+func (p *bpfParser) anyValue(off uint32, size int, vals []uint32) bpfNode {
+	tests := make([]bpfNode, len(vals))
+	for i, val := range vals {
+		t := bpfTest{cond: bpf.JumpEqual, val: val}
+		if i == 0 {
+			t = p.load(off, size, 0, bpf.JumpEqual, val)
+		}
+		tests[i] = t
+	}
+	return bpfAny(tests...)
+}
+
+// parseNet parses net <cidr> or host <ip> of the source and/or destination
+// address selected by dir.
+func (p *bpfParser) parseNet(dir string, host bool) (bpfNode, error) {
+	tok := p.next()
+	var ipnet *net.IPNet
+	if host {
+		ip := net.ParseIP(tok)
+		if ip == nil {
+			return nil, p.unexpected(tok, "an IP address")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		_, n, err := net.ParseCIDR(tok)
+		if err != nil {
+			return nil, p.unexpected(tok, "a network in CIDR notation")
+		}
+		ipnet = n
+	}
+
+	var nodes []bpfNode
+	if dir != "dst" {
+		nodes = append(nodes, p.addr(ipnet, false))
+	}
+	if dir != "src" {
+		nodes = append(nodes, p.addr(ipnet, true))
+	}
+	return bpfAny(nodes...), nil
+}
+
+// addr matches the packets whose source, or destination address is in ipnet.
+func (p *bpfParser) addr(ipnet *net.IPNet, dst bool) bpfNode {
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		off := p.nh + 12
+		if dst {
+			off += 4
+		}
+		mask := binary.BigEndian.Uint32(ipnet.Mask)
+		if mask == 0 {
+			return p.isIPv4()
+		}
+		return bpfAll(p.isIPv4(), p.load(off, 4, mask, bpf.JumpEqual, binary.BigEndian.Uint32(ip4)&mask))
+	}
+
+	off := p.nh + 8
+	if dst {
+		off += 16
+	}
+	nodes := []bpfNode{p.isIPv6()}
+	for i := uint32(0); i < 4; i++ {
+		mask := binary.BigEndian.Uint32(ipnet.Mask[4*i:])
+		if mask == 0 {
+			break
+		}
+		nodes = append(nodes, p.load(off+4*i, 4, mask, bpf.JumpEqual, binary.BigEndian.Uint32(ipnet.IP[4*i:])&mask))
+	}
+	return bpfAll(nodes...)
+}
+
+// parseRelation parses [<offset>:<size>] [& <mask>] <relop> <n> after ip or
+// ip6.
+func (p *bpfParser) parseRelation(ipv6 bool) (bpfNode, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	off, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+	size := uint32(1)
+	if p.peek() == ":" {
+		p.next()
+		if size, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+		if size != 1 && size != 2 && size != 4 {
+			return nil, fmt.Errorf("invalid filter: size must be 1, 2 or 4, got %d", size)
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	var mask uint32
+	if p.peek() == "&" {
+		p.next()
+		if mask, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+	}
+	op := p.next()
+	cond, ok := bpfRelops[op]
+	if !ok {
+		return nil, p.unexpected(op, "a comparison")
+	}
+	val, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+	if ipv6 {
+		return bpfAll(p.isIPv6(), p.load(p.nh+off, int(size), mask, cond, val)), nil
+	}
+	return bpfAll(p.isIPv4(), p.load(p.nh+off, int(size), mask, cond, val)), nil
+}
+
+var bpfRelops = map[string]bpf.JumpTest{
+	"=":  bpf.JumpEqual,
+	"==": bpf.JumpEqual,
+	"!=": bpf.JumpNotEqual,
+	">":  bpf.JumpGreaterThan,
+	"<":  bpf.JumpLessThan,
+	">=": bpf.JumpGreaterOrEqual,
+	"<=": bpf.JumpLessOrEqual,
+}
+
+func (p *bpfParser) load(off uint32, size int, mask uint32, cond bpf.JumpTest, val uint32) bpfTest {
+	return bpfTest{loads: []bpf.Instruction{bpf.LoadAbsolute{Off: off, Size: size}}, mask: mask, cond: cond, val: val}
+}
+
+// isIPv4 matches IPv4 packets by their EtherType, or the version of their IP
+// header when there is no Ethernet header.
+func (p *bpfParser) isIPv4() bpfNode {
+	if p.ethernet {
+		return p.load(12, 2, 0, bpf.JumpEqual, 0x0800)
+	}
+	return p.load(0, 1, 0xf0, bpf.JumpEqual, 0x40)
+}
+
+func (p *bpfParser) isIPv6() bpfNode {
+	if p.ethernet {
+		return p.load(12, 2, 0, bpf.JumpEqual, 0x86dd)
+	}
+	return p.load(0, 1, 0xf0, bpf.JumpEqual, 0x60)
+}
+
+// ipProto matches the IPv4 or IPv6 packets of proto.
+func (p *bpfParser) ipProto(ipv6 bool, proto uint32) bpfNode {
+	if ipv6 {
+		return bpfAll(p.isIPv6(), p.load(p.nh+6, 1, 0, bpf.JumpEqual, proto))
+	}
+	return bpfAll(p.isIPv4(), p.load(p.nh+9, 1, 0, bpf.JumpEqual, proto))
+}
+
+// bpfCompiler generates the instructions of a bpfNode.  Every test jumps
+// forward to a label, which are resolved once all instructions are known.
+type bpfCompiler struct {
+	prog   []bpfInstruction
+	labels []int // instruction index of each label
+}
+
+type bpfInstruction struct {
+	ins    bpf.Instruction
+	jump   bool // a conditional jump to jt or jf
+	always bool // an unconditional jump to jt
+	cond   bpf.JumpTest
+	val    uint32
+	jt, jf int
+}
+
+func (c *bpfCompiler) newLabel() int {
+	c.labels = append(c.labels, -1)
+	return len(c.labels) - 1
+}
+
+func (c *bpfCompiler) place(label int) {
+	c.labels[label] = len(c.prog)
+}
+
+func (c *bpfCompiler) emit(ins bpf.Instruction) {
+	c.prog = append(c.prog, bpfInstruction{ins: ins})
+}
+
+// gen generates n, which continues at label t if it matches and at f if not.
+func (c *bpfCompiler) gen(n bpfNode, t, f int) {
+	switch n := n.(type) {
+	case bpfAnd:
+		mid := c.newLabel()
+		c.gen(n.a, mid, f)
+		c.place(mid)
+		c.gen(n.b, t, f)
+	case bpfOr:
+		mid := c.newLabel()
+		c.gen(n.a, t, mid)
+		c.place(mid)
+		c.gen(n.b, t, f)
+	case bpfNot:
+		c.gen(n.a, f, t)
+	case bpfTest:
+		for _, ins := range n.loads {
+			c.emit(ins)
+		}
+		if n.mask != 0 {
+			c.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+		}
+		c.prog = append(c.prog, bpfInstruction{jump: true, cond: n.cond, val: n.val, jt: t, jf: f})
+	}
+}
+
+// resolve turns the jumps to labels into relative jumps.  A conditional jump
+// can only skip 255 instructions, so a farther one jumps to an unconditional
+// jump right after it instead, which can skip any number of them.
+func (c *bpfCompiler) resolve() ([]bpf.Instruction, error) {
+	for i := 0; i < len(c.prog); i++ {
+		ins := &c.prog[i]
+		if !ins.jump {
+			continue
+		}
+		if c.labels[ins.jt]-i-1 > 255 {
+			ins.jt = c.trampoline(i, ins.jt)
+			i = -1 // the inserted jump moved what comes after it
+			continue
+		}
+		if c.labels[ins.jf]-i-1 > 255 {
+			ins.jf = c.trampoline(i, ins.jf)
+			i = -1
+		}
+	}
+	if len(c.prog) > bpfMaxInstructions {
+		return nil, fmt.Errorf("filter is too long: %d instructions, at most %d are allowed", len(c.prog), bpfMaxInstructions)
+	}
+
+	prog := make([]bpf.Instruction, len(c.prog))
+	for i, ins := range c.prog {
+		switch {
+		case ins.always:
+			prog[i] = bpf.Jump{Skip: uint32(c.labels[ins.jt] - i - 1)}
+		case ins.jump:
+			skipTrue, skipFalse := c.labels[ins.jt]-i-1, c.labels[ins.jf]-i-1
+			prog[i] = bpf.JumpIf{Cond: ins.cond, Val: ins.val, SkipTrue: uint8(skipTrue), SkipFalse: uint8(skipFalse)}
+		default:
+			prog[i] = ins.ins
+		}
+	}
+	return prog, nil
+}
+
+// trampoline inserts an unconditional jump to target right after the jump at
+// i and returns the label of the inserted jump.
+func (c *bpfCompiler) trampoline(i, target int) int {
+	for label, at := range c.labels {
+		if at > i {
+			c.labels[label]++
+		}
+	}
+	c.prog = slices.Insert(c.prog, i+1, bpfInstruction{always: true, jt: target})
+	label := c.newLabel()
+	c.labels[label] = i + 1
+	return label
+}
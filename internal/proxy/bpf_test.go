@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// bpfTestPacket builds a UDP packet from src to dst, with an Ethernet header
+// if ethernet is true.  A non-zero fragOffset makes it a non-first IPv4
+// fragment.
+func bpfTestPacket(t *testing.T, ethernet bool, src, dst string, sport, dport uint16, fragOffset uint16) []byte {
+	t.Helper()
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+	var netLayer gopacket.SerializableLayer
+	etherType := layers.EthernetTypeIPv4
+	if srcIP.To4() != nil {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: dstIP.To4(), FragOffset: fragOffset}
+		_ = udp.SetNetworkLayerForChecksum(ip)
+		netLayer = ip
+	} else {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dstIP}
+		_ = udp.SetNetworkLayerForChecksum(ip)
+		netLayer = ip
+		etherType = layers.EthernetTypeIPv6
+	}
+
+	var stack []gopacket.SerializableLayer
+	if ethernet {
+		stack = append(stack, &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			EthernetType: etherType,
+		})
+	}
+	stack = append(stack, netLayer, udp, gopacket.Payload("hello"))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, stack...); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func runBPF(t *testing.T, filter string, ethernet bool, pkt []byte) bool {
+	t.Helper()
+	raw, err := CompileBPFFilter(filter, ethernet)
+	if err != nil {
+		t.Fatalf("CompileBPFFilter(%q): %v", filter, err)
+	}
+	prog := make([]bpf.Instruction, len(raw))
+	for i, ins := range raw {
+		prog[i] = ins.Disassemble()
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("NewVM(%q): %v", filter, err)
+	}
+	n, err := vm.Run(pkt)
+	if err != nil {
+		t.Fatalf("Run(%q): %v", filter, err)
+	}
+	return n > 0
+}
+
+func TestCompileBPFFilter(t *testing.T) {
+	// The filter BuildBPFFilter in the config package generates.
+	const relay = "(udp port 9003 or udp port 6112 or (ip proto 17 and ip[6:2] & 0x1fff != 0) or (ip6 proto 44 and ip6[40] == 17)) and (src net 192.168.1.0/24 or src net fd00::/64)"
+
+	tests := []struct {
+		name   string
+		filter string
+		src    string
+		dst    string
+		dport  uint16
+		frag   uint16
+		want   bool
+	}{
+		{"port", "udp port 9003", "10.0.0.1", "10.0.0.2", 9003, 0, true},
+		{"other port", "udp port 9003", "10.0.0.1", "10.0.0.2", 9004, 0, false},
+		{"ipv6 port", "udp port 9003", "fd00::1", "ff02::1", 9003, 0, true},
+		{"dst port", "udp dst port 9003", "10.0.0.1", "10.0.0.2", 9003, 0, true},
+		{"src port", "src port 9003", "10.0.0.1", "10.0.0.2", 9003, 0, false},
+		{"tcp port", "tcp port 9003", "10.0.0.1", "10.0.0.2", 9003, 0, false},
+		{"not", "not udp port 9003", "10.0.0.1", "10.0.0.2", 9004, 0, true},
+		{"ip6", "ip6", "10.0.0.1", "10.0.0.2", 9003, 0, false},
+		{"host", "dst host 10.0.0.2 && udp", "10.0.0.1", "10.0.0.2", 9003, 0, true},
+		{"loopback", "src net ::1/128 or src net 127.0.0.0/8", "::1", "::1", 9003, 0, true},
+		{"relay", relay, "192.168.1.10", "192.168.1.255", 9003, 0, true},
+		{"relay other net", relay, "192.168.2.10", "192.168.1.255", 9003, 0, false},
+		{"relay other port", relay, "192.168.1.10", "192.168.1.255", 53, 0, false},
+		{"relay fragment", relay, "192.168.1.10", "192.168.1.255", 53, 100, true},
+		{"relay ipv6", relay, "fd00::10", "ff02::1", 6112, 0, true},
+		{"relay other ipv6 net", relay, "fd00:0:0:1::10", "ff02::1", 6112, 0, false},
+	}
+	for _, tt := range tests {
+		for _, ethernet := range []bool{true, false} {
+			pkt := bpfTestPacket(t, ethernet, tt.src, tt.dst, 1234, tt.dport, tt.frag)
+			if got := runBPF(t, tt.filter, ethernet, pkt); got != tt.want {
+				t.Errorf("%s (ethernet %v): %q matched %v, want %v", tt.name, ethernet, tt.filter, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCompileBPFFilter_VLAN(t *testing.T) {
+	// The VM doesn't support the VLAN extensions, so only check that the
+	// filters of vlan captures compile.
+	for _, filter := range []string{"vlan", "vlan 10", "vlan and ((udp port 9003) or (vlan 10 and udp port 6112))"} {
+		if _, err := CompileBPFFilter(filter, true); err != nil {
+			t.Errorf("CompileBPFFilter(%q): %v", filter, err)
+		}
+	}
+}
+
+func TestCompileBPFFilter_Invalid(t *testing.T) {
+	for _, filter := range []string{"", "udp port", "udp port 70000", "(udp", "net 10.0.0.0", "ip[6:3] = 0", "vlan 4096", "arp", "udp port 1 or"} {
+		if _, err := CompileBPFFilter(filter, true); err == nil {
+			t.Errorf("CompileBPFFilter(%q) succeeded", filter)
+		}
+	}
+}
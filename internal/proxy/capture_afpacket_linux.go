@@ -0,0 +1,473 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+var afpacket = captureBackend{
+	name:       CaptureAFPacket,
+	findDevs:   findNetlinkDevs,
+	openReader: openAFPacketReader,
+	openWriter: openAFPacketWriter,
+}
+
+// The TPACKET_V3 ring of a capture: the kernel fills blocks of packets and
+// hands each over once it's full or after the read timeout.
+const (
+	afpacketBlockSize = 128 * 1024
+	afpacketBlocks    = 8
+	afpacketFrameSize = 2048
+)
+
+// findNetlinkDevs returns the interfaces with their addresses from rtnetlink.
+func findNetlinkDevs() ([]Interface, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the addresses from rtnetlink: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse rtnetlink message: %w", err)
+	}
+
+	addresses := make(map[int][]InterfaceAddress)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		// struct ifaddrmsg
+		family, prefixLen := m.Data[0], int(m.Data[1])
+		index := int(binary.NativeEndian.Uint32(m.Data[4:8]))
+		bits := 8 * net.IPv4len
+		if family == syscall.AF_INET6 {
+			bits = 8 * net.IPv6len
+		} else if family != syscall.AF_INET {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse rtnetlink message: %w", err)
+		}
+		var local, address, broadcast net.IP
+		for _, attr := range attrs {
+			ip := net.IP(append([]byte(nil), attr.Value...))
+			switch attr.Attr.Type {
+			case syscall.IFA_LOCAL:
+				local = ip
+			case syscall.IFA_ADDRESS:
+				address = ip
+			case syscall.IFA_BROADCAST:
+				broadcast = ip
+			}
+		}
+
+		// IFA_ADDRESS is the address of the other end of point to point
+		// links, which have their own address in IFA_LOCAL.
+		a := InterfaceAddress{IP: address, Netmask: net.CIDRMask(prefixLen, bits), Broadaddr: broadcast}
+		if local != nil {
+			a.IP = local
+			if address != nil && !address.Equal(local) {
+				a.P2P = address
+			}
+		}
+		if a.IP == nil {
+			continue
+		}
+		addresses[index] = append(addresses[index], a)
+	}
+
+	ifs := make([]Interface, 0, len(ifis))
+	for _, ifi := range ifis {
+		ifs = append(ifs, Interface{Name: ifi.Name, Addresses: addresses[ifi.Index], MTU: ifi.MTU})
+	}
+	return ifs, nil
+}
+
+// interfaceHardwareType returns the ARPHRD_* type of iname.
+func interfaceHardwareType(iname string) (uint16, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq(iname)
+	if err != nil {
+		return 0, err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFHWADDR, ifr); err != nil {
+		return 0, fmt.Errorf("unable to get the hardware type of %s: %w", iname, err)
+	}
+	// ifr_hwaddr.sa_family
+	return ifr.Uint16(), nil
+}
+
+// afpacketLinkType returns the link type of the packets captured on an
+// interface of hardware type hatype, like libpcap: Ethernet and loopback
+// interfaces are captured with their Ethernet header, tun devices without any
+// header and all others in cooked mode.
+func afpacketLinkType(hatype uint16) layers.LinkType {
+	switch hatype {
+	case unix.ARPHRD_ETHER, unix.ARPHRD_LOOPBACK:
+		return layers.LinkTypeEthernet
+	case unix.ARPHRD_NONE, unix.ARPHRD_RAWIP:
+		return layers.LinkTypeRaw
+	}
+	return layers.LinkTypeLinuxSLL2
+}
+
+// AFPacketHandle captures the packets arriving on an interface with an
+// AF_PACKET socket and a TPACKET_V3 ring, without libpcap.
+type AFPacketHandle struct {
+	iname    string
+	ifindex  int
+	linkType layers.LinkType
+	fd       int
+	wakeFd   int // eventfd interrupting the poll on Close
+	ring     []byte
+	timeout  time.Duration
+
+	fdMu      sync.RWMutex // protects fd from being closed while in use
+	mu        sync.Mutex   // serializes reading and unmapping the ring
+	block     int          // the block being read
+	inBlock   bool         // whether the block was handed over by the kernel
+	remaining uint32       // packets left in the block
+	offset    uint32       // of the next packet in the block
+
+	closed    atomic.Bool
+	closeOnce sync.Once
+}
+
+// openAFPacketReader opens an AFPacketHandle on iname, or on every interface
+// for the any pseudo-interface.
+func openAFPacketReader(iname string, promisc bool, timeout time.Duration) (CaptureHandle, error) {
+	h := &AFPacketHandle{iname: iname, linkType: layers.LinkTypeLinuxSLL2, timeout: timeout, fd: -1, wakeFd: -1}
+	if iname != AnyInterface {
+		ifi, err := net.InterfaceByName(iname)
+		if err != nil {
+			return nil, err
+		}
+		hatype, err := interfaceHardwareType(iname)
+		if err != nil {
+			return nil, err
+		}
+		h.ifindex = ifi.Index
+		h.linkType = afpacketLinkType(hatype)
+	}
+	if err := h.open(promisc); err != nil {
+		h.release()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *AFPacketHandle) open(promisc bool) error {
+	// Only Ethernet headers are captured, the others are in cooked mode
+	// where the kernel strips the link-layer header.
+	sotype := unix.SOCK_DGRAM
+	if h.linkType == layers.LinkTypeEthernet {
+		sotype = unix.SOCK_RAW
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, sotype|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open packet socket on %s: %w", h.iname, err)
+	}
+	h.fd = fd
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("unable to use TPACKET_V3 on %s: %w", h.iname, err)
+	}
+	req := unix.TpacketReq3{
+		Block_size:     afpacketBlockSize,
+		Block_nr:       afpacketBlocks,
+		Frame_size:     afpacketFrameSize,
+		Frame_nr:       afpacketBlockSize * afpacketBlocks / afpacketFrameSize,
+		Retire_blk_tov: uint32(h.timeout.Milliseconds()),
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("unable to set up the packet ring on %s: %w", h.iname, err)
+	}
+	h.ring, err = unix.Mmap(fd, 0, afpacketBlockSize*afpacketBlocks, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("unable to map the packet ring on %s: %w", h.iname, err)
+	}
+
+	// Like libpcap's direction in, there is no need to copy the packets we
+	// send to the ring.  Older kernels don't support it, so the outgoing
+	// packets are skipped in ReadPacketData as well.
+	_ = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1)
+
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: h.ifindex}); err != nil {
+		return fmt.Errorf("unable to bind packet socket to %s: %w", h.iname, err)
+	}
+	if promisc && h.ifindex != 0 {
+		mreq := unix.PacketMreq{Ifindex: int32(h.ifindex), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+			return fmt.Errorf("unable to enable promiscuous mode on %s: %w", h.iname, err)
+		}
+	}
+
+	h.wakeFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("unable to open eventfd: %w", err)
+	}
+	return nil
+}
+
+// LinkType returns the link type of the captured packets.
+func (h *AFPacketHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+// SetBPFFilter compiles filter with CompileBPFFilter and attaches it to the
+// socket, or removes the filter if it's empty.
+func (h *AFPacketHandle) SetBPFFilter(filter string) error {
+	h.fdMu.RLock()
+	defer h.fdMu.RUnlock()
+	if h.closed.Load() {
+		return fmt.Errorf("capture on %s is closed", h.iname)
+	}
+	if filter == "" {
+		err := unix.SetsockoptInt(h.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+		if errors.Is(err, unix.ENOENT) {
+			// there was no filter
+			return nil
+		}
+		return err
+	}
+	prog, err := CompileBPFFilter(filter, h.linkType == layers.LinkTypeEthernet)
+	if err != nil {
+		return err
+	}
+	return attachBPFFilter(h.fd, prog)
+}
+
+func attachBPFFilter(fd int, prog []bpf.RawInstruction) error {
+	filter := make([]unix.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	fprog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog)
+}
+
+// ReadPacketData returns the next packet, a timeout error if there was none
+// within the timeout or io.EOF once the handle is closed or the interface
+// went down or away.
+func (h *AFPacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for {
+		if h.closed.Load() {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		block := h.ring[h.block*afpacketBlockSize : (h.block+1)*afpacketBlockSize]
+		// struct tpacket_block_desc, the status is shared with the kernel
+		status := (*uint32)(unsafe.Pointer(&block[8]))
+
+		if !h.inBlock {
+			if atomic.LoadUint32(status)&unix.TP_STATUS_USER == 0 {
+				if err := h.wait(); err != nil {
+					return nil, gopacket.CaptureInfo{}, err
+				}
+				continue
+			}
+			h.inBlock = true
+			h.remaining = binary.NativeEndian.Uint32(block[12:16])
+			h.offset = binary.NativeEndian.Uint32(block[16:20])
+		}
+		if h.remaining == 0 {
+			// hand the block back to the kernel
+			atomic.StoreUint32(status, unix.TP_STATUS_KERNEL)
+			h.inBlock = false
+			h.block = (h.block + 1) % afpacketBlocks
+			continue
+		}
+
+		hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&block[h.offset]))
+		sll := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&block[h.offset+afpacketHdrLen]))
+		frame := block[h.offset+uint32(hdr.Mac) : h.offset+uint32(hdr.Mac)+hdr.Snaplen]
+		h.remaining--
+		h.offset += hdr.Next_offset
+
+		if sll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		data, length := h.packetData(hdr, sll, frame)
+		ci := gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(hdr.Sec), int64(hdr.Nsec)),
+			CaptureLength:  len(data),
+			Length:         length,
+			InterfaceIndex: int(sll.Ifindex),
+		}
+		return data, ci, nil
+	}
+}
+
+// afpacketHdrLen is TPACKET_ALIGN(sizeof(struct tpacket3_hdr)), where the
+// struct sockaddr_ll of the packet starts.
+const afpacketHdrLen = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+
+// sll2HeaderLen is the length of a Linux cooked capture v2 header.
+const sll2HeaderLen = 20
+
+// packetData copies the frame out of the ring in the format of the link type
+// and returns it with its original length.  Ethernet frames get back the VLAN
+// tag the kernel stripped and cooked ones an SLL2 header.
+func (h *AFPacketHandle) packetData(hdr *unix.Tpacket3Hdr, sll *unix.RawSockaddrLinklayer, frame []byte) ([]byte, int) {
+	length := int(hdr.Len)
+	switch {
+	case h.linkType == layers.LinkTypeEthernet && hdr.Status&unix.TP_STATUS_VLAN_VALID != 0 && len(frame) >= 12:
+		tpid := uint16(layers.EthernetTypeDot1Q)
+		if hdr.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tpid = hdr.Hv1.Vlan_tpid
+		}
+		data := make([]byte, 0, len(frame)+4)
+		data = append(data, frame[:12]...)
+		data = binary.BigEndian.AppendUint16(data, tpid)
+		data = binary.BigEndian.AppendUint16(data, uint16(hdr.Hv1.Vlan_tci))
+		data = append(data, frame[12:]...)
+		return data, length + 4
+	case h.linkType == layers.LinkTypeLinuxSLL2:
+		data := make([]byte, sll2HeaderLen, sll2HeaderLen+len(frame))
+		// sll_protocol is already in network byte order
+		*(*uint16)(unsafe.Pointer(&data[0])) = sll.Protocol
+		binary.BigEndian.PutUint32(data[4:8], uint32(sll.Ifindex))
+		binary.BigEndian.PutUint16(data[8:10], sll.Hatype)
+		data[10] = sll.Pkttype
+		data[11] = sll.Halen
+		copy(data[12:20], sll.Addr[:])
+		return append(data, frame...), length + sll2HeaderLen
+	}
+	return append([]byte(nil), frame...), length
+}
+
+// wait waits up to the timeout for the kernel to hand over the current
+// block.
+func (h *AFPacketHandle) wait() error {
+	timeout := -1
+	if h.timeout > 0 {
+		timeout = int(h.timeout.Milliseconds())
+	}
+	fds := []unix.PollFd{
+		{Fd: int32(h.fd), Events: unix.POLLIN},
+		{Fd: int32(h.wakeFd), Events: unix.POLLIN},
+	}
+	n, err := unix.Poll(fds, timeout)
+	switch {
+	case errors.Is(err, unix.EINTR):
+		return nil
+	case err != nil:
+		return err
+	case fds[1].Revents != 0 || h.closed.Load():
+		return io.EOF
+	case fds[0].Revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0:
+		// The interface went down or away.  Reading again won't return
+		// anything, so end the capture like libpcap does.
+		serr, _ := unix.GetsockoptInt(h.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		return fmt.Errorf("capture on %s ended: %w: %w", h.iname, unix.Errno(serr), io.EOF)
+	case n == 0:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close closes the socket, which ends a ReadPacketData in progress.
+func (h *AFPacketHandle) Close() {
+	h.closeOnce.Do(func() {
+		h.closed.Store(true)
+		if h.wakeFd >= 0 {
+			var one [8]byte
+			binary.NativeEndian.PutUint64(one[:], 1)
+			_, _ = unix.Write(h.wakeFd, one[:])
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.fdMu.Lock()
+		defer h.fdMu.Unlock()
+		h.release()
+	})
+}
+
+func (h *AFPacketHandle) release() {
+	if h.ring != nil {
+		_ = unix.Munmap(h.ring)
+		h.ring = nil
+	}
+	if h.fd >= 0 {
+		unix.Close(h.fd)
+		h.fd = -1
+	}
+	if h.wakeFd >= 0 {
+		unix.Close(h.wakeFd)
+		h.wakeFd = -1
+	}
+}
+
+// openAFPacketWriter opens a writer for iname matching the link type of its
+// AFPacketHandle: Ethernet frames are sent as they are and everything else in
+// cooked mode.
+func openAFPacketWriter(iname string) (PacketWriter, error) {
+	hatype, err := interfaceHardwareType(iname)
+	if err != nil {
+		return nil, err
+	}
+	lt := afpacketLinkType(hatype)
+	if lt != layers.LinkTypeEthernet {
+		return NewCookedWriter(iname, lt)
+	}
+	ifi, err := net.InterfaceByName(iname)
+	if err != nil {
+		return nil, err
+	}
+	// Protocol 0 so the socket never receives anything.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open packet socket on %s: %w", iname, err)
+	}
+	return &ethernetWriter{fd: fd, ifindex: ifi.Index}, nil
+}
+
+// ethernetWriter sends Ethernet frames on an interface.
+type ethernetWriter struct {
+	fd      int
+	ifindex int
+}
+
+func (w *ethernetWriter) WritePacketData(data []byte) error {
+	if len(data) < 14 {
+		return fmt.Errorf("short Ethernet frame")
+	}
+	return unix.Sendto(w.fd, data, 0, &unix.SockaddrLinklayer{
+		Protocol: htons(binary.BigEndian.Uint16(data[12:14])),
+		Ifindex:  w.ifindex,
+	})
+}
+
+func (w *ethernetWriter) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (w *ethernetWriter) Close() {
+	unix.Close(w.fd)
+}
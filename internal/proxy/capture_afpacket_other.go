@@ -0,0 +1,19 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoAFPacket = errors.New("the afpacket capture backend is only supported on Linux")
+
+var afpacket = captureBackend{
+	name:     CaptureAFPacket,
+	findDevs: func() ([]Interface, error) { return nil, errNoAFPacket },
+	openReader: func(string, bool, time.Duration) (CaptureHandle, error) {
+		return nil, errNoAFPacket
+	},
+	openWriter: func(string) (PacketWriter, error) { return nil, errNoAFPacket },
+}
@@ -0,0 +1,132 @@
+//go:build cgo
+
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+)
+
+// libpcapSupported is whether udp-proxy-2020 was built with libpcap, which
+// needs cgo.
+const libpcapSupported = true
+
+var libpcap = captureBackend{
+	name:       CaptureLibpcap,
+	findDevs:   findPcapDevs,
+	openReader: openPcapReader,
+	openWriter: openPcapWriter,
+}
+
+// findPcapDevs returns the interfaces libpcap can capture on.
+func findPcapDevs() ([]Interface, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	// libpcap doesn't report the MTU.
+	mtus := make(map[string]int)
+	if ifis, err := net.Interfaces(); err == nil {
+		for _, ifi := range ifis {
+			mtus[ifi.Name] = ifi.MTU
+		}
+	}
+	ifs := make([]Interface, 0, len(devs))
+	for _, dev := range devs {
+		iface := Interface{Name: dev.Name, MTU: mtus[dev.Name]}
+		for _, a := range dev.Addresses {
+			iface.Addresses = append(iface.Addresses, InterfaceAddress{
+				IP:        a.IP,
+				Netmask:   a.Netmask,
+				Broadaddr: a.Broadaddr,
+				P2P:       a.P2P,
+			})
+		}
+		ifs = append(ifs, iface)
+	}
+	return ifs, nil
+}
+
+// openPcapReader initializes a libpcap handle capturing the packets arriving
+// on the given interface.
+func openPcapReader(iname string, promisc bool, timeout time.Duration) (CaptureHandle, error) {
+	inactive, err := pcap.NewInactiveHandle(iname)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err = inactive.SetTimeout(timeout); err != nil {
+		return nil, err
+	}
+	if err = inactive.SetPromisc(promisc); err != nil {
+		return nil, err
+	}
+	if err = inactive.SetSnapLen(9000); err != nil {
+		return nil, err
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isValidLinkType(handle.LinkType()) {
+		handle.Close()
+		return nil, fmt.Errorf("interface %s has an unsupported link type: %s", iname, handle.LinkType())
+	}
+
+	if iname == AnyInterface {
+		// SLL2 has the index of the interface each packet arrived on.
+		// Older versions of libpcap only support SLL.
+		if err := handle.SetLinkType(layers.LinkTypeLinuxSLL2); err != nil {
+			slog.Debug("Unable to capture with SLL2 headers", slog.String("interface", iname), slog.String("error", err.Error()))
+		}
+	}
+
+	if err := handle.SetDirection(pcap.DirectionIn); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to set direction on interface %s: %w", iname, err)
+	}
+	return handle, nil
+}
+
+// openPcapWriter initializes a libpcap handle sending on the given interface.
+// libpcap can't inject on interfaces it only captures in cooked mode, so those
+// get a CookedWriter instead.
+func openPcapWriter(iname string) (PacketWriter, error) {
+	inactive, err := pcap.NewInactiveHandle(iname)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err = inactive.SetPromisc(false); err != nil {
+		return nil, err
+	}
+	if err = inactive.SetSnapLen(9000); err != nil {
+		return nil, err
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+
+	lt := handle.LinkType()
+	if !isValidLinkType(lt) {
+		handle.Close()
+		return nil, fmt.Errorf("interface %s has an unsupported link type: %s", iname, lt)
+	}
+	if IsCookedLinkType(lt) {
+		handle.Close()
+		slog.Debug("Sending in cooked mode", slog.String("interface", iname), slog.String("link_type", lt.String()))
+		return NewCookedWriter(iname, lt)
+	}
+	return handle, nil
+}
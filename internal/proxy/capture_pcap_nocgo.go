@@ -0,0 +1,23 @@
+//go:build !cgo
+
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+// libpcapSupported is whether udp-proxy-2020 was built with libpcap, which
+// needs cgo.
+const libpcapSupported = false
+
+var errNoLibpcap = errors.New("libpcap is not available, udp-proxy-2020 was built without cgo")
+
+var libpcap = captureBackend{
+	name:     CaptureLibpcap,
+	findDevs: func() ([]Interface, error) { return nil, errNoLibpcap },
+	openReader: func(string, bool, time.Duration) (CaptureHandle, error) {
+		return nil, errNoLibpcap
+	},
+	openWriter: func(string) (PacketWriter, error) { return nil, errNoLibpcap },
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// AnyInterface is the Linux pseudo-interface which captures from every
+// interface at once.  Packets captured on it have a Linux cooked (SLL/SLL2)
+// header instead of the header of the interface they arrived on, and nothing
+// can be sent on it.
+const AnyInterface = "any"
+
+// IsCookedLinkType reports whether lt is one of the Linux cooked capture link
+// types, which libpcap uses for the any pseudo-interface and for interfaces
+// whose link-layer header it can't capture, like PPP and some VPN drivers.
+func IsCookedLinkType(lt layers.LinkType) bool {
+	return lt == layers.LinkTypeLinuxSLL || lt == layers.LinkTypeLinuxSLL2
+}
+
+// PacketHardwareAddr returns the source MAC address of pkt from its Ethernet
+// or Linux cooked header, or nil for packets without one.
+func PacketHardwareAddr(pkt *Packet) net.HardwareAddr {
+	if pkt == nil || pkt.Packet == nil {
+		return nil
+	}
+	var addr net.HardwareAddr
+	if eth, ok := pkt.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		return eth.SrcMAC
+	} else if sll, ok := pkt.Packet.Layer(layers.LayerTypeLinuxSLL).(*layers.LinuxSLL); ok {
+		addr = sll.Addr
+	} else if sll2, ok := pkt.Packet.Layer(layers.LayerTypeLinuxSLL2).(*layers.LinuxSLL2); ok {
+		addr = sll2.Addr
+	}
+	// Cooked headers also carry the addresses of non-Ethernet links, like
+	// the 4 byte "address" of a GRE tunnel.
+	if len(addr) != 6 {
+		return nil
+	}
+	return addr
+}
+
+// PacketInterfaceIndex returns the index of the interface pkt was captured
+// on from its SLL2 header.  ok is false for every other link type.
+func PacketInterfaceIndex(pkt *Packet) (index int, ok bool) {
+	if pkt == nil || pkt.Packet == nil {
+		return 0, false
+	}
+	if sll2, isSLL2 := pkt.Packet.Layer(layers.LayerTypeLinuxSLL2).(*layers.LinuxSLL2); isSLL2 {
+		return int(sll2.InterfaceIndex), true
+	}
+	return 0, false
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// CookedWriter sends packets without a link-layer header on an interface
+// which is captured in cooked mode, where libpcap can't inject, or as raw IP.
+// The kernel adds the link-layer header, if the interface has one.
+type CookedWriter struct {
+	fd       int
+	ifindex  int
+	linkType layers.LinkType
+}
+
+// NewCookedWriter opens a CookedWriter on iname.  linkType is the link type
+// of the captures of the interface.
+func NewCookedWriter(iname string, linkType layers.LinkType) (*CookedWriter, error) {
+	if iname == AnyInterface {
+		return nil, fmt.Errorf("unable to send on the %s pseudo-interface", AnyInterface)
+	}
+	ifi, err := net.InterfaceByName(iname)
+	if err != nil {
+		return nil, err
+	}
+	// Protocol 0 so the socket never receives anything.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open packet socket on %s: %w", iname, err)
+	}
+	return &CookedWriter{fd: fd, ifindex: ifi.Index, linkType: linkType}, nil
+}
+
+// WritePacketData sends the IPv4 or IPv6 packet data.
+func (w *CookedWriter) WritePacketData(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty packet")
+	}
+	var proto uint16
+	switch data[0] >> 4 {
+	case 4:
+		proto = uint16(layers.EthernetTypeIPv4)
+	case 6:
+		proto = uint16(layers.EthernetTypeIPv6)
+	default:
+		return fmt.Errorf("unable to send non-IP packet in cooked mode")
+	}
+	return unix.Sendto(w.fd, data, 0, &unix.SockaddrLinklayer{
+		Protocol: htons(proto),
+		Ifindex:  w.ifindex,
+	})
+}
+
+// LinkType returns the cooked link type of the interface.
+func (w *CookedWriter) LinkType() layers.LinkType {
+	return w.linkType
+}
+
+func (w *CookedWriter) Close() {
+	unix.Close(w.fd)
+}
+
+// htons converts v to network byte order, as stored by the kernel in the
+// uint16 fields of a sockaddr_ll.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
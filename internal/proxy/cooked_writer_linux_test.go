@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHtons(t *testing.T) {
+	// Whatever the byte order of the host, the value is laid out in memory
+	// most significant byte first.
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], htons(unix.ETH_P_ALL))
+	if b != [2]byte{0x00, 0x03} {
+		t.Fatalf("htons(ETH_P_ALL) is stored as % x, want 00 03", b)
+	}
+	binary.NativeEndian.PutUint16(b[:], htons(unix.ETH_P_8021Q))
+	if b != [2]byte{0x81, 0x00} {
+		t.Fatalf("htons(ETH_P_8021Q) is stored as % x, want 81 00", b)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// CookedWriter is only supported on Linux, the only OS with cooked captures.
+type CookedWriter struct{}
+
+func NewCookedWriter(_ string, _ layers.LinkType) (*CookedWriter, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (w *CookedWriter) WritePacketData(_ []byte) error { return errors.ErrUnsupported }
+func (w *CookedWriter) LinkType() layers.LinkType      { return layers.LinkTypeLinuxSLL }
+func (w *CookedWriter) Close()                         {}
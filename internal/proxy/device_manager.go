@@ -1,21 +1,115 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"net"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 )
 
-// DeviceManager handles discovery and initialization of network interfaces.
-type DeviceManager struct {
+// DeviceManager handles discovery of the network interfaces and opens the
+// handles capturing and sending packets on them.  HostDeviceManager uses the
+// interfaces of the host, VirtualNetwork simulated ones for tests.
+type DeviceManager interface {
+	// Refresh updates the list of available interfaces and publishes a
+	// LinkEvent for every change.
+	Refresh() error
+	// Watch refreshes the interfaces whenever they change until ctx is
+	// cancelled.
+	Watch(ctx context.Context, interval time.Duration)
+	// Subscribe returns a channel receiving every published LinkEvent and a
+	// function to cancel the subscription.
+	Subscribe() (<-chan LinkEvent, func())
+
+	// InterfaceNames returns the sorted names of the available interfaces.
+	InterfaceNames() []string
+	// InterfaceAvailable reports whether iname is present and has an address.
+	InterfaceAvailable(iname string) bool
+	// Interface returns the flags, MTU and MAC address of iname, which
+	// exists even when it is down or has no address.
+	Interface(iname string) (*net.Interface, error)
+	// GetAddresses returns the addresses of an available interface.
+	GetAddresses(iname string) ([]InterfaceAddress, error)
+	// GetLoopback returns the name of the loopback interface.
+	GetLoopback() string
+	// ListInterfaces prints the available interfaces.
+	ListInterfaces()
+
+	// CreateReaderHandle opens the capture of iname, or returns the one
+	// already open.
+	CreateReaderHandle(iname string, promisc bool, timeout time.Duration) (CaptureHandle, error)
+	// CreateIsolatedWriter returns a writer sending on iname which is owned
+	// and closed by the caller.
+	CreateIsolatedWriter(iname string) (PacketWriter, error)
+	// Close closes the handle of iname opened for direction.
+	Close(iname string, direction PcapHandleDirection) error
+	// CloseHandles closes every open handle.
+	CloseHandles()
+}
+
+// CaptureHandle is a capture opened by CreateReaderHandle, like a
+// *pcap.Handle or an AFPacketHandle.  ReadPacketData returns io.EOF once the
+// handle is closed or the interface went away.
+type CaptureHandle interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	SetBPFFilter(filter string) error
+	Close()
+}
+
+// Interface is a network interface with its addresses, like pcap.Interface.
+type Interface struct {
+	Name      string
+	Addresses []InterfaceAddress
+	MTU       int // 0 if unknown
+}
+
+// InterfaceAddress is an address of an Interface, like pcap.InterfaceAddress.
+type InterfaceAddress struct {
+	IP        net.IP
+	Netmask   net.IPMask
+	Broadaddr net.IP // broadcast address, if any
+	P2P       net.IP // address of the other end of a point to point link, if any
+}
+
+// The capture backends of a HostDeviceManager.
+const (
+	CaptureLibpcap  = "libpcap"
+	CaptureAFPacket = "afpacket"
+)
+
+// CaptureBackends are the names of the capture backends.
+var CaptureBackends = []string{CaptureLibpcap, CaptureAFPacket}
+
+// captureBackend finds the interfaces of the host and opens them for a
+// HostDeviceManager.
+type captureBackend struct {
+	name       string
+	findDevs   func() ([]Interface, error)
+	openReader func(iname string, promisc bool, timeout time.Duration) (CaptureHandle, error)
+	openWriter func(iname string) (PacketWriter, error)
+}
+
+// HostDeviceManager is the DeviceManager of the interfaces of the host, which
+// are captured with libpcap or, on Linux, AF_PACKET sockets.
+type HostDeviceManager struct {
 	mu         sync.RWMutex
-	interfaces map[string]pcap.Interface
-	handles    map[string]*pcap.Handle
+	interfaces map[string]Interface
+	handles    map[string]CaptureHandle
+
+	linkSubscribers
+	backend   *captureBackend             // nil is libpcap
+	findDevs  func() ([]Interface, error) // replaceable for tests
+	refreshMu sync.Mutex                  // serializes Refresh
 }
 
 type PcapHandleDirection string
@@ -29,41 +123,79 @@ func deviceManagerKey(iname string, direction PcapHandleDirection) string {
 	return fmt.Sprintf("%s:%s", iname, direction)
 }
 
-// NewDeviceManager creates and initializes a new DeviceManager.
-func NewDeviceManager() (*DeviceManager, error) {
-	dm := &DeviceManager{
-		interfaces: make(map[string]pcap.Interface),
-		handles:    make(map[string]*pcap.Handle),
+// NewHostDeviceManager creates and initializes a HostDeviceManager capturing
+// with the named backend.  The default for an empty name is libpcap, unless
+// udp-proxy-2020 was built without cgo.
+func NewHostDeviceManager(backend string) (*HostDeviceManager, error) {
+	if backend == "" {
+		backend = CaptureLibpcap
+		if !libpcapSupported {
+			backend = CaptureAFPacket
+		}
 	}
+	dm := &HostDeviceManager{
+		interfaces: make(map[string]Interface),
+		handles:    make(map[string]CaptureHandle),
+	}
+	switch backend {
+	case CaptureLibpcap:
+		dm.backend = &libpcap
+	case CaptureAFPacket:
+		dm.backend = &afpacket
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q, must be one of [%s]", backend, strings.Join(CaptureBackends, "|"))
+	}
+	slog.Debug("Using capture backend", slog.String("backend", dm.backend.name))
 	if err := dm.Refresh(); err != nil {
 		return nil, err
 	}
 	return dm, nil
 }
 
-// Refresh updates the list of available devices.
-func (dm *DeviceManager) Refresh() error {
-	dm.mu.Lock()
-	defer dm.mu.Unlock()
+func (dm *HostDeviceManager) capture() *captureBackend {
+	if dm.backend == nil {
+		return &libpcap
+	}
+	return dm.backend
+}
 
-	ifs, err := pcap.FindAllDevs()
+// Refresh updates the list of available devices and publishes a LinkEvent to
+// the subscribers for every interface which appeared, went away or whose
+// addresses or MTU changed.
+func (dm *HostDeviceManager) Refresh() error {
+	dm.refreshMu.Lock()
+	defer dm.refreshMu.Unlock()
+
+	findDevs := dm.findDevs
+	if findDevs == nil {
+		findDevs = dm.capture().findDevs
+	}
+	ifs, err := findDevs()
 	if err != nil {
 		return err
 	}
 
-	// Reset map
-	dm.interfaces = make(map[string]pcap.Interface)
+	interfaces := make(map[string]Interface)
 	for _, i := range ifs {
 		if len(i.Addresses) == 0 {
 			continue
 		}
-		dm.interfaces[i.Name] = i
+		interfaces[i.Name] = i
+	}
+
+	dm.mu.Lock()
+	old := dm.interfaces
+	dm.interfaces = interfaces
+	dm.mu.Unlock()
+
+	for _, event := range diffInterfaces(old, interfaces) {
+		dm.publish(event)
 	}
 	return nil
 }
 
 // GetAddresses returns the addresses for a specific interface.
-func (dm *DeviceManager) GetAddresses(iname string) ([]pcap.InterfaceAddress, error) {
+func (dm *HostDeviceManager) GetAddresses(iname string) ([]InterfaceAddress, error) {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
 
@@ -73,8 +205,8 @@ func (dm *DeviceManager) GetAddresses(iname string) ([]pcap.InterfaceAddress, er
 	return nil, fmt.Errorf("interface %s not found or has no addresses", iname)
 }
 
-// CreateHandle initializes a libpcap handle for the given interface.
-func (dm *DeviceManager) CreateReaderHandle(iname string, promisc bool, timeout time.Duration) (*pcap.Handle, error) {
+// CreateReaderHandle opens the capture of the given interface.
+func (dm *HostDeviceManager) CreateReaderHandle(iname string, promisc bool, timeout time.Duration) (CaptureHandle, error) {
 	slog.Debug("Creating reader handle", slog.String("interface", iname), slog.Bool("promisc", promisc), slog.Duration("timeout", timeout))
 	key := deviceManagerKey(iname, Reader)
 	dm.mu.RLock()
@@ -84,37 +216,11 @@ func (dm *DeviceManager) CreateReaderHandle(iname string, promisc bool, timeout
 	}
 	dm.mu.RUnlock()
 
-	inactive, err := pcap.NewInactiveHandle(iname)
-	if err != nil {
-		return nil, err
-	}
-	defer inactive.CleanUp()
-
-	if err = inactive.SetTimeout(timeout); err != nil {
-		return nil, err
-	}
-	if err = inactive.SetPromisc(promisc); err != nil {
-		return nil, err
-	}
-	if err = inactive.SetSnapLen(9000); err != nil {
-		return nil, err
-	}
-
-	handle, err := inactive.Activate()
+	handle, err := dm.capture().openReader(iname, promisc, timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	if !dm.isValidLinkType(handle.LinkType()) {
-		handle.Close()
-		return nil, fmt.Errorf("interface %s has an unsupported link type: %s", iname, handle.LinkType())
-	}
-
-	if err := handle.SetDirection(pcap.DirectionIn); err != nil {
-		handle.Close()
-		return nil, fmt.Errorf("failed to set direction on interface %s: %w", iname, err)
-	}
-
 	dm.mu.Lock()
 	dm.handles[key] = handle
 	dm.mu.Unlock()
@@ -122,10 +228,15 @@ func (dm *DeviceManager) CreateReaderHandle(iname string, promisc bool, timeout
 	return handle, nil
 }
 
-func (dm *DeviceManager) isValidLinkType(lt layers.LinkType) bool {
+// isValidLinkType reports whether packets of link type lt can be relayed.
+func isValidLinkType(lt layers.LinkType) bool {
 	switch lt {
 	case layers.LinkTypeLoop, layers.LinkTypeEthernet, layers.LinkTypeNull, layers.LinkTypeRaw:
 		return true
+	case layers.LinkTypeLinuxSLL, layers.LinkTypeLinuxSLL2:
+		// Linux cooked capture, used by the any pseudo-interface, PPP and
+		// some tunnel drivers
+		return true
 	case LinkTypeRawOpenBSD:
 		// OpenBSD uses different DLT for raw sockets
 		return runtime.GOOS == "openbsd"
@@ -137,11 +248,15 @@ func (dm *DeviceManager) isValidLinkType(lt layers.LinkType) bool {
 }
 
 // ListInterfaces prints available network interfaces.
-func (dm *DeviceManager) ListInterfaces() {
+func (dm *HostDeviceManager) ListInterfaces() {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
+	printInterfaces(dm.interfaces)
+}
 
-	for k, v := range dm.interfaces {
+// printInterfaces prints the addresses of interfaces.
+func printInterfaces(interfaces map[string]Interface) {
+	for k, v := range interfaces {
 		fmt.Printf("Interface: %s\n", k)
 		for _, a := range v.Addresses {
 			ones, _ := a.Netmask.Size()
@@ -159,12 +274,24 @@ func (dm *DeviceManager) ListInterfaces() {
 	}
 }
 
+// InterfaceNames returns the sorted names of the available interfaces as of
+// the last Refresh.
+func (dm *HostDeviceManager) InterfaceNames() []string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return slices.Sorted(maps.Keys(dm.interfaces))
+}
+
 // GetLoopback returns the name of the loopback interface.
-func (dm *DeviceManager) GetLoopback() string {
+func (dm *HostDeviceManager) GetLoopback() string {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
+	return loopbackName(dm.interfaces)
+}
 
-	for k, v := range dm.interfaces {
+// loopbackName returns the name of the interface with a loopback address.
+func loopbackName(interfaces map[string]Interface) string {
+	for k, v := range interfaces {
 		for _, a := range v.Addresses {
 			if a.IP.IsLoopback() {
 				return k
@@ -174,8 +301,8 @@ func (dm *DeviceManager) GetLoopback() string {
 	return ""
 }
 
-// CloseHandles closes all open pcap handles.
-func (dm *DeviceManager) CloseHandles() {
+// CloseHandles closes all open handles.
+func (dm *HostDeviceManager) CloseHandles() {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
@@ -186,90 +313,31 @@ func (dm *DeviceManager) CloseHandles() {
 	}
 }
 
-func (dm *DeviceManager) GetHandle(iname string, direction PcapHandleDirection) (*pcap.Handle, error) {
-	key := deviceManagerKey(iname, direction)
-	dm.mu.RLock()
-	handle, exists := dm.handles[key]
-	dm.mu.RUnlock()
-
-	if !exists {
-		return nil, fmt.Errorf("handle for interface %s with direction %s not found", iname, direction)
+// CreateIsolatedWriter returns a dedicated writer for the given interface,
+// which the caller owns and closes.
+func (dm *HostDeviceManager) CreateIsolatedWriter(iname string) (PacketWriter, error) {
+	if iname == AnyInterface {
+		return nil, fmt.Errorf("unable to send on the %s pseudo-interface", AnyInterface)
 	}
-	return handle, nil
+	slog.Debug("Creating isolated writer handle for interface", slog.String("interface", iname))
+	return dm.capture().openWriter(iname)
 }
 
-// CreateWriterHandle initializes a libpcap handle for the given interface.
-func (dm *DeviceManager) CreateWriterHandle(iname string) (*pcap.Handle, error) {
-	key := deviceManagerKey(iname, Writer)
-	dm.mu.RLock()
-	if handle, exists := dm.handles[key]; exists {
-		dm.mu.RUnlock()
-		return handle, nil
-	}
-	dm.mu.RUnlock()
-	handle, err := dm.newWriterHandle(iname, false)
-	if err != nil {
-		return nil, err
-	}
-
-	dm.mu.Lock()
-	dm.handles[key] = handle
-	dm.mu.Unlock()
-
-	return handle, nil
-}
-
-// CreateIsolatedWriterHandle initializes a dedicated libpcap writer handle for
-// the given interface without storing it in the shared handle cache. This is
-// used when each caller must own and close its own handle independently.
-func (dm *DeviceManager) CreateIsolatedWriterHandle(iname string) (*pcap.Handle, error) {
-	return dm.newWriterHandle(iname, true)
-}
-
-func (dm *DeviceManager) newWriterHandle(iname string, isolated bool) (*pcap.Handle, error) {
-	if isolated {
-		slog.Debug("Creating isolated writer handle for interface", slog.String("interface", iname))
-	} else {
-		slog.Debug("Creating writer handle for interface", slog.String("interface", iname))
-	}
-
-	inactive, err := pcap.NewInactiveHandle(iname)
-	if err != nil {
-		return nil, err
-	}
-	defer inactive.CleanUp()
-
-	if err = inactive.SetPromisc(false); err != nil {
-		return nil, err
-	}
-	if err = inactive.SetSnapLen(9000); err != nil {
-		return nil, err
-	}
-
-	handle, err := inactive.Activate()
-	if err != nil {
-		return nil, err
-	}
-
-	if !dm.isValidLinkType(handle.LinkType()) {
-		handle.Close()
-		return nil, fmt.Errorf("interface %s has an unsupported link type: %s", iname, handle.LinkType())
-	}
-
-	return handle, nil
+// Interface returns the host interface iname.
+func (dm *HostDeviceManager) Interface(iname string) (*net.Interface, error) {
+	return net.InterfaceByName(iname)
 }
 
-// InterfaceAvailable refreshes the interface list and reports whether iname is
-// currently present and has at least one address.
-func (dm *DeviceManager) InterfaceAvailable(iname string) bool {
-	_ = dm.Refresh() // best-effort; ignore transient errors
+// InterfaceAvailable reports whether iname was present and had at least one
+// address as of the last Refresh.
+func (dm *HostDeviceManager) InterfaceAvailable(iname string) bool {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
 	_, ok := dm.interfaces[iname]
 	return ok
 }
 
-func (dm *DeviceManager) Close(iname string, direction PcapHandleDirection) error {
+func (dm *HostDeviceManager) Close(iname string, direction PcapHandleDirection) error {
 	key := deviceManagerKey(iname, direction)
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
@@ -6,25 +6,24 @@ import (
 	"testing"
 
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 )
 
-func TestDeviceManager_GetLoopback(t *testing.T) {
-	dm := &DeviceManager{
-		interfaces: make(map[string]pcap.Interface),
+func TestHostDeviceManager_GetLoopback(t *testing.T) {
+	dm := &HostDeviceManager{
+		interfaces: make(map[string]Interface),
 	}
 
 	// Mock loopback
-	dm.interfaces["lo0"] = pcap.Interface{
+	dm.interfaces["lo0"] = Interface{
 		Name: "lo0",
-		Addresses: []pcap.InterfaceAddress{
+		Addresses: []InterfaceAddress{
 			{IP: net.ParseIP("127.0.0.1")},
 		},
 	}
 	// Mock ethernet
-	dm.interfaces["eth0"] = pcap.Interface{
+	dm.interfaces["eth0"] = Interface{
 		Name: "eth0",
-		Addresses: []pcap.InterfaceAddress{
+		Addresses: []InterfaceAddress{
 			{IP: net.ParseIP("192.168.1.1")},
 		},
 	}
@@ -35,15 +34,25 @@ func TestDeviceManager_GetLoopback(t *testing.T) {
 	}
 }
 
-func TestDeviceManager_GetAddresses(t *testing.T) {
-	dm := &DeviceManager{
-		interfaces: make(map[string]pcap.Interface),
+func TestHostDeviceManager_InterfaceNames(t *testing.T) {
+	dm := &HostDeviceManager{
+		interfaces: map[string]Interface{"tun1": {}, "eth0": {}, "tun0": {}},
 	}
+	names := dm.InterfaceNames()
+	if len(names) != 3 || names[0] != "eth0" || names[1] != "tun0" || names[2] != "tun1" {
+		t.Errorf("Unexpected interface names: %v", names)
+	}
+}
 
-	addr := pcap.InterfaceAddress{IP: net.ParseIP("192.168.1.1")}
-	dm.interfaces["eth0"] = pcap.Interface{
+func TestHostDeviceManager_GetAddresses(t *testing.T) {
+	dm := &HostDeviceManager{
+		interfaces: make(map[string]Interface),
+	}
+
+	addr := InterfaceAddress{IP: net.ParseIP("192.168.1.1")}
+	dm.interfaces["eth0"] = Interface{
 		Name:      "eth0",
-		Addresses: []pcap.InterfaceAddress{addr},
+		Addresses: []InterfaceAddress{addr},
 	}
 
 	addrs, err := dm.GetAddresses("eth0")
@@ -60,34 +69,34 @@ func TestDeviceManager_GetAddresses(t *testing.T) {
 	}
 }
 
-func TestDeviceManager_isValidLinkType(t *testing.T) {
-	dm := &DeviceManager{}
-
+func TestIsValidLinkType(t *testing.T) {
 	alwaysValid := []layers.LinkType{
 		layers.LinkTypeLoop,
 		layers.LinkTypeEthernet,
 		layers.LinkTypeNull,
 		layers.LinkTypeRaw,
+		layers.LinkTypeLinuxSLL,
+		layers.LinkTypeLinuxSLL2,
 	}
 	for _, lt := range alwaysValid {
-		if !dm.isValidLinkType(lt) {
+		if !isValidLinkType(lt) {
 			t.Errorf("expected link type %v to be valid on all platforms", lt)
 		}
 	}
 
-	if dm.isValidLinkType(layers.LinkType(255)) {
+	if isValidLinkType(layers.LinkType(255)) {
 		t.Error("expected unknown link type 255 to be invalid")
 	}
 
 	// LinkTypeRawOpenBSD is only valid on OpenBSD.
-	gotOpenBSD := dm.isValidLinkType(LinkTypeRawOpenBSD)
+	gotOpenBSD := isValidLinkType(LinkTypeRawOpenBSD)
 	wantOpenBSD := runtime.GOOS == "openbsd"
 	if gotOpenBSD != wantOpenBSD {
 		t.Errorf("isValidLinkType(LinkTypeRawOpenBSD) = %v, want %v (GOOS=%s)", gotOpenBSD, wantOpenBSD, runtime.GOOS)
 	}
 
 	// LinkTypeRawOthers is valid on every OS except OpenBSD.
-	gotOthers := dm.isValidLinkType(LinkTypeRawOthers)
+	gotOthers := isValidLinkType(LinkTypeRawOthers)
 	wantOthers := runtime.GOOS != "openbsd"
 	if gotOthers != wantOthers {
 		t.Errorf("isValidLinkType(LinkTypeRawOthers) = %v, want %v (GOOS=%s)", gotOthers, wantOthers, runtime.GOOS)
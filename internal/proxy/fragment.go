@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// NetworkOffset returns the offset of the IPv4 or IPv6 header in the data of
+// p, which is the length of its link-layer headers.  ok is false for packets
+// without an IP header.
+func NetworkOffset(p gopacket.Packet) (offset int, ok bool) {
+	for _, l := range p.Layers() {
+		switch l.LayerType() {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			return offset, true
+		}
+		offset += len(l.LayerContents())
+	}
+	return 0, false
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinkEventKind is what changed about an interface.
+type LinkEventKind int
+
+const (
+	// LinkAppeared is sent when an interface shows up with an address.
+	LinkAppeared LinkEventKind = iota
+	// LinkGone is sent when an interface was deleted or lost its last address.
+	LinkGone
+	// AddressesChanged is sent when the addresses of an interface changed.
+	AddressesChanged
+	// MTUChanged is sent when only the MTU of an interface changed.
+	MTUChanged
+)
+
+func (k LinkEventKind) String() string {
+	switch k {
+	case LinkAppeared:
+		return "appeared"
+	case LinkGone:
+		return "gone"
+	case AddressesChanged:
+		return "addresses_changed"
+	case MTUChanged:
+		return "mtu_changed"
+	}
+	return "unknown"
+}
+
+// LinkEvent describes a change of an interface as seen by Refresh.
+type LinkEvent struct {
+	Kind      LinkEventKind
+	Interface string
+	Addresses []InterfaceAddress // the new addresses, nil for LinkGone
+	MTU       int                // the new MTU, 0 for LinkGone or if unknown
+}
+
+// linkEventBuffer is how many events a subscriber may fall behind by before
+// events are dropped.
+const linkEventBuffer = 64
+
+// linkChangeSettle is how long to wait for a burst of rtnetlink notifications
+// to end before refreshing.
+const linkChangeSettle = 100 * time.Millisecond
+
+// linkSubscribers are the subscribers to the LinkEvents of a DeviceManager.
+type linkSubscribers struct {
+	subMu   sync.Mutex // protects subs and nextSub
+	subs    map[int]chan LinkEvent
+	nextSub int
+}
+
+// Subscribe returns a channel which receives every LinkEvent published by
+// Refresh, and a function to cancel the subscription.  Events are dropped
+// rather than blocking Refresh if the subscriber falls too far behind.
+func (l *linkSubscribers) Subscribe() (<-chan LinkEvent, func()) {
+	ch := make(chan LinkEvent, linkEventBuffer)
+	l.subMu.Lock()
+	defer l.subMu.Unlock()
+	if l.subs == nil {
+		l.subs = make(map[int]chan LinkEvent)
+	}
+	id := l.nextSub
+	l.nextSub++
+	l.subs[id] = ch
+	return ch, func() {
+		l.subMu.Lock()
+		defer l.subMu.Unlock()
+		delete(l.subs, id)
+	}
+}
+
+func (l *linkSubscribers) publish(event LinkEvent) {
+	slog.Debug("Interface changed", "interface", event.Interface, "event", event.Kind.String())
+	l.subMu.Lock()
+	defer l.subMu.Unlock()
+	for _, ch := range l.subs {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Dropped interface event for slow subscriber", "interface", event.Interface, "event", event.Kind.String())
+		}
+	}
+}
+
+// diffInterfaces returns the events to go from the before to the after
+// interfaces, sorted by interface name.
+func diffInterfaces(before, after map[string]Interface) []LinkEvent {
+	var events []LinkEvent
+	for name, iface := range after {
+		prev, ok := before[name]
+		switch {
+		case !ok:
+			events = append(events, LinkEvent{Kind: LinkAppeared, Interface: name, Addresses: iface.Addresses, MTU: iface.MTU})
+		case !SameAddresses(prev.Addresses, iface.Addresses):
+			events = append(events, LinkEvent{Kind: AddressesChanged, Interface: name, Addresses: iface.Addresses, MTU: iface.MTU})
+		case prev.MTU != iface.MTU:
+			events = append(events, LinkEvent{Kind: MTUChanged, Interface: name, Addresses: iface.Addresses, MTU: iface.MTU})
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			events = append(events, LinkEvent{Kind: LinkGone, Interface: name})
+		}
+	}
+	slices.SortFunc(events, func(a, b LinkEvent) int {
+		return strings.Compare(a.Interface, b.Interface)
+	})
+	return events
+}
+
+// SameAddresses reports whether a and b are the same interface addresses.
+func SameAddresses(a, b []InterfaceAddress) bool {
+	return slices.EqualFunc(a, b, func(x, y InterfaceAddress) bool {
+		return x.IP.Equal(y.IP) && x.Netmask.String() == y.Netmask.String() &&
+			x.Broadaddr.Equal(y.Broadaddr) && x.P2P.Equal(y.P2P)
+	})
+}
+
+// Watch refreshes the interfaces whenever they change until ctx is cancelled,
+// so the subscribers get a LinkEvent for every change.  On Linux the changes
+// come from an rtnetlink subscription; elsewhere, or if that fails, the
+// interfaces are polled every interval.
+func (dm *HostDeviceManager) Watch(ctx context.Context, interval time.Duration) {
+	changes, err := subscribeLinkChanges(ctx)
+	if err != nil {
+		slog.Info("Polling for interface changes", "interval", interval, "reason", err)
+		dm.poll(ctx, interval)
+		return
+	}
+	slog.Debug("Watching for interface changes via rtnetlink")
+	// Catch up with whatever changed between the last Refresh and the
+	// subscription, there are no notifications for it.
+	if err := dm.Refresh(); err != nil {
+		slog.Warn("Unable to refresh interfaces", "error", err)
+	}
+
+	for open := true; open; {
+		select {
+		case <-ctx.Done():
+			return
+		case _, open = <-changes:
+		}
+
+		// Adding an interface and its addresses are several notifications,
+		// so wait for them to settle to refresh just once.
+		settle := time.NewTimer(linkChangeSettle)
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				settle.Stop()
+				return
+			case _, ok := <-changes:
+				if !ok {
+					changes, open = nil, false
+				}
+			case <-settle.C:
+				waiting = false
+			}
+		}
+		if err := dm.Refresh(); err != nil {
+			slog.Warn("Unable to refresh interfaces", "error", err)
+		}
+	}
+	slog.Warn("Lost rtnetlink subscription, polling for interface changes", "interval", interval)
+	dm.poll(ctx, interval)
+}
+
+func (dm *HostDeviceManager) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := dm.Refresh(); err != nil {
+				slog.Warn("Unable to refresh interfaces", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func testInterface(name, ip string) Interface {
+	return Interface{
+		Name:      name,
+		Addresses: []InterfaceAddress{{IP: net.ParseIP(ip), Netmask: net.CIDRMask(24, 32)}},
+	}
+}
+
+func TestDiffInterfaces(t *testing.T) {
+	before := map[string]Interface{
+		"eth0": testInterface("eth0", "192.168.1.1"),
+		"eth1": testInterface("eth1", "192.168.2.1"),
+		"eth2": {Name: "eth2", Addresses: testInterface("eth2", "192.168.4.1").Addresses, MTU: 1500},
+		"tun0": testInterface("tun0", "10.8.0.1"),
+	}
+	after := map[string]Interface{
+		"eth0": testInterface("eth0", "192.168.1.1"),
+		"eth1": testInterface("eth1", "192.168.3.1"),
+		"eth2": {Name: "eth2", Addresses: testInterface("eth2", "192.168.4.1").Addresses, MTU: 1400},
+		"wg0":  testInterface("wg0", "10.9.0.1"),
+	}
+
+	events := diffInterfaces(before, after)
+	want := []struct {
+		kind  LinkEventKind
+		iname string
+	}{{AddressesChanged, "eth1"}, {MTUChanged, "eth2"}, {LinkGone, "tun0"}, {LinkAppeared, "wg0"}}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Kind != w.kind || events[i].Interface != w.iname {
+			t.Errorf("event %d: expected %s %s, got %s %s", i, w.kind, w.iname, events[i].Kind, events[i].Interface)
+		}
+	}
+	if len(events[0].Addresses) != 1 || !events[0].Addresses[0].IP.Equal(net.ParseIP("192.168.3.1")) {
+		t.Errorf("expected the new addresses of eth1, got %+v", events[0].Addresses)
+	}
+	if events[1].MTU != 1400 {
+		t.Errorf("expected the new MTU of eth2, got %d", events[1].MTU)
+	}
+}
+
+func TestHostDeviceManager_RefreshPublishesEvents(t *testing.T) {
+	devs := []Interface{testInterface("eth0", "192.168.1.1"), {Name: "eth9"}}
+	dm := &HostDeviceManager{findDevs: func() ([]Interface, error) { return devs, nil }}
+	events, unsubscribe := dm.Subscribe()
+
+	if err := dm.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if event := <-events; event.Kind != LinkAppeared || event.Interface != "eth0" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if !dm.InterfaceAvailable("eth0") || dm.InterfaceAvailable("eth9") {
+		t.Fatal("expected only interfaces with addresses to be available")
+	}
+
+	// Nothing changed, so nothing is published.
+	if err := dm.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %+v", event)
+	default:
+	}
+
+	devs = nil
+	if err := dm.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if event := <-events; event.Kind != LinkGone || event.Interface != "eth0" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	unsubscribe()
+	devs = []Interface{testInterface("eth0", "192.168.1.1")}
+	if err := dm.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event after unsubscribing: %+v", event)
+	default:
+	}
+
+	dm.findDevs = func() ([]Interface, error) { return nil, errors.New("boom") }
+	if err := dm.Refresh(); err == nil || !dm.InterfaceAvailable("eth0") {
+		t.Fatal("expected a failed Refresh to keep the previous interfaces")
+	}
+}
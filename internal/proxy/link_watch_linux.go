@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// subscribeLinkChanges subscribes to the rtnetlink link and address
+// notifications and returns a channel which receives a value whenever any
+// interface changed.  The channel is closed if the subscription fails.
+func subscribeLinkChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open rtnetlink socket: %w", err)
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("unable to subscribe to rtnetlink: %w", err)
+	}
+
+	// Non-blocking, so reads go through the runtime poller and closing the
+	// file interrupts them.
+	f := os.NewFile(uintptr(fd), "rtnetlink")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if errors.Is(err, unix.ENOBUFS) {
+				// We fell behind and lost notifications; a refresh
+				// catches up with whatever they were.
+				notify()
+				continue
+			} else if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("Unable to read from rtnetlink", "error", err)
+				}
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				slog.Debug("Unable to parse rtnetlink message", "error", err)
+				continue
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+					notify()
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscribeLinkChanges_ClosesOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := subscribeLinkChanges(ctx)
+	if err != nil {
+		cancel()
+		t.Skipf("rtnetlink not available: %v", err)
+	}
+
+	cancel()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("expected the changes channel to be closed after cancel")
+		}
+	}
+}
+
+func TestWatch_RefreshesOnceSubscribed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := subscribeLinkChanges(ctx); err != nil {
+		t.Skipf("rtnetlink not available: %v", err)
+	}
+
+	// eth0 showed up before the subscription, so only the initial Refresh
+	// of Watch can report it.
+	devs := []Interface{testInterface("eth0", "192.168.1.1")}
+	dm := &HostDeviceManager{findDevs: func() ([]Interface, error) { return devs, nil }}
+	events, unsubscribe := dm.Subscribe()
+	defer unsubscribe()
+	go dm.Watch(ctx, time.Hour)
+
+	select {
+	case event := <-events:
+		if event.Kind != LinkAppeared || event.Interface != "eth0" {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Watch to refresh the interfaces once subscribed")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+)
+
+// subscribeLinkChanges is only supported on Linux, other OSes poll.
+func subscribeLinkChanges(_ context.Context) (<-chan struct{}, error) {
+	return nil, errors.ErrUnsupported
+}
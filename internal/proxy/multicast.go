@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// MulticastMembership holds IGMP memberships for a set of multicast groups on
+// a single interface.  The kernel sends the IGMP reports for us and answers
+// queries for as long as the membership is open, which keeps IGMP snooping
+// switches delivering the groups to the interface.
+type MulticastMembership struct {
+	Iname  string
+	Groups []net.IP
+	conn   net.PacketConn
+}
+
+// JoinMulticastGroups joins each of the IPv4 multicast groups on the given
+// interface.  The membership uses an unconnected UDP socket on an ephemeral
+// port, so no group traffic is delivered to it.
+func JoinMulticastGroups(ifi *net.Interface, groups []net.IP) (*MulticastMembership, error) {
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open socket for multicast membership: %w", err)
+	}
+
+	m := &MulticastMembership{Iname: ifi.Name, conn: conn}
+	pc := ipv4.NewPacketConn(conn)
+	var errs []error
+	for _, group := range groups {
+		if group.To4() == nil || !group.IsMulticast() {
+			errs = append(errs, fmt.Errorf("%s is not an IPv4 multicast group", group))
+			continue
+		}
+		if err := pc.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+			errs = append(errs, fmt.Errorf("unable to join %s on %s: %w", group, ifi.Name, err))
+			continue
+		}
+		slog.Debug("Joined multicast group", "interface", ifi.Name, "group", group.String())
+		m.Groups = append(m.Groups, group)
+	}
+
+	if len(m.Groups) == 0 {
+		conn.Close()
+		return nil, errors.Join(errs...)
+	}
+	return m, errors.Join(errs...)
+}
+
+// Close leaves all of the multicast groups.
+func (m *MulticastMembership) Close() error {
+	if m == nil || m.conn == nil {
+		return nil
+	}
+	return m.conn.Close()
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestJoinMulticastGroups_RejectsNonMulticast(t *testing.T) {
+	ifi := &net.Interface{Index: 1, Name: "lo"}
+	m, err := JoinMulticastGroups(ifi, []net.IP{{10, 0, 0, 1}, net.ParseIP("ff02::fb")})
+	if err == nil {
+		t.Fatal("expected error for non IPv4 multicast groups")
+	}
+	if m != nil {
+		t.Fatalf("expected no membership when no group was joined, got %+v", m)
+	}
+}
+
+func TestMulticastMembership_CloseNil(t *testing.T) {
+	var m *MulticastMembership
+	if err := m.Close(); err != nil {
+		t.Fatalf("expected nil error closing nil membership, got %v", err)
+	}
+}
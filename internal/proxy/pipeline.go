@@ -3,8 +3,13 @@ package proxy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
 )
 
 // Pipeline orchestrates the flow of packets from a Source through Processors to Sinks.
@@ -12,6 +17,18 @@ type Pipeline struct {
 	Source     Source
 	Processors []Processor
 	Sinks      []Sink
+	// DrainTimeout bounds how long Run keeps processing the packets already
+	// buffered by a Drainer source after the context is cancelled.  Zero
+	// drops them.
+	DrainTimeout time.Duration
+
+	mu sync.RWMutex // protects Sinks and the metrics once the pipeline is running
+
+	// The metrics of the pipeline and of each of its processors and sinks,
+	// nil when the metrics are disabled.
+	metrics      *metrics.PipelineCounters
+	stageMetrics []*metrics.StageCounters
+	sinkMetrics  []*metrics.SinkCounters
 }
 
 // NewPipeline creates a new pipeline with the given source.
@@ -26,67 +43,173 @@ func NewPipeline(source Source) *Pipeline {
 func (p *Pipeline) AddProcessor(proc Processor) {
 	slog.Debug("Adding processor to pipeline", slog.String("name", proc.Name()))
 	p.Processors = append(p.Processors, proc)
+	if p.metrics != nil {
+		p.stageMetrics = append(p.stageMetrics, metrics.NewStageCounters(p.Source.Name(), proc.Name()))
+	}
 }
 
-// AddSink adds a sink to the pipeline.
+// AddSink adds a sink to the pipeline.  Safe to call while the pipeline is running.
 func (p *Pipeline) AddSink(sink Sink) {
 	slog.Debug("Adding sink to pipeline", slog.String("name", sink.Name()))
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.Sinks = append(p.Sinks, sink)
+	if p.metrics != nil {
+		p.sinkMetrics = append(p.sinkMetrics, metrics.NewSinkCounters(p.Source.Name(), sink.Name()))
+	}
+}
+
+// RemoveSink removes a sink from the pipeline without closing it.  Once it returns the sink
+// is no longer being written to.  Safe to call while the pipeline is running.
+func (p *Pipeline) RemoveSink(sink Sink) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.Sinks {
+		if s == sink {
+			slog.Debug("Removing sink from pipeline", slog.String("name", sink.Name()))
+			p.Sinks = append(p.Sinks[:i:i], p.Sinks[i+1:]...)
+			if p.metrics != nil {
+				p.sinkMetrics = append(p.sinkMetrics[:i:i], p.sinkMetrics[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentSinks returns a copy of the sinks.  Safe to call while the pipeline is running.
+func (p *Pipeline) CurrentSinks() []Sink {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]Sink{}, p.Sinks...)
 }
 
 // Run starts the pipeline and processes packets until the context is cancelled or the source is closed.
-func (p *Pipeline) Run(ctx context.Context) error {
-	defer p.closeAll()
+// Once cancelled, buffered packets are drained before the source and then the sinks are closed, in the
+// order they were added.  Errors closing the sinks are returned.
+func (p *Pipeline) Run(ctx context.Context) (err error) {
+	defer func() {
+		if closeErr := p.closeAll(); err == nil {
+			err = closeErr
+		}
+	}()
 
+	name := p.Source.Name()
+	p.resolveMetrics(name)
 	for {
 		pkt, err := p.Source.Read(ctx)
 		if err != nil {
-			if err == io.EOF || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				p.drain(name)
+				return nil
+			}
+			if err == io.EOF {
 				return nil
 			}
 			slog.Error("Source read error", "error", err)
+			if p.metrics != nil {
+				p.metrics.ReadErrors.Inc()
+			}
 			continue
 		}
 
 		if pkt == nil {
 			continue
 		}
+		p.process(pkt)
+	}
+}
 
-		// Process packet through processors
-		continueProcessing := true
-		for _, proc := range p.Processors {
-			keep, err := proc.Process(pkt)
-			if err != nil {
-				slog.Error("Processor error", "error", err)
-				continueProcessing = false
-				break
-			}
-			if !keep {
-				continueProcessing = false
-				break
-			}
+// resolveMetrics looks up the metrics of the pipeline and of its processors
+// and sinks, unless the metrics are disabled.
+func (p *Pipeline) resolveMetrics(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metrics = metrics.NewPipelineCounters(name)
+	if p.metrics == nil {
+		return
+	}
+	p.stageMetrics = make([]*metrics.StageCounters, len(p.Processors))
+	for i, proc := range p.Processors {
+		p.stageMetrics[i] = metrics.NewStageCounters(name, proc.Name())
+	}
+	p.sinkMetrics = make([]*metrics.SinkCounters, len(p.Sinks))
+	for i, sink := range p.Sinks {
+		p.sinkMetrics[i] = metrics.NewSinkCounters(name, sink.Name())
+	}
+}
+
+// process passes a packet through the processors and, unless dropped, writes it to every sink.
+func (p *Pipeline) process(pkt *Packet) {
+	if m := p.metrics; m != nil {
+		m.Packets.Inc()
+		start := time.Now()
+		defer func() {
+			m.Duration.Observe(time.Since(start).Seconds())
+		}()
+	}
+
+	for i, proc := range p.Processors {
+		keep, err := proc.Process(pkt)
+		if p.metrics != nil {
+			p.stageMetrics[i].Observe(keep, err)
+		}
+		if err != nil {
+			slog.Error("Processor error", "error", err)
+			return
 		}
+		if !keep {
+			return
+		}
+	}
 
-		if !continueProcessing {
-			continue
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i, sink := range p.Sinks {
+		err := sink.Write(pkt)
+		if p.metrics != nil {
+			p.sinkMetrics[i].Observe(err)
+		}
+		if err != nil {
+			slog.Error("Sink write error", "error", err)
 		}
+	}
+}
 
-		// Write to sinks
-		for _, sink := range p.Sinks {
-			if err := sink.Write(pkt); err != nil {
-				slog.Error("Sink write error", "error", err)
-			}
+// drain processes the packets still buffered by the source, for at most DrainTimeout.
+func (p *Pipeline) drain(name string) {
+	d, ok := p.Source.(Drainer)
+	if !ok || p.DrainTimeout <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(p.DrainTimeout)
+	drained := 0
+	for time.Now().Before(deadline) {
+		pkt := d.Drain()
+		if pkt == nil {
+			break
 		}
+		p.process(pkt)
+		drained++
+	}
+	if drained > 0 {
+		slog.Info("Drained buffered packets", "pipeline", name, "packets", drained)
 	}
 }
 
-func (p *Pipeline) closeAll() {
+// closeAll closes the source, so no more packets are captured, and then the
+// sinks.  Returns the errors from closing the sinks.
+func (p *Pipeline) closeAll() error {
 	if err := p.Source.Close(); err != nil {
 		slog.Error("Error closing source", "error", err)
 	}
-	for _, sink := range p.Sinks {
+	var errs []error
+	for _, sink := range p.CurrentSinks() {
 		if err := sink.Close(); err != nil {
-			slog.Error("Error closing sink", "error", err)
+			slog.Error("Error closing sink", "sink", sink.Name(), "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
 		}
 	}
+	return errors.Join(errs...)
 }
@@ -2,9 +2,14 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
 )
 
 type mockSource struct {
@@ -100,3 +105,134 @@ func TestPipeline_ProcessorFiltering(t *testing.T) {
 		t.Errorf("Expected 0 packets in sink, got %d", len(sink.written))
 	}
 }
+
+func TestPipeline_RecordsMetrics(t *testing.T) {
+	metrics.Enable()
+	packets := metrics.PipelinePackets.WithLabelValues("mockSource")
+	dropped := metrics.StagePackets.WithLabelValues("mockSource", "mockProcessor", metrics.ResultDropped)
+	written := metrics.SinkPackets.WithLabelValues("mockSource", "mockSink", metrics.ResultOK)
+	beforePackets, beforeDropped, beforeWritten := testutil.ToFloat64(packets), testutil.ToFloat64(dropped), testutil.ToFloat64(written)
+
+	source := &mockSource{packets: []*Packet{{Raw: []byte("test")}, {Raw: []byte("test")}}}
+	pipeline := NewPipeline(source)
+	pipeline.AddProcessor(&mockProcessor{keep: false})
+	pipeline.AddSink(&mockSink{})
+	_ = pipeline.Run(context.Background())
+
+	if got := testutil.ToFloat64(packets) - beforePackets; got != 2 {
+		t.Errorf("expected 2 packets read, got %v", got)
+	}
+	if got := testutil.ToFloat64(dropped) - beforeDropped; got != 2 {
+		t.Errorf("expected 2 packets dropped by mockProcessor, got %v", got)
+	}
+	if got := testutil.ToFloat64(written) - beforeWritten; got != 0 {
+		t.Errorf("expected no packets written to mockSink, got %v", got)
+	}
+}
+
+// drainingSource returns ctx.Err() once cancelled, leaving its buffered
+// packets to be drained.
+type drainingSource struct {
+	buffered []*Packet
+	closed   *[]string
+}
+
+func (s *drainingSource) Read(ctx context.Context) (*Packet, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *drainingSource) Drain() *Packet {
+	if len(s.buffered) == 0 {
+		return nil
+	}
+	pkt := s.buffered[0]
+	s.buffered = s.buffered[1:]
+	return pkt
+}
+
+func (s *drainingSource) Close() error {
+	*s.closed = append(*s.closed, s.Name())
+	return nil
+}
+
+func (s *drainingSource) Name() string { return "drainingSource" }
+
+type closeOrderSink struct {
+	name   string
+	err    error
+	closed *[]string
+}
+
+func (s *closeOrderSink) Write(pkt *Packet) error { return nil }
+
+func (s *closeOrderSink) Close() error {
+	*s.closed = append(*s.closed, s.name)
+	return s.err
+}
+
+func (s *closeOrderSink) Name() string { return s.name }
+
+func TestPipeline_DrainsBufferedPacketsOnCancel(t *testing.T) {
+	var closed []string
+	source := &drainingSource{
+		buffered: []*Packet{{Raw: []byte("one")}, {Raw: []byte("two")}},
+		closed:   &closed,
+	}
+	sink := &mockSink{notify: make(chan struct{}, 2)}
+
+	pipeline := NewPipeline(source)
+	pipeline.DrainTimeout = time.Second
+	pipeline.AddSink(sink)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pipeline.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(sink.written) != 2 {
+		t.Fatalf("expected 2 drained packets, got %d", len(sink.written))
+	}
+	if len(closed) != 1 {
+		t.Fatalf("expected source to be closed once, got %v", closed)
+	}
+}
+
+func TestPipeline_NoDrainWithoutTimeout(t *testing.T) {
+	var closed []string
+	source := &drainingSource{buffered: []*Packet{{Raw: []byte("one")}}, closed: &closed}
+	sink := &mockSink{notify: make(chan struct{}, 1)}
+
+	pipeline := NewPipeline(source)
+	pipeline.AddSink(sink)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pipeline.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(sink.written) != 0 {
+		t.Fatalf("expected buffered packets to be dropped, got %d", len(sink.written))
+	}
+}
+
+func TestPipeline_ClosesSourceThenSinksInOrder(t *testing.T) {
+	var closed []string
+	source := &drainingSource{closed: &closed}
+
+	pipeline := NewPipeline(source)
+	pipeline.AddSink(&closeOrderSink{name: "pcap", closed: &closed})
+	pipeline.AddSink(&closeOrderSink{name: "route", err: errors.New("boom"), closed: &closed})
+	pipeline.AddSink(&closeOrderSink{name: "last", closed: &closed})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := pipeline.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "route: boom") {
+		t.Fatalf("expected sink close error to be returned, got %v", err)
+	}
+	want := []string{"drainingSource", "pcap", "route", "last"}
+	if strings.Join(closed, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected close order %v, got %v", want, closed)
+	}
+}
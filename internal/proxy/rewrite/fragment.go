@@ -0,0 +1,124 @@
+package rewrite
+
+import (
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// ipv6FragmentHeaderLen is the length of the IPv6 fragment extension header.
+const ipv6FragmentHeaderLen = 8
+
+// Fragment splits pkt into IP fragments which fit in mtu, the MTU of the
+// egress interface captured with linkType.  pkt is returned as is when it
+// fits or mtu is 0.  The don't fragment flag of IPv4 packets is ignored since
+// we are the ones sending them.
+func Fragment(pkt *proxy.Packet, mtu int, linkType layers.LinkType) ([]*proxy.Packet, error) {
+	if pkt == nil || pkt.Packet == nil {
+		return nil, fmt.Errorf("packet is nil")
+	}
+	offset, ok := proxy.NetworkOffset(pkt.Packet)
+	if !ok {
+		return nil, fmt.Errorf("packet missing IPv4 or IPv6 layer")
+	}
+	network := pkt.Packet.NetworkLayer()
+	if mtu <= 0 || len(network.LayerContents())+len(network.LayerPayload()) <= mtu {
+		return []*proxy.Packet{pkt}, nil
+	}
+
+	var fragments [][]byte
+	var err error
+	switch ip := network.(type) {
+	case *layers.IPv4:
+		fragments, err = fragmentIPv4(ip, mtu)
+	case *layers.IPv6:
+		fragments, err = fragmentIPv6(ip, mtu)
+	default:
+		err = fmt.Errorf("unable to fragment %s packet", network.LayerType())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	link := pkt.Raw[:offset]
+	out := make([]*proxy.Packet, 0, len(fragments))
+	for _, fragment := range fragments {
+		raw := make([]byte, 0, len(link)+len(fragment))
+		raw = append(append(raw, link...), fragment...)
+		metadata := pkt.Metadata
+		metadata.CaptureLength, metadata.Length = len(raw), len(raw)
+		out = append(out, &proxy.Packet{
+			Metadata:         metadata,
+			Raw:              raw,
+			Packet:           packetFromLinkType(raw, EgressFraming(linkType)),
+			ArrivalInterface: pkt.ArrivalInterface,
+		})
+	}
+	return out, nil
+}
+
+// fragmentIPv4 returns the IPv4 fragments of ip, without link-layer header.
+func fragmentIPv4(ip *layers.IPv4, mtu int) ([][]byte, error) {
+	size := (mtu - len(ip.Contents)) &^ 7
+	if size < 8 {
+		return nil, fmt.Errorf("MTU %d too small to fragment IPv4 packet", mtu)
+	}
+	var fragments [][]byte
+	for off := 0; off < len(ip.Payload); off += size {
+		end := min(off+size, len(ip.Payload))
+		header := *ip
+		header.Flags = ip.Flags &^ (layers.IPv4DontFragment | layers.IPv4MoreFragments)
+		if end < len(ip.Payload) || ip.Flags&layers.IPv4MoreFragments != 0 {
+			header.Flags |= layers.IPv4MoreFragments
+		}
+		header.FragOffset = ip.FragOffset + uint16(off/8)
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, &header, gopacket.Payload(ip.Payload[off:end])); err != nil {
+			return nil, fmt.Errorf("serialize IPv4 fragment: %w", err)
+		}
+		fragments = append(fragments, buf.Bytes())
+	}
+	return fragments, nil
+}
+
+// fragmentIPv6 returns the IPv6 fragments of ip, without link-layer header.
+// Extension headers are fragmented along with the payload.
+func fragmentIPv6(ip *layers.IPv6, mtu int) ([][]byte, error) {
+	size := (mtu - len(ip.Contents) - ipv6FragmentHeaderLen) &^ 7
+	if size < 8 {
+		return nil, fmt.Errorf("MTU %d too small to fragment IPv6 packet", mtu)
+	}
+	id := rand.Uint32()
+	var fragments [][]byte
+	for off := 0; off < len(ip.Payload); off += size {
+		end := min(off+size, len(ip.Payload))
+		header := &layers.IPv6{
+			Version:      6,
+			TrafficClass: ip.TrafficClass,
+			FlowLabel:    ip.FlowLabel,
+			NextHeader:   layers.IPProtocolIPv6Fragment,
+			HopLimit:     ip.HopLimit,
+			SrcIP:        ip.SrcIP,
+			DstIP:        ip.DstIP,
+		}
+		fragment := &layers.IPv6Fragment{
+			NextHeader:     ip.NextHeader,
+			FragmentOffset: uint16(off / 8),
+			MoreFragments:  end < len(ip.Payload),
+			Identification: id,
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, header, fragment, gopacket.Payload(ip.Payload[off:end])); err != nil {
+			return nil, fmt.Errorf("serialize IPv6 fragment: %w", err)
+		}
+		fragments = append(fragments, buf.Bytes())
+	}
+	return fragments, nil
+}
@@ -0,0 +1,95 @@
+package rewrite
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+func TestFragment_IPv4(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 300)
+	pkt := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 255}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, broadcastMAC, payload, "eth0")
+	pkt.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4).Flags = layers.IPv4DontFragment
+
+	fragments, err := Fragment(pkt, 1400, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("Fragment failed: %v", err)
+	}
+	if len(fragments) != 3 {
+		t.Fatalf("expected 3 fragments, got %d", len(fragments))
+	}
+	var data []byte
+	for i, fragment := range fragments {
+		if fragment.Packet.Layer(layers.LayerTypeEthernet) == nil {
+			t.Fatalf("fragment %d: expected the ethernet header to be kept", i)
+		}
+		ip := fragment.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if int(ip.Length) > 1400 {
+			t.Errorf("fragment %d: %d bytes exceeds the MTU", i, ip.Length)
+		}
+		if int(ip.FragOffset)*8 != len(data) {
+			t.Errorf("fragment %d: unexpected offset %d", i, ip.FragOffset)
+		}
+		if more := ip.Flags&layers.IPv4MoreFragments != 0; more != (i < len(fragments)-1) {
+			t.Errorf("fragment %d: unexpected more fragments flag %v", i, more)
+		}
+		if ip.Flags&layers.IPv4DontFragment != 0 {
+			t.Errorf("fragment %d: expected the don't fragment flag to be cleared", i)
+		}
+		if fragment.Metadata.CaptureLength != len(fragment.Raw) {
+			t.Errorf("fragment %d: capture length %d, want %d", i, fragment.Metadata.CaptureLength, len(fragment.Raw))
+		}
+		data = append(data, ip.Payload...)
+	}
+	udp := pkt.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !bytes.Equal(data, append(udp.Contents, udp.Payload...)) {
+		t.Fatal("expected the fragments to carry the whole UDP datagram")
+	}
+}
+
+func TestFragment_IPv6(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 200)
+	pkt := buildUDPPacketForLinkType(t, layers.LinkTypeRaw, net.ParseIP("2001:db8::1"), net.ParseIP("ff02::1"), nil, nil, payload, "wg0")
+
+	fragments, err := Fragment(pkt, 1280, layers.LinkTypeLinuxSLL)
+	if err != nil {
+		t.Fatalf("Fragment failed: %v", err)
+	}
+	if len(fragments) != 2 {
+		t.Fatalf("expected 2 fragments, got %d", len(fragments))
+	}
+	var id uint32
+	for i, fragment := range fragments {
+		if len(fragment.Raw) > 1280 {
+			t.Errorf("fragment %d: %d bytes exceeds the MTU", i, len(fragment.Raw))
+		}
+		frag, ok := fragment.Packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		if !ok {
+			t.Fatalf("fragment %d: expected a fragment header", i)
+		}
+		if i == 0 {
+			id = frag.Identification
+		} else if frag.Identification != id {
+			t.Errorf("fragment %d: expected identification %d, got %d", i, id, frag.Identification)
+		}
+		if frag.NextHeader != layers.IPProtocolUDP || frag.MoreFragments != (i == 0) {
+			t.Errorf("fragment %d: unexpected fragment header %+v", i, frag)
+		}
+	}
+}
+
+func TestFragment_FitsMTU(t *testing.T) {
+	pkt := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 255}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, broadcastMAC, []byte("hello"), "eth0")
+	for _, mtu := range []int{0, 1500} {
+		fragments, err := Fragment(pkt, mtu, layers.LinkTypeEthernet)
+		if err != nil || len(fragments) != 1 || fragments[0] != pkt {
+			t.Errorf("MTU %d: expected the packet as is, got %d fragments, %v", mtu, len(fragments), err)
+		}
+	}
+	if _, err := Fragment(&proxy.Packet{}, 1500, layers.LinkTypeEthernet); err == nil {
+		t.Error("expected an error for an empty packet")
+	}
+}
@@ -3,6 +3,7 @@ package rewrite
 import (
 	"fmt"
 	"net"
+	"runtime"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
@@ -19,24 +20,25 @@ type Options struct {
 	EgressLinkType         layers.LinkType
 	AllowBroadcastDstMAC   bool
 	ForceBroadcastDestMAC  bool
+	TTL                    uint8  // overrides the IPv4 TTL/IPv6 hop limit when non-zero
+	VLANID                 uint16 // adds an 802.1Q tag on ethernet egress when non-zero
 	ArrivalInterface       string
 	OutputArrivalInterface string
 }
 
 // PacketForEgress applies destination/source L2/L3 changes and returns a new packet.
+// IPv4 and IPv6 are both supported, but TargetIP must be of the same address family
+// as the packet.
 func PacketForEgress(pkt *proxy.Packet, opts Options) (*proxy.Packet, error) {
 	if pkt == nil || pkt.Packet == nil {
 		return nil, fmt.Errorf("packet is nil")
 	}
 
-	ipLayer := pkt.Packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		return nil, fmt.Errorf("packet missing IPv4 layer")
-	}
-	ipv4, ok := ipLayer.(*layers.IPv4)
-	if !ok {
-		return nil, fmt.Errorf("packet IPv4 layer decode error")
+	netLayer, etherType, err := networkLayerForEgress(pkt, opts.TargetIP, opts.TTL)
+	if err != nil {
+		return nil, err
 	}
+	isIPv6 := etherType == layers.EthernetTypeIPv6
 
 	udpLayer := pkt.Packet.Layer(layers.LayerTypeUDP)
 	if udpLayer == nil {
@@ -54,40 +56,33 @@ func PacketForEgress(pkt *proxy.Packet, opts Options) (*proxy.Packet, error) {
 		}
 	}
 
-	newIP4 := layers.IPv4{
-		Version:    4,
-		IHL:        5,
-		TTL:        ipv4.TTL,
-		Protocol:   layers.IPProtocolUDP,
-		SrcIP:      ipv4.SrcIP.To4(),
-		DstIP:      opts.TargetIP.To4(),
-		Id:         ipv4.Id,
-		Flags:      ipv4.Flags,
-		FragOffset: ipv4.FragOffset,
-	}
-
 	newUDP := layers.UDP{
 		SrcPort: udp.SrcPort,
 		DstPort: udp.DstPort,
 	}
-	if err := newUDP.SetNetworkLayerForChecksum(&newIP4); err != nil {
+	if err := newUDP.SetNetworkLayerForChecksum(netLayer); err != nil {
 		return nil, fmt.Errorf("set network layer for checksum: %w", err)
 	}
 
 	sz := gopacket.NewSerializeBuffer()
 	serializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 
+	if opts.VLANID != 0 && opts.EgressLinkType != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("unable to tag VLAN %d on egress link type: %v", opts.VLANID, opts.EgressLinkType)
+	}
+
+	linkType := EgressFraming(opts.EgressLinkType)
 	var layersToSerialize []gopacket.SerializableLayer
-	switch opts.EgressLinkType {
+	switch linkType {
 	case layers.LinkTypeEthernet:
 		dstMAC := opts.TargetMAC
 		if opts.ForceBroadcastDestMAC {
-			dstMAC = broadcastMAC
+			dstMAC = broadcastMACFor(opts.TargetIP)
 		} else if len(dstMAC) == 0 {
 			if !opts.AllowBroadcastDstMAC {
 				return nil, fmt.Errorf("missing destination MAC for non-broadcast interface")
 			}
-			dstMAC = broadcastMAC
+			dstMAC = broadcastMACFor(opts.TargetIP)
 		}
 		if len(opts.SourceMAC) == 0 {
 			return nil, fmt.Errorf("missing source MAC for ethernet egress")
@@ -95,18 +90,29 @@ func PacketForEgress(pkt *proxy.Packet, opts Options) (*proxy.Packet, error) {
 		eth := &layers.Ethernet{
 			DstMAC:       dstMAC,
 			SrcMAC:       opts.SourceMAC,
-			EthernetType: layers.EthernetTypeIPv4,
+			EthernetType: etherType,
 		}
 		layersToSerialize = append(layersToSerialize, eth)
+		if opts.VLANID != 0 {
+			eth.EthernetType = layers.EthernetTypeDot1Q
+			layersToSerialize = append(layersToSerialize, &layers.Dot1Q{
+				VLANIdentifier: opts.VLANID,
+				Type:           etherType,
+			})
+		}
 	case layers.LinkTypeNull, layers.LinkTypeLoop:
-		layersToSerialize = append(layersToSerialize, &layers.Loopback{Family: layers.ProtocolFamilyIPv4})
+		family := layers.ProtocolFamilyIPv4
+		if isIPv6 {
+			family = loopbackIPv6Family()
+		}
+		layersToSerialize = append(layersToSerialize, &layers.Loopback{Family: family})
 	case layers.LinkTypeRaw, proxy.LinkTypeRawOpenBSD, proxy.LinkTypeRawOthers:
 		// No L2 header.
 	default:
 		return nil, fmt.Errorf("unsupported egress link type: %v", opts.EgressLinkType)
 	}
 
-	layersToSerialize = append(layersToSerialize, &newIP4, &newUDP, gopacket.Payload(payload))
+	layersToSerialize = append(layersToSerialize, netLayer.(gopacket.SerializableLayer), &newUDP, gopacket.Payload(payload))
 
 	if err := gopacket.SerializeLayers(sz, serializeOpts, layersToSerialize...); err != nil {
 		return nil, fmt.Errorf("serialize rewritten packet: %w", err)
@@ -121,11 +127,107 @@ func PacketForEgress(pkt *proxy.Packet, opts Options) (*proxy.Packet, error) {
 	return &proxy.Packet{
 		Metadata:         pkt.Metadata,
 		Raw:              raw,
-		Packet:           packetFromLinkType(raw, opts.EgressLinkType),
+		Packet:           packetFromLinkType(raw, linkType),
 		ArrivalInterface: arrivalIf,
 	}, nil
 }
 
+// EgressFraming returns the link type of the packets sent on an interface
+// captured with linkType.  Interfaces captured in Linux cooked mode are sent
+// bare IP packets, the kernel adds their link-layer header, if any.
+func EgressFraming(linkType layers.LinkType) layers.LinkType {
+	if proxy.IsCookedLinkType(linkType) {
+		return layers.LinkTypeRaw
+	}
+	return linkType
+}
+
+// networkLayerForEgress builds the new IPv4 or IPv6 header for the packet with
+// targetIP as the destination and returns it with the matching EtherType.  A
+// non-zero ttl replaces the original TTL/hop limit.
+func networkLayerForEgress(pkt *proxy.Packet, targetIP net.IP, ttl uint8) (gopacket.NetworkLayer, layers.EthernetType, error) {
+	if ipLayer := pkt.Packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ipv4, ok := ipLayer.(*layers.IPv4)
+		if !ok {
+			return nil, 0, fmt.Errorf("packet IPv4 layer decode error")
+		}
+		if targetIP.To4() == nil {
+			return nil, 0, fmt.Errorf("unable to send IPv4 packet to non-IPv4 target %s", targetIP)
+		}
+		if ttl == 0 {
+			ttl = ipv4.TTL
+		}
+		return &layers.IPv4{
+			Version:    4,
+			IHL:        5,
+			TTL:        ttl,
+			Protocol:   layers.IPProtocolUDP,
+			SrcIP:      ipv4.SrcIP.To4(),
+			DstIP:      targetIP.To4(),
+			Id:         ipv4.Id,
+			Flags:      ipv4.Flags,
+			FragOffset: ipv4.FragOffset,
+		}, layers.EthernetTypeIPv4, nil
+	}
+
+	if ipLayer := pkt.Packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ipv6, ok := ipLayer.(*layers.IPv6)
+		if !ok {
+			return nil, 0, fmt.Errorf("packet IPv6 layer decode error")
+		}
+		if targetIP.To4() != nil || targetIP.To16() == nil {
+			return nil, 0, fmt.Errorf("unable to send IPv6 packet to non-IPv6 target %s", targetIP)
+		}
+		if ttl == 0 {
+			ttl = ipv6.HopLimit
+		}
+		return &layers.IPv6{
+			Version:      6,
+			TrafficClass: ipv6.TrafficClass,
+			FlowLabel:    ipv6.FlowLabel,
+			NextHeader:   layers.IPProtocolUDP,
+			HopLimit:     ttl,
+			SrcIP:        ipv6.SrcIP.To16(),
+			DstIP:        targetIP.To16(),
+		}, layers.EthernetTypeIPv6, nil
+	}
+
+	return nil, 0, fmt.Errorf("packet missing IPv4 or IPv6 layer")
+}
+
+// broadcastMACFor returns the destination MAC used when sending to everyone
+// on the link (or in a multicast group): 01:00:5e:xx:xx:xx (RFC 1112) for IPv4
+// multicast groups, 33:33:xx:xx:xx:xx (RFC 2464) for IPv6 multicast groups
+// like ff02::1 and ff:ff:ff:ff:ff:ff for everything else.
+func broadcastMACFor(ip net.IP) net.HardwareAddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.IsMulticast() {
+			return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+		}
+		return broadcastMAC
+	}
+	if ip.IsMulticast() {
+		ip6 := ip.To16()
+		return net.HardwareAddr{0x33, 0x33, ip6[12], ip6[13], ip6[14], ip6[15]}
+	}
+	return broadcastMAC
+}
+
+// loopbackIPv6Family returns the DLT_NULL address family for IPv6 which,
+// unlike AF_INET, differs between the BSDs.
+func loopbackIPv6Family() layers.ProtocolFamily {
+	switch runtime.GOOS {
+	case "darwin", "ios":
+		return layers.ProtocolFamilyIPv6Darwin
+	case "freebsd", "dragonfly":
+		return layers.ProtocolFamilyIPv6FreeBSD
+	case "linux":
+		return layers.ProtocolFamilyIPv6Linux
+	default:
+		return layers.ProtocolFamilyIPv6BSD
+	}
+}
+
 func packetFromLinkType(raw []byte, linkType layers.LinkType) gopacket.Packet {
 	switch linkType {
 	case layers.LinkTypeNull, layers.LinkTypeLoop:
@@ -133,6 +235,9 @@ func packetFromLinkType(raw []byte, linkType layers.LinkType) gopacket.Packet {
 	case layers.LinkTypeEthernet:
 		return gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
 	case layers.LinkTypeRaw, proxy.LinkTypeRawOpenBSD, proxy.LinkTypeRawOthers:
+		if len(raw) > 0 && raw[0]>>4 == 6 {
+			return gopacket.NewPacket(raw, layers.LayerTypeIPv6, gopacket.Default)
+		}
 		return gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.Default)
 	default:
 		return gopacket.NewPacket(raw, gopacket.LayerTypePayload, gopacket.Default)
@@ -14,13 +14,29 @@ import (
 func buildUDPPacketForLinkType(t *testing.T, linkType layers.LinkType, srcIP, dstIP net.IP, srcMAC, dstMAC net.HardwareAddr, payload []byte, iname string) *proxy.Packet {
 	t.Helper()
 
-	ip := &layers.IPv4{
-		Version:  4,
-		IHL:      5,
-		TTL:      64,
-		Protocol: layers.IPProtocolUDP,
-		SrcIP:    srcIP.To4(),
-		DstIP:    dstIP.To4(),
+	var ip interface {
+		gopacket.NetworkLayer
+		gopacket.SerializableLayer
+	}
+	etherType, family := layers.EthernetTypeIPv4, layers.ProtocolFamilyIPv4
+	if srcIP.To4() == nil {
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      srcIP.To16(),
+			DstIP:      dstIP.To16(),
+		}
+		etherType, family = layers.EthernetTypeIPv6, layers.ProtocolFamilyIPv6BSD
+	} else {
+		ip = &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}
 	}
 	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
 	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
@@ -33,9 +49,9 @@ func buildUDPPacketForLinkType(t *testing.T, linkType layers.LinkType, srcIP, ds
 	var layersToSerialize []gopacket.SerializableLayer
 	switch linkType {
 	case layers.LinkTypeEthernet:
-		layersToSerialize = append(layersToSerialize, &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4})
+		layersToSerialize = append(layersToSerialize, &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: etherType})
 	case layers.LinkTypeNull, layers.LinkTypeLoop:
-		layersToSerialize = append(layersToSerialize, &layers.Loopback{Family: layers.ProtocolFamilyIPv4})
+		layersToSerialize = append(layersToSerialize, &layers.Loopback{Family: family})
 	case layers.LinkTypeRaw:
 		// No L2 header.
 	default:
@@ -282,6 +298,8 @@ func TestPacketForEgress_CrossLinkType_EthernetToRawVariants(t *testing.T) {
 	}{
 		{name: "RawOpenBSD", egressType: proxy.LinkTypeRawOpenBSD, targetIP: net.IP{10, 0, 1, 63}},
 		{name: "RawOthers", egressType: proxy.LinkTypeRawOthers, targetIP: net.IP{10, 0, 1, 64}},
+		{name: "LinuxSLL", egressType: layers.LinkTypeLinuxSLL, targetIP: net.IP{10, 0, 1, 65}},
+		{name: "LinuxSLL2", egressType: layers.LinkTypeLinuxSLL2, targetIP: net.IP{10, 0, 1, 66}},
 	}
 
 	for _, tc := range tests {
@@ -321,3 +339,233 @@ func TestPacketForEgress_CrossLinkType_EthernetToRawVariants(t *testing.T) {
 		})
 	}
 }
+
+func TestPacketForEgress_IPv6BroadcastUsesMulticastMAC(t *testing.T) {
+	pkt := buildEthernetPacket(
+		t,
+		net.ParseIP("fe80::1"),
+		net.ParseIP("ff02::1"),
+		net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1},
+		[]byte("hello"),
+		"eth-in",
+	)
+
+	out, err := PacketForEgress(pkt, Options{
+		TargetIP:              net.ParseIP("ff02::1"),
+		SourceMAC:             net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		EgressLinkType:        layers.LinkTypeEthernet,
+		ForceBroadcastDestMAC: true,
+	})
+	if err != nil {
+		t.Fatalf("PacketForEgress failed: %v", err)
+	}
+
+	eth := out.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if eth.EthernetType != layers.EthernetTypeIPv6 {
+		t.Fatalf("expected IPv6 ethertype, got %s", eth.EthernetType)
+	}
+	if !bytes.Equal(eth.DstMAC, net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}) {
+		t.Fatalf("unexpected dst mac: %s", eth.DstMAC)
+	}
+
+	ipLayer := out.Packet.Layer(layers.LayerTypeIPv6)
+	if ipLayer == nil {
+		t.Fatal("expected IPv6 layer")
+	}
+	ipv6 := ipLayer.(*layers.IPv6)
+	if !ipv6.SrcIP.Equal(net.ParseIP("fe80::1")) || !ipv6.DstIP.Equal(net.ParseIP("ff02::1")) {
+		t.Fatalf("unexpected IPv6 addresses: %s > %s", ipv6.SrcIP, ipv6.DstIP)
+	}
+	if ipv6.HopLimit != 64 {
+		t.Fatalf("expected hop limit to be preserved, got %d", ipv6.HopLimit)
+	}
+	if out.Packet.Layer(layers.LayerTypeUDP) == nil {
+		t.Fatal("expected UDP layer")
+	}
+}
+
+func TestPacketForEgress_IPv6EthernetToRaw(t *testing.T) {
+	pkt := buildEthernetPacket(
+		t,
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		[]byte("hello"),
+		"eth-in",
+	)
+
+	out, err := PacketForEgress(pkt, Options{
+		TargetIP:       net.ParseIP("2001:db8:1::60"),
+		EgressLinkType: layers.LinkTypeRaw,
+	})
+	if err != nil {
+		t.Fatalf("PacketForEgress failed: %v", err)
+	}
+	if out.Raw[0]>>4 != 6 {
+		t.Fatalf("expected raw IPv6 packet, got version %d", out.Raw[0]>>4)
+	}
+	ipLayer := out.Packet.Layer(layers.LayerTypeIPv6)
+	if ipLayer == nil {
+		t.Fatal("expected IPv6 layer")
+	}
+	if !ipLayer.(*layers.IPv6).DstIP.Equal(net.ParseIP("2001:db8:1::60")) {
+		t.Fatalf("unexpected dst IP: %s", ipLayer.(*layers.IPv6).DstIP)
+	}
+}
+
+func TestPacketForEgress_AddressFamilyMismatchFails(t *testing.T) {
+	v4 := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{6, 7, 8, 9, 10, 11}, []byte("hello"), "eth-in")
+	if _, err := PacketForEgress(v4, Options{TargetIP: net.ParseIP("2001:db8::2"), EgressLinkType: layers.LinkTypeRaw}); err == nil {
+		t.Fatal("expected error sending IPv4 packet to IPv6 target")
+	}
+
+	v6 := buildEthernetPacket(t, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{6, 7, 8, 9, 10, 11}, []byte("hello"), "eth-in")
+	if _, err := PacketForEgress(v6, Options{TargetIP: net.IP{10, 0, 0, 2}, EgressLinkType: layers.LinkTypeRaw}); err == nil {
+		t.Fatal("expected error sending IPv6 packet to IPv4 target")
+	}
+}
+
+func TestPacketForEgress_IPv4MulticastMACAndTTL(t *testing.T) {
+	pkt := buildEthernetPacket(
+		t,
+		net.IP{10, 0, 0, 1},
+		net.IP{224, 0, 0, 251},
+		net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb},
+		[]byte("hello"),
+		"eth-in",
+	)
+
+	out, err := PacketForEgress(pkt, Options{
+		TargetIP:              net.IP{224, 0, 0, 251},
+		SourceMAC:             net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		EgressLinkType:        layers.LinkTypeEthernet,
+		ForceBroadcastDestMAC: true,
+		TTL:                   255,
+	})
+	if err != nil {
+		t.Fatalf("PacketForEgress failed: %v", err)
+	}
+
+	eth := out.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !bytes.Equal(eth.DstMAC, net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}) {
+		t.Fatalf("unexpected dst mac: %s", eth.DstMAC)
+	}
+	ipv4 := out.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if ipv4.TTL != 255 {
+		t.Fatalf("expected TTL override to 255, got %d", ipv4.TTL)
+	}
+}
+
+func buildVLANPacket(t *testing.T, vid uint16, srcIP, dstIP net.IP, payload []byte, iname string) *proxy.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum failed: %v", err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: broadcastMAC, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: vid, Type: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload(payload),
+	); err != nil {
+		t.Fatalf("SerializeLayers failed: %v", err)
+	}
+	raw := buf.Bytes()
+	return &proxy.Packet{Raw: raw, Packet: packetFromLinkType(raw, layers.LinkTypeEthernet), ArrivalInterface: iname}
+}
+
+func TestPacketForEgress_VLANTag(t *testing.T) {
+	pkt := buildVLANPacket(t, 10, net.IP{10, 0, 10, 5}, net.IP{10, 0, 10, 255}, []byte("hello"), "eth0@vlan10")
+	if vid, ok := proxy.PacketVLAN(pkt); !ok || vid != 10 {
+		t.Fatalf("expected the test packet to be tagged with VLAN 10, got %d, %v", vid, ok)
+	}
+
+	out, err := PacketForEgress(pkt, Options{
+		TargetIP:              net.IP{10, 0, 20, 255},
+		SourceMAC:             net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		EgressLinkType:        layers.LinkTypeEthernet,
+		ForceBroadcastDestMAC: true,
+		VLANID:                20,
+	})
+	if err != nil {
+		t.Fatalf("PacketForEgress failed: %v", err)
+	}
+	eth := out.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if eth.EthernetType != layers.EthernetTypeDot1Q {
+		t.Fatalf("expected an 802.1Q ethertype, got %s", eth.EthernetType)
+	}
+	if vid, ok := proxy.PacketVLAN(out); !ok || vid != 20 {
+		t.Fatalf("expected the packet to be tagged with VLAN 20, got %d, %v", vid, ok)
+	}
+	ip4, ok := out.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || !ip4.DstIP.Equal(net.IP{10, 0, 20, 255}) {
+		t.Fatalf("expected the IPv4 layer behind the tag, got %v", out.Packet)
+	}
+	if app := out.Packet.ApplicationLayer(); app == nil || string(app.Payload()) != "hello" {
+		t.Fatal("expected the payload to be kept")
+	}
+
+	// Without a VLAN ID the tag of the ingress packet is removed.
+	out, err = PacketForEgress(pkt, Options{
+		TargetIP:              net.IP{192, 168, 1, 255},
+		SourceMAC:             net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		EgressLinkType:        layers.LinkTypeEthernet,
+		ForceBroadcastDestMAC: true,
+	})
+	if err != nil {
+		t.Fatalf("PacketForEgress failed: %v", err)
+	}
+	if _, ok := proxy.PacketVLAN(out); ok {
+		t.Fatal("expected an untagged packet")
+	}
+
+	if _, err := PacketForEgress(pkt, Options{TargetIP: net.IP{10, 0, 20, 255}, EgressLinkType: layers.LinkTypeRaw, VLANID: 20}); err == nil {
+		t.Fatal("expected an error tagging a VLAN on a raw egress interface")
+	}
+}
+
+func TestEgressFraming(t *testing.T) {
+	for lt, want := range map[layers.LinkType]layers.LinkType{
+		layers.LinkTypeEthernet:  layers.LinkTypeEthernet,
+		layers.LinkTypeNull:      layers.LinkTypeNull,
+		layers.LinkTypeRaw:       layers.LinkTypeRaw,
+		layers.LinkTypeLinuxSLL:  layers.LinkTypeRaw,
+		layers.LinkTypeLinuxSLL2: layers.LinkTypeRaw,
+	} {
+		if got := EgressFraming(lt); got != want {
+			t.Errorf("EgressFraming(%s) = %s, want %s", lt, got, want)
+		}
+	}
+}
+
+func TestPacketForEgress_CookedToEthernet(t *testing.T) {
+	ipPkt := buildUDPPacketForLinkType(t, layers.LinkTypeRaw, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 255}, nil, nil, []byte("hello"), "any")
+	// SLL2 header: protocol, reserved, ifindex 3, ARPHRD_ETHER, PACKET_BROADCAST, halen 6, address
+	raw := append([]byte{0x08, 0x00, 0, 0, 0, 0, 0, 3, 0, 1, 1, 6, 0, 1, 2, 3, 4, 5, 0, 0}, ipPkt.Raw...)
+	pkt := &proxy.Packet{Raw: raw, Packet: gopacket.NewPacket(raw, layers.LayerTypeLinuxSLL2, gopacket.Default), ArrivalInterface: "any"}
+
+	out, err := PacketForEgress(pkt, Options{
+		TargetIP:              net.IP{10, 0, 1, 255},
+		SourceMAC:             net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EgressLinkType:        layers.LinkTypeEthernet,
+		ForceBroadcastDestMAC: true,
+	})
+	if err != nil {
+		t.Fatalf("PacketForEgress failed: %v", err)
+	}
+	if out.Packet.Layer(layers.LayerTypeLinuxSLL2) != nil {
+		t.Fatal("did not expect the cooked header on ethernet egress")
+	}
+	eth, ok := out.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || eth.DstMAC.String() != "ff:ff:ff:ff:ff:ff" {
+		t.Fatalf("expected a broadcast ethernet header, got %v", out.Packet)
+	}
+	udp, ok := out.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || !bytes.Equal(udp.Payload, []byte("hello")) {
+		t.Fatalf("expected the UDP payload to be kept, got %v", out.Packet)
+	}
+}
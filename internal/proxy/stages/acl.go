@@ -0,0 +1,107 @@
+package stages
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// ACLRule allows or denies the packets matching all of its conditions.  An
+// empty condition matches every packet, a condition with several values
+// matches any of them.
+type ACLRule struct {
+	Allow bool
+	// Interface reports whether a packet captured on the named interface
+	// matches.  Nil matches every interface.
+	Interface func(iname string) bool
+	Networks  []*net.IPNet
+	MACs      []net.HardwareAddr
+	SrcPorts  []int32
+	DstPorts  []int32
+}
+
+// ACLProcessor allows or denies packets by the first of its Rules they match.
+// Packets matching no rule are allowed.  On ingress it must run before the
+// RegistryLearnerProcessor so denied clients are never learned.  On egress, in
+// the Processors of a RouteSink, packets have already been rewritten and the
+// interface rules match In, the interface the route relays from.
+type ACLProcessor struct {
+	Iname     string
+	Direction DecodeDirection
+	In        string // the ingress interface on egress, empty on ingress
+	Rules     []ACLRule
+}
+
+func (a *ACLProcessor) Process(pkt *proxy.Packet) (bool, error) {
+	if pkt == nil || pkt.Packet == nil {
+		return true, nil
+	}
+	in := a.ingress(pkt)
+	for i, rule := range a.Rules {
+		if !rule.matches(pkt, in) {
+			continue
+		}
+		if !rule.Allow {
+			slog.Debug("Packet denied by ACL", "interface", a.Iname, "direction", a.Direction, "rule", i)
+			metrics.ACLDenied.WithLabelValues(a.Iname, string(a.Direction)).Inc()
+		}
+		return rule.Allow, nil
+	}
+	return true, nil
+}
+
+func (a *ACLProcessor) Name() string {
+	if a.In != "" {
+		return fmt.Sprintf("ACLProcessor:%s->%s", a.In, a.Iname)
+	}
+	return fmt.Sprintf("ACLProcessor:%s", a.Iname)
+}
+
+// ingress returns the name of the interface pkt was captured on, which for
+// the any pseudo-interface is the one it arrived on.
+func (a *ACLProcessor) ingress(pkt *proxy.Packet) string {
+	if a.In != "" {
+		return a.In
+	}
+	if pkt.ArrivalInterface != "" {
+		return pkt.ArrivalInterface
+	}
+	return a.Iname
+}
+
+func (r *ACLRule) matches(pkt *proxy.Packet, iname string) bool {
+	if r.Interface != nil && !r.Interface(iname) {
+		return false
+	}
+	if len(r.Networks) > 0 {
+		src := packetSrcIP(pkt)
+		if src == nil || !slices.ContainsFunc(r.Networks, func(n *net.IPNet) bool { return n.Contains(src) }) {
+			return false
+		}
+	}
+	if len(r.MACs) > 0 {
+		mac := proxy.PacketHardwareAddr(pkt)
+		if mac == nil || !slices.ContainsFunc(r.MACs, func(m net.HardwareAddr) bool { return bytes.Equal(m, mac) }) {
+			return false
+		}
+	}
+	if len(r.SrcPorts) > 0 || len(r.DstPorts) > 0 {
+		udp, ok := pkt.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok {
+			return false
+		}
+		if len(r.SrcPorts) > 0 && !slices.Contains(r.SrcPorts, int32(udp.SrcPort)) {
+			return false
+		}
+		if len(r.DstPorts) > 0 && !slices.Contains(r.DstPorts, int32(udp.DstPort)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package stages
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACLProcessor_Process(t *testing.T) {
+	guest := &net.IPNet{IP: net.ParseIP("10.0.20.0").To4(), Mask: net.CIDRMask(24, 32)}
+	guestMAC := net.HardwareAddr{0x02, 0, 0, 0, 0x20, 0x01}
+	otherMAC := net.HardwareAddr{0x02, 0, 0, 0, 0x10, 0x01}
+	dstIP, dstMAC := net.ParseIP("255.255.255.255"), net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	onGuest := func(iname string) bool { return iname == "eth0@vlan20" }
+
+	tests := []struct {
+		name  string
+		rules []ACLRule
+		srcIP string
+		mac   net.HardwareAddr
+		iname string
+		want  bool
+	}{
+		{name: "no rules", srcIP: "10.0.20.5", mac: guestMAC, iname: "eth0", want: true},
+		{name: "deny network", rules: []ACLRule{{Networks: []*net.IPNet{guest}}}, srcIP: "10.0.20.5", mac: guestMAC, iname: "eth0", want: false},
+		{name: "other network", rules: []ACLRule{{Networks: []*net.IPNet{guest}}}, srcIP: "10.0.10.5", mac: guestMAC, iname: "eth0", want: true},
+		{name: "deny mac", rules: []ACLRule{{MACs: []net.HardwareAddr{guestMAC}}}, srcIP: "10.0.10.5", mac: guestMAC, iname: "eth0", want: false},
+		{name: "other mac", rules: []ACLRule{{MACs: []net.HardwareAddr{guestMAC}}}, srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0", want: true},
+		{name: "deny interface", rules: []ACLRule{{Interface: onGuest}}, srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0@vlan20", want: false},
+		{name: "other interface", rules: []ACLRule{{Interface: onGuest}}, srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0", want: true},
+		{name: "deny src port", rules: []ACLRule{{SrcPorts: []int32{1234}}}, srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0", want: false},
+		{name: "deny dst port", rules: []ACLRule{{DstPorts: []int32{5678}}}, srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0", want: false},
+		{name: "ports must both match", rules: []ACLRule{{SrcPorts: []int32{1234}, DstPorts: []int32{9999}}}, srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0", want: true},
+		{
+			name:  "first match wins",
+			rules: []ACLRule{{Allow: true, MACs: []net.HardwareAddr{guestMAC}}, {Networks: []*net.IPNet{guest}}},
+			srcIP: "10.0.20.5", mac: guestMAC, iname: "eth0", want: true,
+		},
+		{
+			name:  "allow list",
+			rules: []ACLRule{{Allow: true, Networks: []*net.IPNet{guest}}, {}},
+			srcIP: "10.0.10.5", mac: otherMAC, iname: "eth0", want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := &ACLProcessor{Iname: "eth0", Direction: DirectionInbound, Rules: tt.rules}
+			pkt := buildEthernetPacket(t, net.ParseIP(tt.srcIP), dstIP, tt.mac, dstMAC, []byte("hello"), tt.iname)
+			keep, err := acl.Process(pkt)
+			if err != nil {
+				t.Fatalf("Process failed: %v", err)
+			}
+			if keep != tt.want {
+				t.Errorf("Process() = %v, want %v", keep, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLProcessor_EgressMatchesRouteSource(t *testing.T) {
+	acl := &ACLProcessor{
+		Iname:     "eth1",
+		Direction: DirectionOutbound,
+		In:        "eth0@vlan20",
+		Rules:     []ACLRule{{Interface: func(iname string) bool { return iname == "eth0@vlan20" }}},
+	}
+	if got, want := acl.Name(), "ACLProcessor:eth0@vlan20->eth1"; got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+
+	// Rewritten packets have already arrived on the egress interface.
+	pkt := buildEthernetPacket(t, net.ParseIP("10.0.20.5"), net.ParseIP("10.0.10.255"),
+		net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "eth1")
+	if keep, err := acl.Process(pkt); err != nil || keep {
+		t.Errorf("Process() = %v, %v, want false, nil", keep, err)
+	}
+}
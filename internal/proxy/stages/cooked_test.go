@@ -0,0 +1,117 @@
+package stages
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// buildSLL2Packet returns a UDP broadcast from srcIP as captured on the any
+// pseudo-interface, arriving on the interface with the given index.
+func buildSLL2Packet(t *testing.T, ifindex byte, srcIP net.IP) *proxy.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: net.IPv4bcast.To4()}
+	udp := &layers.UDP{SrcPort: 9003, DstPort: 9003}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum failed: %v", err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ip, udp, gopacket.Payload("hello"),
+	); err != nil {
+		t.Fatalf("SerializeLayers failed: %v", err)
+	}
+	// protocol, reserved, ifindex, ARPHRD_ETHER, PACKET_BROADCAST, halen, address
+	raw := append([]byte{0x08, 0x00, 0, 0, 0, 0, 0, ifindex, 0, 1, 1, 6, 0, 1, 2, 3, 4, 5, 0, 0}, buf.Bytes()...)
+	return &proxy.Packet{Raw: raw, Packet: gopacket.NewPacket(raw, layers.LayerTypeLinuxSLL2, gopacket.Default), ArrivalInterface: proxy.AnyInterface}
+}
+
+func TestRegistryLearnerProcessor_AnyInterface(t *testing.T) {
+	registry, err := NewRegistryProcessor(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessor failed: %v", err)
+	}
+	pkt := buildSLL2Packet(t, 3, net.IP{10, 0, 0, 5})
+	pkt.ArrivalInterface = "wg0"
+	if _, err := (&RegistryLearnerProcessor{Registry: registry, Iname: proxy.AnyInterface}).Process(pkt); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	clients := registry.GetClientsForInterface("wg0")
+	if len(clients) != 1 || !clients[0].IP.Equal(net.IP{10, 0, 0, 5}) {
+		t.Fatalf("expected the client on the interface it arrived on, got %+v", registry.GetClients())
+	}
+	if clients[0].MAC.String() != "00:01:02:03:04:05" {
+		t.Fatalf("expected the MAC from the SLL2 header, got %s", clients[0].MAC)
+	}
+}
+
+func TestPcapSource_ArrivalInterfaceOnAny(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skipf("no interfaces: %v", err)
+	}
+	ifi := ifaces[0]
+	if ifi.Index > 255 {
+		t.Skipf("interface index %d too large for the test packet", ifi.Index)
+	}
+	pkt := buildSLL2Packet(t, byte(ifi.Index), net.IP{10, 0, 0, 5})
+
+	s := &PcapSource{iname: proxy.AnyInterface}
+	if got := s.arrivalInterface(pkt); got != ifi.Name {
+		t.Fatalf("expected the packet to arrive on %s, got %s", ifi.Name, got)
+	}
+	if s.indexNames[ifi.Index] != ifi.Name {
+		t.Fatalf("expected the name of interface %d to be cached", ifi.Index)
+	}
+	if got := (&PcapSource{iname: "eth0"}).arrivalInterface(pkt); got != "eth0" {
+		t.Fatalf("expected only the any pseudo-interface to use the SLL2 header, got %s", got)
+	}
+}
+
+func TestRouteSink_Write_SkipsArrivalInterface(t *testing.T) {
+	sink := &routeSinkTestSink{}
+	route := &RouteSink{
+		Iname:              "wg0",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 0, 255}},
+		LinkType:           layers.LinkTypeLinuxSLL,
+		Sinks:              []proxy.Sink{sink},
+	}
+	pkt := buildSLL2Packet(t, 3, net.IP{10, 0, 0, 5})
+
+	pkt.ArrivalInterface = "wg0"
+	if err := route.Write(pkt); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(sink.pkts) != 0 {
+		t.Fatalf("expected no packets relayed back to the interface they arrived on, got %d", len(sink.pkts))
+	}
+
+	pkt.ArrivalInterface = "eth0"
+	if err := route.Write(pkt); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(sink.pkts) != 1 {
+		t.Fatalf("expected 1 packet, got %d", len(sink.pkts))
+	}
+	if sink.pkts[0].Packet.LinkLayer() != nil {
+		t.Fatal("expected a bare IP packet on cooked egress")
+	}
+}
+
+func TestDecodeProcessor_Process_WritesSLL2Summary(t *testing.T) {
+	var out bytes.Buffer
+	processor := &DecodeProcessor{Iname: proxy.AnyInterface, Writer: &out}
+	if _, err := processor.Process(buildSLL2Packet(t, 3, net.IP{10, 0, 0, 5})); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if got := out.String(); !strings.Contains(got, "any ifindex 3 broadcast 00:01:02:03:04:05, ethertype IPv4") {
+		t.Fatalf("unexpected decode output: %q", got)
+	}
+}
@@ -112,6 +112,27 @@ func formatLinkSummary(packet gopacket.Packet) string {
 		}
 	}
 
+	if sll, ok := packet.Layer(layers.LayerTypeLinuxSLL).(*layers.LinuxSLL); ok {
+		return fmt.Sprintf(
+			"%s %s, ethertype %s, length %d:",
+			sll.PacketType,
+			formatMAC(sll.Addr),
+			sll.EthernetType,
+			len(packet.Data()),
+		)
+	}
+
+	if sll2, ok := packet.Layer(layers.LayerTypeLinuxSLL2).(*layers.LinuxSLL2); ok {
+		return fmt.Sprintf(
+			"ifindex %d %s %s, ethertype %s, length %d:",
+			sll2.InterfaceIndex,
+			sll2.PacketType,
+			formatMAC(sll2.Addr),
+			sll2.ProtocolType,
+			len(packet.Data()),
+		)
+	}
+
 	if packet.Layer(layers.LayerTypeLoopback) != nil {
 		if ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
 			return fmt.Sprintf("loopback IPv4, IPID: 0x%04x, length %d:", ipv4.Id, len(packet.Data()))
@@ -150,20 +171,13 @@ func formatNetworkSummary(packet gopacket.Packet) string {
 		ipv4, ipOK := ipLayer.(*layers.IPv4)
 		udp, udpOK := udpLayer.(*layers.UDP)
 		if ipOK && udpOK {
-			payloadLen := 0
-			if app := packet.ApplicationLayer(); app != nil {
-				payloadLen = len(app.Payload())
-			} else if udp.Length >= 8 {
-				payloadLen = int(udp.Length - 8)
-			}
-
 			return fmt.Sprintf(
 				"%s:%d > %s:%d: UDP, length %d, IPID: 0x%04x",
 				ipv4.SrcIP,
 				udp.SrcPort,
 				ipv4.DstIP,
 				udp.DstPort,
-				payloadLen,
+				udpPayloadLen(packet, udp),
 				ipv4.Id,
 			)
 		}
@@ -175,9 +189,35 @@ func formatNetworkSummary(packet gopacket.Packet) string {
 		}
 	}
 
+	if ip6Layer := packet.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+		if ipv6, ok := ip6Layer.(*layers.IPv6); ok {
+			if udp, ok := udpLayer.(*layers.UDP); ok {
+				return fmt.Sprintf(
+					"[%s]:%d > [%s]:%d: UDP, length %d, FlowLabel: %d",
+					ipv6.SrcIP,
+					udp.SrcPort,
+					ipv6.DstIP,
+					udp.DstPort,
+					udpPayloadLen(packet, udp),
+					ipv6.FlowLabel,
+				)
+			}
+			return fmt.Sprintf("%s > %s: %s", ipv6.SrcIP, ipv6.DstIP, ipv6.NextHeader)
+		}
+	}
+
 	return packet.Dump()
 }
 
+func udpPayloadLen(packet gopacket.Packet, udp *layers.UDP) int {
+	if app := packet.ApplicationLayer(); app != nil {
+		return len(app.Payload())
+	} else if udp.Length >= 8 {
+		return int(udp.Length - 8)
+	}
+	return 0
+}
+
 func formatMAC(mac net.HardwareAddr) string {
 	if len(mac) == 0 {
 		return "<unknown>"
@@ -83,6 +83,44 @@ func TestDecodeProcessor_Process_WritesSummary(t *testing.T) {
 	}
 }
 
+func TestDecodeProcessor_Process_WritesIPv6Summary(t *testing.T) {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   1,
+		FlowLabel:  42,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fe80::1"),
+		DstIP:      net.ParseIP("ff02::1"),
+	}
+	udp := &layers.UDP{SrcPort: 5678, DstPort: 9003}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum failed: %v", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload([]byte("hello"))); err != nil {
+		t.Fatalf("SerializeLayers failed: %v", err)
+	}
+
+	raw := buf.Bytes()
+	pkt := &proxy.Packet{
+		Raw:    raw,
+		Packet: gopacket.NewPacket(raw, layers.LayerTypeIPv6, gopacket.Default),
+	}
+
+	var out bytes.Buffer
+	processor := &DecodeProcessor{Iname: "tun0", Writer: &out}
+	if _, err := processor.Process(pkt); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	want := "[fe80::1]:5678 > [ff02::1]:9003: UDP, length 5, FlowLabel: 42"
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Fatalf("expected output to contain %q, got %q", want, got)
+	}
+}
+
 func TestDecodeProcessor_Process_NilPacketNoOutput(t *testing.T) {
 	var out bytes.Buffer
 	processor := &DecodeProcessor{Writer: &out}
@@ -0,0 +1,132 @@
+package stages
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// DedupCache remembers which packets were seen recently.  A single cache is
+// shared by every pipeline so that a packet which comes back in on another
+// interface, either because of a loop between relays or because it is one we
+// injected ourselves, is recognized as a copy.
+type DedupCache struct {
+	mu         sync.Mutex
+	window     time.Duration
+	seen       map[uint64]time.Time
+	lastSweep  time.Time
+	suppressed atomic.Uint64
+	now        func() time.Time
+}
+
+// NewDedupCache creates a DedupCache which treats identical packets seen
+// within window of each other as duplicates.
+func NewDedupCache(window time.Duration) *DedupCache {
+	return &DedupCache{
+		window: window,
+		seen:   make(map[uint64]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Seen records key and reports whether it was already seen within the window.
+// The first sighting starts the window; later copies do not extend it.
+func (c *DedupCache) Seen(key uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Sub(c.lastSweep) > c.window {
+		c.sweep(now)
+	}
+
+	if first, ok := c.seen[key]; ok && now.Sub(first) <= c.window {
+		c.suppressed.Add(1)
+		return true
+	}
+	c.seen[key] = now
+	return false
+}
+
+// sweep removes expired entries.  Caller must hold c.mu.
+func (c *DedupCache) sweep(now time.Time) {
+	for key, first := range c.seen {
+		if now.Sub(first) > c.window {
+			delete(c.seen, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// Len returns the number of packets currently remembered.
+func (c *DedupCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
+
+// Suppressed returns the total number of duplicates seen across all pipelines.
+func (c *DedupCache) Suppressed() uint64 {
+	return c.suppressed.Load()
+}
+
+// DedupProcessor drops packets which were already seen on any interface within
+// the window of the shared DedupCache.  Packets are identified by their source
+// IP, source port, destination port and payload, which we never modify when
+// relaying, so our own injected copies match the original.
+type DedupProcessor struct {
+	Cache      *DedupCache
+	Iname      string
+	suppressed atomic.Uint64
+}
+
+func (d *DedupProcessor) Process(pkt *proxy.Packet) (bool, error) {
+	if d.Cache == nil || pkt == nil || pkt.Packet == nil {
+		return true, nil
+	}
+
+	key, ok := dedupKey(pkt)
+	if !ok {
+		return true, nil
+	}
+	if d.Cache.Seen(key) {
+		d.suppressed.Add(1)
+		slog.Debug("Suppressed duplicate packet", "interface", d.Iname, "suppressed", d.suppressed.Load())
+		return false, nil
+	}
+	return true, nil
+}
+
+// Suppressed returns the number of duplicates dropped by this processor.
+func (d *DedupProcessor) Suppressed() uint64 {
+	return d.suppressed.Load()
+}
+
+func (d *DedupProcessor) Name() string {
+	return fmt.Sprintf("DedupProcessor:%s", d.Iname)
+}
+
+// dedupKey hashes the source IP, UDP ports and payload of pkt.
+func dedupKey(pkt *proxy.Packet) (uint64, bool) {
+	srcIP := packetSrcIP(pkt)
+	udp, ok := pkt.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if srcIP == nil || !ok {
+		return 0, false
+	}
+
+	h := fnv.New64a()
+	h.Write(srcIP.To16())
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:2], uint16(udp.SrcPort))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(udp.DstPort))
+	h.Write(ports[:])
+	h.Write(udp.Payload)
+	return h.Sum64(), true
+}
@@ -0,0 +1,80 @@
+package stages
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+func TestDedupProcessor_SuppressesCopiesAcrossInterfaces(t *testing.T) {
+	cache := NewDedupCache(time.Second)
+	eth0 := &DedupProcessor{Cache: cache, Iname: "eth0"}
+	eth1 := &DedupProcessor{Cache: cache, Iname: "eth1"}
+
+	original := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 255}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "eth0")
+	keep, err := eth0.Process(original)
+	if err != nil || !keep {
+		t.Fatalf("expected first packet to be kept, got keep=%v err=%v", keep, err)
+	}
+
+	// Our own relayed copy has a different destination and MACs, but the
+	// same source, ports and payload.
+	relayed := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 1, 255}, net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "eth1")
+	keep, err = eth1.Process(relayed)
+	if err != nil || keep {
+		t.Fatalf("expected relayed copy to be dropped, got keep=%v err=%v", keep, err)
+	}
+
+	other := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 255}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("world"), "eth0")
+	if keep, _ := eth0.Process(other); !keep {
+		t.Fatal("expected packet with a different payload to be kept")
+	}
+
+	if got := eth0.Suppressed(); got != 0 {
+		t.Errorf("expected 0 suppressed on eth0, got %d", got)
+	}
+	if got := eth1.Suppressed(); got != 1 {
+		t.Errorf("expected 1 suppressed on eth1, got %d", got)
+	}
+	if got := cache.Suppressed(); got != 1 {
+		t.Errorf("expected 1 suppressed in total, got %d", got)
+	}
+}
+
+func TestDedupCache_WindowExpires(t *testing.T) {
+	now := time.Date(2026, time.May, 18, 12, 0, 0, 0, time.UTC)
+	cache := NewDedupCache(500 * time.Millisecond)
+	cache.now = func() time.Time { return now }
+
+	if cache.Seen(42) {
+		t.Fatal("expected first sighting to not be a duplicate")
+	}
+	now = now.Add(400 * time.Millisecond)
+	if !cache.Seen(42) {
+		t.Fatal("expected second sighting inside the window to be a duplicate")
+	}
+	now = now.Add(200 * time.Millisecond)
+	if cache.Seen(42) {
+		t.Fatal("expected sighting after the window to not be a duplicate")
+	}
+
+	now = now.Add(time.Second)
+	cache.Seen(43)
+	if got := cache.Len(); got != 1 {
+		t.Fatalf("expected expired entries to be swept, got %d entries", got)
+	}
+}
+
+func TestDedupProcessor_KeepsNonUDP(t *testing.T) {
+	processor := &DedupProcessor{Cache: NewDedupCache(time.Second), Iname: "eth0"}
+	pkt := &proxy.Packet{Packet: gopacket.NewPacket([]byte{1, 2, 3}, layers.LayerTypeEthernet, gopacket.Default)}
+	for i := 0; i < 2; i++ {
+		if keep, err := processor.Process(pkt); err != nil || !keep {
+			t.Fatalf("expected non-UDP packet to be kept, got keep=%v err=%v", keep, err)
+		}
+	}
+}
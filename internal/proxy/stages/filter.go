@@ -2,19 +2,23 @@ package stages
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/gopacket/gopacket/layers"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 )
 
-// FilterProcessor drops packets that are not valid UDP/IPv4.
+// FilterProcessor drops packets that are not valid UDP over IPv4 or IPv6.  On a
+// logical VLAN interface like eth0@vlan10 it also drops packets which are not
+// tagged with its VLAN ID.
 type FilterProcessor struct {
 	Iname string
 }
 
 func (f *FilterProcessor) Process(pkt *proxy.Packet) (bool, error) {
-	if pkt.Packet.NetworkLayer() == nil ||
-		pkt.Packet.NetworkLayer().LayerType() != layers.LayerTypeIPv4 ||
+	network := pkt.Packet.NetworkLayer()
+	if network == nil ||
+		(network.LayerType() != layers.LayerTypeIPv4 && network.LayerType() != layers.LayerTypeIPv6) ||
 		pkt.Packet.TransportLayer() == nil ||
 		pkt.Packet.TransportLayer().LayerType() != layers.LayerTypeUDP {
 		return false, nil
@@ -24,9 +28,62 @@ func (f *FilterProcessor) Process(pkt *proxy.Packet) (bool, error) {
 		return false, nil
 	}
 
+	if _, want, ok := proxy.ParseVLANInterface(f.Iname); ok {
+		if vid, tagged := proxy.PacketVLAN(pkt); !tagged || vid != want {
+			return false, nil
+		}
+	}
+
 	return true, nil
 }
 
 func (f *FilterProcessor) Name() string {
 	return fmt.Sprintf("FilterProcessor:%s", f.Iname)
 }
+
+// matchesPorts reports whether the UDP source or destination port of pkt is
+// one of ports, mirroring the "udp port N" BPF filter.  An empty list matches
+// every packet.
+func matchesPorts(pkt *proxy.Packet, ports []int32) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	if pkt == nil || pkt.Packet == nil {
+		return false
+	}
+	udp, ok := pkt.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return false
+	}
+	for _, port := range ports {
+		if int32(udp.SrcPort) == port || int32(udp.DstPort) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesGroupPorts reports whether pkt belongs to the relay group relaying
+// ports, where otherPorts are relayed by the other groups of the interface
+// pkt was captured on.  A packet belongs to the group relaying its destination
+// port, or failing that its source port, so it never belongs to two groups.
+// An empty list of ports matches every packet.
+func matchesGroupPorts(pkt *proxy.Packet, ports, otherPorts []int32) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	if pkt == nil || pkt.Packet == nil {
+		return false
+	}
+	udp, ok := pkt.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return false
+	}
+	switch dst := int32(udp.DstPort); {
+	case slices.Contains(ports, dst):
+		return true
+	case slices.Contains(otherPorts, dst):
+		return false
+	}
+	return slices.Contains(ports, int32(udp.SrcPort))
+}
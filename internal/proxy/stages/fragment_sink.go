@@ -0,0 +1,67 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	proxyrewrite "github.com/synfinatic/udp-proxy-2020/internal/proxy/rewrite"
+)
+
+// FragmentSink splits the packets written to it into IP fragments which fit
+// in the MTU of the egress interface and writes them to Sink, usually the
+// TransmitterSink of the interface.
+type FragmentSink struct {
+	Iname    string
+	MTU      int // use SetMTU once running
+	LinkType layers.LinkType
+	Sink     proxy.Sink
+
+	mu sync.RWMutex // protects MTU
+}
+
+func (s *FragmentSink) Name() string {
+	return fmt.Sprintf("FragmentSink(%s)", s.Iname)
+}
+
+// SetMTU changes the MTU of the egress interface.  Safe to call while packets
+// are being written.
+func (s *FragmentSink) SetMTU(mtu int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MTU = mtu
+}
+
+func (s *FragmentSink) mtu() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.MTU
+}
+
+func (s *FragmentSink) Write(pkt *proxy.Packet) error {
+	if pkt == nil {
+		return nil
+	}
+	fragments, err := proxyrewrite.Fragment(pkt, s.mtu(), s.LinkType)
+	if err != nil {
+		return fmt.Errorf("unable to fragment packet for %s: %w", s.Iname, err)
+	}
+	if len(fragments) > 1 {
+		metrics.EgressFragments.WithLabelValues(s.Iname).Add(float64(len(fragments)))
+	}
+	var errs []error
+	for _, fragment := range fragments {
+		if err := s.Sink.Write(fragment); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the wrapped sink.
+func (s *FragmentSink) Close() error {
+	return s.Sink.Close()
+}
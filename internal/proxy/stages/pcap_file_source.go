@@ -0,0 +1,172 @@
+package stages
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// pcapngMagic is the block type of the section header starting a pcapng file.
+const pcapngMagic = 0x0A0D0D0A
+
+type packetFileReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// PcapFileSource reads the packets of a pcap or pcapng file, like the
+// udp-proxy-in-*.pcap files written by --pcap, as if they were captured on
+// an interface.  By default packets are read as fast as the pipeline takes
+// them.  With Realtime they are spaced out like they were captured, sped up
+// Speed times.  With Loop the file starts over at the end instead of ending
+// the pipeline.
+type PcapFileSource struct {
+	Realtime bool
+	Speed    float64
+	Loop     bool
+
+	path     string
+	iname    string
+	file     *os.File
+	reader   packetFileReader
+	linkType layers.LinkType
+	failed   bool
+	packets  int       // packets read in the current pass
+	first    time.Time // capture time of the first packet of the current pass
+	start    time.Time // when the first packet of the current pass was read
+	now      func() time.Time
+}
+
+// NewPcapFileSource opens the pcap or pcapng file at path for replaying its
+// packets as if they were captured on iname.
+func NewPcapFileSource(path, iname string) (*PcapFileSource, error) {
+	s := &PcapFileSource{
+		Speed: 1,
+		path:  path,
+		iname: iname,
+		now:   time.Now,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.linkType = s.reader.LinkType()
+	return s, nil
+}
+
+// open opens the file and reads its header, picking the reader from the
+// magic number.
+func (s *PcapFileSource) open() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: unable to read file header: %w", s.path, err)
+	}
+	var reader packetFileReader
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		reader, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	} else {
+		reader, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.file, s.reader, s.packets = f, reader, 0
+	return nil
+}
+
+func (s *PcapFileSource) Read(ctx context.Context) (*proxy.Packet, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if s.failed {
+			return nil, io.EOF
+		}
+
+		data, ci, err := s.reader.ReadPacketData()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Files which are still being written end with a partial packet.
+			if !s.Loop || s.packets == 0 {
+				return nil, io.EOF
+			}
+			s.file.Close()
+			if err := s.open(); err != nil {
+				s.failed = true
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			// The rest of the file can't be trusted.
+			s.failed = true
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+
+		if s.packets == 0 {
+			s.first, s.start = ci.Timestamp, s.now()
+		}
+		s.packets++
+		if s.Realtime {
+			if err := s.wait(ctx, ci.Timestamp); err != nil {
+				return nil, err
+			}
+		}
+
+		return &proxy.Packet{
+			Raw:              data,
+			Metadata:         ci,
+			Packet:           gopacket.NewPacket(data, s.linkType, gopacket.Default),
+			ArrivalInterface: s.iname,
+		}, nil
+	}
+}
+
+// wait sleeps until a packet captured at ts is due.
+func (s *PcapFileSource) wait(ctx context.Context, ts time.Time) error {
+	speed := s.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	due := s.start.Add(time.Duration(float64(ts.Sub(s.first)) / speed))
+	delay := due.Sub(s.now())
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// LinkType returns the link type of the packets in the file.
+func (s *PcapFileSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// Close closes the file.
+func (s *PcapFileSource) Close() error {
+	return s.file.Close()
+}
+
+func (s *PcapFileSource) Name() string {
+	return "PcapFileSource:" + s.iname
+}
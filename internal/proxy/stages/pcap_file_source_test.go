@@ -0,0 +1,158 @@
+package stages
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// writeTestCapture writes count packets 10ms apart to a pcap or pcapng file.
+func writeTestCapture(t *testing.T, name string, count int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+
+	var write func(ci gopacket.CaptureInfo, data []byte) error
+	if filepath.Ext(name) == ".pcapng" {
+		w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatalf("NewNgWriter failed: %v", err)
+		}
+		defer w.Flush()
+		write = w.WritePacket
+	} else {
+		w := pcapgo.NewWriter(f)
+		if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+			t.Fatalf("WriteFileHeader failed: %v", err)
+		}
+		write = w.WritePacket
+	}
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < count; i++ {
+		pkt := buildEthernetPacket(t, net.IPv4(10, 0, 0, byte(i+1)), net.IPv4bcast,
+			net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i + 1)}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "")
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * 10 * time.Millisecond), CaptureLength: len(pkt.Raw), Length: len(pkt.Raw)}
+		if err := write(ci, pkt.Raw); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	return path
+}
+
+func readAll(t *testing.T, s *PcapFileSource, max int) []string {
+	t.Helper()
+	var srcs []string
+	for len(srcs) < max {
+		pkt, err := s.Read(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if pkt.ArrivalInterface != "eth0" {
+			t.Errorf("expected packets to arrive on eth0, got %q", pkt.ArrivalInterface)
+		}
+		srcs = append(srcs, packetSrcIP(pkt).String())
+	}
+	return srcs
+}
+
+func TestPcapFileSource_Read(t *testing.T) {
+	for _, name := range []string{"capture.pcap", "capture.pcapng"} {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewPcapFileSource(writeTestCapture(t, name, 3), "eth0")
+			if err != nil {
+				t.Fatalf("NewPcapFileSource failed: %v", err)
+			}
+			defer s.Close()
+			if s.LinkType() != layers.LinkTypeEthernet {
+				t.Errorf("expected Ethernet, got %v", s.LinkType())
+			}
+			if got := readAll(t, s, 10); len(got) != 3 || got[0] != "10.0.0.1" || got[2] != "10.0.0.3" {
+				t.Errorf("unexpected packets %v", got)
+			}
+		})
+	}
+}
+
+func TestPcapFileSource_Loop(t *testing.T) {
+	s, err := NewPcapFileSource(writeTestCapture(t, "capture.pcap", 2), "eth0")
+	if err != nil {
+		t.Fatalf("NewPcapFileSource failed: %v", err)
+	}
+	defer s.Close()
+	s.Loop = true
+
+	got := readAll(t, s, 5)
+	want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2", "10.0.0.1"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestPcapFileSource_Realtime(t *testing.T) {
+	s, err := NewPcapFileSource(writeTestCapture(t, "capture.pcap", 3), "eth0")
+	if err != nil {
+		t.Fatalf("NewPcapFileSource failed: %v", err)
+	}
+	defer s.Close()
+	s.Realtime = true
+	s.Speed = 2
+
+	// 20ms of packets take 10ms at twice the speed.
+	start := time.Now()
+	if got := readAll(t, s, 10); len(got) != 3 {
+		t.Fatalf("expected 3 packets, got %v", got)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the replay to take about 10ms, took %v", elapsed)
+	}
+
+	// Cancelling the context stops a wait.
+	s, err = NewPcapFileSource(writeTestCapture(t, "slow.pcap", 2), "eth0")
+	if err != nil {
+		t.Fatalf("NewPcapFileSource failed: %v", err)
+	}
+	defer s.Close()
+	s.Realtime, s.Speed = true, 0.0001
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Read(ctx); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, err := s.Read(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNewPcapFileSource_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bogus.pcap")
+	if err := os.WriteFile(path, []byte("not a capture file"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := NewPcapFileSource(path, "eth0"); err == nil {
+		t.Error("expected an error for an invalid file")
+	}
+	if _, err := NewPcapFileSource(filepath.Join(t.TempDir(), "missing.pcap"), "eth0"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -21,11 +21,16 @@ func (s *PcapFileSink) Write(pkt *proxy.Packet) error {
 	return s.Writer.WritePacket(pkt.Metadata, pkt.Raw)
 }
 
+// Close syncs the pcap file to disk and closes it.
 func (s *PcapFileSink) Close() error {
-	if s.File != nil {
-		return s.File.Close()
+	if s.File == nil {
+		return nil
+	}
+	if err := s.File.Sync(); err != nil {
+		s.File.Close()
+		return fmt.Errorf("unable to sync %s: %w", s.File.Name(), err)
 	}
-	return nil
+	return s.File.Close()
 }
 
 func (s *PcapFileSink) Name() string {
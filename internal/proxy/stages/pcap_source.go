@@ -3,10 +3,13 @@ package stages
 import (
 	"context"
 	"log/slog"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/pcap"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 )
 
@@ -15,26 +18,30 @@ const (
 	reconnectMaxDelay     = 30 * time.Second
 )
 
-// PcapSource reads packets from a libpcap handle.
+// PcapSource reads packets from a capture handle of a DeviceManager.
 type PcapSource struct {
-	dm           *proxy.DeviceManager
-	handle       *pcap.Handle
+	dm           proxy.DeviceManager
+	mu           sync.Mutex // protects handle and filter
+	handle       proxy.CaptureHandle
+	filter       string
 	packetSource *gopacket.PacketSource
 	packets      chan gopacket.Packet
 	iname        string
 	promisc      bool
 	timeout      time.Duration
 
-	createReaderHandle func(iname string, promisc bool, timeout time.Duration) (*pcap.Handle, error)
+	createReaderHandle func(iname string, promisc bool, timeout time.Duration) (proxy.CaptureHandle, error)
 	closeReaderHandle  func(iname string, direction proxy.PcapHandleDirection) error
-	interfaceAvailable func(iname string) bool
-	newPacketSource    func(handle *pcap.Handle) (*gopacket.PacketSource, chan gopacket.Packet)
+	subscribe          func() (<-chan proxy.LinkEvent, func())
+	newPacketSource    func(handle proxy.CaptureHandle) (*gopacket.PacketSource, chan gopacket.Packet)
 	reconnectSignal    chan struct{}
+	linkEvents         chan proxy.LinkEvent // events for iname, forwarded by the monitor
 	monitorCancel      context.CancelFunc
+	indexNames         map[int]string // interface names by index on the any pseudo-interface, only used by the reader
 }
 
 // NewPcapSource creates a new PcapSource.
-func NewPcapSource(dm *proxy.DeviceManager, iname string, promisc bool, timeout time.Duration) (*PcapSource, error) {
+func NewPcapSource(dm proxy.DeviceManager, iname string, promisc bool, timeout time.Duration) (*PcapSource, error) {
 	handle, err := dm.CreateReaderHandle(iname, promisc, timeout)
 	if err != nil {
 		return nil, err
@@ -50,64 +57,108 @@ func NewPcapSource(dm *proxy.DeviceManager, iname string, promisc bool, timeout
 		timeout:            timeout,
 		createReaderHandle: dm.CreateReaderHandle,
 		closeReaderHandle:  dm.Close,
-		interfaceAvailable: dm.InterfaceAvailable,
-		newPacketSource: func(h *pcap.Handle) (*gopacket.PacketSource, chan gopacket.Packet) {
+		subscribe:          dm.Subscribe,
+		newPacketSource: func(h proxy.CaptureHandle) (*gopacket.PacketSource, chan gopacket.Packet) {
 			ps := gopacket.NewPacketSource(h, h.LinkType())
 			return ps, ps.Packets()
 		},
 		reconnectSignal: make(chan struct{}, 1),
+		linkEvents:      make(chan proxy.LinkEvent, 1),
 		monitorCancel:   nil,
 	}
 	source.startInterfaceMonitor()
 	return source, nil
 }
 
+// startInterfaceMonitor follows the link events of the DeviceManager and
+// reconnects the capture handle when the interface comes back after going
+// away.
 func (s *PcapSource) startInterfaceMonitor() {
-	if s.interfaceAvailable == nil {
+	if s.subscribe == nil {
 		return
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s.monitorCancel = cancel
+	events, unsubscribe := s.subscribe()
 
 	go func() {
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
-
-		interfaceWasDown := false
+		defer unsubscribe()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
-				available := s.interfaceAvailable(s.iname)
-				if !available {
-					if !interfaceWasDown {
-						slog.Warn("interface appears down, awaiting recovery",
-							slog.String("interface", s.iname))
-					}
-					interfaceWasDown = true
+			case event := <-events:
+				if event.Interface != s.iname {
 					continue
 				}
-
-				if interfaceWasDown {
+				switch event.Kind {
+				case proxy.LinkGone:
+					slog.Warn("interface appears down, awaiting recovery",
+						slog.String("interface", s.iname))
+				case proxy.LinkAppeared:
 					slog.Info("interface is back, reconnecting capture handle",
 						slog.String("interface", s.iname))
 					select {
 					case s.reconnectSignal <- struct{}{}:
 					default:
 					}
-					interfaceWasDown = false
+				}
+				// Wake up a reconnect already in progress.
+				select {
+				case s.linkEvents <- event:
+				default:
 				}
 			}
 		}
 	}()
 }
 
-func (s *PcapSource) Handle() *pcap.Handle {
+// waitRetry waits for delay before the next reconnect attempt, or less if
+// iname appears on events in the meantime.
+func waitRetry(ctx context.Context, events <-chan proxy.LinkEvent, iname string, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case event := <-events:
+			if event.Interface == iname && event.Kind == proxy.LinkAppeared {
+				return nil
+			}
+		}
+	}
+}
+
+func (s *PcapSource) Handle() proxy.CaptureHandle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.handle
 }
 
+// LinkType returns the link type of the capture handle.
+func (s *PcapSource) LinkType() layers.LinkType {
+	if h := s.Handle(); h != nil {
+		return h.LinkType()
+	}
+	return layers.LinkTypeNull
+}
+
+// SetBPFFilter sets the capture filter, which is also applied to the new handle
+// after a reconnect.  Safe to call while packets are being read.
+func (s *PcapSource) SetBPFFilter(filter string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = filter
+	if s.handle == nil {
+		return nil
+	}
+	return s.handle.SetBPFFilter(filter)
+}
+
 // reconnect closes the stale pcap handle and waits for the interface to come
 // back up, then opens a fresh handle and resets the packet channel. It returns
 // when reconnection succeeds or ctx is cancelled.
@@ -115,16 +166,15 @@ func (s *PcapSource) reconnect(ctx context.Context, reason string) error {
 	slog.Warn("pcap source lost, waiting for interface to come back",
 		slog.String("interface", s.iname),
 		slog.String("reason", reason))
+	metrics.SourceReconnects.WithLabelValues(s.iname, "started").Inc()
 
 	// Close the old handle; ignore "not found" — it may already be gone.
 	_ = s.closeReaderHandle(s.iname, proxy.Reader)
 
 	delay := reconnectInitialDelay
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(delay):
+		if err := waitRetry(ctx, s.linkEvents, s.iname, delay); err != nil {
+			return err
 		}
 
 		handle, err := s.createReaderHandle(s.iname, s.promisc, s.timeout)
@@ -143,10 +193,21 @@ func (s *PcapSource) reconnect(ctx context.Context, reason string) error {
 			continue
 		}
 
-		packetSource, packets := s.newPacketSource(handle)
+		s.mu.Lock()
+		if handle != nil && s.filter != "" {
+			if err := handle.SetBPFFilter(s.filter); err != nil {
+				slog.Error("unable to set BPF filter after reconnect",
+					slog.String("interface", s.iname),
+					slog.String("error", err.Error()))
+			}
+		}
 		s.handle = handle
+		s.mu.Unlock()
+
+		packetSource, packets := s.newPacketSource(handle)
 		s.packetSource = packetSource
 		s.packets = packets
+		metrics.SourceReconnects.WithLabelValues(s.iname, "succeeded").Inc()
 		slog.Info("interface reconnected",
 			slog.String("interface", s.iname),
 			slog.String("reason", reason))
@@ -179,16 +240,61 @@ func (s *PcapSource) Read(ctx context.Context) (*proxy.Packet, error) {
 				continue
 			}
 
-			return &proxy.Packet{
-				Raw:              p.Data(),
-				Metadata:         p.Metadata().CaptureInfo,
-				Packet:           p,
-				ArrivalInterface: s.iname,
-			}, nil
+			return s.newPacket(p), nil
 		}
 	}
 }
 
+// Drain returns the next packet already captured by the PCAP handle, or nil if
+// there are none.  It never blocks or reconnects.
+func (s *PcapSource) Drain() *proxy.Packet {
+	select {
+	case p, ok := <-s.packets:
+		if !ok {
+			return nil
+		}
+		return s.newPacket(p)
+	default:
+		return nil
+	}
+}
+
+func (s *PcapSource) newPacket(p gopacket.Packet) *proxy.Packet {
+	pkt := &proxy.Packet{
+		Raw:      p.Data(),
+		Metadata: p.Metadata().CaptureInfo,
+		Packet:   p,
+	}
+	pkt.ArrivalInterface = s.arrivalInterface(pkt)
+	return pkt
+}
+
+// arrivalInterface returns the interface pkt was captured on.  On the any
+// pseudo-interface this is the interface in its SLL2 header, so clients are
+// learned on the interface they are on and packets aren't relayed back to it.
+// Interface indexes aren't reused, so their names are cached.
+func (s *PcapSource) arrivalInterface(pkt *proxy.Packet) string {
+	if s.iname != proxy.AnyInterface {
+		return s.iname
+	}
+	index, ok := proxy.PacketInterfaceIndex(pkt)
+	if !ok {
+		return s.iname
+	}
+	if name, ok := s.indexNames[index]; ok {
+		return name
+	}
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return s.iname
+	}
+	if s.indexNames == nil {
+		s.indexNames = make(map[int]string)
+	}
+	s.indexNames[index] = ifi.Name
+	return ifi.Name
+}
+
 // Close closes the underlying PCAP handle
 func (s *PcapSource) Close() error {
 	if s.monitorCancel != nil {
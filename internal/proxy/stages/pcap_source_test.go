@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/pcap"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 )
 
@@ -28,7 +27,7 @@ func TestPcapSourceRead_ReconnectsAfterPacketChannelClose(t *testing.T) {
 			atomic.AddInt32(&closeCalls, 1)
 			return nil
 		},
-		createReaderHandle: func(string, bool, time.Duration) (*pcap.Handle, error) {
+		createReaderHandle: func(string, bool, time.Duration) (proxy.CaptureHandle, error) {
 			atomic.AddInt32(&createCalls, 1)
 			select {
 			case created <- struct{}{}:
@@ -36,7 +35,7 @@ func TestPcapSourceRead_ReconnectsAfterPacketChannelClose(t *testing.T) {
 			}
 			return nil, nil
 		},
-		newPacketSource: func(_ *pcap.Handle) (*gopacket.PacketSource, chan gopacket.Packet) {
+		newPacketSource: func(_ proxy.CaptureHandle) (*gopacket.PacketSource, chan gopacket.Packet) {
 			return nil, newPackets
 		},
 	}
@@ -89,7 +88,7 @@ func TestPcapSourceRead_ReconnectsAfterSignal(t *testing.T) {
 			atomic.AddInt32(&closeCalls, 1)
 			return nil
 		},
-		createReaderHandle: func(string, bool, time.Duration) (*pcap.Handle, error) {
+		createReaderHandle: func(string, bool, time.Duration) (proxy.CaptureHandle, error) {
 			atomic.AddInt32(&createCalls, 1)
 			select {
 			case created <- struct{}{}:
@@ -97,7 +96,7 @@ func TestPcapSourceRead_ReconnectsAfterSignal(t *testing.T) {
 			}
 			return nil, nil
 		},
-		newPacketSource: func(_ *pcap.Handle) (*gopacket.PacketSource, chan gopacket.Packet) {
+		newPacketSource: func(_ proxy.CaptureHandle) (*gopacket.PacketSource, chan gopacket.Packet) {
 			return nil, newPackets
 		},
 	}
@@ -131,3 +130,42 @@ func TestPcapSourceRead_ReconnectsAfterSignal(t *testing.T) {
 		t.Fatal("expected reader handle create during reconnect")
 	}
 }
+
+func TestPcapSource_MonitorSignalsReconnectWhenInterfaceAppears(t *testing.T) {
+	events := make(chan proxy.LinkEvent, 3)
+	unsubscribed := make(chan struct{})
+	s := &PcapSource{
+		iname:           "wg0",
+		reconnectSignal: make(chan struct{}, 1),
+		linkEvents:      make(chan proxy.LinkEvent, 1),
+		subscribe: func() (<-chan proxy.LinkEvent, func()) {
+			return events, func() { close(unsubscribed) }
+		},
+	}
+	s.startInterfaceMonitor()
+
+	events <- proxy.LinkEvent{Kind: proxy.LinkAppeared, Interface: "wg1"}
+	events <- proxy.LinkEvent{Kind: proxy.LinkGone, Interface: "wg0"}
+	events <- proxy.LinkEvent{Kind: proxy.LinkAppeared, Interface: "wg0"}
+
+	select {
+	case <-s.reconnectSignal:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a reconnect signal when wg0 appeared")
+	}
+	select {
+	case event := <-s.linkEvents:
+		if event.Interface != "wg0" {
+			t.Fatalf("unexpected event forwarded: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the wg0 events to be forwarded")
+	}
+
+	s.monitorCancel()
+	select {
+	case <-unsubscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the monitor to unsubscribe")
+	}
+}
@@ -0,0 +1,223 @@
+package stages
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// RateLimitKey selects what a RateLimit counts packets by.
+type RateLimitKey string
+
+const (
+	// RateLimitBySource gives every source IP address its own bucket.
+	RateLimitBySource RateLimitKey = "source"
+	// RateLimitByInterface limits the packets captured on an interface.
+	RateLimitByInterface RateLimitKey = "interface"
+	// RateLimitByEgress limits the packets relayed to an interface.
+	RateLimitByEgress RateLimitKey = "egress"
+)
+
+const (
+	// rateLimitLogInterval is how often drops are logged.
+	rateLimitLogInterval = 10 * time.Second
+	// rateLimitSweepInterval is how often idle buckets are forgotten.
+	rateLimitSweepInterval = time.Minute
+
+	// DefaultRateLimitMaxSources bounds the buckets of the source limits, so
+	// spoofed source addresses can't use up the memory.
+	DefaultRateLimitMaxSources = 16384
+)
+
+// RateLimit is a token bucket allowing Rate packets per second on average and
+// bursts of up to Burst packets.  A Burst below 1 allows a second worth of
+// packets.  Only packets for Ports are counted, every packet when empty.
+type RateLimit struct {
+	Ports []int32
+	By    RateLimitKey
+	Rate  float64
+	Burst int
+}
+
+func (l *RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return math.Max(1, math.Ceil(l.Rate))
+	}
+	return float64(l.Burst)
+}
+
+type rateLimitBucket struct {
+	limit int
+	key   string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitProcessor drops the packets exceeding any of its Limits.  On
+// ingress it applies the source and interface limits to the packets captured
+// on Iname.  On egress, in the Processors of every RouteSink relaying to
+// Iname, it applies the egress limits; a single processor must then be shared
+// by all of those routes.  A packet only takes a token from its buckets if
+// every one of them has one, so packets dropped by one limit don't count
+// against the others.  Once there are MaxSources source buckets, the packets
+// of new sources are dropped until idle ones are forgotten.  Drops are logged
+// at most every 10 seconds.
+type RateLimitProcessor struct {
+	Iname      string
+	Direction  DecodeDirection
+	Limits     []RateLimit
+	MaxSources int
+
+	mu        sync.Mutex
+	buckets   map[rateLimitBucket]*tokenBucket
+	sources   int            // buckets of the source limits
+	matched   []*tokenBucket // the buckets of the packet being processed
+	dropped   int
+	lastLog   time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimitProcessor creates a RateLimitProcessor for iname with the limits
+// which apply in direction.
+func NewRateLimitProcessor(iname string, direction DecodeDirection, limits []RateLimit) *RateLimitProcessor {
+	r := &RateLimitProcessor{
+		Iname:      iname,
+		Direction:  direction,
+		MaxSources: DefaultRateLimitMaxSources,
+		buckets:    make(map[rateLimitBucket]*tokenBucket),
+		now:        time.Now,
+	}
+	for _, limit := range limits {
+		if (limit.By == RateLimitByEgress) == (direction == DirectionOutbound) {
+			r.Limits = append(r.Limits, limit)
+		}
+	}
+	return r
+}
+
+func (r *RateLimitProcessor) Process(pkt *proxy.Packet) (bool, error) {
+	if pkt == nil || pkt.Packet == nil {
+		return true, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.matched = r.matched[:0]
+	if now.Sub(r.lastSweep) > rateLimitSweepInterval {
+		r.sweep(now)
+	}
+
+	for i := range r.Limits {
+		limit := &r.Limits[i]
+		if !matchesPorts(pkt, limit.Ports) {
+			continue
+		}
+		key := rateLimitBucket{limit: i}
+		if limit.By == RateLimitBySource {
+			src := packetSrcIP(pkt)
+			if src == nil {
+				continue
+			}
+			key.key = src.String()
+		}
+		b, ok := r.buckets[key]
+		if !ok {
+			if b = r.newBucket(now, limit, key); b == nil {
+				r.drop(now, limit, key.key)
+				return false, nil
+			}
+		}
+		if !b.refill(now, limit.Rate, limit.burst()) {
+			r.drop(now, limit, key.key)
+			return false, nil
+		}
+		r.matched = append(r.matched, b)
+	}
+	for _, b := range r.matched {
+		b.tokens--
+	}
+	return true, nil
+}
+
+func (r *RateLimitProcessor) Name() string {
+	return fmt.Sprintf("RateLimitProcessor:%s:%s", r.Iname, r.Direction)
+}
+
+// drop counts a packet dropped by limit.  Caller must hold r.mu.
+func (r *RateLimitProcessor) drop(now time.Time, limit *RateLimit, key string) {
+	metrics.RateLimited.WithLabelValues(r.Iname, string(r.Direction), string(limit.By)).Inc()
+	r.dropped++
+	if now.Sub(r.lastLog) < rateLimitLogInterval {
+		return
+	}
+	args := []any{"interface", r.Iname, "direction", r.Direction, "by", limit.By, "dropped", r.dropped}
+	if key != "" {
+		args = append(args, "source", key)
+	}
+	slog.Warn("Rate limiting packets", args...)
+	r.dropped = 0
+	r.lastLog = now
+}
+
+// newBucket adds a full bucket for key, or returns nil if there are already
+// MaxSources source buckets even after forgetting the idle ones.  Caller must
+// hold r.mu.
+func (r *RateLimitProcessor) newBucket(now time.Time, limit *RateLimit, key rateLimitBucket) *tokenBucket {
+	if limit.By == RateLimitBySource && r.MaxSources > 0 && r.sources >= r.MaxSources {
+		// Sweeping every bucket is too expensive for every packet of a flood
+		// of new sources.
+		if now.Sub(r.lastSweep) > time.Second {
+			r.sweep(now)
+		}
+		if r.sources >= r.MaxSources {
+			return nil
+		}
+	}
+	b := &tokenBucket{tokens: limit.burst(), last: now}
+	r.buckets[key] = b
+	if limit.By == RateLimitBySource {
+		r.sources++
+	}
+	return b
+}
+
+// sweep forgets the buckets which have been refilled, so idle sources don't
+// use memory.  The buckets matched by the packet being processed are kept, it
+// takes its tokens from them.  Caller must hold r.mu.
+func (r *RateLimitProcessor) sweep(now time.Time) {
+	for key, b := range r.buckets {
+		limit := &r.Limits[key.limit]
+		if slices.Contains(r.matched, b) {
+			continue
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(r.buckets, key)
+			if limit.By == RateLimitBySource {
+				r.sources--
+			}
+		}
+	}
+	r.lastSweep = now
+}
+
+// refill refills the bucket for the time since it was last used and reports
+// whether it has a token for a packet.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+	}
+	b.last = now
+	return b.tokens >= 1
+}
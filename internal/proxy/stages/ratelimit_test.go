@@ -0,0 +1,177 @@
+package stages
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+func rateLimitTestPacket(t *testing.T, srcIP string) *proxy.Packet {
+	t.Helper()
+	return buildEthernetPacket(t, net.ParseIP(srcIP), net.ParseIP("255.255.255.255"),
+		net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "eth0")
+}
+
+func TestRateLimitProcessor_Process(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRateLimitProcessor("eth0", DirectionInbound, []RateLimit{
+		{By: RateLimitBySource, Rate: 1, Burst: 2},
+		{By: RateLimitByInterface, Rate: 10, Burst: 3},
+		{By: RateLimitByEgress, Rate: 1, Burst: 1},
+	})
+	r.now = func() time.Time { return now }
+	if len(r.Limits) != 2 {
+		t.Fatalf("expected the egress limit to be left out, got %d limits", len(r.Limits))
+	}
+
+	process := func(srcIP string) bool {
+		t.Helper()
+		keep, err := r.Process(rateLimitTestPacket(t, srcIP))
+		if err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		return keep
+	}
+
+	// Each source gets a burst of 2.
+	if !process("10.0.0.1") || !process("10.0.0.1") {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if process("10.0.0.1") {
+		t.Fatal("expected the source limit to drop the third packet")
+	}
+	// The interface allows 3 packets, one was dropped before taking a token.
+	if !process("10.0.0.2") {
+		t.Fatal("expected another source to be allowed")
+	}
+	if process("10.0.0.3") {
+		t.Fatal("expected the interface limit to drop the packet")
+	}
+
+	// After a second both buckets have refilled enough for another packet.
+	now = now.Add(time.Second)
+	if !process("10.0.0.1") {
+		t.Fatal("expected the bucket to refill")
+	}
+}
+
+func TestRateLimitProcessor_Ports(t *testing.T) {
+	r := NewRateLimitProcessor("eth1", DirectionOutbound, []RateLimit{
+		{Ports: []int32{9003}, By: RateLimitByEgress, Rate: 1, Burst: 1},
+		{Ports: []int32{5678}, By: RateLimitByEgress, Rate: 1, Burst: 1},
+	})
+	r.now = func() time.Time { return time.Unix(1000, 0) }
+
+	// Packets from 1234 to 5678 are only counted by the second limit.
+	for i, want := range []bool{true, false} {
+		if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.1")); keep != want {
+			t.Errorf("packet %d: Process() = %v, want %v", i, keep, want)
+		}
+	}
+}
+
+func TestRateLimitProcessor_SweepsIdleBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRateLimitProcessor("eth0", DirectionInbound, []RateLimit{{By: RateLimitBySource, Rate: 1}})
+	r.now = func() time.Time { return now }
+
+	for _, src := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if keep, _ := r.Process(rateLimitTestPacket(t, src)); !keep {
+			t.Fatalf("expected the first packet of %s to be allowed", src)
+		}
+	}
+	if len(r.buckets) != 3 {
+		t.Fatalf("expected 3 buckets, got %d", len(r.buckets))
+	}
+
+	now = now.Add(2 * rateLimitSweepInterval)
+	if _, err := r.Process(rateLimitTestPacket(t, "10.0.0.1")); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if len(r.buckets) != 1 {
+		t.Errorf("expected only the bucket in use to remain, got %d", len(r.buckets))
+	}
+}
+
+func TestRateLimitProcessor_DropDoesNotTakeTokens(t *testing.T) {
+	r := NewRateLimitProcessor("eth0", DirectionInbound, []RateLimit{
+		{By: RateLimitBySource, Rate: 1, Burst: 2},
+		{By: RateLimitByInterface, Rate: 1, Burst: 1},
+	})
+	r.now = func() time.Time { return time.Unix(1000, 0) }
+
+	// The interface limit drops the second packet, which must not take the
+	// last token of the source.
+	for i, want := range []bool{true, false} {
+		if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.1")); keep != want {
+			t.Fatalf("packet %d: Process() = %v, want %v", i, keep, want)
+		}
+	}
+	if tokens := r.buckets[rateLimitBucket{limit: 0, key: "10.0.0.1"}].tokens; tokens != 1 {
+		t.Fatalf("expected the source to have 1 token left, got %v", tokens)
+	}
+}
+
+func TestRateLimitProcessor_MaxSources(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRateLimitProcessor("eth0", DirectionInbound, []RateLimit{{By: RateLimitBySource, Rate: 1, Burst: 2}})
+	r.MaxSources = 2
+	r.now = func() time.Time { return now }
+
+	for _, src := range []string{"10.0.0.1", "10.0.0.2"} {
+		if keep, _ := r.Process(rateLimitTestPacket(t, src)); !keep {
+			t.Fatalf("expected the first packet of %s to be allowed", src)
+		}
+	}
+	if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.3")); keep {
+		t.Fatal("expected a new source to be dropped while there are MaxSources buckets")
+	}
+	if len(r.buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(r.buckets))
+	}
+
+	// Once the buckets have refilled they are forgotten to make room.
+	now = now.Add(2 * time.Second)
+	if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.3")); !keep {
+		t.Fatal("expected a new source to be allowed once the idle buckets are forgotten")
+	}
+	if len(r.buckets) != 1 || r.sources != 1 {
+		t.Fatalf("expected only the bucket of the new source, got %d buckets, %d sources", len(r.buckets), r.sources)
+	}
+}
+
+func TestRateLimitProcessor_MaxSourcesKeepsMatchedBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRateLimitProcessor("eth0", DirectionInbound, []RateLimit{
+		{By: RateLimitByInterface, Rate: 1, Burst: 2},
+		{By: RateLimitBySource, Rate: 1, Burst: 2},
+	})
+	r.MaxSources = 1
+	r.now = func() time.Time { return now }
+
+	if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.1")); !keep {
+		t.Fatal("expected the first packet to be allowed")
+	}
+
+	// At the cap, the new source sweeps the buckets after the interface
+	// bucket, refilled by now, was matched.  It must still take the token.
+	now = now.Add(2 * time.Second)
+	if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.2")); !keep {
+		t.Fatal("expected the new source to be allowed once the idle bucket is forgotten")
+	}
+	b, ok := r.buckets[rateLimitBucket{limit: 0}]
+	if !ok {
+		t.Fatal("expected the interface bucket matched by the packet to be kept")
+	}
+	if b.tokens != 1 {
+		t.Fatalf("expected the packet to take a token from the interface bucket, %v left", b.tokens)
+	}
+	if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.2")); !keep {
+		t.Fatal("expected the second packet of the burst to be allowed")
+	}
+	if keep, _ := r.Process(rateLimitTestPacket(t, "10.0.0.2")); keep {
+		t.Fatal("expected the interface limit to be enforced")
+	}
+}
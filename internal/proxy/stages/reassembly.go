@@ -0,0 +1,336 @@
+package stages
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+const (
+	// DefaultReassemblyTimeout is how long the fragments of a datagram are
+	// kept waiting for the rest, like the ipfrag_time of Linux.
+	DefaultReassemblyTimeout = 30 * time.Second
+	// DefaultReassemblyOrphanTimeout is how long fragments are kept waiting
+	// for the first fragment, which has the UDP ports telling whether the
+	// datagram is relayed at all.  The fragments of a datagram usually
+	// arrive together, so this is much shorter than the Timeout.
+	DefaultReassemblyOrphanTimeout = 2 * time.Second
+	// DefaultReassemblyMaxBytes bounds the fragments held per interface.
+	// The oldest datagrams are dropped to make room for new ones.
+	DefaultReassemblyMaxBytes = 1 << 20
+
+	maxDatagramLen = 65535
+)
+
+// fragmentKey identifies the fragments of a single datagram (RFC 791, RFC 8200).
+type fragmentKey struct {
+	src, dst [16]byte
+	id       uint32
+	ipv6     bool
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type datagram struct {
+	first     *proxy.Packet // the fragment with offset 0, nil until seen
+	unmatched bool          // the first fragment isn't for Ports, drop the rest
+	fragments []fragment
+	total     int // length of the payload, -1 until the last fragment is seen
+	held      int // bytes of fragments held
+	started   time.Time
+}
+
+// ReassemblyProcessor reassembles fragmented UDP datagrams, so the rest of the
+// pipeline sees a single packet with the whole payload.  Fragments are dropped
+// until their datagram is complete, which then replaces the packet of its last
+// fragment.  Datagrams which aren't complete within Timeout, or which have
+// overlapping fragments, are dropped.  At most MaxBytes of fragments are held.
+//
+// The BPF filter can't tell which datagram a fragment other than the first
+// belongs to, so it lets all of them through.  Only the datagrams whose first
+// fragment has a source or destination port in Ports are reassembled; the
+// fragments of other datagrams are dropped as soon as their first fragment
+// shows up, and fragments still waiting for it after OrphanTimeout are
+// dropped too.  Without Ports every datagram is reassembled.
+// Must be the first processor, the others expect a UDP header.
+type ReassemblyProcessor struct {
+	Iname         string
+	Ports         []int32
+	Timeout       time.Duration
+	OrphanTimeout time.Duration
+	MaxBytes      int
+
+	mu        sync.Mutex
+	datagrams map[fragmentKey]*datagram
+	held      int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewReassemblyProcessor creates a ReassemblyProcessor for the datagrams to
+// or from ports on iname with the default bounds.
+func NewReassemblyProcessor(iname string, ports []int32) *ReassemblyProcessor {
+	return &ReassemblyProcessor{
+		Iname:         iname,
+		Ports:         ports,
+		Timeout:       DefaultReassemblyTimeout,
+		OrphanTimeout: DefaultReassemblyOrphanTimeout,
+		MaxBytes:      DefaultReassemblyMaxBytes,
+		datagrams:     make(map[fragmentKey]*datagram),
+		now:           time.Now,
+	}
+}
+
+func (r *ReassemblyProcessor) Process(pkt *proxy.Packet) (bool, error) {
+	if pkt == nil || pkt.Packet == nil {
+		return true, nil
+	}
+	key, offset, more, data, ok := fragmentOf(pkt)
+	if !ok {
+		return true, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.lastSweep) > time.Second {
+		r.sweep(now)
+	}
+
+	d, ok := r.datagrams[key]
+	if !ok {
+		d = &datagram{total: -1, started: now}
+		r.datagrams[key] = d
+	}
+	if d.unmatched {
+		return false, nil
+	}
+	if offset == 0 && !r.matchesPorts(data) {
+		// Keep the datagram without its fragments until it times out, so
+		// the rest of them are dropped right away.
+		r.held -= d.held
+		d.fragments, d.held, d.unmatched = nil, 0, true
+		return false, nil
+	}
+
+	end := offset + len(data)
+	switch {
+	case end > maxDatagramLen:
+		r.drop(key, "too_large")
+		return false, nil
+	case !d.fits(offset, end, more):
+		r.drop(key, "invalid")
+		return false, nil
+	case d.overlaps(offset, end):
+		r.drop(key, "overlap")
+		return false, nil
+	}
+	for r.held+len(data) > r.MaxBytes && len(r.datagrams) > 1 {
+		r.dropOldest(key)
+	}
+	if r.held+len(data) > r.MaxBytes {
+		r.drop(key, "memory")
+		return false, nil
+	}
+
+	d.fragments = append(d.fragments, fragment{offset: offset, data: data})
+	d.held += len(data)
+	r.held += len(data)
+	if offset == 0 {
+		d.first = pkt
+	}
+	if !more {
+		d.total = end
+	}
+	if d.first == nil || d.total < 0 || d.held != d.total {
+		return false, nil
+	}
+
+	delete(r.datagrams, key)
+	r.held -= d.held
+	if err := d.reassemble(pkt); err != nil {
+		slog.Debug("Unable to reassemble datagram", "interface", r.Iname, "error", err)
+		return false, nil
+	}
+	metrics.Reassembled.WithLabelValues(r.Iname).Inc()
+	return true, nil
+}
+
+func (r *ReassemblyProcessor) Name() string {
+	return fmt.Sprintf("ReassemblyProcessor:%s", r.Iname)
+}
+
+// Pending returns the number of datagrams waiting for more fragments.
+func (r *ReassemblyProcessor) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.datagrams)
+}
+
+// matchesPorts reports whether the UDP header at the start of the first
+// fragment has a source or destination port in Ports.
+func (r *ReassemblyProcessor) matchesPorts(data []byte) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	if len(data) < 4 {
+		return false
+	}
+	src, dst := int32(binary.BigEndian.Uint16(data[0:2])), int32(binary.BigEndian.Uint16(data[2:4]))
+	return slices.Contains(r.Ports, src) || slices.Contains(r.Ports, dst)
+}
+
+// sweep drops the datagrams which timed out: after OrphanTimeout while the
+// first fragment is missing or the datagram isn't for Ports, after Timeout
+// otherwise.  Caller must hold r.mu.
+func (r *ReassemblyProcessor) sweep(now time.Time) {
+	for key, d := range r.datagrams {
+		switch age := now.Sub(d.started); {
+		case d.unmatched && age > r.OrphanTimeout:
+			delete(r.datagrams, key) // its fragments were dropped already
+		case d.first == nil && age > r.OrphanTimeout:
+			r.drop(key, "orphan")
+		case age > r.Timeout:
+			r.drop(key, "timeout")
+		}
+	}
+	r.lastSweep = now
+}
+
+// dropOldest drops the oldest datagram other than keep.  Caller must hold r.mu.
+func (r *ReassemblyProcessor) dropOldest(keep fragmentKey) {
+	var oldest fragmentKey
+	var started time.Time
+	for key, d := range r.datagrams {
+		if key != keep && (started.IsZero() || d.started.Before(started)) {
+			oldest, started = key, d.started
+		}
+	}
+	r.drop(oldest, "memory")
+}
+
+// drop forgets the fragments of a datagram.  Caller must hold r.mu.
+func (r *ReassemblyProcessor) drop(key fragmentKey, reason string) {
+	if d, ok := r.datagrams[key]; ok {
+		r.held -= d.held
+		delete(r.datagrams, key)
+	}
+	slog.Debug("Dropped fragmented datagram", "interface", r.Iname, "reason", reason)
+	metrics.ReassemblyDropped.WithLabelValues(r.Iname, reason).Inc()
+}
+
+// fragmentOf returns the fragment of a UDP datagram carried by pkt.  ok is
+// false for packets which aren't fragments.
+func fragmentOf(pkt *proxy.Packet) (key fragmentKey, offset int, more bool, data []byte, ok bool) {
+	if ipv4, isIPv4 := pkt.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); isIPv4 {
+		if ipv4.Protocol != layers.IPProtocolUDP || (ipv4.Flags&layers.IPv4MoreFragments == 0 && ipv4.FragOffset == 0) {
+			return key, 0, false, nil, false
+		}
+		copy(key.src[:], ipv4.SrcIP.To16())
+		copy(key.dst[:], ipv4.DstIP.To16())
+		key.id = uint32(ipv4.Id)
+		return key, int(ipv4.FragOffset) * 8, ipv4.Flags&layers.IPv4MoreFragments != 0, ipv4.Payload, true
+	}
+	if frag, isFragment := pkt.Packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment); isFragment {
+		ipv6, isIPv6 := pkt.Packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		// Only fragment headers right after the IPv6 header are supported.
+		if !isIPv6 || ipv6.NextHeader != layers.IPProtocolIPv6Fragment || frag.NextHeader != layers.IPProtocolUDP {
+			return key, 0, false, nil, false
+		}
+		copy(key.src[:], ipv6.SrcIP.To16())
+		copy(key.dst[:], ipv6.DstIP.To16())
+		key.id, key.ipv6 = frag.Identification, true
+		return key, int(frag.FragmentOffset) * 8, frag.MoreFragments, frag.Payload, true
+	}
+	return key, 0, false, nil, false
+}
+
+// fits reports whether a fragment from offset to end is consistent with the
+// fragments already seen: only the last fragment may be shorter than a
+// multiple of 8 bytes and nothing may come after it.
+func (d *datagram) fits(offset, end int, more bool) bool {
+	if more {
+		return (end-offset)%8 == 0 && (d.total < 0 || end <= d.total)
+	}
+	if d.total >= 0 {
+		return false // a second last fragment
+	}
+	for _, f := range d.fragments {
+		if f.offset+len(f.data) > end {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps reports whether [offset, end) overlaps a fragment already seen.
+// Overlapping fragments are either duplicates or an attack (RFC 5722).
+func (d *datagram) overlaps(offset, end int) bool {
+	for _, f := range d.fragments {
+		if offset < f.offset+len(f.data) && f.offset < end {
+			return true
+		}
+	}
+	return false
+}
+
+// reassemble replaces the data of pkt with the whole datagram: the link-layer
+// and IP headers of the first fragment followed by the payloads of every
+// fragment.
+func (d *datagram) reassemble(pkt *proxy.Packet) error {
+	slices.SortFunc(d.fragments, func(a, b fragment) int { return a.offset - b.offset })
+	payload := make([]byte, 0, d.total)
+	for _, f := range d.fragments {
+		payload = append(payload, f.data...)
+	}
+
+	first := d.first.Packet
+	offset, ok := proxy.NetworkOffset(first)
+	if !ok {
+		return fmt.Errorf("first fragment missing IP layer")
+	}
+	var header gopacket.SerializableLayer
+	if ipv4, ok := first.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		ip := *ipv4
+		ip.Flags &^= layers.IPv4MoreFragments
+		ip.FragOffset = 0
+		header = &ip
+	} else if ipv6, ok := first.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		header = &layers.IPv6{
+			Version:      6,
+			TrafficClass: ipv6.TrafficClass,
+			FlowLabel:    ipv6.FlowLabel,
+			NextHeader:   layers.IPProtocolUDP,
+			HopLimit:     ipv6.HopLimit,
+			SrcIP:        ipv6.SrcIP,
+			DstIP:        ipv6.DstIP,
+		}
+	} else {
+		return fmt.Errorf("first fragment missing IP layer")
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, header, gopacket.Payload(payload)); err != nil {
+		return fmt.Errorf("serialize reassembled datagram: %w", err)
+	}
+
+	raw := make([]byte, 0, offset+len(buf.Bytes()))
+	raw = append(append(raw, d.first.Raw[:offset]...), buf.Bytes()...)
+	pkt.Raw = raw
+	pkt.Metadata.CaptureLength, pkt.Metadata.Length = len(raw), len(raw)
+	pkt.Packet = gopacket.NewPacket(raw, first.Layers()[0].LayerType(), gopacket.Default)
+	return nil
+}
@@ -0,0 +1,200 @@
+package stages
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+	proxyrewrite "github.com/synfinatic/udp-proxy-2020/internal/proxy/rewrite"
+)
+
+// buildFragments returns the fragments of a UDP datagram from srcIP with
+// payload, split to fit mtu.
+func buildFragments(t *testing.T, srcIP net.IP, payload []byte, mtu int) (*proxy.Packet, []*proxy.Packet) {
+	t.Helper()
+	dstIP := net.IPv4bcast
+	if srcIP.To4() == nil {
+		dstIP = net.ParseIP("ff02::1")
+	}
+	pkt := buildEthernetPacket(t, srcIP, dstIP, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, payload, "eth0")
+	fragments, err := proxyrewrite.Fragment(pkt, mtu, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("Fragment failed: %v", err)
+	}
+	if len(fragments) < 2 {
+		t.Fatalf("expected the datagram to be fragmented, got %d fragments", len(fragments))
+	}
+	return pkt, fragments
+}
+
+func TestReassemblyProcessor_Reassembles(t *testing.T) {
+	for _, srcIP := range []net.IP{{10, 0, 0, 5}, net.ParseIP("2001:db8::5")} {
+		payload := bytes.Repeat([]byte("0123456789"), 400)
+		_, fragments := buildFragments(t, srcIP, payload, 1400)
+		r := NewReassemblyProcessor("eth0", nil)
+
+		// Out of order, the first fragment last.
+		for i := len(fragments) - 1; i > 0; i-- {
+			if keep, err := r.Process(fragments[i]); keep || err != nil {
+				t.Fatalf("%s: expected fragment %d to be held, got %v, %v", srcIP, i, keep, err)
+			}
+		}
+		if r.Pending() != 1 {
+			t.Fatalf("%s: expected 1 pending datagram, got %d", srcIP, r.Pending())
+		}
+		pkt := fragments[0]
+		keep, err := r.Process(pkt)
+		if !keep || err != nil {
+			t.Fatalf("%s: expected the reassembled datagram, got %v, %v", srcIP, keep, err)
+		}
+		if r.Pending() != 0 {
+			t.Fatalf("%s: expected no pending datagrams, got %d", srcIP, r.Pending())
+		}
+
+		udp, ok := pkt.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || !bytes.Equal(udp.Payload, payload) {
+			t.Fatalf("%s: expected the whole payload, got %v", srcIP, pkt.Packet)
+		}
+		if pkt.Packet.ErrorLayer() != nil || pkt.Packet.Layer(layers.LayerTypeEthernet) == nil {
+			t.Fatalf("%s: expected a valid ethernet packet, got %v", srcIP, pkt.Packet)
+		}
+		if keep, _ := (&FilterProcessor{Iname: "eth0"}).Process(pkt); !keep {
+			t.Fatalf("%s: expected the reassembled datagram to pass the filter", srcIP)
+		}
+		if pkt.Metadata.CaptureLength != len(pkt.Raw) {
+			t.Fatalf("%s: capture length %d, want %d", srcIP, pkt.Metadata.CaptureLength, len(pkt.Raw))
+		}
+	}
+}
+
+func TestReassemblyProcessor_PassesUnfragmented(t *testing.T) {
+	pkt := buildEthernetPacket(t, net.IP{10, 0, 0, 5}, net.IPv4bcast, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "eth0")
+	raw := pkt.Raw
+	if keep, err := NewReassemblyProcessor("eth0", nil).Process(pkt); !keep || err != nil {
+		t.Fatalf("expected the packet to be kept, got %v, %v", keep, err)
+	}
+	if !bytes.Equal(pkt.Raw, raw) {
+		t.Fatal("expected the packet to be unchanged")
+	}
+}
+
+func TestReassemblyProcessor_DropsOverlapping(t *testing.T) {
+	_, fragments := buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+	r := NewReassemblyProcessor("eth0", nil)
+	r.Process(fragments[0])
+	if keep, _ := r.Process(fragments[0]); keep {
+		t.Fatal("expected the duplicate fragment to be dropped")
+	}
+	if r.Pending() != 0 {
+		t.Fatal("expected the datagram to be dropped")
+	}
+}
+
+func TestReassemblyProcessor_Timeout(t *testing.T) {
+	_, fragments := buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+	now := time.Unix(1000, 0)
+	r := NewReassemblyProcessor("eth0", nil)
+	r.now = func() time.Time { return now }
+
+	r.Process(fragments[0])
+	now = now.Add(r.Timeout + 2*time.Second)
+	for _, fragment := range fragments[1:] {
+		if keep, _ := r.Process(fragment); keep {
+			t.Fatal("expected the fragments of a timed out datagram not to be reassembled")
+		}
+	}
+	if r.Pending() != 1 {
+		t.Fatalf("expected only the new fragments to be pending, got %d", r.Pending())
+	}
+}
+
+func TestReassemblyProcessor_OnlyReassemblesPorts(t *testing.T) {
+	_, fragments := buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+
+	// The datagram is from port 1234 to 5678.
+	r := NewReassemblyProcessor("eth0", []int32{5678})
+	for i := len(fragments) - 1; i >= 0; i-- {
+		if keep, _ := r.Process(fragments[i]); keep != (i == 0) {
+			t.Fatalf("fragment %d: expected keep %v", i, i == 0)
+		}
+	}
+
+	_, fragments = buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+	r = NewReassemblyProcessor("eth0", []int32{9003})
+	r.Process(fragments[1])
+	if r.held == 0 {
+		t.Fatal("expected the fragment to be held until the first one shows up")
+	}
+	r.Process(fragments[0])
+	if r.held != 0 {
+		t.Fatalf("expected the fragments of another port to be dropped, %d bytes held", r.held)
+	}
+	for _, fragment := range fragments[2:] {
+		if keep, _ := r.Process(fragment); keep || r.held != 0 {
+			t.Fatal("expected the rest of the fragments to be dropped right away")
+		}
+	}
+}
+
+func TestReassemblyProcessor_OrphanTimeout(t *testing.T) {
+	_, fragments := buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+	now := time.Unix(1000, 0)
+	r := NewReassemblyProcessor("eth0", []int32{5678})
+	r.now = func() time.Time { return now }
+
+	r.Process(fragments[1])
+	now = now.Add(r.OrphanTimeout + 2*time.Second)
+	r.Process(fragments[2])
+	if keep, _ := r.Process(fragments[0]); keep {
+		t.Fatal("expected the fragment which waited too long for the first one to be dropped")
+	}
+	if r.Pending() != 1 {
+		t.Fatalf("expected the datagram to be pending, got %d", r.Pending())
+	}
+}
+
+func TestReassemblyProcessor_MaxBytes(t *testing.T) {
+	r := NewReassemblyProcessor("eth0", nil)
+	r.MaxBytes = 2000
+	_, first := buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+	_, second := buildFragments(t, net.IP{10, 0, 0, 6}, bytes.Repeat([]byte("y"), 3000), 1400)
+
+	r.Process(first[0])
+	r.Process(second[0])
+	if r.Pending() != 1 {
+		t.Fatalf("expected the oldest datagram to make room, got %d pending", r.Pending())
+	}
+	for _, fragment := range second[1:] {
+		if keep, _ := r.Process(fragment); keep {
+			t.Fatal("expected a datagram larger than MaxBytes not to be reassembled")
+		}
+	}
+	if r.held > r.MaxBytes {
+		t.Fatalf("expected at most %d bytes held, got %d", r.MaxBytes, r.held)
+	}
+}
+
+func TestFragmentSink_Write(t *testing.T) {
+	inner := &routeSinkTestSink{}
+	sink := &FragmentSink{Iname: "tun0", MTU: 1400, LinkType: layers.LinkTypeEthernet, Sink: inner}
+	pkt, _ := buildFragments(t, net.IP{10, 0, 0, 5}, bytes.Repeat([]byte("x"), 3000), 1400)
+
+	if err := sink.Write(pkt); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if inner.writes != 3 {
+		t.Fatalf("expected 3 fragments to be written, got %d", inner.writes)
+	}
+	for _, fragment := range inner.pkts {
+		if fragment.Packet.Layer(gopacket.LayerTypeFragment) == nil && fragment.Packet.Layer(layers.LayerTypeUDP) == nil {
+			t.Fatal("expected IP fragments")
+		}
+	}
+	if err := sink.Close(); err != nil || inner.closed != 1 {
+		t.Fatalf("expected Close to close the wrapped sink, got %v", err)
+	}
+}
@@ -1,9 +1,11 @@
 package stages
 
 import (
+	"bytes"
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -102,7 +104,8 @@ func (r *RegistryProcessor) Has(ip string) bool {
 	return false
 }
 
-// GetClientsForInterface returns currently known clients discovered on a specific interface.
+// GetClientsForInterface returns currently known clients discovered on a specific interface,
+// ordered by IP address so packets are unicast to them in the same order every time.
 func (r *RegistryProcessor) GetClientsForInterface(iname string) []ClientInfo {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -113,12 +116,21 @@ func (r *RegistryProcessor) GetClientsForInterface(iname string) []ClientInfo {
 			clients = append(clients, info)
 		}
 	}
+	slices.SortFunc(clients, func(a, b ClientInfo) int {
+		return bytes.Compare(a.IP.To16(), b.IP.To16())
+	})
 	return clients
 }
 
+// Process learns the source of pkt on the interface it arrived on.  Tagged
+// packets captured on a trunk are learned on its logical VLAN interface.
 func (r *RegistryProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	if pkt != nil {
-		return r.ProcessForInterface(pkt.ArrivalInterface, pkt)
+		iname := pkt.ArrivalInterface
+		if vid, ok := proxy.PacketVLAN(pkt); ok && !proxy.IsVLANInterfaceName(iname) {
+			iname = proxy.VLANInterfaceName(iname, vid)
+		}
+		return r.ProcessForInterface(iname, pkt)
 	}
 	return r.ProcessForInterface("", nil)
 }
@@ -133,27 +145,13 @@ func (r *RegistryProcessor) ProcessForInterface(iname string, pkt *proxy.Packet)
 		return true, nil
 	}
 
-	ipLayer := pkt.Packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		return true, nil
-	}
-	ipv4, ok := ipLayer.(*layers.IPv4)
-	if !ok {
-		return true, nil
-	}
-	srcIP := ipv4.SrcIP
+	srcIP := packetSrcIP(pkt)
 
 	if len(srcIP) == 0 {
 		return true, nil
 	}
 
-	var srcMAC net.HardwareAddr
-	ethLayer := pkt.Packet.Layer(layers.LayerTypeEthernet)
-	if ethLayer != nil {
-		if eth, ok := ethLayer.(*layers.Ethernet); ok {
-			srcMAC = eth.SrcMAC
-		}
-	}
+	srcMAC := proxy.PacketHardwareAddr(pkt)
 
 	ipStr := srcIP.String()
 	if ipStr == "" {
@@ -188,6 +186,131 @@ func (r *RegistryProcessor) ProcessForInterface(iname string, pkt *proxy.Packet)
 	return true, nil
 }
 
+// packetSrcIP returns the IPv4 or IPv6 source address of pkt, or nil.
+func packetSrcIP(pkt *proxy.Packet) net.IP {
+	if ipLayer := pkt.Packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		if ipv4, ok := ipLayer.(*layers.IPv4); ok {
+			return ipv4.SrcIP
+		}
+	}
+	if ipLayer := pkt.Packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		if ipv6, ok := ipLayer.(*layers.IPv6); ok {
+			return ipv6.SrcIP
+		}
+	}
+	return nil
+}
+
+// AddFixedIP adds an immortal client on the given interface, replacing any
+// learned entry for the same IP.
+func (r *RegistryProcessor) AddFixedIP(iname string, ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := keyForClient(iname, ip.String())
+	info := r.clients[key]
+	r.clients[key] = ClientInfo{
+		IP:        ip,
+		Interface: iname,
+		LastSeen:  time.Time{}, // zero = immortal
+		MAC:       info.MAC,
+	}
+}
+
+// RemoveFixedIP removes a fixed client from the given interface.  Returns false
+// if the IP is not a fixed client on that interface.
+func (r *RegistryProcessor) RemoveFixedIP(iname string, ip net.IP) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := keyForClient(iname, ip.String())
+	if info, ok := r.clients[key]; !ok || !info.LastSeen.IsZero() {
+		return false
+	}
+	delete(r.clients, key)
+	return true
+}
+
+// FlushInterface removes the learned clients on iname, keeping the fixed IPs,
+// and returns the number of clients removed.
+func (r *RegistryProcessor) FlushInterface(iname string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := 0
+	for key, info := range r.clients {
+		if info.Interface == iname && !info.LastSeen.IsZero() {
+			delete(r.clients, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes every learned client, keeping the fixed IPs, and returns the
+// number of clients removed.
+func (r *RegistryProcessor) Flush() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := 0
+	for key, info := range r.clients {
+		if !info.LastSeen.IsZero() {
+			delete(r.clients, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// RemoveStaleClients removes the learned clients on iname for which stale
+// returns true, keeping the fixed IPs, and returns the number of clients
+// removed.
+func (r *RegistryProcessor) RemoveStaleClients(iname string, stale func(ip net.IP) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := 0
+	for key, info := range r.clients {
+		if info.Interface == iname && !info.LastSeen.IsZero() && stale(info.IP) {
+			slog.Info("Removing stale client", slog.String("interface", info.Interface), slog.String("ip", info.IP.String()), slog.String("mac", info.MAC.String()))
+			delete(r.clients, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// GetTTL returns how long learned clients are remembered.  Safe for concurrent use.
+func (r *RegistryProcessor) GetTTL() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.TTL
+}
+
+// SetTTL changes how long learned clients are remembered.  Safe for concurrent use.
+func (r *RegistryProcessor) SetTTL(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.TTL = ttl
+}
+
+// Restore adds previously learned clients, keeping their original LastSeen.
+// Clients which have expired by now, or which are already known, are skipped.
+// Returns the number of clients restored.
+func (r *RegistryProcessor) Restore(clients []ClientInfo, now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	restored := 0
+	for _, info := range clients {
+		if info.LastSeen.IsZero() || now.Sub(info.LastSeen) > r.TTL {
+			continue
+		}
+		key := keyForClient(info.Interface, info.IP.String())
+		if _, ok := r.clients[key]; ok {
+			continue
+		}
+		r.clients[key] = info
+		restored++
+	}
+	return restored
+}
+
 // Cleanup removes expired clients.
 func (r *RegistryProcessor) Cleanup() {
 	r.mu.Lock()
@@ -209,19 +332,34 @@ func (r *RegistryProcessor) Name() string {
 }
 
 // RegistryLearnerProcessor binds a shared RegistryProcessor to one source interface.
+// When Ports is set, only packets for those ports are learned, OtherPorts being
+// the ports of the other groups on the interface.  It never drops packets.
 type RegistryLearnerProcessor struct {
-	Registry *RegistryProcessor
-	Iname    string
+	Registry   *RegistryProcessor
+	Iname      string
+	Group      string
+	Ports      []int32
+	OtherPorts []int32
 }
 
 func (p *RegistryLearnerProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	if p == nil || p.Registry == nil {
 		return true, nil
 	}
+	if !matchesGroupPorts(pkt, p.Ports, p.OtherPorts) {
+		return true, nil
+	}
+	if p.Iname == proxy.AnyInterface {
+		// Learned on the interface the packet arrived on.
+		return p.Registry.ProcessForInterface("", pkt)
+	}
 	return p.Registry.ProcessForInterface(p.Iname, pkt)
 }
 
 func (p *RegistryLearnerProcessor) Name() string {
+	if p.Group != "" {
+		return fmt.Sprintf("RegistryLearnerProcessor:%s:%s", p.Group, p.Iname)
+	}
 	return fmt.Sprintf("RegistryLearnerProcessor:%s", p.Iname)
 }
 
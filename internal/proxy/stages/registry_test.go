@@ -2,6 +2,7 @@ package stages
 
 import (
 	"net"
+	"slices"
 	"testing"
 	"time"
 
@@ -271,3 +272,157 @@ func TestRegistryProcessor_ProcessForInterfaceTracksSource(t *testing.T) {
 		t.Fatalf("expected interface eth9, got %s", clients[0].Interface)
 	}
 }
+
+func TestRegistryProcessor_GetClientsForInterfaceSorted(t *testing.T) {
+	reg, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth0": {"10.0.0.20", "10.0.0.3", "10.0.0.100", "fe80::1"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+
+	var got []string
+	for _, c := range reg.GetClientsForInterface("eth0") {
+		got = append(got, c.IP.String())
+	}
+	want := []string{"10.0.0.3", "10.0.0.20", "10.0.0.100", "fe80::1"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRegistryLearnerProcessor_OnlyLearnsGroupPorts(t *testing.T) {
+	reg, err := NewRegistryProcessor(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessor failed: %v", err)
+	}
+	learner := &RegistryLearnerProcessor{Registry: reg, Iname: "eth0", Group: "roon", Ports: []int32{9003}}
+	if got := learner.Name(); got != "RegistryLearnerProcessor:roon:eth0" {
+		t.Fatalf("unexpected name: %s", got)
+	}
+
+	pkt := buildEthernetPacket(
+		t,
+		net.IP{10, 0, 0, 7},
+		net.IP{10, 0, 0, 255},
+		net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		[]byte("hello"),
+		"eth0",
+	)
+
+	keep, err := learner.Process(pkt)
+	if err != nil || !keep {
+		t.Fatalf("expected keep=true and no error, got keep=%v err=%v", keep, err)
+	}
+	if reg.Len() != 0 {
+		t.Fatal("expected packet for another group's port not to be learned")
+	}
+
+	learner.Ports = []int32{5678}
+	if _, err := learner.Process(pkt); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if !reg.Has("10.0.0.7") {
+		t.Fatal("expected packet for group port to be learned")
+	}
+}
+
+func TestRegistryProcessor_FixedIPManagementAndFlush(t *testing.T) {
+	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth0": {"10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+
+	learned := buildEthernetPacket(t, net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 255}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, "eth0")
+	if _, err := registry.ProcessForInterface("eth0", learned); err != nil {
+		t.Fatalf("ProcessForInterface failed: %v", err)
+	}
+	registry.AddFixedIP("eth1", net.IP{10, 0, 1, 5})
+	if registry.Len() != 3 {
+		t.Fatalf("expected 3 clients, got %d", registry.Len())
+	}
+
+	if registry.RemoveFixedIP("eth0", net.IP{10, 0, 0, 2}) {
+		t.Fatal("expected RemoveFixedIP to refuse removing a learned client")
+	}
+	if !registry.RemoveFixedIP("eth1", net.IP{10, 0, 1, 5}) {
+		t.Fatal("expected RemoveFixedIP to remove the fixed client")
+	}
+
+	if removed := registry.FlushInterface("eth1"); removed != 0 {
+		t.Fatalf("expected FlushInterface to remove no clients of eth1, got %d", removed)
+	}
+	if removed := registry.Flush(); removed != 1 {
+		t.Fatalf("expected Flush to remove 1 learned client, got %d", removed)
+	}
+	clients := registry.GetClients()
+	if len(clients) != 1 || !clients[0].IP.Equal(net.IP{10, 0, 0, 1}) || !clients[0].LastSeen.IsZero() {
+		t.Fatalf("expected only the fixed client to remain, got %+v", clients)
+	}
+}
+
+func TestRegistryProcessor_Restore(t *testing.T) {
+	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth0": {"10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+
+	now := time.Now()
+	restored := registry.Restore([]ClientInfo{
+		{IP: net.IP{10, 8, 0, 2}, Interface: "tun0", LastSeen: now.Add(-50 * time.Minute)},
+		{IP: net.IP{10, 8, 0, 3}, Interface: "tun0", LastSeen: now.Add(-2 * time.Hour)}, // expired
+		{IP: net.IP{10, 0, 0, 1}, Interface: "eth0", LastSeen: now.Add(-time.Minute)},   // already fixed
+		{IP: net.IP{10, 0, 0, 9}, Interface: "eth0"},                                    // fixed IPs are not restored
+	}, now)
+	if restored != 1 {
+		t.Fatalf("expected 1 client restored, got %d", restored)
+	}
+
+	clients := registry.GetClientsForInterface("tun0")
+	if len(clients) != 1 || !clients[0].LastSeen.Equal(now.Add(-50*time.Minute)) {
+		t.Fatalf("expected restored client to keep its LastSeen, got %+v", clients)
+	}
+	for _, c := range registry.GetClientsForInterface("eth0") {
+		if !c.LastSeen.IsZero() {
+			t.Fatalf("expected the fixed IP to stay fixed, got %+v", c)
+		}
+	}
+
+	// The original LastSeen counts against the TTL.
+	registry.TTL = 30 * time.Minute
+	registry.Cleanup()
+	if registry.Has("10.8.0.2") {
+		t.Fatal("expected restored client to expire based on its original LastSeen")
+	}
+}
+
+func TestRegistryProcessor_RemoveStaleClients(t *testing.T) {
+	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth1": {"192.168.1.10"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+	now := time.Now()
+	registry.Restore([]ClientInfo{
+		{IP: net.IP{192, 168, 1, 50}, Interface: "eth1", LastSeen: now},
+		{IP: net.IP{10, 1, 0, 50}, Interface: "eth1", LastSeen: now},
+		{IP: net.IP{192, 168, 1, 60}, Interface: "eth0", LastSeen: now},
+	}, now)
+
+	_, oldNet, _ := net.ParseCIDR("192.168.1.0/24")
+	removed := registry.RemoveStaleClients("eth1", oldNet.Contains)
+	if removed != 1 || registry.Has("192.168.1.50") {
+		t.Fatalf("expected the learned client on the old subnet to be removed, removed %d", removed)
+	}
+	for _, ip := range []string{"192.168.1.10", "10.1.0.50", "192.168.1.60"} {
+		if !registry.Has(ip) {
+			t.Errorf("expected %s to be kept", ip)
+		}
+	}
+}
@@ -4,47 +4,104 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
 
 	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 	proxyrewrite "github.com/synfinatic/udp-proxy-2020/internal/proxy/rewrite"
 )
 
 // RouteSink makes routing decisions (determines target destinations) and fans out packets
 // to those targets. Per-target packet rewriting and nested sink processing is handled
-// by writeToTarget().
+// by writeToTarget().  When Ports is set, only packets for those ports are routed so
+// that several relay groups can share a source pipeline, OtherPorts being the
+// ports of the other groups on the source interface.  When Multicast is set,
+// packets sent to a multicast group are re-emitted to the same group instead of
+// the known clients or the broadcast address.  An egress interface with several
+// IPv4 subnets gets one copy per broadcast address.
 type RouteSink struct {
-	Iname            string
-	Broadcast        bool
-	BroadcastAddress net.IP
-	HardwareAddr     net.HardwareAddr
-	Registry         *RegistryProcessor
-	LinkType         layers.LinkType
-	Processors       []proxy.Processor
-	Sinks            []proxy.Sink
+	Iname              string
+	Group              string
+	Ports              []int32
+	OtherPorts         []int32
+	Broadcast          bool
+	BroadcastAddresses []net.IP // use SetBroadcastAddresses once running
+	Multicast          bool
+	MulticastTTL       uint8 // 0 keeps the original TTL
+	HardwareAddr       net.HardwareAddr
+	VLAN               uint16 // 802.1Q tag added on egress, 0 for none
+	Registry           *RegistryProcessor
+	LinkType           layers.LinkType
+	Processors         []proxy.Processor
+	Sinks              []proxy.Sink
+
+	mu sync.RWMutex // protects BroadcastAddresses
+
+	metricsOnce  sync.Once
+	metrics      *metrics.RouteCounters // nil when the metrics are disabled
+	stageMetrics []*metrics.StageCounters
+	sinkMetrics  []*metrics.SinkCounters
 }
 
+// ipv6AllNodes is the link-local all-nodes multicast group, which is the IPv6
+// equivalent of the subnet broadcast address.
+var ipv6AllNodes = net.ParseIP("ff02::1")
+
 type routeTarget struct {
 	IP                net.IP
 	MAC               net.HardwareAddr
 	BroadcastDestMAC  bool
 	AllowBroadcastMAC bool
+	TTL               uint8
 }
 
 func (s *RouteSink) Name() string {
+	if s.Group != "" {
+		return fmt.Sprintf("RouteSink(%s:%s)", s.Group, s.Iname)
+	}
 	return fmt.Sprintf("RouteSink(%s)", s.Iname)
 }
 
+// SetBroadcastAddresses changes the broadcast addresses of the egress
+// interface, for when its subnets changed.  Safe to call while packets are
+// being written.
+func (s *RouteSink) SetBroadcastAddresses(ips []net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.BroadcastAddresses = ips
+}
+
+func (s *RouteSink) broadcastAddresses() []net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.BroadcastAddresses
+}
+
 func (s *RouteSink) Write(pkt *proxy.Packet) error {
 	if pkt == nil {
 		return nil
 	}
+	if !matchesGroupPorts(pkt, s.Ports, s.OtherPorts) {
+		return nil
+	}
+	if pkt.ArrivalInterface == s.Iname {
+		// Captured on the any pseudo-interface; it's already there.
+		return nil
+	}
 
+	s.metricsOnce.Do(s.resolveMetrics)
 	targets := s.targetsForPacket(pkt)
 	if len(targets) == 0 {
 		slog.Debug("0 targets on interface to forward packet, dropping", "interface", s.Iname)
+		if s.metrics != nil {
+			s.metrics.NoTargets.Inc()
+		}
 		return nil
 	}
+	if s.metrics != nil {
+		s.metrics.Targets.Add(float64(len(targets)))
+	}
 
 	for _, target := range targets {
 		s.writeToTarget(pkt, target)
@@ -53,6 +110,23 @@ func (s *RouteSink) Write(pkt *proxy.Packet) error {
 	return nil
 }
 
+// resolveMetrics looks up the metrics of the route and of its processors and
+// sinks, which are set by the time the first packet is written, unless the
+// metrics are disabled.
+func (s *RouteSink) resolveMetrics() {
+	name := s.Name()
+	s.metrics = metrics.NewRouteCounters(name)
+	if s.metrics == nil {
+		return
+	}
+	for _, proc := range s.Processors {
+		s.stageMetrics = append(s.stageMetrics, metrics.NewStageCounters(name, proc.Name()))
+	}
+	for _, sink := range s.Sinks {
+		s.sinkMetrics = append(s.sinkMetrics, metrics.NewSinkCounters(name, sink.Name()))
+	}
+}
+
 // writeToTarget handles per-target packet rewriting and forwarding to nested sinks.
 func (s *RouteSink) writeToTarget(pkt *proxy.Packet, target routeTarget) {
 	rewritten, err := proxyrewrite.PacketForEgress(pkt, proxyrewrite.Options{
@@ -62,6 +136,8 @@ func (s *RouteSink) writeToTarget(pkt *proxy.Packet, target routeTarget) {
 		EgressLinkType:         s.LinkType,
 		AllowBroadcastDstMAC:   target.AllowBroadcastMAC,
 		ForceBroadcastDestMAC:  target.BroadcastDestMAC,
+		TTL:                    target.TTL,
+		VLANID:                 s.VLAN,
 		OutputArrivalInterface: s.Iname,
 	})
 	if err != nil {
@@ -70,8 +146,11 @@ func (s *RouteSink) writeToTarget(pkt *proxy.Packet, target routeTarget) {
 	}
 
 	continueProcessing := true
-	for _, proc := range s.Processors {
+	for i, proc := range s.Processors {
 		keep, err := proc.Process(rewritten)
+		if s.metrics != nil {
+			s.stageMetrics[i].Observe(keep, err)
+		}
 		if err != nil {
 			slog.Error("Route sink processor error", "processor", proc.Name(), "to_interface", s.Iname, "error", err)
 			continueProcessing = false
@@ -86,8 +165,12 @@ func (s *RouteSink) writeToTarget(pkt *proxy.Packet, target routeTarget) {
 		return
 	}
 
-	for _, sink := range s.Sinks {
-		if err := sink.Write(rewritten); err != nil {
+	for i, sink := range s.Sinks {
+		err := sink.Write(rewritten)
+		if s.metrics != nil {
+			s.sinkMetrics[i].Observe(err)
+		}
+		if err != nil {
 			slog.Error("Route sink write error", "sink", sink.Name(), "to_interface", s.Iname, "error", err)
 		}
 	}
@@ -95,11 +178,28 @@ func (s *RouteSink) writeToTarget(pkt *proxy.Packet, target routeTarget) {
 
 func (s *RouteSink) targetsForPacket(pkt *proxy.Packet) []routeTarget {
 	targets := make([]routeTarget, 0)
+	isIPv6 := pkt.Packet != nil && pkt.Packet.Layer(layers.LayerTypeIPv6) != nil
+
+	if s.Multicast {
+		if dst := packetDstIP(pkt); dst != nil && dst.IsMulticast() {
+			// Re-emit to the same group; the rewrite maps the group to its
+			// multicast MAC.
+			return append(targets, routeTarget{
+				IP:               dst,
+				BroadcastDestMAC: true,
+				TTL:              s.MulticastTTL,
+			})
+		}
+	}
 
 	if s.Registry != nil {
-		// Route toward clients known on the egress interface.
+		// Route toward clients known on the egress interface which use the same
+		// address family as the packet.
 		clients := s.Registry.GetClientsForInterface(s.Iname)
 		for _, client := range clients {
+			if (client.IP.To4() == nil) != isIPv6 {
+				continue
+			}
 			targets = append(targets, routeTarget{
 				IP:                client.IP,
 				MAC:               client.MAC,
@@ -112,15 +212,37 @@ func (s *RouteSink) targetsForPacket(pkt *proxy.Packet) []routeTarget {
 	}
 
 	if s.Broadcast {
-		targets = append(targets, routeTarget{
-			IP:               s.BroadcastAddress,
-			BroadcastDestMAC: true,
-		})
+		if isIPv6 {
+			return append(targets, routeTarget{
+				IP:               ipv6AllNodes,
+				BroadcastDestMAC: true,
+			})
+		}
+		for _, broadcast := range s.broadcastAddresses() {
+			targets = append(targets, routeTarget{
+				IP:               broadcast,
+				BroadcastDestMAC: true,
+			})
+		}
 	}
 
 	return targets
 }
 
+// packetDstIP returns the IPv4 or IPv6 destination address of pkt, or nil.
+func packetDstIP(pkt *proxy.Packet) net.IP {
+	if pkt.Packet == nil {
+		return nil
+	}
+	if ipv4, ok := pkt.Packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		return ipv4.DstIP
+	}
+	if ipv6, ok := pkt.Packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		return ipv6.DstIP
+	}
+	return nil
+}
+
 func (s *RouteSink) Close() error {
 	var firstErr error
 	for _, sink := range s.Sinks {
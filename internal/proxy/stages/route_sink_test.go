@@ -1,6 +1,7 @@
 package stages
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"net"
@@ -51,13 +52,29 @@ func (p *routeSinkTestProcessor) Name() string { return "routeSinkTestProcessor"
 func buildUDPPacketForLinkType(t *testing.T, linkType layers.LinkType, srcIP, dstIP net.IP, srcMAC, dstMAC net.HardwareAddr, payload []byte, iname string) *proxy.Packet {
 	t.Helper()
 
-	ip := &layers.IPv4{
-		Version:  4,
-		IHL:      5,
-		TTL:      64,
-		Protocol: layers.IPProtocolUDP,
-		SrcIP:    srcIP.To4(),
-		DstIP:    dstIP.To4(),
+	var ip interface {
+		gopacket.NetworkLayer
+		gopacket.SerializableLayer
+	}
+	etherType, family := layers.EthernetTypeIPv4, layers.ProtocolFamilyIPv4
+	if srcIP.To4() == nil {
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      srcIP.To16(),
+			DstIP:      dstIP.To16(),
+		}
+		etherType, family = layers.EthernetTypeIPv6, layers.ProtocolFamilyIPv6BSD
+	} else {
+		ip = &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}
 	}
 	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
 	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
@@ -70,9 +87,9 @@ func buildUDPPacketForLinkType(t *testing.T, linkType layers.LinkType, srcIP, ds
 	var layersToSerialize []gopacket.SerializableLayer
 	switch linkType {
 	case layers.LinkTypeEthernet:
-		layersToSerialize = append(layersToSerialize, &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4})
+		layersToSerialize = append(layersToSerialize, &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: etherType})
 	case layers.LinkTypeNull, layers.LinkTypeLoop:
-		layersToSerialize = append(layersToSerialize, &layers.Loopback{Family: layers.ProtocolFamilyIPv4})
+		layersToSerialize = append(layersToSerialize, &layers.Loopback{Family: family})
 	case layers.LinkTypeRaw:
 		// No L2 header.
 	default:
@@ -121,6 +138,61 @@ func TestRouteSink_Name(t *testing.T) {
 	}
 }
 
+func TestRouteSink_NameWithGroup(t *testing.T) {
+	sink := &RouteSink{Iname: "eth9", Group: "ssdp"}
+	if got := sink.Name(); got != "RouteSink(ssdp:eth9)" {
+		t.Fatalf("unexpected name: %s", got)
+	}
+}
+
+func TestRouteSink_Write_OnlyRoutesGroupPorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		ports      []int32
+		otherPorts []int32
+		wantWrites int
+	}{
+		{name: "no ports routes everything", ports: nil, wantWrites: 1},
+		{name: "matching dst port", ports: []int32{5678}, wantWrites: 1},
+		{name: "matching src port", ports: []int32{1900, 1234}, wantWrites: 1},
+		{name: "other group port", ports: []int32{9003}, wantWrites: 0},
+		{name: "dst port of another group", ports: []int32{1234}, otherPorts: []int32{5678}, wantWrites: 0},
+		{name: "dst port over src port of another group", ports: []int32{5678}, otherPorts: []int32{1234}, wantWrites: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &routeSinkTestSink{}
+			routeSink := &RouteSink{
+				Iname:              "eth-out",
+				Ports:              tt.ports,
+				OtherPorts:         tt.otherPorts,
+				Broadcast:          true,
+				BroadcastAddresses: []net.IP{{10, 0, 1, 255}},
+				HardwareAddr:       net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+				LinkType:           layers.LinkTypeEthernet,
+				Sinks:              []proxy.Sink{sink},
+			}
+
+			pkt := buildEthernetPacket(
+				t,
+				net.IP{10, 0, 0, 1},
+				net.IP{10, 0, 0, 255},
+				net.HardwareAddr{0, 1, 2, 3, 4, 5},
+				net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+				[]byte("hello"),
+				"eth-in",
+			)
+			if err := routeSink.Write(pkt); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if sink.writes != tt.wantWrites {
+				t.Fatalf("expected %d writes, got %d", tt.wantWrites, sink.writes)
+			}
+		})
+	}
+}
+
 func TestRouteSink_TargetsForPacket_RegistryPreferredOverBroadcast(t *testing.T) {
 	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
 		"eth-out": {"10.0.0.10", "10.0.0.20"},
@@ -130,10 +202,10 @@ func TestRouteSink_TargetsForPacket_RegistryPreferredOverBroadcast(t *testing.T)
 	}
 
 	sink := &RouteSink{
-		Iname:            "eth-out",
-		Broadcast:        true,
-		BroadcastAddress: net.IP{10, 0, 0, 255},
-		Registry:         registry,
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 0, 255}},
+		Registry:           registry,
 	}
 
 	targets := sink.targetsForPacket(&proxy.Packet{})
@@ -159,9 +231,9 @@ func TestRouteSink_TargetsForPacket_RegistryPreferredOverBroadcast(t *testing.T)
 
 func TestRouteSink_TargetsForPacket_BroadcastFallback(t *testing.T) {
 	sink := &RouteSink{
-		Iname:            "eth-out",
-		Broadcast:        true,
-		BroadcastAddress: net.IP{192, 168, 1, 255},
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{192, 168, 1, 255}},
 	}
 
 	targets := sink.targetsForPacket(&proxy.Packet{})
@@ -176,6 +248,38 @@ func TestRouteSink_TargetsForPacket_BroadcastFallback(t *testing.T) {
 	}
 }
 
+func TestRouteSink_SetBroadcastAddresses(t *testing.T) {
+	sink := &RouteSink{
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{192, 168, 1, 255}},
+	}
+	sink.SetBroadcastAddresses([]net.IP{{10, 1, 0, 255}})
+
+	targets := sink.targetsForPacket(&proxy.Packet{})
+	if len(targets) != 1 || !targets[0].IP.Equal(net.IP{10, 1, 0, 255}) {
+		t.Fatalf("expected the new broadcast address, got %+v", targets)
+	}
+}
+
+func TestRouteSink_TargetsForPacket_BroadcastPerSubnet(t *testing.T) {
+	sink := &RouteSink{
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{192, 168, 1, 255}, {10, 20, 0, 255}},
+	}
+
+	targets := sink.targetsForPacket(&proxy.Packet{})
+	if len(targets) != 2 {
+		t.Fatalf("expected one target per subnet, got %+v", targets)
+	}
+	for i, want := range sink.BroadcastAddresses {
+		if !targets[i].IP.Equal(want) || !targets[i].BroadcastDestMAC {
+			t.Fatalf("unexpected target %d: %+v", i, targets[i])
+		}
+	}
+}
+
 func TestRouteSink_Write_FansOutToTargetsAndSinks(t *testing.T) {
 	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
 		"eth-out": {"10.0.1.10", "10.0.1.20"},
@@ -188,14 +292,14 @@ func TestRouteSink_Write_FansOutToTargetsAndSinks(t *testing.T) {
 	sinkA := &routeSinkTestSink{}
 	sinkB := &routeSinkTestSink{}
 	routeSink := &RouteSink{
-		Iname:            "eth-out",
-		Broadcast:        true,
-		BroadcastAddress: net.IP{10, 0, 1, 255},
-		HardwareAddr:     net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
-		Registry:         registry,
-		LinkType:         layers.LinkTypeEthernet,
-		Processors:       []proxy.Processor{proc},
-		Sinks:            []proxy.Sink{sinkA, sinkB},
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 1, 255}},
+		HardwareAddr:       net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		Registry:           registry,
+		LinkType:           layers.LinkTypeEthernet,
+		Processors:         []proxy.Processor{proc},
+		Sinks:              []proxy.Sink{sinkA, sinkB},
 	}
 
 	pkt := buildEthernetPacket(
@@ -240,13 +344,13 @@ func TestRouteSink_Write_DropsWhenProcessorReturnsFalse(t *testing.T) {
 	proc := &routeSinkTestProcessor{keep: false}
 	capture := &routeSinkTestSink{}
 	routeSink := &RouteSink{
-		Iname:            "eth-out",
-		Broadcast:        true,
-		BroadcastAddress: net.IP{10, 0, 2, 255},
-		HardwareAddr:     net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
-		LinkType:         layers.LinkTypeEthernet,
-		Processors:       []proxy.Processor{proc},
-		Sinks:            []proxy.Sink{capture},
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 2, 255}},
+		HardwareAddr:       net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		LinkType:           layers.LinkTypeEthernet,
+		Processors:         []proxy.Processor{proc},
+		Sinks:              []proxy.Sink{capture},
 	}
 
 	pkt := buildEthernetPacket(
@@ -275,13 +379,13 @@ func TestRouteSink_Write_SkipsSinkWhenProcessorErrors(t *testing.T) {
 	proc := &routeSinkTestProcessor{keep: true, err: errors.New("boom")}
 	capture := &routeSinkTestSink{}
 	routeSink := &RouteSink{
-		Iname:            "eth-out",
-		Broadcast:        true,
-		BroadcastAddress: net.IP{10, 0, 3, 255},
-		HardwareAddr:     net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
-		LinkType:         layers.LinkTypeEthernet,
-		Processors:       []proxy.Processor{proc},
-		Sinks:            []proxy.Sink{capture},
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 3, 255}},
+		HardwareAddr:       net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		LinkType:           layers.LinkTypeEthernet,
+		Processors:         []proxy.Processor{proc},
+		Sinks:              []proxy.Sink{capture},
 	}
 
 	pkt := buildEthernetPacket(
@@ -366,7 +470,7 @@ func TestRouteSink_WithTransmitterReconnect_DoesNotPanic(t *testing.T) {
 	defer cancel()
 
 	tx := &TransmitterSink{
-		dm:     &proxy.DeviceManager{},
+		dm:     &proxy.HostDeviceManager{},
 		Writer: &mockWriter{linkType: layers.LinkTypeEthernet, writeErr: errors.New("send: Device not configured")},
 		Iname:  "wg0",
 		ctx:    ctx,
@@ -374,12 +478,12 @@ func TestRouteSink_WithTransmitterReconnect_DoesNotPanic(t *testing.T) {
 	}
 
 	route := &RouteSink{
-		Iname:            "wg0",
-		Broadcast:        true,
-		BroadcastAddress: net.IP{10, 7, 0, 255},
-		HardwareAddr:     net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
-		LinkType:         layers.LinkTypeEthernet,
-		Sinks:            []proxy.Sink{tx},
+		Iname:              "wg0",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 7, 0, 255}},
+		HardwareAddr:       net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		LinkType:           layers.LinkTypeEthernet,
+		Sinks:              []proxy.Sink{tx},
 	}
 
 	pkt := buildEthernetPacket(
@@ -413,3 +517,143 @@ func TestRouteSink_WithTransmitterReconnect_DoesNotPanic(t *testing.T) {
 		t.Fatalf("second route write failed while reconnecting: %v", err)
 	}
 }
+
+func TestRouteSink_TargetsForPacket_IPv6UsesAllNodesAndMatchingClients(t *testing.T) {
+	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth-out": {"10.0.0.10"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+
+	sink := &RouteSink{
+		Iname:              "eth-out",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 0, 255}},
+		Registry:           registry,
+	}
+	pkt := buildEthernetPacket(t, net.ParseIP("fe80::1"), net.ParseIP("ff02::1"), net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, []byte("hello"), "eth-in")
+
+	targets := sink.targetsForPacket(pkt)
+	if len(targets) != 1 {
+		t.Fatalf("expected only the all-nodes target, got %+v", targets)
+	}
+	if !targets[0].IP.Equal(net.ParseIP("ff02::1")) || !targets[0].BroadcastDestMAC {
+		t.Fatalf("unexpected IPv6 broadcast target: %+v", targets[0])
+	}
+
+	if _, err := registry.ProcessForInterface("eth-out", buildEthernetPacket(t, net.ParseIP("fe80::20"), net.ParseIP("ff02::1"), net.HardwareAddr{0, 1, 2, 3, 4, 6}, net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, nil, "eth-out")); err != nil {
+		t.Fatalf("ProcessForInterface failed: %v", err)
+	}
+	targets = sink.targetsForPacket(pkt)
+	if len(targets) != 1 || !targets[0].IP.Equal(net.ParseIP("fe80::20")) {
+		t.Fatalf("expected learned IPv6 client as the only target, got %+v", targets)
+	}
+}
+
+func TestRouteSink_Write_MulticastReemitsToGroup(t *testing.T) {
+	registry, err := NewRegistryProcessorByInterface(time.Hour, map[string][]string{
+		"eth-out": {"10.0.1.10"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistryProcessorByInterface failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		multicast bool
+		dstIP     net.IP
+		wantIP    net.IP
+		wantMAC   net.HardwareAddr
+		wantTTL   uint8
+	}{
+		{
+			name:      "multicast group is re-emitted",
+			multicast: true,
+			dstIP:     net.IP{239, 255, 255, 250},
+			wantIP:    net.IP{239, 255, 255, 250},
+			wantMAC:   net.HardwareAddr{0x01, 0x00, 0x5e, 0x7f, 0xff, 0xfa},
+			wantTTL:   4,
+		},
+		{
+			name:      "broadcast is unchanged in multicast mode",
+			multicast: true,
+			dstIP:     net.IP{10, 0, 0, 255},
+			wantIP:    net.IP{10, 0, 1, 10},
+			wantMAC:   net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			wantTTL:   64,
+		},
+		{
+			name:      "multicast disabled routes to clients",
+			multicast: false,
+			dstIP:     net.IP{239, 255, 255, 250},
+			wantIP:    net.IP{10, 0, 1, 10},
+			wantMAC:   net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			wantTTL:   64,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &routeSinkTestSink{}
+			routeSink := &RouteSink{
+				Iname:              "eth-out",
+				Broadcast:          true,
+				BroadcastAddresses: []net.IP{{10, 0, 1, 255}},
+				Multicast:          tt.multicast,
+				MulticastTTL:       4,
+				HardwareAddr:       net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+				Registry:           registry,
+				LinkType:           layers.LinkTypeEthernet,
+				Sinks:              []proxy.Sink{sink},
+			}
+
+			pkt := buildEthernetPacket(t, net.IP{10, 0, 0, 1}, tt.dstIP, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("M-SEARCH"), "eth-in")
+			if err := routeSink.Write(pkt); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if len(sink.pkts) != 1 {
+				t.Fatalf("expected 1 packet, got %d", len(sink.pkts))
+			}
+
+			out := sink.pkts[0].Packet
+			eth := out.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+			if !bytes.Equal(eth.DstMAC, tt.wantMAC) {
+				t.Errorf("expected dst MAC %s, got %s", tt.wantMAC, eth.DstMAC)
+			}
+			ipv4 := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if !ipv4.DstIP.Equal(tt.wantIP) {
+				t.Errorf("expected dst IP %s, got %s", tt.wantIP, ipv4.DstIP)
+			}
+			if ipv4.TTL != tt.wantTTL {
+				t.Errorf("expected TTL %d, got %d", tt.wantTTL, ipv4.TTL)
+			}
+		})
+	}
+}
+
+func TestRouteSink_Write_TagsVLAN(t *testing.T) {
+	sink := &routeSinkTestSink{}
+	routeSink := &RouteSink{
+		Iname:              "eth0@vlan20",
+		Broadcast:          true,
+		BroadcastAddresses: []net.IP{{10, 0, 20, 255}},
+		HardwareAddr:       net.HardwareAddr{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc},
+		LinkType:           layers.LinkTypeEthernet,
+		VLAN:               20,
+		Sinks:              []proxy.Sink{sink},
+	}
+
+	if err := routeSink.Write(buildVLANPacket(t, 10, net.IP{10, 0, 10, 5})); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if sink.writes != 1 {
+		t.Fatalf("expected a single write, got %d", sink.writes)
+	}
+	if vid, ok := proxy.PacketVLAN(sink.pkts[0]); !ok || vid != 20 {
+		t.Fatalf("expected the packet to be tagged with VLAN 20, got %d, %v", vid, ok)
+	}
+	if sink.pkts[0].ArrivalInterface != "eth0@vlan20" {
+		t.Fatalf("unexpected arrival interface %s", sink.pkts[0].ArrivalInterface)
+	}
+}
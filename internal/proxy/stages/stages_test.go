@@ -1,6 +1,7 @@
 package stages
 
 import (
+	"net"
 	"testing"
 
 	"github.com/gopacket/gopacket"
@@ -107,6 +108,31 @@ func TestFilterProcessor(t *testing.T) {
 		t.Error("Expected to keep valid UDP packet")
 	}
 
+	// Valid IPv6 UDP packet
+	ip6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fe80::1"),
+		DstIP:      net.ParseIP("ff02::1"),
+	}
+	udp6 := &layers.UDP{SrcPort: 1234, DstPort: 1234}
+	if err := udp6.SetNetworkLayerForChecksum(ip6); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum failed: %v", err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip6, udp6, gopacket.Payload([]byte("hello"))); err != nil {
+		t.Fatalf("SerializeLayers failed: %v", err)
+	}
+	pkt.Packet = gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
+	keep, err = filter.Process(pkt)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if !keep {
+		t.Error("Expected to keep valid IPv6 UDP packet")
+	}
+
 	// Invalid packet (no network layer)
 	invalidPacket := gopacket.NewPacket([]byte{1, 2, 3}, layers.LayerTypeEthernet, gopacket.Default)
 	pkt.Packet = invalidPacket
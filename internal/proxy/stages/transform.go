@@ -19,11 +19,27 @@ func (t *TransformProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	// Re-calculating checksums and modifying the packet.
 	packet := pkt.Packet
 
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
+	var netLayer gopacket.SerializableLayer
+	var checksumLayer gopacket.NetworkLayer
+	decodeAs := layers.LayerTypeIPv4
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ipv4 := ipLayer.(*layers.IPv4)
+		if t.DestinationIP.To4() == nil {
+			return false, fmt.Errorf("unable to set IPv6 destination %s on IPv4 packet", t.DestinationIP)
+		}
+		ipv4.DstIP = t.DestinationIP.To4()
+		netLayer, checksumLayer = ipv4, ipv4
+	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ipv6 := ipLayer.(*layers.IPv6)
+		if t.DestinationIP.To4() != nil {
+			return false, fmt.Errorf("unable to set IPv4 destination %s on IPv6 packet", t.DestinationIP)
+		}
+		ipv6.DstIP = t.DestinationIP.To16()
+		netLayer, checksumLayer = ipv6, ipv6
+		decodeAs = layers.LayerTypeIPv6
+	} else {
 		return false, nil
 	}
-	ipv4 := ipLayer.(*layers.IPv4)
 
 	udpLayer := packet.Layer(layers.LayerTypeUDP)
 	if udpLayer == nil {
@@ -31,9 +47,6 @@ func (t *TransformProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	}
 	udp := udpLayer.(*layers.UDP)
 
-	// Update destination IP
-	ipv4.DstIP = t.DestinationIP
-
 	// We need to re-serialize the packet to update checksums and the raw byte slice
 	opts := gopacket.SerializeOptions{
 		FixLengths:       true,
@@ -43,11 +56,11 @@ func (t *TransformProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	buffer := gopacket.NewSerializeBuffer()
 
 	// Set the network layer for the UDP checksum calculation
-	if err := udp.SetNetworkLayerForChecksum(ipv4); err != nil {
+	if err := udp.SetNetworkLayerForChecksum(checksumLayer); err != nil {
 		return false, fmt.Errorf("failed to set network layer for checksum: %w", err)
 	}
 
-	// Re-serialize the layers. Note: we are currently only handling IPv4/UDP.
+	// Re-serialize the layers. Note: we are currently only handling IPv4/IPv6 UDP.
 	// We use the application layer (payload) and work outwards.
 	payload := packet.ApplicationLayer()
 	if payload == nil {
@@ -55,7 +68,7 @@ func (t *TransformProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	}
 
 	err := gopacket.SerializeLayers(buffer, opts,
-		ipv4,
+		netLayer,
 		udp,
 		gopacket.Payload(payload.Payload()),
 	)
@@ -67,7 +80,7 @@ func (t *TransformProcessor) Process(pkt *proxy.Packet) (bool, error) {
 	pkt.Raw = buffer.Bytes()
 
 	// Update the decoded packet as well so downstream processors see the change
-	newPacket := gopacket.NewPacket(pkt.Raw, layers.LayerTypeIPv4, gopacket.Default)
+	newPacket := gopacket.NewPacket(pkt.Raw, decodeAs, gopacket.Default)
 	if newPacket.ErrorLayer() != nil {
 		return false, fmt.Errorf("failed to re-decode modified packet: %w", newPacket.ErrorLayer().Error())
 	}
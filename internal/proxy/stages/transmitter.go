@@ -5,14 +5,14 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
-	"time"
 
+	"github.com/synfinatic/udp-proxy-2020/internal/metrics"
 	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
 )
 
 // TransmitterSink sends packets to a physical interface.
 type TransmitterSink struct {
-	dm           *proxy.DeviceManager
+	dm           proxy.DeviceManager
 	mu           sync.Mutex // protects Writer and reconnecting
 	Writer       proxy.PacketWriter
 	Iname        string
@@ -20,25 +20,25 @@ type TransmitterSink struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	createWriter func(iname string) (proxy.PacketWriter, error)
+	subscribe    func() (<-chan proxy.LinkEvent, func())
 }
 
 // NewTransmitterSink creates a new TransmitterSink.
-func NewTransmitterSink(dm *proxy.DeviceManager, iname string) (*TransmitterSink, error) {
-	handle, err := dm.CreateIsolatedWriterHandle(iname)
+func NewTransmitterSink(dm proxy.DeviceManager, iname string) (*TransmitterSink, error) {
+	writer, err := dm.CreateIsolatedWriter(iname)
 	if err != nil {
 		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	return &TransmitterSink{
-		dm:     dm,
-		Writer: handle,
-		Iname:  iname,
-		ctx:    ctx,
-		cancel: cancel,
-		createWriter: func(iname string) (proxy.PacketWriter, error) {
-			return dm.CreateIsolatedWriterHandle(iname)
-		},
+		dm:           dm,
+		Writer:       writer,
+		Iname:        iname,
+		ctx:          ctx,
+		cancel:       cancel,
+		createWriter: dm.CreateIsolatedWriter,
+		subscribe:    dm.Subscribe,
 	}, nil
 }
 
@@ -55,6 +55,7 @@ func (s *TransmitterSink) Write(pkt *proxy.Packet) error {
 	if s.Writer == nil {
 		// Reconnect is in progress; drop this packet.
 		s.mu.Unlock()
+		metrics.TransmitterDropped.WithLabelValues(s.Iname, "reconnecting").Inc()
 		return nil
 	}
 
@@ -65,8 +66,10 @@ func (s *TransmitterSink) Write(pkt *proxy.Packet) error {
 		slog.Warn("transmitter write failed, initiating reconnect",
 			slog.String("interface", s.Iname),
 			slog.String("error", err.Error()))
+		metrics.TransmitterDropped.WithLabelValues(s.Iname, "write_error").Inc()
 
 		if !s.reconnecting {
+			metrics.TransmitterReconnects.WithLabelValues(s.Iname, "started").Inc()
 			s.reconnecting = true
 			s.Writer = nil
 			closePacketWriter(staleWriter)
@@ -89,12 +92,19 @@ func (s *TransmitterSink) reconnectLoop() {
 		return
 	}
 
+	// Retry as soon as the interface is back instead of waiting out the
+	// backoff.
+	var events <-chan proxy.LinkEvent
+	if s.subscribe != nil {
+		var unsubscribe func()
+		events, unsubscribe = s.subscribe()
+		defer unsubscribe()
+	}
+
 	delay := reconnectInitialDelay
 	for {
-		select {
-		case <-s.ctx.Done():
+		if err := waitRetry(s.ctx, events, s.Iname, delay); err != nil {
 			return
-		case <-time.After(delay):
 		}
 
 		if s.createWriter == nil {
@@ -124,6 +134,7 @@ func (s *TransmitterSink) reconnectLoop() {
 		s.Writer = handle
 		s.reconnecting = false
 		s.mu.Unlock()
+		metrics.TransmitterReconnects.WithLabelValues(s.Iname, "succeeded").Inc()
 		slog.Info("interface reconnected for writing",
 			slog.String("interface", s.Iname))
 		return
@@ -71,7 +71,7 @@ func TestTransmitterSink_WriteErrorTriggersReconnect(t *testing.T) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel() // cancel immediately so the goroutine doesn't spin or touch pcap
-	dm := &proxy.DeviceManager{}
+	dm := &proxy.HostDeviceManager{}
 	s := &TransmitterSink{
 		dm:     dm,
 		Writer: writer,
@@ -166,3 +166,41 @@ func TestTransmitterSink_WriteErrorWithNilDeviceManagerDoesNotPanic(t *testing.T
 		t.Fatalf("Write should not return error: %v", err)
 	}
 }
+
+// TestTransmitterSink_ReconnectsWhenInterfaceAppears verifies that a link
+// event for the interface cuts the reconnect backoff short.
+func TestTransmitterSink_ReconnectsWhenInterfaceAppears(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan proxy.LinkEvent, 2)
+	writer := &mockWriter{linkType: layers.LinkTypeEthernet}
+	s := &TransmitterSink{
+		Iname:        "eth0",
+		reconnecting: true,
+		ctx:          ctx,
+		cancel:       cancel,
+		createWriter: func(string) (proxy.PacketWriter, error) { return writer, nil },
+		subscribe: func() (<-chan proxy.LinkEvent, func()) {
+			return events, func() {}
+		},
+	}
+
+	events <- proxy.LinkEvent{Kind: proxy.LinkAppeared, Interface: "eth1"}
+	events <- proxy.LinkEvent{Kind: proxy.LinkAppeared, Interface: "eth0"}
+	done := make(chan struct{})
+	go func() {
+		s.reconnectLoop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(reconnectInitialDelay / 2):
+		t.Fatal("reconnectLoop did not retry when the interface appeared")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Writer != writer || s.reconnecting {
+		t.Fatal("expected the new writer to be installed")
+	}
+}
@@ -0,0 +1,256 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+// vlanBuffer is how many packets a VLANSource may fall behind the capture of
+// its trunk before packets for it are dropped.
+const vlanBuffer = 256
+
+// trunkReader is the capture of a trunk interface shared by its VLANSources.
+type trunkReader interface {
+	proxy.Source
+	SetBPFFilter(filter string) error
+	LinkType() layers.LinkType
+}
+
+// TrunkCaptures shares a single capture of each trunk interface between the
+// VLANSources of its VLANs, so tagged traffic is only captured once and is
+// demultiplexed by VLAN ID.  The capture of a trunk is opened with its first
+// VLANSource and closed with the last one.
+type TrunkCaptures struct {
+	mu     sync.Mutex // protects trunks, serializes opening and closing
+	trunks map[string]*trunkCapture
+
+	open func(trunk string, promisc bool, timeout time.Duration) (trunkReader, error) // replaceable for tests
+}
+
+type trunkCapture struct {
+	name   string
+	reader trunkReader
+	cancel context.CancelFunc
+	done   chan struct{} // closed once run returns
+	err    error         // why run returned, set before done is closed
+
+	mu    sync.RWMutex // protects vlans and the filters of the VLANSources
+	vlans map[uint16]*VLANSource
+}
+
+// NewTrunkCaptures creates a TrunkCaptures capturing from the interfaces of dm.
+func NewTrunkCaptures(dm proxy.DeviceManager) *TrunkCaptures {
+	return &TrunkCaptures{
+		trunks: make(map[string]*trunkCapture),
+		open: func(trunk string, promisc bool, timeout time.Duration) (trunkReader, error) {
+			return NewPcapSource(dm, trunk, promisc, timeout)
+		},
+	}
+}
+
+// Open returns the source of the packets tagged with vid on trunk.  filter is
+// the BPF filter for the packets of the VLAN without their tag; the capture of
+// the trunk lets through the union of the filters of its VLANs.  The promisc
+// and timeout settings of the first VLAN opened on a trunk are used.
+func (t *TrunkCaptures) Open(trunk string, vid uint16, filter string, promisc bool, timeout time.Duration) (*VLANSource, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc, ok := t.trunks[trunk]
+	if !ok {
+		reader, err := t.open(trunk, promisc, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if lt := reader.LinkType(); lt != layers.LinkTypeEthernet {
+			reader.Close()
+			return nil, fmt.Errorf("unable to capture VLANs on %s: unsupported link type %s", trunk, lt)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		tc = &trunkCapture{
+			name:   trunk,
+			reader: reader,
+			cancel: cancel,
+			done:   make(chan struct{}),
+			vlans:  make(map[uint16]*VLANSource),
+		}
+		t.trunks[trunk] = tc
+		go tc.run(ctx)
+	}
+
+	tc.mu.Lock()
+	if _, ok := tc.vlans[vid]; ok {
+		tc.mu.Unlock()
+		return nil, fmt.Errorf("VLAN %d of %s is already being captured", vid, trunk)
+	}
+	s := &VLANSource{
+		captures: t,
+		capture:  tc,
+		vid:      vid,
+		iname:    proxy.VLANInterfaceName(trunk, vid),
+		filter:   filter,
+		packets:  make(chan *proxy.Packet, vlanBuffer),
+	}
+	tc.vlans[vid] = s
+	tc.mu.Unlock()
+
+	if err := tc.updateFilter(); err != nil {
+		t.release(s)
+		return nil, fmt.Errorf("failed to set BPF filter for %s: %w", s.iname, err)
+	}
+	return s, nil
+}
+
+// release removes s from the capture of its trunk and stops the capture if it
+// was the last VLAN.  Must be called with mu held.
+func (t *TrunkCaptures) release(s *VLANSource) error {
+	tc := s.capture
+	tc.mu.Lock()
+	if tc.vlans[s.vid] != s {
+		tc.mu.Unlock()
+		return nil // already closed
+	}
+	delete(tc.vlans, s.vid)
+	last := len(tc.vlans) == 0
+	tc.mu.Unlock()
+
+	if !last {
+		return tc.updateFilter()
+	}
+	delete(t.trunks, tc.name)
+	tc.cancel()
+	<-tc.done
+	return tc.reader.Close()
+}
+
+// run reads the packets of the trunk and hands them to the VLANSource of their
+// VLAN until ctx is cancelled or the capture fails.
+func (tc *trunkCapture) run(ctx context.Context) {
+	defer close(tc.done)
+	for {
+		pkt, err := tc.reader.Read(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Trunk capture failed", "interface", tc.name, "error", err)
+				tc.err = err
+			}
+			return
+		}
+		vid, ok := proxy.PacketVLAN(pkt)
+		if !ok {
+			continue
+		}
+		tc.mu.RLock()
+		s := tc.vlans[vid]
+		tc.mu.RUnlock()
+		if s == nil {
+			continue
+		}
+		pkt.ArrivalInterface = s.iname
+		select {
+		case s.packets <- pkt:
+		default:
+			slog.Debug("Dropped packet for slow VLAN source", "interface", s.iname)
+		}
+	}
+}
+
+// updateFilter sets the BPF filter of the trunk to the union of the filters of
+// its VLANs.
+func (tc *trunkCapture) updateFilter() error {
+	tc.mu.RLock()
+	filters := make([]string, 0, len(tc.vlans))
+	for _, vid := range slices.Sorted(maps.Keys(tc.vlans)) {
+		filters = append(filters, tc.vlans[vid].filter)
+	}
+	tc.mu.RUnlock()
+	return tc.reader.SetBPFFilter(trunkFilter(filters))
+}
+
+// trunkFilter returns the BPF filter for a trunk which only lets through
+// tagged packets matching one of filters.
+func trunkFilter(filters []string) string {
+	if len(filters) == 0 || slices.Contains(filters, "") {
+		return "vlan"
+	}
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if !slices.Contains(parts, "("+f+")") {
+			parts = append(parts, "("+f+")")
+		}
+	}
+	return "vlan and (" + strings.Join(parts, " or ") + ")"
+}
+
+// VLANSource reads the packets tagged with a single VLAN ID from the shared
+// capture of a trunk interface, as the logical interface trunk@vlanID.
+type VLANSource struct {
+	captures *TrunkCaptures
+	capture  *trunkCapture
+	vid      uint16
+	iname    string
+	filter   string // protected by capture.mu
+	packets  chan *proxy.Packet
+}
+
+// Read returns the next packet of the VLAN.
+func (s *VLANSource) Read(ctx context.Context) (*proxy.Packet, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pkt := <-s.packets:
+		return pkt, nil
+	case <-s.capture.done:
+		if s.capture.err != nil {
+			return nil, s.capture.err
+		}
+		return nil, io.EOF
+	}
+}
+
+// Drain returns the next packet already captured for the VLAN, or nil if
+// there are none.
+func (s *VLANSource) Drain() *proxy.Packet {
+	select {
+	case pkt := <-s.packets:
+		return pkt
+	default:
+		return nil
+	}
+}
+
+// SetBPFFilter changes the filter of the VLAN.  Safe to call while packets are
+// being read.
+func (s *VLANSource) SetBPFFilter(filter string) error {
+	s.capture.mu.Lock()
+	s.filter = filter
+	s.capture.mu.Unlock()
+	return s.capture.updateFilter()
+}
+
+// LinkType returns the link type of the trunk capture.
+func (s *VLANSource) LinkType() layers.LinkType {
+	return s.capture.reader.LinkType()
+}
+
+// Close stops reading the VLAN, closing the capture of the trunk if this was
+// its last VLAN.
+func (s *VLANSource) Close() error {
+	s.captures.mu.Lock()
+	defer s.captures.mu.Unlock()
+	return s.captures.release(s)
+}
+
+func (s *VLANSource) Name() string {
+	return "VLANSource:" + s.iname
+}
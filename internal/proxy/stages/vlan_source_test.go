@@ -0,0 +1,191 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/synfinatic/udp-proxy-2020/internal/proxy"
+)
+
+type fakeTrunkReader struct {
+	packets chan *proxy.Packet
+
+	mu     sync.Mutex
+	filter string
+	closed bool
+}
+
+func newFakeTrunkReader() *fakeTrunkReader {
+	return &fakeTrunkReader{packets: make(chan *proxy.Packet, 8)}
+}
+
+func (r *fakeTrunkReader) Read(ctx context.Context) (*proxy.Packet, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pkt := <-r.packets:
+		return pkt, nil
+	}
+}
+
+func (r *fakeTrunkReader) SetBPFFilter(filter string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.filter = filter
+	return nil
+}
+
+func (r *fakeTrunkReader) currentFilter() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.filter
+}
+
+func (r *fakeTrunkReader) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+func (r *fakeTrunkReader) Name() string              { return "fakeTrunkReader" }
+
+func (r *fakeTrunkReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func newTestTrunkCaptures(reader *fakeTrunkReader, opened *int) *TrunkCaptures {
+	return &TrunkCaptures{
+		trunks: make(map[string]*trunkCapture),
+		open: func(string, bool, time.Duration) (trunkReader, error) {
+			*opened++
+			return reader, nil
+		},
+	}
+}
+
+// buildVLANPacket returns a UDP broadcast from srcIP tagged with vid.
+func buildVLANPacket(t *testing.T, vid uint16, srcIP net.IP) *proxy.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: net.IPv4bcast.To4()}
+	udp := &layers.UDP{SrcPort: 9003, DstPort: 9003}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum failed: %v", err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: vid, Type: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload("hello"),
+	); err != nil {
+		t.Fatalf("SerializeLayers failed: %v", err)
+	}
+	raw := buf.Bytes()
+	return &proxy.Packet{Raw: raw, Packet: gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default), ArrivalInterface: "eth0"}
+}
+
+func TestTrunkCaptures_DemultiplexesByVLAN(t *testing.T) {
+	reader := newFakeTrunkReader()
+	opened := 0
+	captures := newTestTrunkCaptures(reader, &opened)
+
+	vlan10, err := captures.Open("eth0", 10, "udp port 9003", true, time.Second)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	vlan20, err := captures.Open("eth0", 20, "udp port 1900", true, time.Second)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if opened != 1 {
+		t.Fatalf("expected a single capture of the trunk, got %d", opened)
+	}
+	if _, err := captures.Open("eth0", 10, "", true, time.Second); err == nil {
+		t.Fatal("expected an error opening the same VLAN twice")
+	}
+	if got, want := reader.currentFilter(), "vlan and ((udp port 9003) or (udp port 1900))"; got != want {
+		t.Fatalf("unexpected trunk filter %q, want %q", got, want)
+	}
+
+	reader.packets <- buildVLANPacket(t, 30, net.IP{10, 0, 30, 5}) // no source, dropped
+	reader.packets <- buildVLANPacket(t, 20, net.IP{10, 0, 20, 5})
+	reader.packets <- buildVLANPacket(t, 10, net.IP{10, 0, 10, 5})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, tt := range []struct {
+		source *VLANSource
+		iname  string
+	}{{vlan10, "eth0@vlan10"}, {vlan20, "eth0@vlan20"}} {
+		pkt, err := tt.source.Read(ctx)
+		if err != nil {
+			t.Fatalf("%s: Read failed: %v", tt.iname, err)
+		}
+		if pkt.ArrivalInterface != tt.iname {
+			t.Fatalf("expected the packet to arrive on %s, got %s", tt.iname, pkt.ArrivalInterface)
+		}
+		if tt.source.Drain() != nil {
+			t.Fatalf("%s: expected no other packets", tt.iname)
+		}
+	}
+
+	if err := vlan10.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := reader.currentFilter(); got != "vlan and ((udp port 1900))" {
+		t.Fatalf("expected the filter of the closed VLAN to be removed, got %q", got)
+	}
+	if err := vlan20.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if !reader.closed {
+		t.Fatal("expected the trunk capture to be closed with its last VLAN")
+	}
+	if _, err := vlan20.Read(ctx); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF once closed, got %v", err)
+	}
+
+	if _, err := captures.Open("eth0", 10, "", true, time.Second); err != nil || opened != 2 {
+		t.Fatalf("expected the trunk to be captured again, got %d captures, %v", opened, err)
+	}
+	if got := reader.currentFilter(); got != "vlan" {
+		t.Fatalf("expected every tagged packet to be captured without a filter, got %q", got)
+	}
+}
+
+func TestFilterProcessor_VLAN(t *testing.T) {
+	pkt := buildVLANPacket(t, 10, net.IP{10, 0, 10, 5})
+
+	for iname, want := range map[string]bool{"eth0": true, "eth0@vlan10": true, "eth0@vlan20": false} {
+		keep, err := (&FilterProcessor{Iname: iname}).Process(pkt)
+		if err != nil || keep != want {
+			t.Errorf("FilterProcessor(%s) = %v, %v, want %v", iname, keep, err, want)
+		}
+	}
+
+	untagged := buildEthernetPacket(t, net.IP{10, 0, 10, 5}, net.IP{10, 0, 10, 255}, net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte("hello"), "eth0")
+	if keep, _ := (&FilterProcessor{Iname: "eth0@vlan10"}).Process(untagged); keep {
+		t.Error("expected untagged packets to be dropped on a VLAN interface")
+	}
+}
+
+func TestRegistryProcessor_LearnsTaggedPacketsOnVLANInterface(t *testing.T) {
+	registry, err := NewRegistryProcessor(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryProcessor failed: %v", err)
+	}
+	if _, err := registry.Process(buildVLANPacket(t, 10, net.IP{10, 0, 10, 5})); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	clients := registry.GetClientsForInterface("eth0@vlan10")
+	if len(clients) != 1 || !clients[0].IP.Equal(net.IP{10, 0, 10, 5}) {
+		t.Fatalf("expected the client on eth0@vlan10, got %+v", registry.GetClients())
+	}
+	if clients[0].MAC.String() != "00:01:02:03:04:05" {
+		t.Fatalf("expected the MAC of the client, got %s", clients[0].MAC)
+	}
+}
@@ -26,6 +26,13 @@ type Source interface {
 	Name() string
 }
 
+// Drainer is implemented by sources which buffer packets internally.  Drain
+// returns the next buffered packet without blocking, or nil when there are
+// none left.  It is used to finish processing captured packets on shutdown.
+type Drainer interface {
+	Drain() *Packet
+}
+
 // PacketWriter is an interface for writing packet data to a network device.
 type PacketWriter interface {
 	WritePacketData(data []byte) error
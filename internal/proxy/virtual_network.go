@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// virtualQueueSize is how many packets the capture or the transmit queue of a
+// virtual interface holds before packets are dropped.
+const virtualQueueSize = 1024
+
+// VirtualInterface describes an interface of a VirtualNetwork.
+type VirtualInterface struct {
+	Name         string
+	LinkType     layers.LinkType
+	HardwareAddr net.HardwareAddr
+	Addresses    []InterfaceAddress
+	MTU          int
+	Flags        net.Flags // net.FlagUp follows SetUp
+}
+
+// VirtualNetwork is a DeviceManager of simulated interfaces, so the whole proxy
+// can be run without root or real interfaces.  Packets injected on an
+// interface are captured by its reader handle and packets sent on it are
+// queued for Transmitted.  Like Refresh on the host, an interface is only
+// available while it has an address, and every change is published as a
+// LinkEvent as soon as it is made.  An interface which is down keeps its
+// addresses, but its capture ends and sending on it fails until it is up again.
+//
+// BPF filters are recorded but not applied, every injected packet is captured.
+type VirtualNetwork struct {
+	linkSubscribers
+
+	mu        sync.Mutex // protects everything below, serializes the events
+	ifaces    map[string]*virtualInterface
+	listed    map[string]Interface // the available interfaces
+	readers   map[string]*virtualCapture
+	nextIndex int
+}
+
+type virtualInterface struct {
+	VirtualInterface
+	index int
+	up    bool
+	sent  chan []byte
+}
+
+// NewVirtualNetwork returns a VirtualNetwork without any interfaces.
+func NewVirtualNetwork() *VirtualNetwork {
+	return &VirtualNetwork{
+		ifaces:    make(map[string]*virtualInterface),
+		listed:    make(map[string]Interface),
+		readers:   make(map[string]*virtualCapture),
+		nextIndex: 1,
+	}
+}
+
+// Add creates an interface, which is up.
+func (n *VirtualNetwork) Add(iface VirtualInterface) error {
+	if !isValidLinkType(iface.LinkType) {
+		return fmt.Errorf("interface %s has an unsupported link type: %s", iface.Name, iface.LinkType)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.ifaces[iface.Name]; ok {
+		return fmt.Errorf("interface %s already exists", iface.Name)
+	}
+	iface.Addresses = slices.Clone(iface.Addresses)
+	n.ifaces[iface.Name] = &virtualInterface{
+		VirtualInterface: iface,
+		index:            n.nextIndex,
+		up:               true,
+		sent:             make(chan []byte, virtualQueueSize),
+	}
+	n.nextIndex++
+	n.update()
+	return nil
+}
+
+// Remove deletes an interface, ending its capture.  Its writers fail from now
+// on, even if an interface with the same name is added again.
+func (n *VirtualNetwork) Remove(iname string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.ifaces[iname]; !ok {
+		return fmt.Errorf("interface %s not found", iname)
+	}
+	delete(n.ifaces, iname)
+	n.endCapture(iname)
+	n.update()
+	return nil
+}
+
+// SetUp brings an interface up or down.  Taking it down ends its capture.
+func (n *VirtualNetwork) SetUp(iname string, up bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return fmt.Errorf("interface %s not found", iname)
+	}
+	iface.up = up
+	if !up {
+		n.endCapture(iname)
+	}
+	return nil
+}
+
+// SetAddresses replaces the addresses of an interface.
+func (n *VirtualNetwork) SetAddresses(iname string, addrs []InterfaceAddress) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return fmt.Errorf("interface %s not found", iname)
+	}
+	iface.Addresses = slices.Clone(addrs)
+	n.update()
+	return nil
+}
+
+// SetMTU changes the MTU of an interface.
+func (n *VirtualNetwork) SetMTU(iname string, mtu int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return fmt.Errorf("interface %s not found", iname)
+	}
+	iface.MTU = mtu
+	n.update()
+	return nil
+}
+
+// Inject delivers data to the capture of iname as if it arrived on the wire.
+// Packets arriving while nothing captures on the interface are lost.
+func (n *VirtualNetwork) Inject(iname string, data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return fmt.Errorf("interface %s not found", iname)
+	}
+	if !iface.up {
+		return fmt.Errorf("interface %s is down", iname)
+	}
+	if c, ok := n.readers[iname]; ok && !c.ended {
+		select {
+		case c.packets <- slices.Clone(data):
+		default:
+		}
+	}
+	return nil
+}
+
+// Transmitted returns the next packet sent on iname, waiting for one until ctx
+// is done.
+func (n *VirtualNetwork) Transmitted(ctx context.Context, iname string) ([]byte, error) {
+	n.mu.Lock()
+	iface, ok := n.ifaces[iname]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("interface %s not found", iname)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case data := <-iface.sent:
+		return data, nil
+	}
+}
+
+// update publishes the changes of the available interfaces since the last
+// update.  Must be called with mu held.
+func (n *VirtualNetwork) update() {
+	listed := make(map[string]Interface)
+	for name, iface := range n.ifaces {
+		if len(iface.Addresses) > 0 {
+			listed[name] = Interface{Name: name, Addresses: iface.Addresses, MTU: iface.MTU}
+		}
+	}
+	old := n.listed
+	n.listed = listed
+	for _, event := range diffInterfaces(old, listed) {
+		n.publish(event)
+	}
+}
+
+// endCapture ends the capture of iname, which stays open until it is closed
+// like a pcap handle of an interface which went away.  Must be called with mu
+// held.
+func (n *VirtualNetwork) endCapture(iname string) {
+	if c, ok := n.readers[iname]; ok && !c.ended {
+		c.ended = true
+		close(c.done)
+	}
+}
+
+// closeReader closes the capture of iname.  Must be called with mu held.
+func (n *VirtualNetwork) closeReader(iname string) bool {
+	_, ok := n.readers[iname]
+	if ok {
+		n.endCapture(iname)
+		delete(n.readers, iname)
+	}
+	return ok
+}
+
+// Refresh does nothing, the changes are published when they are made.
+func (n *VirtualNetwork) Refresh() error {
+	return nil
+}
+
+// Watch waits for ctx to be cancelled, the changes are published when they
+// are made.
+func (n *VirtualNetwork) Watch(ctx context.Context, _ time.Duration) {
+	<-ctx.Done()
+}
+
+func (n *VirtualNetwork) InterfaceNames() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Sorted(maps.Keys(n.listed))
+}
+
+func (n *VirtualNetwork) InterfaceAvailable(iname string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.listed[iname]
+	return ok
+}
+
+func (n *VirtualNetwork) Interface(iname string) (*net.Interface, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return nil, fmt.Errorf("interface %s not found", iname)
+	}
+	flags := iface.Flags &^ net.FlagUp
+	if iface.up {
+		flags |= net.FlagUp
+	}
+	return &net.Interface{
+		Index:        iface.index,
+		MTU:          iface.MTU,
+		Name:         iname,
+		HardwareAddr: iface.HardwareAddr,
+		Flags:        flags,
+	}, nil
+}
+
+func (n *VirtualNetwork) GetAddresses(iname string) ([]InterfaceAddress, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if dev, ok := n.listed[iname]; ok {
+		return dev.Addresses, nil
+	}
+	return nil, fmt.Errorf("interface %s not found or has no addresses", iname)
+}
+
+func (n *VirtualNetwork) GetLoopback() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return loopbackName(n.listed)
+}
+
+func (n *VirtualNetwork) ListInterfaces() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	printInterfaces(n.listed)
+}
+
+// CreateReaderHandle opens the capture of iname, which must be up, replacing
+// a capture which ended.  The promisc and timeout settings have no effect.
+func (n *VirtualNetwork) CreateReaderHandle(iname string, _ bool, _ time.Duration) (CaptureHandle, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c, ok := n.readers[iname]; ok && !c.ended {
+		return c, nil
+	}
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return nil, fmt.Errorf("interface %s not found", iname)
+	}
+	if !iface.up {
+		return nil, fmt.Errorf("interface %s is down", iname)
+	}
+	c := &virtualCapture{
+		network:  n,
+		iname:    iname,
+		linkType: iface.LinkType,
+		packets:  make(chan []byte, virtualQueueSize),
+		done:     make(chan struct{}),
+	}
+	n.readers[iname] = c
+	return c, nil
+}
+
+// CreateIsolatedWriter returns a writer queueing the packets sent on iname,
+// which must be up.
+func (n *VirtualNetwork) CreateIsolatedWriter(iname string) (PacketWriter, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	iface, ok := n.ifaces[iname]
+	if !ok {
+		return nil, fmt.Errorf("interface %s not found", iname)
+	}
+	if !iface.up {
+		return nil, fmt.Errorf("interface %s is down", iname)
+	}
+	return &virtualWriter{network: n, iface: iface}, nil
+}
+
+func (n *VirtualNetwork) Close(iname string, direction PcapHandleDirection) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if direction != Reader || !n.closeReader(iname) {
+		return fmt.Errorf("handle for interface %s with direction %s not found", iname, direction)
+	}
+	return nil
+}
+
+func (n *VirtualNetwork) CloseHandles() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for iname := range n.readers {
+		n.closeReader(iname)
+	}
+}
+
+// virtualCapture is the capture of a virtual interface.
+type virtualCapture struct {
+	network  *VirtualNetwork
+	iname    string
+	linkType layers.LinkType
+	packets  chan []byte
+	done     chan struct{} // closed when the capture ends
+	ended    bool          // protected by network.mu
+
+	mu     sync.Mutex // protects filter
+	filter string
+}
+
+func (c *virtualCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case <-c.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	case data := <-c.packets:
+		return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+	}
+}
+
+func (c *virtualCapture) LinkType() layers.LinkType {
+	return c.linkType
+}
+
+// SetBPFFilter records filter without applying it.
+func (c *virtualCapture) SetBPFFilter(filter string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filter = filter
+	return nil
+}
+
+func (c *virtualCapture) Close() {
+	c.network.mu.Lock()
+	defer c.network.mu.Unlock()
+	if c.network.readers[c.iname] == c {
+		c.network.closeReader(c.iname)
+	}
+}
+
+// virtualWriter sends packets on a virtual interface.
+type virtualWriter struct {
+	network *VirtualNetwork
+	iface   *virtualInterface
+}
+
+func (w *virtualWriter) WritePacketData(data []byte) error {
+	w.network.mu.Lock()
+	defer w.network.mu.Unlock()
+	if w.network.ifaces[w.iface.Name] != w.iface {
+		return fmt.Errorf("send: interface %s no longer exists", w.iface.Name)
+	}
+	if !w.iface.up {
+		return fmt.Errorf("send: interface %s is down", w.iface.Name)
+	}
+	select {
+	case w.iface.sent <- slices.Clone(data):
+	default:
+	}
+	return nil
+}
+
+func (w *virtualWriter) LinkType() layers.LinkType {
+	return w.iface.LinkType
+}
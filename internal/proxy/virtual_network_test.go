@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+var (
+	_ DeviceManager = (*HostDeviceManager)(nil)
+	_ DeviceManager = (*VirtualNetwork)(nil)
+)
+
+func virtualTestInterface(name, ip string) VirtualInterface {
+	return VirtualInterface{
+		Name:         name,
+		LinkType:     layers.LinkTypeEthernet,
+		HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+		Addresses:    testInterface(name, ip).Addresses,
+		MTU:          1500,
+		Flags:        net.FlagBroadcast | net.FlagMulticast,
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan LinkEvent) LinkEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a link event")
+		return LinkEvent{}
+	}
+}
+
+func TestVirtualNetwork_PublishesEvents(t *testing.T) {
+	n := NewVirtualNetwork()
+	events, unsubscribe := n.Subscribe()
+	defer unsubscribe()
+
+	if err := n.Add(virtualTestInterface("eth0", "192.168.1.1")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if event := nextEvent(t, events); event.Kind != LinkAppeared || event.Interface != "eth0" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if err := n.Add(virtualTestInterface("eth0", "192.168.1.1")); err == nil {
+		t.Fatal("expected adding eth0 twice to fail")
+	}
+
+	// Without addresses an interface exists, but isn't available.
+	if err := n.Add(VirtualInterface{Name: "tun0", LinkType: layers.LinkTypeRaw}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := n.Interface("tun0"); err != nil || n.InterfaceAvailable("tun0") {
+		t.Fatalf("expected tun0 to exist without being available: %v", err)
+	}
+	if err := n.SetAddresses("tun0", testInterface("tun0", "10.8.0.1").Addresses); err != nil {
+		t.Fatalf("SetAddresses failed: %v", err)
+	}
+	if event := nextEvent(t, events); event.Kind != LinkAppeared || event.Interface != "tun0" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if names := n.InterfaceNames(); len(names) != 2 || names[0] != "eth0" || names[1] != "tun0" {
+		t.Fatalf("unexpected interface names: %v", names)
+	}
+
+	if err := n.SetAddresses("eth0", testInterface("eth0", "192.168.2.1").Addresses); err != nil {
+		t.Fatalf("SetAddresses failed: %v", err)
+	}
+	event := nextEvent(t, events)
+	if event.Kind != AddressesChanged || event.Interface != "eth0" || !event.Addresses[0].IP.Equal(net.ParseIP("192.168.2.1")) {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	if err := n.Remove("eth0"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if event := nextEvent(t, events); event.Kind != LinkGone || event.Interface != "eth0" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if _, err := n.Interface("eth0"); err == nil {
+		t.Fatal("expected eth0 to be gone")
+	}
+
+	if err := n.Add(VirtualInterface{Name: "bad0", LinkType: layers.LinkType(255)}); err == nil {
+		t.Fatal("expected an unsupported link type to be rejected")
+	}
+}
+
+func TestVirtualNetwork_CaptureAndTransmit(t *testing.T) {
+	n := NewVirtualNetwork()
+	if err := n.Add(virtualTestInterface("eth0", "192.168.1.1")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	// Nothing captures yet, so the packet is lost.
+	if err := n.Inject("eth0", []byte{1}); err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	handle, err := n.CreateReaderHandle("eth0", false, time.Second)
+	if err != nil {
+		t.Fatalf("CreateReaderHandle failed: %v", err)
+	}
+	if again, _ := n.CreateReaderHandle("eth0", false, time.Second); again != handle {
+		t.Fatal("expected the open capture to be returned")
+	}
+	if err := n.Inject("eth0", []byte{2}); err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	data, ci, err := handle.ReadPacketData()
+	if err != nil || len(data) != 1 || data[0] != 2 || ci.Length != 1 {
+		t.Fatalf("unexpected packet %v %+v: %v", data, ci, err)
+	}
+
+	writer, err := n.CreateIsolatedWriter("eth0")
+	if err != nil {
+		t.Fatalf("CreateIsolatedWriter failed: %v", err)
+	}
+	if writer.LinkType() != layers.LinkTypeEthernet {
+		t.Fatalf("unexpected link type %v", writer.LinkType())
+	}
+	if err := writer.WritePacketData([]byte{3}); err != nil {
+		t.Fatalf("WritePacketData failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if data, err := n.Transmitted(ctx, "eth0"); err != nil || len(data) != 1 || data[0] != 3 {
+		t.Fatalf("unexpected transmitted packet %v: %v", data, err)
+	}
+
+	// Down ends the capture and fails writes until the interface is up.
+	if err := n.SetUp("eth0", false); err != nil {
+		t.Fatalf("SetUp failed: %v", err)
+	}
+	if _, _, err := handle.ReadPacketData(); err != io.EOF {
+		t.Fatalf("expected io.EOF from a capture of a down interface, got %v", err)
+	}
+	if netif, _ := n.Interface("eth0"); netif.Flags&net.FlagUp != 0 {
+		t.Fatal("expected eth0 to be down")
+	}
+	if err := writer.WritePacketData([]byte{4}); err == nil {
+		t.Fatal("expected writing on a down interface to fail")
+	}
+	if _, err := n.CreateReaderHandle("eth0", false, time.Second); err == nil {
+		t.Fatal("expected capturing on a down interface to fail")
+	}
+	if err := n.SetUp("eth0", true); err != nil {
+		t.Fatalf("SetUp failed: %v", err)
+	}
+	if err := writer.WritePacketData([]byte{5}); err != nil {
+		t.Fatalf("WritePacketData failed: %v", err)
+	}
+
+	// A new interface with the same name doesn't revive old writers.
+	if err := n.Remove("eth0"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := n.Add(virtualTestInterface("eth0", "192.168.1.1")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := writer.WritePacketData([]byte{6}); err == nil {
+		t.Fatal("expected writing on a deleted interface to fail")
+	}
+}
+
+func TestVirtualNetwork_Close(t *testing.T) {
+	n := NewVirtualNetwork()
+	if err := n.Add(virtualTestInterface("eth0", "192.168.1.1")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	handle, err := n.CreateReaderHandle("eth0", false, time.Second)
+	if err != nil {
+		t.Fatalf("CreateReaderHandle failed: %v", err)
+	}
+	if err := n.Close("eth0", Reader); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, _, err := handle.ReadPacketData(); err != io.EOF {
+		t.Fatalf("expected io.EOF from a closed capture, got %v", err)
+	}
+	if err := n.Close("eth0", Reader); err == nil {
+		t.Fatal("expected closing twice to fail")
+	}
+
+	// A capture which ended on Remove is still open until it is closed.
+	if _, err := n.CreateReaderHandle("eth0", false, time.Second); err != nil {
+		t.Fatalf("CreateReaderHandle failed: %v", err)
+	}
+	if err := n.Remove("eth0"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := n.Close("eth0", Reader); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// vlanSeparator separates the trunk interface from the VLAN ID in the name of
+// a logical VLAN interface, like eth0@vlan10.
+const vlanSeparator = "@vlan"
+
+// VLANInterfaceName returns the name of the logical interface for VLAN vid on
+// the trunk interface.
+func VLANInterfaceName(trunk string, vid uint16) string {
+	return fmt.Sprintf("%s%s%d", trunk, vlanSeparator, vid)
+}
+
+// IsVLANInterfaceName reports whether name looks like the name of a logical
+// VLAN interface, valid or not.
+func IsVLANInterfaceName(name string) bool {
+	return strings.Contains(name, vlanSeparator)
+}
+
+// ParseVLANInterface splits the name of a logical VLAN interface into its
+// trunk interface and VLAN ID.  ok is false for names which aren't a valid
+// logical VLAN interface.
+func ParseVLANInterface(name string) (trunk string, vid uint16, ok bool) {
+	i := strings.LastIndex(name, vlanSeparator)
+	if i <= 0 {
+		return "", 0, false
+	}
+	id, err := strconv.ParseUint(name[i+len(vlanSeparator):], 10, 16)
+	if err != nil || id < 1 || id > 4094 {
+		return "", 0, false
+	}
+	return name[:i], uint16(id), true
+}
+
+// DeviceName returns the network device iname is captured and sent on, which
+// is the trunk for a logical VLAN interface and iname itself otherwise.
+func DeviceName(iname string) string {
+	if trunk, _, ok := ParseVLANInterface(iname); ok {
+		return trunk
+	}
+	return iname
+}
+
+// PacketVLAN returns the VLAN ID of the outer 802.1Q tag of pkt.  ok is false
+// for untagged packets.
+func PacketVLAN(pkt *Packet) (vid uint16, ok bool) {
+	if pkt == nil || pkt.Packet == nil {
+		return 0, false
+	}
+	if dot1q, isDot1Q := pkt.Packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); isDot1Q {
+		return dot1q.VLANIdentifier, true
+	}
+	return 0, false
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import "testing"
+
+func TestParseVLANInterface(t *testing.T) {
+	tests := []struct {
+		name  string
+		trunk string
+		vid   uint16
+		ok    bool
+	}{
+		{"eth0@vlan10", "eth0", 10, true},
+		{"bond0.5@vlan4094", "bond0.5", 4094, true},
+		{"eth0", "", 0, false},
+		{"eth0@vlan", "", 0, false},
+		{"eth0@vlan0", "", 0, false},
+		{"eth0@vlan4095", "", 0, false},
+		{"eth0@vlanx", "", 0, false},
+		{"@vlan10", "", 0, false},
+	}
+	for _, tt := range tests {
+		trunk, vid, ok := ParseVLANInterface(tt.name)
+		if trunk != tt.trunk || vid != tt.vid || ok != tt.ok {
+			t.Errorf("ParseVLANInterface(%q) = %q, %d, %v, want %q, %d, %v", tt.name, trunk, vid, ok, tt.trunk, tt.vid, tt.ok)
+		}
+	}
+	if got := VLANInterfaceName("eth0", 10); got != "eth0@vlan10" {
+		t.Errorf("VLANInterfaceName() = %q", got)
+	}
+	if got := DeviceName("eth0@vlan10"); got != "eth0" {
+		t.Errorf("DeviceName() = %q", got)
+	}
+}
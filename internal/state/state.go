@@ -0,0 +1,100 @@
+// Package state reads and writes the state file used to remember learned
+// clients across restarts.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is the current state file format version.  Files with any other
+// version are ignored.
+const Version = 1
+
+// File is the contents of the state file.
+type File struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	Groups  []Group   `json:"groups"`
+}
+
+// Group holds the learned clients of a relay group.  The unnamed default group
+// has an empty Name.
+type Group struct {
+	Name    string   `json:"name"`
+	Clients []Client `json:"clients"`
+}
+
+// Client is a learned client.  Fixed IPs come from the config and are not
+// saved.
+type Client struct {
+	Interface string    `json:"interface"`
+	IP        string    `json:"ip"`
+	MAC       string    `json:"mac,omitempty"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Load reads the state file at path.  A missing file returns an error
+// matching os.ErrNotExist.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %w", path, err)
+	}
+	if f.Version != Version {
+		return nil, fmt.Errorf("unsupported state file version %d in %s", f.Version, path)
+	}
+	return &f, nil
+}
+
+// Save atomically replaces the state file at path: the new contents are
+// written and synced to a temporary file in the same directory which is then
+// renamed over path, so a crash leaves either the old or the new file.
+func Save(path string, f *File) error {
+	f.Version = Version
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to set state file permissions: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to sync state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace state file: %w", err)
+	}
+
+	// Make sure the rename itself is durable.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoad_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	lastSeen := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := &File{
+		SavedAt: lastSeen.Add(time.Minute),
+		Groups: []Group{
+			{Name: "roon", Clients: []Client{{Interface: "tun0", IP: "10.8.0.2", LastSeen: lastSeen}}},
+			{Name: "", Clients: []Client{{Interface: "eth0", IP: "fe80::1", MAC: "00:01:02:03:04:05", LastSeen: lastSeen}}},
+		},
+	}
+	if err := Save(path, in); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	out, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if out.Version != Version || len(out.Groups) != 2 {
+		t.Fatalf("unexpected state: %+v", out)
+	}
+	if c := out.Groups[0].Clients[0]; c.IP != "10.8.0.2" || !c.LastSeen.Equal(lastSeen) {
+		t.Fatalf("unexpected client: %+v", c)
+	}
+	if c := out.Groups[1].Clients[0]; c.MAC != "00:01:02:03:04:05" {
+		t.Fatalf("unexpected client: %+v", c)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected 0600 permissions, got %o", perm)
+	}
+}
+
+func TestSave_ReplacesWithoutLeavingTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for i := 0; i < 3; i++ {
+		if err := Save(path, &File{Groups: []Group{{Name: "roon"}}}); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		t.Fatalf("expected only state.json, got %v", entries)
+	}
+}
+
+func TestSave_MissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "state.json")
+	if err := Save(path, &File{}); err == nil {
+		t.Fatal("expected error saving into a missing directory")
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := Load(filepath.Join(dir, "nope.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`{"version": 1, "groups": [`), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := Load(corrupt); err == nil {
+		t.Fatal("expected error loading a truncated state file")
+	}
+
+	future := filepath.Join(dir, "future.json")
+	if err := os.WriteFile(future, []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := Load(future); err == nil {
+		t.Fatal("expected error loading an unsupported version")
+	}
+}